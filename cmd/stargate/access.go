@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/stargate/pkg/access"
+	"github.com/ipfs/stargate/pkg/unixfsstore/sql"
+	"github.com/urfave/cli/v2"
+)
+
+func accessKeyPath(cfgDir string) string {
+	return filepath.Join(cfgDir, "access.key")
+}
+
+// accessKey reads the key URLs are signed with, generating it the first time it is needed
+func accessKey(cfgDir string) ([]byte, error) {
+	key, err := os.ReadFile(accessKeyPath(cfgDir))
+	if err == nil {
+		if len(key) != access.KeySize {
+			return nil, fmt.Errorf("access key %s is corrupt", accessKeyPath(cfgDir))
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading access key: %w", err)
+	}
+	key, err = access.NewKey()
+	if err != nil {
+		return nil, fmt.Errorf("generating access key: %w", err)
+	}
+	if err := os.WriteFile(accessKeyPath(cfgDir), key, 0600); err != nil {
+		return nil, fmt.Errorf("writing access key: %w", err)
+	}
+	return key, nil
+}
+
+// rootArg parses the root CID given as the first argument of a command
+func rootArg(cctx *cli.Context) (cid.Cid, error) {
+	if cctx.Args().Len() < 1 {
+		return cid.Undef, fmt.Errorf("usage: %s", cctx.Command.UsageText)
+	}
+	root, err := cid.Parse(cctx.Args().First())
+	if err != nil {
+		return cid.Undef, fmt.Errorf("parsing root CID: %w", err)
+	}
+	return root, nil
+}
+
+// setVisibility returns the action of a command setting whether a root is private
+func setVisibility(private bool) cli.ActionFunc {
+	return func(cctx *cli.Context) error {
+		root, err := rootArg(cctx)
+		if err != nil {
+			return err
+		}
+		_, store, release, err := openAccess(cctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		err = store.SetRootPrivate(cctx.Context, root, private)
+		if errors.Is(err, sql.ErrNotFound) {
+			return fmt.Errorf("%s has not been imported", root)
+		}
+		return err
+	}
+}
+
+var accessCmd = &cli.Command{
+	Name:   "access",
+	Usage:  "Control who can retrieve imported roots",
+	Before: before,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "private",
+			Usage:     "Only serve a root to requests with a token for it",
+			UsageText: "stargate access private <root>",
+			Action:    setVisibility(true),
+		},
+		{
+			Name:      "public",
+			Usage:     "Serve a root to anyone",
+			UsageText: "stargate access public <root>",
+			Action:    setVisibility(false),
+		},
+		{
+			Name:      "mint",
+			Usage:     "Create a bearer token granting access to a private root",
+			UsageText: "stargate access mint [--name <name>] [--expires <duration>] <root>",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "name",
+					Usage: "who or what the token is for",
+				},
+				&cli.DurationFlag{
+					Name:  "expires",
+					Usage: "how long the token is valid for -- it does not expire when unset",
+				},
+			},
+			Action: func(cctx *cli.Context) error {
+				root, err := rootArg(cctx)
+				if err != nil {
+					return err
+				}
+				_, store, release, err := openAccess(cctx)
+				if err != nil {
+					return err
+				}
+				defer release()
+				var expires time.Time
+				if cctx.IsSet("expires") {
+					expires = time.Now().Add(cctx.Duration("expires"))
+				}
+				bearer, token, err := access.NewToken(root, cctx.String("name"), expires)
+				if err != nil {
+					return fmt.Errorf("creating token: %w", err)
+				}
+				if err := store.AddAccessToken(cctx.Context, token); err != nil {
+					return fmt.Errorf("saving token: %w", err)
+				}
+				fmt.Fprintf(os.Stderr, "Token %s created -- it is only shown once:\n", token.ID)
+				fmt.Println(bearer)
+				return nil
+			},
+		},
+		{
+			Name:      "revoke",
+			Usage:     "Revoke a token, and any URLs signed through it",
+			UsageText: "stargate access revoke <token id>",
+			Action: func(cctx *cli.Context) error {
+				if cctx.Args().Len() != 1 {
+					return fmt.Errorf("usage: %s", cctx.Command.UsageText)
+				}
+				_, store, release, err := openAccess(cctx)
+				if err != nil {
+					return err
+				}
+				defer release()
+				err = store.RevokeAccessToken(cctx.Context, cctx.Args().First())
+				if errors.Is(err, sql.ErrNotFound) {
+					return fmt.Errorf("no token %s", cctx.Args().First())
+				}
+				return err
+			},
+		},
+		{
+			Name:      "list",
+			Usage:     "List tokens, for all roots or a single root",
+			UsageText: "stargate access list [<root>]",
+			Action: func(cctx *cli.Context) error {
+				root := cid.Undef
+				if cctx.Args().Present() {
+					var err error
+					if root, err = rootArg(cctx); err != nil {
+						return err
+					}
+				}
+				_, store, release, err := openAccess(cctx)
+				if err != nil {
+					return err
+				}
+				defer release()
+				tokens, err := store.AccessTokens(cctx.Context, root)
+				if err != nil {
+					return err
+				}
+				tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(tw, "ID\tROOT\tNAME\tCREATED\tEXPIRES\tSTATUS")
+				for _, token := range tokens {
+					expires, status := "never", "active"
+					if !token.Expires.IsZero() {
+						expires = token.Expires.Format(time.RFC3339)
+						if time.Now().After(token.Expires) {
+							status = "expired"
+						}
+					}
+					if token.Revoked {
+						status = "revoked"
+					}
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", token.ID, token.Root, token.Name,
+						token.Created.Format(time.RFC3339), expires, status)
+				}
+				return tw.Flush()
+			},
+		},
+		{
+			Name:      "sign",
+			Usage:     "Create a URL for a private root that works without a token until it expires",
+			UsageText: "stargate access sign --token <token id> [--expires <duration>] <root> [<path>]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "token",
+					Usage:    "the ID of a token for the root -- the URL stops working if it is revoked",
+					Required: true,
+				},
+				&cli.DurationFlag{
+					Name:  "expires",
+					Usage: "how long the URL is valid for",
+					Value: 24 * time.Hour,
+				},
+				&cli.StringFlag{
+					Name:  "base-url",
+					Usage: "the URL the server is reached at",
+					Value: "http://localhost:7777",
+				},
+			},
+			Action: func(cctx *cli.Context) error {
+				root, err := rootArg(cctx)
+				if err != nil {
+					return err
+				}
+				repoDir, store, release, err := openAccess(cctx)
+				if err != nil {
+					return err
+				}
+				defer release()
+				token, err := store.AccessToken(cctx.Context, cctx.String("token"))
+				if err != nil {
+					return err
+				}
+				if token == nil || !token.Root.Equals(root) {
+					return fmt.Errorf("no token %s for %s", cctx.String("token"), root)
+				}
+				key, err := accessKey(repoDir)
+				if err != nil {
+					return err
+				}
+				params := access.SignURL(key, token.ID, root, time.Now().Add(cctx.Duration("expires")))
+				target := strings.TrimSuffix(cctx.String("base-url"), "/") + "/ipfs/" + root.String()
+				if path := strings.Trim(cctx.Args().Get(1), "/"); path != "" {
+					target += "/" + path
+				}
+				fmt.Println(target + "?" + params.Encode())
+				return nil
+			},
+		},
+	},
+}
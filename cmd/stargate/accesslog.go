@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ipfs/stargate/internal/config"
+	"github.com/ipfs/stargate/pkg/handler"
+	"github.com/mattn/go-isatty"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+var accessLogFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "access-log",
+		Usage: "where to write access logs: 'stdout', or the path of a file that is rotated as it grows",
+	},
+	&cli.StringFlag{
+		Name:  "access-log-format",
+		Usage: "access log format: 'json', 'logfmt' or 'color' -- defaults to color when writing to a terminal, otherwise json",
+	},
+	&cli.IntFlag{
+		Name:  "access-log-max-size",
+		Usage: "the size in megabytes an access log file reaches before it is rotated",
+	},
+	&cli.IntFlag{
+		Name:  "access-log-max-backups",
+		Usage: "the number of rotated access log files to keep",
+	},
+}
+
+// accessLogger sets up the configured access logger. The returned closer closes the log file, if there is one
+func accessLogger(cfg config.AccessLog) (handler.AccessLogger, io.Closer, error) {
+	var sink io.Writer
+	var closer io.Closer = io.NopCloser(nil)
+	interactive := false
+	if path := cfg.Path; path == "stdout" {
+		sink = os.Stdout
+		interactive = isatty.IsTerminal(os.Stdout.Fd())
+	} else {
+		file := &lumberjack.Logger{
+			Filename:   path,
+			MaxSize:    cfg.MaxSize,
+			MaxBackups: cfg.MaxBackups,
+		}
+		sink, closer = file, file
+	}
+	format := cfg.Format
+	if format == "" {
+		format = "json"
+		if interactive {
+			format = "color"
+		}
+	}
+	switch format {
+	case "json":
+		return handler.NewJSONAccessLogger(sink), closer, nil
+	case "logfmt":
+		return handler.NewLogfmtAccessLogger(sink), closer, nil
+	case "color":
+		return handler.NewColorAccessLogger(sink), closer, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown access log format '%s'", format)
+	}
+}
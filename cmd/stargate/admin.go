@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/stargate/internal/admin"
+	"github.com/urfave/cli/v2"
+)
+
+var FlagAdminListen = &cli.StringFlag{
+	Name: "admin-listen",
+	Usage: "serve the admin API for importing and managing content on this address, such as '10.0.0.5:7778' or " +
+		"'unix:/run/stargate-admin.sock' -- requests must present the token in the repo's admin.token file",
+}
+
+func adminTokenPath(cfgDir string) string {
+	return filepath.Join(cfgDir, "admin.token")
+}
+
+// adminToken reads the token admin API requests must present, generating it the first time it is needed. An empty
+// token file is an error rather than a token anyone could present
+func adminToken(cfgDir string) (string, error) {
+	token, err := os.ReadFile(adminTokenPath(cfgDir))
+	if err == nil {
+		if trimmed := strings.TrimSpace(string(token)); trimmed != "" {
+			return trimmed, nil
+		}
+		return "", fmt.Errorf("admin token %s is empty -- remove it to generate a new one", adminTokenPath(cfgDir))
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("reading admin token: %w", err)
+	}
+	newToken, err := admin.NewToken()
+	if err != nil {
+		return "", fmt.Errorf("generating admin token: %w", err)
+	}
+	if err := os.WriteFile(adminTokenPath(cfgDir), []byte(newToken+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("writing admin token: %w", err)
+	}
+	return newToken, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/ipfs/stargate/internal/config"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli/v2"
+)
+
+// loadConfig reads the configuration of the repo, returning the repo directory too
+func loadConfig(cctx *cli.Context) (string, *config.Config, error) {
+	repoDir, err := homedir.Expand(cctx.String(FlagRepo.Name))
+	if err != nil {
+		return "", nil, fmt.Errorf("expanding repo file path: %w", err)
+	}
+	cfg, err := config.Load(repoDir)
+	if err != nil {
+		return "", nil, err
+	}
+	return repoDir, cfg, nil
+}
+
+// overrideServerConfig replaces the server settings of a config with those set on the command line
+func overrideServerConfig(cctx *cli.Context, cfg *config.Config) error {
+	s := &cfg.Server
+	if cctx.IsSet("listen") {
+		s.Listen = cctx.StringSlice("listen")
+	} else if cctx.IsSet("port") {
+		s.Listen = []string{fmt.Sprintf(":%d", cctx.Uint("port"))}
+	}
+	overrideString(cctx, FlagAdminListen.Name, &s.AdminListen)
+	if cctx.IsSet("app") {
+		s.Apps = cctx.StringSlice("app")
+	}
+	overrideString(cctx, "tls-cert", &s.TLSCert)
+	overrideString(cctx, "tls-key", &s.TLSKey)
+	overrideDuration(cctx, "read-header-timeout", &s.ReadHeaderTimeout)
+	overrideDuration(cctx, "read-timeout", &s.ReadTimeout)
+	overrideDuration(cctx, "write-timeout", &s.WriteTimeout)
+	overrideDuration(cctx, "idle-timeout", &s.IdleTimeout)
+	overrideDuration(cctx, "shutdown-timeout", &s.ShutdownTimeout)
+	overrideInt(cctx, "max-header-bytes", &s.MaxHeaderBytes)
+	overrideInt(cctx, "max-concurrent-requests", &s.MaxConcurrentRequests)
+	if cctx.IsSet("client-rate-limit") {
+		s.ClientLimits.RateLimit = cctx.Float64("client-rate-limit")
+	}
+	overrideInt(cctx, "client-rate-burst", &s.ClientLimits.RateBurst)
+	overrideInt(cctx, "client-max-concurrent-requests", &s.ClientLimits.MaxConcurrentRequests)
+	overrideInt(cctx, "client-bytes-per-second", &s.ClientLimits.BytesPerSecond)
+	overrideString(cctx, "client-key", &s.ClientLimits.Key)
+	overrideString(cctx, "cache-dir", &s.Cache.Dir)
+	if cctx.IsSet("cache-size") {
+		s.Cache.Size = cctx.Int64("cache-size")
+	}
+	overrideString(cctx, "access-log", &s.AccessLog.Path)
+	overrideString(cctx, "access-log-format", &s.AccessLog.Format)
+	overrideInt(cctx, "access-log-max-size", &s.AccessLog.MaxSize)
+	overrideInt(cctx, "access-log-max-backups", &s.AccessLog.MaxBackups)
+	overrideString(cctx, FlagTraceExporter.Name, &s.TraceExporter)
+	return cfg.Validate()
+}
+
+func overrideString(cctx *cli.Context, name string, setting *string) {
+	if cctx.IsSet(name) {
+		*setting = cctx.String(name)
+	}
+}
+
+func overrideInt(cctx *cli.Context, name string, setting *int) {
+	if cctx.IsSet(name) {
+		*setting = cctx.Int(name)
+	}
+}
+
+func overrideDuration(cctx *cli.Context, name string, setting *config.Duration) {
+	if cctx.IsSet(name) {
+		*setting = config.Duration(cctx.Duration(name))
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	gosql "database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	fslock "github.com/ipfs/go-fs-lock"
+	"github.com/ipfs/stargate/internal/admin"
+	"github.com/ipfs/stargate/internal/importer"
+	"github.com/ipfs/stargate/pkg/unixfsstore"
+	"github.com/ipfs/stargate/pkg/unixfsstore/sql"
+	"github.com/mitchellh/go-homedir"
+	"github.com/urfave/cli/v2"
+)
+
+// repoLockFile is held by whichever process writes to the repo. Other commands go through the local API of a server
+// holding it
+const repoLockFile = "repo.lock"
+
+// errRepoLocked is returned when another process holds the repo lock
+var errRepoLocked = errors.New("in use by another stargate process")
+
+// maxSocketPath is the longest Unix socket path accepted on all platforms
+const maxSocketPath = 103
+
+// apiFilePath is the file a running server records the address of its local API in
+func apiFilePath(cfgDir string) string {
+	return filepath.Join(cfgDir, "api")
+}
+
+func apiSocketPath(cfgDir string) string {
+	return filepath.Join(cfgDir, "api.sock")
+}
+
+// lockRepo takes the repo lock, returning an error wrapping errRepoLocked if another process holds it
+func lockRepo(cfgDir string) (io.Closer, error) {
+	if err := os.MkdirAll(cfgDir, 0744); err != nil {
+		return nil, err
+	}
+	lock, err := fslock.Lock(cfgDir, repoLockFile)
+	if err != nil {
+		var lockedErr fslock.LockedError
+		if errors.As(err, &lockedErr) {
+			return nil, fmt.Errorf("repo %s is %w", cfgDir, errRepoLocked)
+		}
+		return nil, fmt.Errorf("locking repo: %w", err)
+	}
+	return lock, nil
+}
+
+// openRepo locks the repo and opens its database, for a process that writes to it. The returned function closes
+// the database and releases the lock
+func openRepo(ctx context.Context, cfgDir string) (*gosql.DB, func(), error) {
+	lock, err := lockRepo(cfgDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = os.Stat(dbPath(cfgDir))
+	newRepo := os.IsNotExist(err)
+	sqldb, err := configureRepo(ctx, cfgDir)
+	if err != nil {
+		lock.Close()
+		return nil, nil, fmt.Errorf("initializing repo: %w", err)
+	}
+	if newRepo {
+		err = writeRepoVersion(cfgDir)
+	} else {
+		err = migrateRepo(ctx, cfgDir)
+	}
+	if err != nil {
+		_ = sqldb.Close()
+		lock.Close()
+		return nil, nil, fmt.Errorf("migrating repo: %w", err)
+	}
+	return sqldb, func() {
+		_ = sqldb.Close()
+		_ = lock.Close()
+	}, nil
+}
+
+// localAPIAddress returns the address to serve the local API on, or "" if the repo path is too long for a socket
+func localAPIAddress(cfgDir string) string {
+	path, err := filepath.Abs(apiSocketPath(cfgDir))
+	if err != nil || len(path) > maxSocketPath {
+		return ""
+	}
+	return "unix:" + path
+}
+
+// contentManager imports and manages the content of a repo, either through a running server or directly
+type contentManager interface {
+	ImportPath(ctx context.Context, srcPath string, settings importer.Settings, progress importer.ProgressFunc) (cid.Cid, error)
+	ImportReader(ctx context.Context, src io.Reader, name string, settings importer.Settings, progress importer.ProgressFunc) (cid.Cid, error)
+	ImportTar(ctx context.Context, src io.Reader, settings importer.Settings, progress importer.ProgressFunc) (cid.Cid, error)
+	ImportCAR(ctx context.Context, src io.Reader, progress importer.ProgressFunc) (cid.Cid, error)
+	Roots(ctx context.Context) ([]unixfsstore.RootCID, error)
+	Remove(ctx context.Context, root cid.Cid) error
+}
+
+// accessManager controls access to the content of a repo, either through a running server or directly
+type accessManager interface {
+	SetRootPrivate(ctx context.Context, root cid.Cid, private bool) error
+	AddAccessToken(ctx context.Context, token unixfsstore.AccessToken) error
+	AccessToken(ctx context.Context, id string) (*unixfsstore.AccessToken, error)
+	AccessTokens(ctx context.Context, root cid.Cid) ([]unixfsstore.AccessToken, error)
+	RevokeAccessToken(ctx context.Context, id string) error
+}
+
+// nameManager keeps the names of a repo, either through a running server or directly
+type nameManager interface {
+	SetName(ctx context.Context, name unixfsstore.Name) error
+	Name(ctx context.Context, name string) (*unixfsstore.Name, error)
+	Names(ctx context.Context) ([]unixfsstore.Name, error)
+	RemoveName(ctx context.Context, name string) error
+}
+
+var (
+	_ contentManager = (*importer.Importer)(nil)
+	_ contentManager = (*admin.Client)(nil)
+	_ accessManager  = (*sql.SQLUnixFSStore)(nil)
+	_ accessManager  = (*admin.Client)(nil)
+	_ nameManager    = (*sql.SQLUnixFSStore)(nil)
+	_ nameManager    = (*admin.Client)(nil)
+)
+
+// repoAccess is a repo opened by a command, either directly or through the API of a running server
+type repoAccess struct {
+	dir string
+	// client is set when going through a server, and db otherwise
+	client  *admin.Client
+	db      *gosql.DB
+	release func()
+}
+
+// openRepoAccess opens the repo directly if no other process is writing to it, holding the lock until the command
+// releases it, so its database is never written from two processes. Otherwise it goes through the API of the server
+// holding the lock
+func openRepoAccess(cctx *cli.Context) (*repoAccess, error) {
+	repoDir, err := homedir.Expand(cctx.String(FlagRepo.Name))
+	if err != nil {
+		return nil, fmt.Errorf("expanding repo file path: %w", err)
+	}
+	if repoDir == "" {
+		return nil, fmt.Errorf("%s is a required flag", FlagRepo.Name)
+	}
+	sqldb, release, err := openRepo(cctx.Context, repoDir)
+	if err == nil {
+		return &repoAccess{dir: repoDir, db: sqldb, release: release}, nil
+	}
+	if !errors.Is(err, errRepoLocked) {
+		return nil, err
+	}
+	client, err := apiClient(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("repo is in use by a server, sending requests through its API")
+	return &repoAccess{dir: repoDir, client: client, release: func() {}}, nil
+}
+
+// openRepoForReading opens the database of the repo to read from it. If a server holds the repo lock the database is
+// opened without it, as sqlite lets one process read while another writes, and the server has already migrated the
+// repo. The returned function closes the database and releases the lock, if it was taken
+func openRepoForReading(cctx *cli.Context) (*gosql.DB, func(), error) {
+	repoDir, err := homedir.Expand(cctx.String(FlagRepo.Name))
+	if err != nil {
+		return nil, nil, fmt.Errorf("expanding repo file path: %w", err)
+	}
+	if repoDir == "" {
+		return nil, nil, fmt.Errorf("%s is a required flag", FlagRepo.Name)
+	}
+	sqldb, release, err := openRepo(cctx.Context, repoDir)
+	if err == nil {
+		return sqldb, release, nil
+	}
+	if !errors.Is(err, errRepoLocked) {
+		return nil, nil, err
+	}
+	sqldb, err = sql.SqlDB(dbPath(repoDir))
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening repo database: %w", err)
+	}
+	return sqldb, func() { _ = sqldb.Close() }, nil
+}
+
+func (repo *repoAccess) content() contentManager {
+	if repo.client != nil {
+		return repo.client
+	}
+	return importer.New(carPath(repo.dir), sql.NewSQLUnixFSStore(repo.db))
+}
+
+func (repo *repoAccess) names() nameManager {
+	if repo.client != nil {
+		return repo.client
+	}
+	return sql.NewSQLUnixFSStore(repo.db)
+}
+
+// openContent opens the content of the repo for import and management. The returned function releases the repo
+func openContent(cctx *cli.Context) (contentManager, func(), error) {
+	repo, err := openRepoAccess(cctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return repo.content(), repo.release, nil
+}
+
+// openNames opens the names of the repo. The returned function releases the repo
+func openNames(cctx *cli.Context) (nameManager, func(), error) {
+	repo, err := openRepoAccess(cctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return repo.names(), repo.release, nil
+}
+
+// openAccess opens the access controls of the repo, returning the repo directory too. The returned function
+// releases the repo
+func openAccess(cctx *cli.Context) (string, accessManager, func(), error) {
+	repo, err := openRepoAccess(cctx)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if repo.client != nil {
+		return repo.dir, repo.client, repo.release, nil
+	}
+	return repo.dir, sql.NewSQLUnixFSStore(repo.db), repo.release, nil
+}
+
+// apiClient connects to the local API of the server running on a repo
+func apiClient(repoDir string) (*admin.Client, error) {
+	address, err := os.ReadFile(apiFilePath(repoDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("repo %s is %w, and has no local API to go through", repoDir, errRepoLocked)
+		}
+		return nil, fmt.Errorf("reading API address: %w", err)
+	}
+	token, err := adminToken(repoDir)
+	if err != nil {
+		return nil, err
+	}
+	return admin.NewClient(strings.TrimSpace(string(address)), token), nil
+}
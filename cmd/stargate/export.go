@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/ipfs/stargate/pkg/server"
+	"github.com/ipfs/stargate/pkg/unixfsresolver"
+	"github.com/ipfs/stargate/pkg/unixfsstore/sql"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/blockstore"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/urfave/cli/v2"
+)
+
+var exportCmd = &cli.Command{
+	Name:      "export",
+	Usage:     "Write content from the repo to a CAR file or a directory, without going through a server",
+	UsageText: "stargate export (--car <file> [--car-version 1] [--bytes <range>] | --dir <dir>) <cid>[/path]",
+	Before:    before,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "car",
+			Usage: "write the DAG, along with the blocks proving the path to it, to this CAR file",
+		},
+		&cli.IntFlag{
+			Name:  "car-version",
+			Usage: "write a CARv1 (1) or a CARv2 with an index (2)",
+			Value: 2,
+		},
+		&cli.StringSliceFlag{
+			Name:  "bytes",
+			Usage: "only write the blocks of a file holding these bytes: 'start-end' (end exclusive), 'start-' or '-length'",
+		},
+		&cli.StringFlag{
+			Name:  "dir",
+			Usage: "write the files to this directory",
+		},
+	},
+	Action: func(cctx *cli.Context) error {
+		if cctx.Args().Len() != 1 {
+			return fmt.Errorf("usage: %s", cctx.Command.UsageText)
+		}
+		carFile, outputDir := cctx.String("car"), cctx.String("dir")
+		if (carFile == "") == (outputDir == "") {
+			return errors.New("exactly one of --car and --dir must be set")
+		}
+		if outputDir != "" && (cctx.IsSet("bytes") || cctx.IsSet("car-version")) {
+			return errors.New("--bytes and --car-version only apply to --car")
+		}
+		carVersion := cctx.Int("car-version")
+		if carVersion != 1 && carVersion != 2 {
+			return fmt.Errorf("unsupported CAR version %d", carVersion)
+		}
+		root, segments, err := parseExportPath(cctx.Args().First())
+		if err != nil {
+			return err
+		}
+
+		sqldb, release, err := openRepoForReading(cctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		// the CAR files opened to resolve the root are closed when the export is done
+		ctx, cancel := context.WithCancel(cctx.Context)
+		defer cancel()
+		appResolver := unixfsresolver.NewUnixFSAppResolver(sql.NewSQLUnixFSStore(sqldb), server.CARLinkSystemResolver{})
+		lsys, pathResolver, err := appResolver.GetResolver(ctx, root)
+		if err != nil {
+			return err
+		}
+		path, _, pathResolver, err := pathResolver.ResolvePathSegments(cctx.Context, segments)
+		if err != nil {
+			return err
+		}
+		query := stargate.Query{}
+		if cctx.IsSet("bytes") {
+			query["bytes"] = cctx.StringSlice("bytes")
+		}
+		queryResolver, err := pathResolver.ResolveQuery(cctx.Context, query, nil)
+		if err != nil {
+			return err
+		}
+
+		if carFile != "" {
+			err = exportCAR(cctx.Context, lsys, root, path, queryResolver, cctx.IsSet("bytes"), carFile, carVersion)
+		} else {
+			err = exportDir(cctx, lsys, root, segments, queryResolver, outputDir)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Exported %s\n", cctx.Args().First())
+		return nil
+	},
+}
+
+// parseExportPath splits a <cid>[/path] argument, optionally prefixed with /ipfs/, into the CID and path segments
+func parseExportPath(arg string) (cid.Cid, stargate.PathSegments, error) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(arg, "/ipfs/"), "/"), "/")
+	root, err := cid.Parse(parts[0])
+	if err != nil {
+		return cid.Undef, nil, fmt.Errorf("parsing CID: %w", err)
+	}
+	var segments stargate.PathSegments
+	for _, segment := range parts[1:] {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return root, segments, nil
+}
+
+// exportCAR writes the blocks of the path from root to a CAR file, followed by the DAG at its end -- all of it, or
+// with byte ranges only the blocks of the file holding those bytes, as a server would send them. The file is written
+// under a temporary name and renamed once complete
+func exportCAR(ctx context.Context, lsys *ipld.LinkSystem, root cid.Cid, path *stargate.Path,
+	queryResolver stargate.QueryResolver, byteRanges bool, carFile string, carVersion int) error {
+	f, err := os.CreateTemp(filepath.Dir(carFile), filepath.Base(carFile)+"-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	dest, err := blockstore.OpenReadWriteFile(f, []cid.Cid{root},
+		carv2.StoreIdentityCIDs(true),
+		blockstore.UseWholeCIDs(true),
+		blockstore.WriteAsCarV1(carVersion == 1),
+	)
+	if err != nil {
+		return err
+	}
+	put := func(metadata stargate.BlockMetadata) error {
+		for _, blockMetadatum := range metadata {
+			if blockMetadatum.Status != stargate.BlockStatusPresent {
+				continue
+			}
+			block, err := loadBlock(ctx, lsys, blockMetadatum.Link)
+			if err != nil {
+				return err
+			}
+			if err := dest.Put(ctx, block); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := put(path.Blocks); err != nil {
+		return err
+	}
+	if byteRanges {
+		for !queryResolver.Done() {
+			dag, err := queryResolver.Next()
+			if err != nil {
+				return err
+			}
+			if err := put(dag.Blocks); err != nil {
+				return err
+			}
+		}
+	} else {
+		// the query for a directory only lists its own blocks, so the DAG is walked instead
+		dag, err := queryResolver.Next()
+		if err != nil {
+			return err
+		}
+		if err := walkDAG(ctx, lsys, dag.Blocks[0].Link, make(map[cid.Cid]struct{}), func(block blocks.Block) error {
+			return dest.Put(ctx, block)
+		}); err != nil {
+			return err
+		}
+	}
+	if err := dest.Finalize(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// the file is meant to be handed on, unlike the temporary file it was written as
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), carFile)
+}
+
+// walkDAG loads every block of the DAG under c depth first, skipping those seen before
+func walkDAG(ctx context.Context, lsys *ipld.LinkSystem, c cid.Cid, seen map[cid.Cid]struct{}, visit func(blocks.Block) error) error {
+	if _, ok := seen[c]; ok {
+		return nil
+	}
+	seen[c] = struct{}{}
+	block, err := loadBlock(ctx, lsys, c)
+	if err != nil {
+		return err
+	}
+	if err := visit(block); err != nil {
+		return err
+	}
+	if c.Prefix().Codec != cid.DagProtobuf {
+		return nil
+	}
+	nb := dagpb.Type.PBNode.NewBuilder()
+	if err := dagpb.DecodeBytes(nb, block.RawData()); err != nil {
+		return fmt.Errorf("decoding %s: %w", c, err)
+	}
+	iter := nb.Build().(dagpb.PBNode).FieldLinks().Iterator()
+	for !iter.Done() {
+		_, link := iter.Next()
+		if err := walkDAG(ctx, lsys, link.FieldHash().Link().(cidlink.Link).Cid, seen, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportDir writes the files at the end of the path from root to a directory. A file is named after the last
+// segment of the path, or after root if there is none
+func exportDir(cctx *cli.Context, lsys *ipld.LinkSystem, root cid.Cid, segments stargate.PathSegments,
+	queryResolver stargate.QueryResolver, outputDir string) error {
+	// the DAG at the end of the path is listed from its root
+	dag, err := queryResolver.Next()
+	if err != nil {
+		return err
+	}
+	fileName := root.String()
+	if len(segments) > 0 {
+		fileName = segments[len(segments)-1]
+	}
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return err
+	}
+	return extractRoot(cctx, lsys, dag.Blocks[0].Link, outputDir, fileName)
+}
+
+func loadBlock(ctx context.Context, lsys *ipld.LinkSystem, c cid.Cid) (blocks.Block, error) {
+	r, err := lsys.StorageReadOpener(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c})
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
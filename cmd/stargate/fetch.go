@@ -1,171 +1,444 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 
 	blocks "github.com/ipfs/go-block-format"
 	"github.com/ipfs/go-cid"
+	format "github.com/ipfs/go-ipld-format"
 	"github.com/ipfs/go-unixfsnode"
 	"github.com/ipfs/go-unixfsnode/data"
 	"github.com/ipfs/go-unixfsnode/file"
 	stargate "github.com/ipfs/stargate/pkg"
-	"github.com/ipld/go-car"
-	"github.com/ipld/go-car/util"
+	"github.com/ipfs/stargate/pkg/carreader"
+	"github.com/ipfs/stargate/pkg/handler"
+	"github.com/ipfs/stargate/pkg/unixfsresolver"
 	"github.com/ipld/go-car/v2/blockstore"
 	dagpb "github.com/ipld/go-codec-dagpb"
 	"github.com/ipld/go-ipld-prime"
 	"github.com/ipld/go-ipld-prime/codec/dagcbor"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
 	"github.com/urfave/cli/v2"
 )
 
-// TODO: This command doesn't work yet, nor does it verify data
+// TODO: Blocks are verified against their CIDs, but not yet against the DAG that was requested
 
 var fetchCmd = &cli.Command{
 	Name:   "fetch",
 	Usage:  "Get something from the stargate",
 	Before: before,
-	Flags:  []cli.Flag{},
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "have",
+			Usage: "a CAR file with blocks already held locally, which the server will not send again",
+		},
+	},
 	Action: func(cctx *cli.Context) error {
 		if cctx.Args().Len() != 2 {
 			return fmt.Errorf("usage: fetch <url> <outputDir>")
 		}
-		url := cctx.Args().First()
-		outputDir := cctx.Args().Slice()[1]
-		req, err := http.NewRequestWithContext(cctx.Context, "GET", url, nil)
+		u, err := url.Parse(cctx.Args().First())
 		if err != nil {
-			return fmt.Errorf("constructing request: %w", err)
+			return fmt.Errorf("parsing url: %w", err)
 		}
-		res, err := http.DefaultClient.Do(req)
+		// ask for a proof if the path does not exist
+		q := u.Query()
+		q.Set(handler.QueryProof, "")
+		u.RawQuery = q.Encode()
+		outputDir := cctx.Args().Slice()[1]
+		local, err := openLocalStores(cctx.StringSlice("have"))
 		if err != nil {
-			return fmt.Errorf("executing request: %w", err)
+			return err
 		}
-		if res.StatusCode < 200 || res.StatusCode >= 300 {
-			bd, err := io.ReadAll(res.Body)
+		defer local.Close()
+		var haves *stargate.Haves
+		var body []byte
+		if len(local) > 0 {
+			haves, err = local.haves(cctx.Context)
+			if err != nil {
+				return err
+			}
+			body, err = stargate.BindnodeRegistry.TypeToBytes(haves, dagcbor.Encode)
 			if err != nil {
-				return fmt.Errorf("response error: status code: %s, error parsing message: %w", res.Status, err)
+				return err
 			}
-			return fmt.Errorf("response error: status code: %s, message: %s", res.Status, string(bd))
 		}
-		bufReader := bufio.NewReader(res.Body)
-		header, err := car.ReadHeader(bufReader)
+		res, err := request(cctx, u, body)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode == http.StatusNotFound && res.Header.Get("Content-Type") == handler.ContentType {
+			return verifyAbsence(cctx, u, res.Body)
+		}
+		if err := checkStatus(res); err != nil {
+			return err
+		}
+		reader, err := carreader.NewReaderWithLocalStore(cctx.Context, res.Body, local)
 		if err != nil {
 			return fmt.Errorf("parsing response: %w", err)
 		}
-		f, err := os.CreateTemp("", header.Roots[0].String()+"-")
+		f, err := os.CreateTemp("", reader.Root().String()+"-")
 		if err != nil {
 			return err
 		}
 		name := f.Name()
-		dest, err := blockstore.OpenReadWriteFile(f, header.Roots)
+		dest, err := blockstore.OpenReadWriteFile(f, []cid.Cid{reader.Root()})
 		if err != nil {
 			return err
 		}
-		for {
-			_, blk, err := util.ReadNode(bufReader)
-			if err != nil {
-				return fmt.Errorf("parsing response: %w", err)
+		haveSet, err := stargate.NewHaveSet(haves)
+		if err != nil {
+			return err
+		}
+		held, missing, err := readDAG(cctx.Context, reader, haveSet, dest)
+		if err != nil {
+			return err
+		}
+		if len(missing) > 0 {
+			// a false positive of the bloom filter sent as haves makes the server skip blocks the client does not
+			// have, so the DAG is requested again with the blocks now held as haves. Unless there are too many to
+			// list, these have no false positives
+			if err := refetch(cctx, u, reader.Root(), held, dest); err != nil {
+				return fmt.Errorf("fetching %d blocks that were not sent: %w", len(missing), err)
 			}
-			msg, err := stargate.BindnodeRegistry.TypeFromBytes(blk, (*stargate.StarGateMessage)(nil), dagcbor.Decode)
+		}
+		err = dest.Finalize()
+		if err != nil {
+			return err
+		}
+		ro, err := blockstore.OpenReadOnly(name)
+		if err != nil {
+			return err
+		}
+
+		ls := cidlink.DefaultLinkSystem()
+		ls.TrustedStorage = true
+		ls.StorageReadOpener = func(_ ipld.LinkContext, l ipld.Link) (io.Reader, error) {
+			cl, ok := l.(cidlink.Link)
+			if !ok {
+				return nil, fmt.Errorf("not a cidlink")
+			}
+			blk, err := ro.Get(cctx.Context, cl.Cid)
 			if err != nil {
-				return fmt.Errorf("parsing response: %w", err)
+				return nil, err
 			}
-			sgmsg := msg.(*stargate.StarGateMessage)
-			if sgmsg.Kind == stargate.KindPath {
-				for _, block := range sgmsg.Path.Blocks {
-					if block.Status == stargate.BlockStatusPresent {
-						_, _, err := util.ReadNode(bufReader)
-						if err != nil {
-							return fmt.Errorf("parsing response: %w", err)
-						}
-					}
-				}
-			} else {
-				for _, block := range sgmsg.DAG.Blocks {
-					if block.Status == stargate.BlockStatusPresent {
-						c, data, err := util.ReadNode(bufReader)
-						if err != nil {
-							return fmt.Errorf("parsing response: %w", err)
-						}
-						final, err := blocks.NewBlockWithCid(data, c)
-						if err != nil {
-							return err
-						}
-						err = dest.Put(cctx.Context, final)
-						if err != nil {
-							return err
-						}
-					}
-				}
-				err := dest.Finalize()
-				if err != nil {
-					return err
-				}
-				ro, err := blockstore.OpenReadOnly(name)
-				if err != nil {
-					return err
-				}
-
-				ls := cidlink.DefaultLinkSystem()
-				ls.TrustedStorage = true
-				ls.StorageReadOpener = func(_ ipld.LinkContext, l ipld.Link) (io.Reader, error) {
-					cl, ok := l.(cidlink.Link)
-					if !ok {
-						return nil, fmt.Errorf("not a cidlink")
-					}
-					blk, err := ro.Get(cctx.Context, cl.Cid)
-					if err != nil {
-						return nil, err
-					}
-					return bytes.NewBuffer(blk.RawData()), nil
-				}
+			return bytes.NewBuffer(blk.RawData()), nil
+		}
 
-				roots, err := ro.Roots()
-				if err != nil {
-					return err
-				}
+		roots, err := ro.Roots()
+		if err != nil {
+			return err
+		}
 
-				for _, root := range roots {
-					if err := extractRoot(cctx, &ls, root, outputDir); err != nil {
-						return err
-					}
+		for _, root := range roots {
+			if root.Prefix().Codec == cid.Raw {
+				if cctx.IsSet("verbose") {
+					fmt.Fprintf(cctx.App.ErrWriter, "skipping raw root %s\n", root)
 				}
-
-				return nil
-
+				continue
+			}
+			if err := extractRoot(cctx, &ls, root, outputDir, "unknown"); err != nil {
+				return err
 			}
 		}
+
+		return nil
 	},
 }
 
-func extractRoot(c *cli.Context, ls *ipld.LinkSystem, root cid.Cid, outputDir string) error {
-	if root.Prefix().Codec == cid.Raw {
-		if c.IsSet("verbose") {
-			fmt.Fprintf(c.App.ErrWriter, "skipping raw root %s\n", root)
+// request sends a GET request for u, or a POST request with haves in body if there are any
+func request(cctx *cli.Context, u *url.URL, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(cctx.Context, "GET", u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("constructing request: %w", err)
+	}
+	if body != nil {
+		req, err = http.NewRequestWithContext(cctx.Context, "POST", u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("constructing request: %w", err)
 		}
+		req.Header.Set("Content-Type", "application/vnd.ipld.dag-cbor")
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("executing request: %w", err)
+	}
+	return res, nil
+}
+
+func checkStatus(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
 		return nil
 	}
+	bd, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("response error: status code: %s, error parsing message: %w", res.Status, err)
+	}
+	return fmt.Errorf("response error: status code: %s, message: %s", res.Status, string(bd))
+}
 
-	pbn, err := ls.Load(ipld.LinkContext{}, cidlink.Link{Cid: root}, dagpb.Type.PBNode)
+// readDAG writes the blocks of the DAG messages in a response to dest, returning the CIDs of the blocks written and
+// of the blocks the server did not send because it took them to be held locally, but which are not. haves are the
+// blocks the request said it held
+func readDAG(ctx context.Context, reader *carreader.Reader, haves *stargate.HaveSet, dest *blockstore.ReadWrite) (held []cid.Cid, missing []cid.Cid, _ error) {
+	// blocks for path messages are not needed to extract the result, unless the DAG lists them again
+	pathBlocks := make(map[cid.Cid]blocks.Block)
+	// the status each block was first listed with
+	listed := make(map[cid.Cid]stargate.BlockStatus)
+	missed := make(map[cid.Cid]struct{})
+	for {
+		sgmsg, blks, err := reader.Next()
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading response: %w", err)
+		}
+		switch sgmsg.Kind {
+		case stargate.KindSummary:
+			if !sgmsg.Summary.Complete {
+				return nil, nil, errors.New("response is incomplete")
+			}
+			return held, missing, nil
+		case stargate.KindPath:
+			for _, blk := range blks {
+				pathBlocks[blk.Cid()] = blk
+			}
+			continue
+		case stargate.KindDAG:
+		default:
+			continue
+		}
+		if err := dest.PutMany(ctx, blks); err != nil {
+			return nil, nil, err
+		}
+		for _, blk := range blks {
+			held = append(held, blk.Cid())
+		}
+		for _, blockMetadatum := range sgmsg.DAG.Blocks {
+			first, ok := listed[blockMetadatum.Link]
+			if !ok {
+				listed[blockMetadatum.Link] = blockMetadatum.Status
+				first = blockMetadatum.Status
+			}
+			// a duplicate was either sent before, not sent before and still not needed, or matched the haves
+			if blockMetadatum.Status != stargate.BlockStatusDuplicate {
+				continue
+			}
+			if first != stargate.BlockStatusPresent && !haves.Has(blockMetadatum.Link) {
+				continue
+			}
+			if _, ok := missed[blockMetadatum.Link]; ok {
+				continue
+			}
+			has, err := dest.Has(ctx, blockMetadatum.Link)
+			if err != nil {
+				return nil, nil, err
+			}
+			if has {
+				continue
+			}
+			if blk, ok := pathBlocks[blockMetadatum.Link]; ok {
+				if err := dest.Put(ctx, blk); err != nil {
+					return nil, nil, err
+				}
+				held = append(held, blk.Cid())
+				continue
+			}
+			missed[blockMetadatum.Link] = struct{}{}
+			missing = append(missing, blockMetadatum.Link)
+		}
+	}
+}
+
+// refetch requests the DAG at u again, sending the blocks held as haves so that only the others are sent, and writes
+// them to dest
+func refetch(cctx *cli.Context, u *url.URL, root cid.Cid, held []cid.Cid, dest *blockstore.ReadWrite) error {
+	haves := newHaves(held)
+	body, err := stargate.BindnodeRegistry.TypeToBytes(haves, dagcbor.Encode)
 	if err != nil {
 		return err
 	}
-	pbnode := pbn.(dagpb.PBNode)
-
-	ufn, err := unixfsnode.Reify(ipld.LinkContext{}, pbnode, ls)
+	res, err := request(cctx, u, body)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
+	if err := checkStatus(res); err != nil {
+		return err
+	}
+	reader, err := carreader.NewReader(res.Body)
+	if err != nil {
+		return fmt.Errorf("parsing response: %w", err)
+	}
+	if !reader.Root().Equals(root) {
+		return fmt.Errorf("response is for %s rather than %s", reader.Root(), root)
+	}
+	haveSet, err := stargate.NewHaveSet(haves)
+	if err != nil {
+		return err
+	}
+	_, missing, err := readDAG(cctx.Context, reader, haveSet, dest)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%d blocks are still neither sent nor held", len(missing))
+	}
+	return nil
+}
+
+// maxHavesList is the most CIDs sent as an explicit list -- beyond this, a bloom filter is sent instead
+const maxHavesList = 10000
+
+// havesFalsePositiveRate is the false positive rate of bloom filters sent to the server. A false positive means a
+// block is neither sent nor available locally, and has to be requested again
+const havesFalsePositiveRate = 0.0001
 
+// localStores are CAR files holding blocks the client already has
+type localStores []*blockstore.ReadOnly
+
+func openLocalStores(carFiles []string) (localStores, error) {
+	local := make(localStores, 0, len(carFiles))
+	for _, carFile := range carFiles {
+		bs, err := blockstore.OpenReadOnly(carFile)
+		if err != nil {
+			local.Close()
+			return nil, fmt.Errorf("opening %s: %w", carFile, err)
+		}
+		local = append(local, bs)
+	}
+	return local, nil
+}
+
+func (ls localStores) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	for _, bs := range ls {
+		has, err := bs.Has(ctx, c)
+		if err != nil || has {
+			return has, err
+		}
+	}
+	return false, nil
+}
+
+func (ls localStores) Get(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+	for _, bs := range ls {
+		has, err := bs.Has(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		if has {
+			return bs.Get(ctx, c)
+		}
+	}
+	return nil, format.ErrNotFound{Cid: c}
+}
+
+func (ls localStores) Close() {
+	for _, bs := range ls {
+		_ = bs.Close()
+	}
+}
+
+// haves lists the CIDs of all local blocks
+func (ls localStores) haves(ctx context.Context) (*stargate.Haves, error) {
+	var cids []cid.Cid
+	for _, bs := range ls {
+		keys, err := bs.AllKeysChan(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for c := range keys {
+			cids = append(cids, c)
+		}
+	}
+	return newHaves(cids), nil
+}
+
+// newHaves lists CIDs as haves, or adds them to a bloom filter if there are too many to list
+func newHaves(cids []cid.Cid) *stargate.Haves {
+	haves := &stargate.Haves{Cids: cids}
+	if len(cids) > maxHavesList {
+		bloom := stargate.NewBloom(len(cids), havesFalsePositiveRate)
+		for _, c := range cids {
+			bloom.Add(c)
+		}
+		haves = &stargate.Haves{Bloom: bloom}
+	}
+	return haves
+}
+
+// verifyAbsence checks a not found response carrying a proof that the path requested at u does not exist, under
+// the root requested rather than one chosen by the server
+func verifyAbsence(cctx *cli.Context, u *url.URL, body io.Reader) error {
+	// the path is /<app>/<root>/<segments...>
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(segments) < 2 {
+		return fmt.Errorf("url path '%s' is missing CID", u.Path)
+	}
+	root, err := cid.Parse(segments[1])
+	if err != nil {
+		return fmt.Errorf("parsing requested CID: %w", err)
+	}
+	requested := segments[2:]
+	reader, err := carreader.NewReader(body)
+	if err != nil {
+		return fmt.Errorf("parsing response: %w", err)
+	}
+	if !reader.Root().Equals(root) {
+		return fmt.Errorf("response is for %s rather than the requested %s", reader.Root(), root)
+	}
+	// the proof precedes the error that ends the response
+	var proof *stargate.Path
+	var proofBlocks []blocks.Block
+	for proof == nil {
+		sgmsg, blks, err := reader.Next()
+		if err != nil {
+			return fmt.Errorf("reading response: %w", err)
+		}
+		if sgmsg.Kind == stargate.KindSummary {
+			return errors.New("not found response does not contain a proof of absence")
+		}
+		if sgmsg.Kind == stargate.KindPath && sgmsg.Path.Missing != nil {
+			proof, proofBlocks = sgmsg.Path, blks
+		}
+	}
+	// only the blocks in the proof are available for verification
+	store := memstore.Store{Bag: make(map[string][]byte)}
+	ls := cidlink.DefaultLinkSystem()
+	ls.SetReadStorage(&store)
+	for _, blk := range proofBlocks {
+		if err := store.Put(cctx.Context, string(blk.Cid().Bytes()), blk.RawData()); err != nil {
+			return err
+		}
+	}
+	// the proof must be for a segment of the requested path
+	proven := len(proof.Segments)
+	matches := proven < len(requested) && *proof.Missing == requested[proven]
+	for i := 0; matches && i < proven; i++ {
+		matches = proof.Segments[i] == requested[i]
+	}
+	if !matches {
+		return fmt.Errorf("proof of absence of %s/%s is not for the requested path", path.Join(proof.Segments...), *proof.Missing)
+	}
+	if err := unixfsresolver.VerifyAbsence(cctx.Context, &ls, root, proof); err != nil {
+		return fmt.Errorf("verifying proof of absence: %w", err)
+	}
+	return fmt.Errorf("verified %s does not exist under %s/%s", *proof.Missing, root, path.Join(proof.Segments...))
+}
+
+// extractRoot writes the content under root to outputDir: the entries of a directory, or a file named fileName
+func extractRoot(c *cli.Context, ls *ipld.LinkSystem, root cid.Cid, outputDir string, fileName string) error {
 	outputResolvedDir, err := filepath.EvalSymlinks(outputDir)
 	if err != nil {
 		return err
@@ -175,6 +448,26 @@ func extractRoot(c *cli.Context, ls *ipld.LinkSystem, root cid.Cid, outputDir st
 			return err
 		}
 	}
+
+	if root.Prefix().Codec == cid.Raw {
+		raw, err := ls.Load(ipld.LinkContext{}, cidlink.Link{Cid: root}, basicnode.Prototype.Bytes)
+		if err != nil {
+			return err
+		}
+		return extractFile(c, ls, raw, filepath.Join(outputResolvedDir, fileName))
+	}
+
+	pbn, err := ls.Load(ipld.LinkContext{}, cidlink.Link{Cid: root}, dagpb.Type.PBNode)
+	if err != nil {
+		return err
+	}
+	pbnode := pbn.(dagpb.PBNode)
+
+	ufn, err := unixfsnode.Reify(ipld.LinkContext{}, pbnode, ls)
+	if err != nil {
+		return err
+	}
+
 	if err := extractDir(c, ls, ufn, outputResolvedDir, "/"); err != nil {
 		if !errors.Is(err, ErrNotDir) {
 			return fmt.Errorf("%s: %w", root, err)
@@ -192,7 +485,7 @@ func extractRoot(c *cli.Context, ls *ipld.LinkSystem, root cid.Cid, outputDir st
 			return err
 		}
 		if ufsNode.DataType.Int() == data.Data_File || ufsNode.DataType.Int() == data.Data_Raw {
-			if err := extractFile(c, ls, pbnode, filepath.Join(outputResolvedDir, "unknown")); err != nil {
+			if err := extractFile(c, ls, pbnode, filepath.Join(outputResolvedDir, fileName)); err != nil {
 				return err
 			}
 		}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/ipfs/stargate/pkg/carreader"
+	carwriter "github.com/ipfs/stargate/pkg/carwriter.go"
+	"github.com/ipfs/stargate/pkg/unixfsresolver"
+	"github.com/ipfs/stargate/pkg/unixfsstore/sql"
+	"github.com/ipld/go-car/v2/blockstore"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadDAGRepeatedLeaves(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	ls := cidlink.DefaultLinkSystem()
+	store := memstore.Store{Bag: make(map[string][]byte)}
+	ls.SetReadStorage(&store)
+	ls.SetWriteStorage(&store)
+
+	// every leaf of a file of zeros is the same block
+	n, _, err := builder.BuildUnixFSFile(bytes.NewReader(make([]byte, 10*4096)), "size-4096", &ls)
+	req.NoError(err)
+	root := n.(cidlink.Link).Cid
+
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	req.NoError(err)
+	req.NoError(f.Close())
+	sqldb, err := sql.SqlDB(f.Name())
+	req.NoError(err)
+	req.NoError(sql.CreateTables(ctx, sqldb))
+	db := sql.NewSQLUnixFSStore(sqldb)
+	req.NoError(db.AddRoot(ctx, root, nil, &ls))
+	appResolver := unixfsresolver.NewUnixFSAppResolver(db, fixedLinkSystem{&ls})
+
+	read := func(query stargate.Query, haves *stargate.Haves) []cid.Cid {
+		haveSet, err := stargate.NewHaveSet(haves)
+		req.NoError(err)
+		var buf bytes.Buffer
+		req.NoError(carwriter.WriteCar(ctx, &buf, root, nil, query, haveSet, appResolver))
+		reader, err := carreader.NewReader(&buf)
+		req.NoError(err)
+		dest, err := blockstore.OpenReadWrite(filepath.Join(t.TempDir(), "dest.car"), []cid.Cid{root})
+		req.NoError(err)
+		_, missing, err := readDAG(ctx, reader, haveSet, dest)
+		req.NoError(err)
+		return missing
+	}
+
+	// leaves repeated outside the range, or when leaves are not sent, are listed as duplicates but were never sent
+	req.Empty(read(nil, nil))
+	req.Empty(read(stargate.Query{"bytes": {"-4096"}}, nil))
+	req.Empty(read(stargate.Query{"bytes": {"8192-12288"}}, nil))
+	req.Empty(read(stargate.Query{"noleaves": {""}}, nil))
+
+	// a leaf the server takes to be held, but which is not, is missing
+	_, pathResolver, err := appResolver.GetResolver(ctx, root)
+	req.NoError(err)
+	queryResolver, err := pathResolver.ResolveQuery(ctx, nil, nil)
+	req.NoError(err)
+	dag, err := queryResolver.Next()
+	req.NoError(err)
+	leaf := dag.Blocks[2].Link
+	req.Equal([]cid.Cid{leaf}, read(stargate.Query{"bytes": {"-4096"}}, &stargate.Haves{Cids: []cid.Cid{leaf}}))
+}
+
+type fixedLinkSystem struct {
+	lsys *ipld.LinkSystem
+}
+
+func (fls fixedLinkSystem) ResolveLinkSystem(ctx context.Context, root cid.Cid, metadata []byte) (*ipld.LinkSystem, error) {
+	return fls.lsys, nil
+}
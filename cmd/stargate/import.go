@@ -1,151 +1,183 @@
 package main
 
 import (
-	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/ipfs/go-cid"
-	"github.com/ipfs/go-unixfsnode/data/builder"
-	"github.com/ipfs/stargate/internal/stores"
-	"github.com/ipfs/stargate/internal/storeutil"
-	"github.com/ipfs/stargate/pkg/unixfsstore/sql"
-	"github.com/ipfs/stargate/pkg/unixfsstore/traversal"
-	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipfs/stargate/internal/importer"
 	"github.com/mitchellh/go-homedir"
 	"github.com/urfave/cli/v2"
 )
 
+// stdinArg is the source argument that reads from stdin
+const stdinArg = "-"
+
 var importCmd = &cli.Command{
-	Name:   "import",
-	Usage:  "Import a file into the StarGate",
-	Before: before,
+	Name:      "import",
+	Usage:     "Import a file into the StarGate",
+	UsageText: "stargate import [--car | --tar | --nocopy | --watch] <path>, or - for stdin",
+	Before:    before,
 	Flags: []cli.Flag{
 		&cli.BoolFlag{
 			Name:  "car",
 			Usage: "Imports a car file directly",
 			Value: false,
 		},
+		&cli.BoolFlag{
+			Name:  "tar",
+			Usage: "Imports the files in a tar archive as a directory, without extracting them",
+		},
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "when importing a file from stdin, wrap it in a directory under this name",
+		},
+		&cli.StringFlag{
+			Name:  "chunker",
+			Usage: "how to split files into blocks: 'size-<bytes>' or 'rabin-<min>-<avg>-<max>' -- overrides the repo config",
+		},
+		&cli.BoolFlag{
+			Name:  "preserve-mode",
+			Usage: "record the permissions of the entries of a directory or tar archive -- overrides the repo config",
+		},
+		&cli.BoolFlag{
+			Name:  "nocopy",
+			Usage: "leave the bytes of files where they are, only referencing them -- they can't be served once changed",
+		},
+		&cli.BoolFlag{
+			Name:  "preserve-mtime",
+			Usage: "record the modification times of the entries of a directory or tar archive -- overrides the repo config",
+		},
+		&cli.IntFlag{
+			Name:  "concurrency",
+			Usage: "how many files of a directory to read and hash at once, one per CPU if zero -- overrides the repo config",
+		},
+		&cli.StringFlag{
+			Name:  "progress",
+			Usage: "report progress as 'text' on stderr, as 'json' events on stdout in place of the CID, or 'none' -- text if stderr is a terminal",
+		},
+		&cli.BoolFlag{
+			Name:  "watch",
+			Usage: "keep importing each top-level entry of a directory once it appears or changes, pointing a name at its latest root",
+		},
+		&cli.DurationFlag{
+			Name:  "interval",
+			Usage: "how often --watch looks for changes",
+			Value: 10 * time.Second,
+		},
+		&cli.BoolFlag{
+			Name:  "remove",
+			Usage: "with --watch, remove the roots of entries that change or are deleted",
+		},
 	},
 	Action: func(cctx *cli.Context) error {
 		if cctx.Args().Len() != 1 {
-			return fmt.Errorf("usage: import <filepath>")
+			return fmt.Errorf("usage: %s", cctx.Command.UsageText)
 		}
-
-		repoDir, err := homedir.Expand(cctx.String(FlagRepo.Name))
-		if err != nil {
-			return fmt.Errorf("expanding repo file path: %w", err)
+		if cctx.Bool("car") && cctx.Bool("tar") {
+			return errors.New("--car and --tar can't be used together")
 		}
-		sqldb, err := configureRepo(cctx.Context, repoDir)
-		if err != nil {
-			return fmt.Errorf("initializing repo: %w", err)
+		fromStdin := cctx.Args().First() == stdinArg
+		if cctx.IsSet("name") && (!fromStdin || cctx.Bool("car") || cctx.Bool("tar")) {
+			return errors.New("--name only applies to a file imported from stdin")
 		}
-		srcName, err := homedir.Expand(cctx.Args().First())
-		if err != nil {
-			return fmt.Errorf("expanding source file path: %w", err)
+		if cctx.Bool("nocopy") && (fromStdin || cctx.Bool("car") || cctx.Bool("tar")) {
+			return errors.New("--nocopy only applies to a file or directory on disk")
+		}
+		if cctx.Bool("watch") && (fromStdin || cctx.Bool("car") || cctx.Bool("tar")) {
+			return errors.New("--watch only applies to a directory on disk")
+		}
+		if (cctx.IsSet("interval") || cctx.IsSet("remove")) && !cctx.Bool("watch") {
+			return errors.New("--interval and --remove only apply to --watch")
+		}
+		if cctx.IsSet("progress") && cctx.Bool("watch") {
+			return errors.New("--progress doesn't apply to --watch")
 		}
-		srcName, err = filepath.Abs(srcName)
+		progress, endProgress, err := importProgress(cctx.String("progress"))
 		if err != nil {
-			return fmt.Errorf("expanding source file path: %w", err)
+			return err
 		}
 
-		root, carFileName, err := writeRawCarFile(repoDir, srcName)
-		defer func() {
-			if err != nil && carFileName != "" {
-				_ = os.Remove(carFileName)
-			}
-		}()
+		_, cfg, err := loadConfig(cctx)
 		if err != nil {
 			return err
 		}
-		newLocale := filepath.Join(carPath(repoDir), root.String()+".car")
-		if fileExists(newLocale) {
-			return errors.New("file or directory already imported")
+		if cctx.IsSet("chunker") {
+			cfg.Import.Chunker = cctx.String("chunker")
 		}
-		err = os.Rename(carFileName, newLocale)
-		if err != nil {
-			return fmt.Errorf("renaming file: %w", err)
+		if cctx.IsSet("concurrency") {
+			cfg.Import.Concurrency = cctx.Int("concurrency")
 		}
-		carFileName = newLocale
-
-		db := sql.NewSQLUnixFSStore(sqldb)
-		err = indexImport(cctx.Context, carFileName, db)
-		if err != nil {
-			return fmt.Errorf("indexing the imported data: %w", err)
+		if err := cfg.Validate(); err != nil {
+			return err
+		}
+		if cctx.IsSet("preserve-mode") {
+			cfg.Import.PreserveMode = cctx.Bool("preserve-mode")
+		}
+		if cctx.IsSet("preserve-mtime") {
+			cfg.Import.PreserveMtime = cctx.Bool("preserve-mtime")
+		}
+		settings := importer.Settings{
+			Chunker:       cfg.Import.Chunker,
+			PreserveMode:  cfg.Import.PreserveMode,
+			PreserveMtime: cfg.Import.PreserveMtime,
+			NoCopy:        cctx.Bool("nocopy"),
+			Concurrency:   cfg.Import.Concurrency,
 		}
-		fmt.Printf("Sending CID %s through the Stargate!\n", root.String())
-		return err
-	},
-}
 
-func fileExists(filename string) bool {
-	info, err := os.Stat(filename)
-	if os.IsNotExist(err) {
-		return false
-	}
-	return !info.IsDir()
-}
+		var src io.Reader = os.Stdin
+		srcName := stdinArg
+		if !fromStdin {
+			srcName, err = homedir.Expand(cctx.Args().First())
+			if err != nil {
+				return fmt.Errorf("expanding source file path: %w", err)
+			}
+			srcName, err = filepath.Abs(srcName)
+			if err != nil {
+				return fmt.Errorf("expanding source file path: %w", err)
+			}
+			if cctx.Bool("watch") {
+				return watchDir(cctx, srcName, settings)
+			}
+			if cctx.Bool("car") || cctx.Bool("tar") {
+				f, err := os.Open(srcName)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				src = f
+			}
+		}
 
-func writeRawCarFile(repoDir string, srcName string) (cid.Cid, string, error) {
-	f, err := os.CreateTemp(carPath(repoDir), "stargate-tmp-")
-	if err != nil {
-		return cid.Undef, "", fmt.Errorf("creating CAR: %w", err)
-	}
-	defer func() {
+		imp, release, err := openContent(cctx)
 		if err != nil {
-			f.Close()
+			return err
 		}
-	}()
-
-	bs, err := stores.ReadWriteFilestoreFile(f)
-	if err != nil {
-		return cid.Undef, "", fmt.Errorf("cpening CAR Blockstore: %w", err)
-	}
-	lsys := storeutil.LinkSystemForBlockstore(bs)
-	root, _, err := builder.BuildUnixFSRecursive(srcName, &lsys)
-	if err != nil {
-		return cid.Undef, "", fmt.Errorf("importing data: %w", err)
-	}
-	err = bs.Close()
-	if err != nil {
-		return cid.Undef, "", fmt.Errorf("finalizing CAR file: %w", err)
-	}
-	st, err := f.Stat()
-	if err != nil {
-		return cid.Undef, "", fmt.Errorf("reading CAR stats: %w", err)
-	}
-	existingName := filepath.Join(carPath(repoDir), st.Name())
-
-	if err = f.Close(); err != nil {
-		return cid.Undef, "", fmt.Errorf("closing car file: %w", err)
-	}
-	return root.(cidlink.Link).Cid, existingName, nil
-}
-
-func indexImport(ctx context.Context, carFileName string, db *sql.SQLUnixFSStore) error {
-
-	bs, err := stores.ReadOnlyFilestore(carFileName)
-	if err != nil {
-		return fmt.Errorf("reopening file store")
-	}
-	allKeys, err := bs.AllKeysChan(ctx)
-	if err != nil {
-		return fmt.Errorf("fetching all block keys")
-	}
-	lsys := storeutil.LinkSystemForBlockstore(bs)
-
-	roots, err := traversal.DiscoverRoots(ctx, allKeys, &lsys)
-	if err != nil {
-		return fmt.Errorf("discovering roots: %w", err)
-	}
-
-	for _, root := range roots {
-		err := db.AddRoot(ctx, root, []byte(carFileName), &lsys)
+		defer release()
+		var root cid.Cid
+		switch {
+		case cctx.Bool("car"):
+			root, err = imp.ImportCAR(cctx.Context, src, progress)
+		case cctx.Bool("tar"):
+			root, err = imp.ImportTar(cctx.Context, src, settings, progress)
+		case fromStdin:
+			root, err = imp.ImportReader(cctx.Context, src, cctx.String("name"), settings, progress)
+		default:
+			root, err = imp.ImportPath(cctx.Context, srcName, settings, progress)
+		}
+		endProgress()
 		if err != nil {
-			return fmt.Errorf("adding root to index: %w", err)
+			return err
 		}
-	}
-	return bs.Close()
+		// the last event carries the root
+		if cctx.String("progress") == progressJSON {
+			return nil
+		}
+		fmt.Printf("Sending CID %s through the Stargate!\n", root.String())
+		return nil
+	},
 }
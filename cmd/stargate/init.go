@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/ipfs/stargate/internal/config"
 	ufssql "github.com/ipfs/stargate/pkg/unixfsstore/sql"
 	"github.com/mitchellh/go-homedir"
 	"github.com/urfave/cli/v2"
@@ -51,10 +52,21 @@ var initCmd = &cli.Command{
 		if err != nil {
 			return fmt.Errorf("expanding repo file path: %w", err)
 		}
-		_, err = configureRepo(cctx.Context, repoDir)
-		if err == nil {
-			fmt.Println("Stargate activated!")
+		_, release, err := openRepo(cctx.Context, repoDir)
+		if err != nil {
+			return err
+		}
+		defer release()
+		// keep the settings of a repo initialized before
+		if _, err := os.Stat(config.Path(repoDir)); os.IsNotExist(err) {
+			if err := config.Default().Save(repoDir); err != nil {
+				return err
+			}
+			fmt.Printf("Wrote the default config to %s\n", config.Path(repoDir))
+		} else if _, err := config.Load(repoDir); err != nil {
+			return err
 		}
-		return err
+		fmt.Println("Stargate activated!")
+		return nil
 	},
 }
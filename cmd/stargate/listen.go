@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipfs/stargate/internal/config"
+	"github.com/ipfs/stargate/pkg/server"
+	"github.com/urfave/cli/v2"
+)
+
+var listenFlags = []cli.Flag{
+	&cli.StringSliceFlag{
+		Name: "listen",
+		Usage: "an address to listen on, such as '127.0.0.1:7777' or 'unix:/run/stargate.sock' -- may be " +
+			"repeated, and replaces --port",
+	},
+	&cli.StringFlag{
+		Name:  "tls-cert",
+		Usage: "serve HTTPS with the certificate in this PEM file, reloaded when it changes",
+	},
+	&cli.StringFlag{
+		Name:  "tls-key",
+		Usage: "the PEM file of the private key for --tls-cert",
+	},
+	&cli.DurationFlag{
+		Name:  "read-header-timeout",
+		Usage: "time allowed to read a request's headers",
+	},
+	&cli.DurationFlag{
+		Name:  "read-timeout",
+		Usage: "time allowed to read a whole request -- no limit when zero",
+	},
+	&cli.DurationFlag{
+		Name:  "write-timeout",
+		Usage: "time allowed to write a response -- no limit when zero",
+	},
+	&cli.DurationFlag{
+		Name:  "idle-timeout",
+		Usage: "how long to keep idle connections open",
+	},
+	&cli.IntFlag{
+		Name:  "max-header-bytes",
+		Usage: "the largest request headers accepted",
+	},
+	&cli.IntFlag{
+		Name:  "max-concurrent-requests",
+		Usage: "requests served at once before rejecting more with 503 -- no limit when zero",
+	},
+	&cli.Float64Flag{
+		Name:  "client-rate-limit",
+		Usage: "requests per second each client may make before getting 429 -- no limit when zero",
+	},
+	&cli.IntFlag{
+		Name:  "client-rate-burst",
+		Usage: "requests each client may make at once above --client-rate-limit",
+	},
+	&cli.IntFlag{
+		Name:  "client-max-concurrent-requests",
+		Usage: "requests each client may have in progress before getting 429 -- no limit when zero",
+	},
+	&cli.IntFlag{
+		Name:  "client-bytes-per-second",
+		Usage: "throttle each client's responses to this many bytes per second -- no limit when zero",
+	},
+	&cli.StringFlag{
+		Name: "client-key",
+		Usage: "how clients are told apart for limits: 'ip', or 'header:<name>', such as 'header:X-Forwarded-For' " +
+			"behind a proxy or 'header:Authorization' to limit each token",
+	},
+}
+
+// listenOptions configures where and how the server listens, and the limits on what it serves
+func listenOptions(cfg config.Server) ([]server.Option, error) {
+	options := make([]server.Option, 0, len(cfg.Listen)+4)
+	for _, address := range cfg.Listen {
+		options = append(options, server.WithAddress(address))
+	}
+	options = append(options,
+		server.WithTimeouts(server.Timeouts{
+			ReadHeader: time.Duration(cfg.ReadHeaderTimeout),
+			Read:       time.Duration(cfg.ReadTimeout),
+			Write:      time.Duration(cfg.WriteTimeout),
+			Idle:       time.Duration(cfg.IdleTimeout),
+		}),
+		server.WithMaxHeaderBytes(cfg.MaxHeaderBytes),
+		server.WithMaxConcurrentRequests(cfg.MaxConcurrentRequests),
+	)
+	if limits := cfg.ClientLimits; limits.RateLimit > 0 || limits.MaxConcurrentRequests > 0 || limits.BytesPerSecond > 0 {
+		clientLimits := server.ClientLimits{
+			RequestsPerSecond:     limits.RateLimit,
+			RequestBurst:          limits.RateBurst,
+			MaxConcurrentRequests: limits.MaxConcurrentRequests,
+			BytesPerSecond:        limits.BytesPerSecond,
+		}
+		switch key := limits.Key; {
+		case key == "ip":
+			clientLimits.ClientKey = server.ClientIP
+		case strings.HasPrefix(key, "header:"):
+			clientLimits.ClientKey = server.ClientHeader(strings.TrimPrefix(key, "header:"))
+		default:
+			return nil, fmt.Errorf("unknown client key '%s'", key)
+		}
+		options = append(options, server.WithClientLimits(clientLimits))
+	}
+	if cfg.TLSCert != "" {
+		options = append(options, server.WithTLSFiles(cfg.TLSCert, cfg.TLSKey))
+	}
+	return options, nil
+}
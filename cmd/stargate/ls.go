@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ipfs/go-unixfsnode/data"
+	"github.com/urfave/cli/v2"
+)
+
+var lsCmd = &cli.Command{
+	Name:   "ls",
+	Usage:  "List the root of each import",
+	Before: before,
+	Action: func(cctx *cli.Context) error {
+		imp, release, err := openContent(cctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		roots, err := imp.Roots(cctx.Context)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "CID\tKIND\tCAR")
+		for _, root := range roots {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", root.CID, data.DataTypeNames[root.Kind], root.Metadata)
+		}
+		return tw.Flush()
+	},
+}
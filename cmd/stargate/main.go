@@ -42,7 +42,12 @@ func main() {
 			initCmd,
 			serverCmd,
 			fetchCmd,
+			exportCmd,
 			importCmd,
+			lsCmd,
+			rmCmd,
+			namesCmd,
+			accessCmd,
 		},
 	}
 	app.Setup()
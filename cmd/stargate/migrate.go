@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/stargate/internal/stores"
+)
+
+// repoVersion is the version of the layout of the repo written by this release. Repos written before it was
+// recorded are version 1, which kept the positional mappings of no-copy imports inside their CAR files
+const repoVersion = 2
+
+func versionPath(cfgDir string) string {
+	return filepath.Join(cfgDir, "version")
+}
+
+// readRepoVersion returns the version of the layout of a repo, which is 1 if it has none recorded
+func readRepoVersion(cfgDir string) (int, error) {
+	raw, err := os.ReadFile(versionPath(cfgDir))
+	if os.IsNotExist(err) {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil {
+		return 0, fmt.Errorf("parsing repo version %s: %w", versionPath(cfgDir), err)
+	}
+	return version, nil
+}
+
+func writeRepoVersion(cfgDir string) error {
+	return os.WriteFile(versionPath(cfgDir), []byte(strconv.Itoa(repoVersion)+"\n"), 0644)
+}
+
+// migrateRepo brings the layout of an existing repo up to repoVersion. The repo lock must be held
+func migrateRepo(ctx context.Context, cfgDir string) error {
+	version, err := readRepoVersion(cfgDir)
+	if err != nil {
+		return err
+	}
+	switch {
+	case version == repoVersion:
+		return nil
+	case version > repoVersion:
+		return fmt.Errorf("repo %s is version %d, newer than this stargate supports (%d)", cfgDir, version, repoVersion)
+	}
+	carFiles, err := filepath.Glob(filepath.Join(carPath(cfgDir), "*.car"))
+	if err != nil {
+		return err
+	}
+	for _, carFile := range carFiles {
+		migrated, err := stores.MigrateCAR(ctx, carFile)
+		if err != nil {
+			return fmt.Errorf("migrating %s: %w", carFile, err)
+		}
+		if migrated {
+			fmt.Fprintf(os.Stderr, "Moved the positional mappings of %s beside it\n", carFile)
+		}
+	}
+	return writeRepoVersion(cfgDir)
+}
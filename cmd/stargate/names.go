@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+var namesCmd = &cli.Command{
+	Name:      "names",
+	Usage:     "List the names pointing at the latest root of each entry published by import --watch, or get the root of one",
+	UsageText: "stargate names [<name>]",
+	Before:    before,
+	Action: func(cctx *cli.Context) error {
+		if cctx.Args().Len() > 1 {
+			return fmt.Errorf("usage: %s", cctx.Command.UsageText)
+		}
+		names, release, err := openNames(cctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		if cctx.Args().Len() == 1 {
+			name, err := names.Name(cctx.Context, cctx.Args().First())
+			if err != nil {
+				return err
+			}
+			if name == nil {
+				return fmt.Errorf("no name %s", cctx.Args().First())
+			}
+			fmt.Println(name.Root)
+			return nil
+		}
+		all, err := names.Names(cctx.Context)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tCID\tUPDATED\tSOURCE")
+		for _, name := range all {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", name.Name, name.Root, name.Updated.Format(time.RFC3339), name.Source)
+		}
+		return tw.Flush()
+	},
+}
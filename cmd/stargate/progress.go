@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ipfs/stargate/internal/importer"
+	"github.com/mattn/go-isatty"
+)
+
+// Formats of the progress of an import
+const (
+	progressText = "text"
+	progressJSON = "json"
+	progressNone = "none"
+)
+
+// importProgress returns the function reporting the progress of an import in a format: as a line on stderr rewritten
+// with each report, or as JSON events on stdout. Without a format, progress is reported as text when stderr is a
+// terminal, and not at all otherwise. The returned end func must be called once the import returns, to end a line
+// left unfinished by a failure
+func importProgress(format string) (_ importer.ProgressFunc, end func(), _ error) {
+	if format == "" {
+		format = progressNone
+		if isatty.IsTerminal(os.Stderr.Fd()) {
+			format = progressText
+		}
+	}
+	switch format {
+	case progressNone:
+		return nil, func() {}, nil
+	case progressJSON:
+		encoder := json.NewEncoder(os.Stdout)
+		return func(progress importer.Progress) { _ = encoder.Encode(progress) }, func() {}, nil
+	case progressText:
+		tp := &textProgress{w: os.Stderr}
+		return tp.report, tp.end, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown progress format '%s'", format)
+	}
+}
+
+// textProgress writes progress as a single line, rewritten in place
+type textProgress struct {
+	w io.Writer
+	// width is the length of the line written last, or zero once it is ended
+	width int
+}
+
+func (tp *textProgress) report(progress importer.Progress) {
+	line := fmt.Sprintf("%s: %d files, %s, %d blocks", progress.Stage, progress.Files, formatBytes(progress.Bytes),
+		progress.Blocks)
+	if progress.Elapsed > 0 {
+		line += fmt.Sprintf(", %s/s", formatBytes(int64(float64(progress.Bytes)/progress.Elapsed)))
+	}
+	// blank out what is left of a longer line before
+	padding := ""
+	if tp.width > len(line) {
+		padding = strings.Repeat(" ", tp.width-len(line))
+	}
+	fmt.Fprintf(tp.w, "\r%s%s", line, padding)
+	tp.width = len(line)
+	if progress.Stage == importer.StageDone {
+		tp.end()
+	}
+}
+
+func (tp *textProgress) end() {
+	if tp.width > 0 {
+		fmt.Fprintln(tp.w)
+		tp.width = 0
+	}
+}
+
+// formatBytes formats a number of bytes in binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+var rmCmd = &cli.Command{
+	Name:      "rm",
+	Usage:     "Remove an import and its CAR file",
+	UsageText: "stargate rm <root>",
+	Before:    before,
+	Action: func(cctx *cli.Context) error {
+		root, err := rootArg(cctx)
+		if err != nil {
+			return err
+		}
+		imp, release, err := openContent(cctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+		if err := imp.Remove(cctx.Context, root); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s\n", root)
+		return nil
+	},
+}
@@ -3,38 +3,63 @@ package main
 import (
 	"context"
 	"fmt"
-	"net"
 	"net/http"
 	_ "net/http/pprof"
-
-	"github.com/ipfs/go-cid"
-	"github.com/ipfs/stargate/internal/stores"
-	"github.com/ipfs/stargate/internal/storeutil"
-	stargate "github.com/ipfs/stargate/pkg"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ipfs/stargate/internal/admin"
+	"github.com/ipfs/stargate/internal/importer"
+	"github.com/ipfs/stargate/pkg/access"
 	"github.com/ipfs/stargate/pkg/handler"
+	"github.com/ipfs/stargate/pkg/metrics"
+	"github.com/ipfs/stargate/pkg/server"
 	"github.com/ipfs/stargate/pkg/unixfsresolver"
 	"github.com/ipfs/stargate/pkg/unixfsstore/sql"
-	"github.com/ipld/go-ipld-prime"
 	"github.com/mitchellh/go-homedir"
 	"github.com/urfave/cli/v2"
 )
 
 var serverCmd = &cli.Command{
-	Name:   "server",
-	Usage:  "Start a stargate http server",
+	Name:  "server",
+	Usage: "Start a stargate http server",
+	Description: "Settings are read from the repo's config.json, written by init. Flags override them for a single " +
+		"run.",
 	Before: before,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.BoolFlag{
 			Name:  "pprof",
 			Usage: "run pprof web server on localhost:6070",
 		},
 		&cli.UintFlag{
 			Name:  "port",
-			Usage: "the port the web server listens on",
-			Value: 7777,
+			Usage: "the port the web server listens on, on all interfaces, when --listen is not set",
 		},
-	},
+		&cli.StringSliceFlag{
+			Name:  "app",
+			Usage: "a URL prefix to serve UnixFS content under, such as 'ipfs' -- may be repeated",
+		},
+		&cli.StringFlag{
+			Name:  "cache-dir",
+			Usage: "directory to cache responses in -- responses are not cached when unset",
+		},
+		&cli.Int64Flag{
+			Name:  "cache-size",
+			Usage: "the most bytes of responses to keep in the cache",
+		},
+		&cli.DurationFlag{
+			Name:  "shutdown-timeout",
+			Usage: "how long to wait for requests in flight to complete when shutting down",
+		},
+		FlagTraceExporter,
+		FlagAdminListen,
+	}, append(listenFlags, accessLogFlags...)...),
 	Action: func(cctx *cli.Context) error {
+		// shut down gracefully on interrupt
+		ctx, stop := signal.NotifyContext(cctx.Context, os.Interrupt, syscall.SIGTERM)
+		defer stop()
 		if cctx.Bool("pprof") {
 			go func() {
 				err := http.ListenAndServe("localhost:6070", nil)
@@ -43,34 +68,127 @@ var serverCmd = &cli.Command{
 				}
 			}()
 		}
-		repoDir, err := homedir.Expand(cctx.String(FlagRepo.Name))
+		repoDir, cfg, err := loadConfig(cctx)
 		if err != nil {
-			return fmt.Errorf("expanding repo file path: %w", err)
+			return err
 		}
-		sqldb, err := configureRepo(cctx.Context, repoDir)
+		if err := overrideServerConfig(cctx, cfg); err != nil {
+			return err
+		}
+		if cfg.Server.TraceExporter != "" {
+			shutdownTracing, err := setupTracing(cctx.Context, cfg.Server.TraceExporter)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := shutdownTracing(context.Background()); err != nil {
+					log.Errorf("flushing traces: %s", err)
+				}
+			}()
+		}
+		// other commands write to the repo through the local API while the server holds the lock
+		sqldb, release, err := openRepo(cctx.Context, repoDir)
 		if err != nil {
-			return fmt.Errorf("initializing repo: %w", err)
+			return err
 		}
+		defer release()
 		db := sql.NewSQLUnixFSStore(sqldb)
-		unixFSAppResolver := unixfsresolver.NewUnixFSAppResolver(db, &resolver{})
-		server := NewHttpServer(
-			cctx.Int("port"),
-			map[string]stargate.AppResolver{
-				"ipfs": unixFSAppResolver,
-			},
-		)
+		unixFSAppResolver := unixfsresolver.NewUnixFSAppResolver(db, server.CARLinkSystemResolver{})
+		logger, logCloser, err := accessLogger(cfg.Server.AccessLog)
+		if err != nil {
+			return err
+		}
+		defer logCloser.Close()
+		key, err := accessKey(repoDir)
+		if err != nil {
+			return err
+		}
+		handlerOptions := []handler.Option{
+			handler.WithAccessLogger(logger),
+			handler.WithAuthorizer(access.NewController(db, key)),
+		}
+		if cfg.Server.Cache.Dir != "" {
+			cacheDir, err := homedir.Expand(cfg.Server.Cache.Dir)
+			if err != nil {
+				return fmt.Errorf("expanding cache directory path: %w", err)
+			}
+			cache, err := handler.NewResponseCache(cacheDir, cfg.Server.Cache.Size)
+			if err != nil {
+				return fmt.Errorf("opening response cache: %w", err)
+			}
+			metrics.Registry.MustRegister(cache.Collectors()...)
+			handlerOptions = append(handlerOptions, handler.WithResponseCache(cache))
+		}
+		serverOptions, err := listenOptions(cfg.Server)
+		if err != nil {
+			return err
+		}
+		var adminAddresses []string
+		localAPI := localAPIAddress(repoDir)
+		if localAPI != "" {
+			adminAddresses = append(adminAddresses, localAPI)
+		} else {
+			log.Warnf("repo path is too long for the local API socket, so other commands can't be used while the server runs")
+		}
+		if cfg.Server.AdminListen != "" {
+			adminAddresses = append(adminAddresses, cfg.Server.AdminListen)
+		}
+		if len(adminAddresses) > 0 {
+			token, err := adminToken(repoDir)
+			if err != nil {
+				return err
+			}
+			adminHandler, err := admin.NewHandler(importer.New(carPath(repoDir), db), db, token)
+			if err != nil {
+				return err
+			}
+			serverOptions = append(serverOptions, server.WithAdmin(adminHandler, adminAddresses...))
+		}
+		for _, prefix := range cfg.Server.Apps {
+			serverOptions = append(serverOptions, server.WithApp(prefix, unixFSAppResolver))
+		}
+		srv, err := server.New(append(serverOptions,
+			server.WithHandlerOptions(handlerOptions...),
+			server.WithMetrics("/metrics"),
+			server.WithBaseContext(cctx.Context),
+		)...)
+		if err != nil {
+			return err
+		}
 
 		// Start the server
-		log.Infof("Opening a stargate on port %d",
-			cctx.Int("port"))
-		server.Start(cctx.Context)
+		if err := srv.Start(); err != nil {
+			return err
+		}
+		for _, addr := range srv.Addrs() {
+			log.Infof("Opening a stargate on %s", addr)
+		}
+		adminAddrs := srv.AdminAddrs()
+		if localAPI != "" {
+			if err := os.WriteFile(apiFilePath(repoDir), []byte(localAPI+"\n"), 0600); err != nil {
+				_ = srv.Shutdown(context.Background())
+				return fmt.Errorf("writing API address: %w", err)
+			}
+			defer os.Remove(apiFilePath(repoDir))
+			adminAddrs = adminAddrs[1:]
+		}
+		for _, addr := range adminAddrs {
+			log.Infof("Serving the admin API on %s, with the token in %s", addr, adminTokenPath(repoDir))
+		}
 
 		// Monitor for shutdown.
-		<-cctx.Context.Done()
+		select {
+		case <-ctx.Done():
+		case err := <-srv.Errors():
+			return fmt.Errorf("serving: %w", err)
+		}
 
 		log.Info("Shutting down stargate...")
 
-		err = server.Stop()
+		// wait for requests in flight to complete
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Server.ShutdownTimeout))
+		defer cancel()
+		err = srv.Shutdown(shutdownCtx)
 		if err != nil {
 			return err
 		}
@@ -82,58 +200,3 @@ var serverCmd = &cli.Command{
 		return nil
 	},
 }
-
-type resolver struct{}
-
-func (r resolver) ResolveLinkSystem(ctx context.Context, root cid.Cid, metadata []byte) (*ipld.LinkSystem, error) {
-	carFile := string(metadata)
-	bs, err := stores.ReadOnlyFilestore(carFile)
-	if err != nil {
-		return nil, err
-	}
-	ls := storeutil.LinkSystemForBlockstore(bs)
-	return &ls, nil
-}
-
-type HttpServer struct {
-	port   int
-	apps   map[string]stargate.AppResolver
-	ctx    context.Context
-	cancel context.CancelFunc
-	server *http.Server
-}
-
-func NewHttpServer(port int, apps map[string]stargate.AppResolver) *HttpServer {
-	return &HttpServer{port: port, apps: apps}
-}
-
-func (s *HttpServer) Start(ctx context.Context) {
-	s.ctx, s.cancel = context.WithCancel(ctx)
-
-	listenAddr := fmt.Sprintf(":%d", s.port)
-	server := http.NewServeMux()
-	for key, resolver := range s.apps {
-		h := handler.NewHandler(key, resolver)
-		server.Handle("/"+key+"/", h)
-	}
-	s.server = &http.Server{
-		Addr:    listenAddr,
-		Handler: server,
-		// This context will be the parent of the context associated with all
-		// incoming requests
-		BaseContext: func(listener net.Listener) context.Context {
-			return s.ctx
-		},
-	}
-
-	go func() {
-		if err := s.server.ListenAndServe(); err != http.ErrServerClosed {
-			log.Fatalf("http.ListenAndServe(): %w", err)
-		}
-	}()
-}
-
-func (s *HttpServer) Stop() error {
-	s.cancel()
-	return s.server.Close()
-}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+)
+
+var FlagTraceExporter = &cli.StringFlag{
+	Name: "trace-exporter",
+	Usage: "export traces to 'stdout', to a file with 'file:<path>', or to an OTLP collector with 'otlp' " +
+		"(configured by the OTEL_EXPORTER_OTLP_* environment variables) -- traces are not recorded when unset",
+	EnvVars: []string{"STARGATE_TRACE_EXPORTER"},
+}
+
+// setupTracing registers a global tracer provider sending spans to the given exporter. The returned function
+// flushes any remaining spans and stops the provider
+func setupTracing(ctx context.Context, exporter string) (func(context.Context) error, error) {
+	var spanExporter sdktrace.SpanExporter
+	var closer io.Closer
+	switch {
+	case exporter == "stdout":
+		var err error
+		spanExporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+		if err != nil {
+			return nil, fmt.Errorf("creating stdout trace exporter: %w", err)
+		}
+	case strings.HasPrefix(exporter, "file:"):
+		file, err := os.OpenFile(strings.TrimPrefix(exporter, "file:"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("opening trace file: %w", err)
+		}
+		closer = file
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			return nil, fmt.Errorf("creating file trace exporter: %w", err)
+		}
+	case exporter == "otlp":
+		var err error
+		spanExporter, err = otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("creating otlp trace exporter: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter '%s'", exporter)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("stargate"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}, nil
+}
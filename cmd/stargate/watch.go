@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ipfs/stargate/internal/importer"
+	"github.com/ipfs/stargate/internal/watch"
+	"github.com/urfave/cli/v2"
+)
+
+// watchDir publishes the entries of a directory until interrupted. The repo is only opened while polling, so a
+// server can start or stop in between, taking over the imports through its API while it runs
+func watchDir(cctx *cli.Context, dir string, settings importer.Settings) error {
+	ctx, stop := signal.NotifyContext(cctx.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	w, err := watch.New(dir, settings, cctx.Bool("remove"))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Watching %s for changes\n", w.Dir())
+	ticker := time.NewTicker(cctx.Duration("interval"))
+	defer ticker.Stop()
+	for {
+		if err := pollWatched(ctx, cctx, w); err != nil {
+			fmt.Fprintf(os.Stderr, "Polling %s: %s\n", w.Dir(), err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func pollWatched(ctx context.Context, cctx *cli.Context, w *watch.Watcher) error {
+	repo, err := openRepoAccess(cctx)
+	if err != nil {
+		return err
+	}
+	defer repo.release()
+	events, err := w.Poll(ctx, repo.content(), repo.names())
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		switch {
+		case event.Err != nil:
+			fmt.Fprintf(os.Stderr, "Publishing %s: %s\n", event.Name, event.Err)
+		case event.Root.Defined():
+			fmt.Printf("Published %s as %s\n", event.Name, event.Root)
+		default:
+			fmt.Printf("Unpublished %s\n", event.Name)
+		}
+		if event.RemovedPrevious {
+			fmt.Printf("Removed %s, the previous root of %s\n", event.Previous, event.Name)
+		}
+	}
+	return nil
+}
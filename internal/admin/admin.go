@@ -0,0 +1,636 @@
+/*
+Package admin serves an HTTP API for importing and managing the content of a repo from another host. It is meant
+for a listener of its own, apart from public traffic, and every request must present the admin token as a bearer
+token.
+
+	POST   /admin/v0/import?type=file|tar|car  import the request body, streaming progress
+	POST   /admin/v0/import?type=path&path=<p> import a file or directory on the server's host, streaming progress
+	GET    /admin/v0/roots                     list the roots of each import
+	DELETE /admin/v0/roots/<cid>               remove an import
+	POST   /admin/v0/roots/<cid>/reindex       index an import again, streaming progress
+	POST   /admin/v0/roots/<cid>/verify        check every block of an import against its CID
+	POST   /admin/v0/roots/<cid>/private       only serve a root to requests with a token for it
+	POST   /admin/v0/roots/<cid>/public        serve a root to anyone
+	GET    /admin/v0/tokens[?root=<cid>]       list access tokens
+	POST   /admin/v0/tokens                    add an access token
+	GET    /admin/v0/tokens/<id>               get an access token
+	DELETE /admin/v0/tokens/<id>               revoke an access token
+	GET    /admin/v0/names                     list names
+	GET    /admin/v0/names/<name>              get the root a name points at
+	PUT    /admin/v0/names/<name>              point a name at a root
+	DELETE /admin/v0/names/<name>              remove a name
+
+Imports take the settings of the UnixFS DAG to build as query parameters: chunker, such as size-1048576, and
+preserveMode and preserveMtime for the entries of a tar archive or directory. A file import wraps the file in a
+directory as the entry named by the name parameter, if it is set. A path import reads an absolute path on the
+server's host, and is only accepted over a Unix socket -- whose clients share the host. With nocopy, it leaves the
+bytes of the files where they are, only referencing them, and concurrency sets how many of its files are hashed at
+once.
+
+Progress is streamed as newline delimited JSON events, the last of which has either a root or an error. An import of
+content already in the repo ends with both the error and the root.
+*/
+package admin
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/ipfs/go-unixfsnode/data"
+	"github.com/ipfs/stargate/internal/importer"
+	"github.com/ipfs/stargate/pkg/unixfsstore"
+	"github.com/ipfs/stargate/pkg/unixfsstore/sql"
+)
+
+var log = logging.Logger("stargateadmin")
+
+// PathPrefix is the path all admin API requests are under
+const PathPrefix = "/admin/v0/"
+
+// Types of content the import endpoint accepts, selected with the type query parameter
+const (
+	TypeFile = "file"
+	TypeTar  = "tar"
+	TypeCAR  = "car"
+	TypePath = "path"
+)
+
+// ContentTypeProgress is the content type of streamed progress
+const ContentTypeProgress = "application/x-ndjson"
+
+// Event is a line of streamed progress
+type Event struct {
+	importer.Progress
+	Error string `json:"error,omitempty"`
+}
+
+// Root describes the root of an import
+type Root struct {
+	CID  string `json:"cid"`
+	Kind string `json:"kind"`
+	CAR  string `json:"car"`
+}
+
+// Token is an access token. The hash of its secret is only sent when adding it
+type Token struct {
+	ID         string    `json:"id"`
+	Root       string    `json:"root"`
+	Name       string    `json:"name,omitempty"`
+	SecretHash []byte    `json:"secretHash,omitempty"`
+	Created    time.Time `json:"created"`
+	// Expires is zero if the token does not expire
+	Expires time.Time `json:"expires"`
+	Revoked bool      `json:"revoked"`
+}
+
+// Name points a stable name at the latest root published under it
+type Name struct {
+	Name string `json:"name"`
+	Root string `json:"root"`
+	// Source is the directory the name is published from, if any
+	Source string `json:"source,omitempty"`
+	// Fingerprint identifies the state of the entry of Source the root was imported from
+	Fingerprint []byte    `json:"fingerprint,omitempty"`
+	Updated     time.Time `json:"updated"`
+}
+
+func nameFromStore(name unixfsstore.Name) Name {
+	return Name{Name: name.Name, Root: name.Root.String(), Source: name.Source, Fingerprint: name.Fingerprint,
+		Updated: name.Updated}
+}
+
+func (n Name) storeName() (unixfsstore.Name, error) {
+	root, err := cid.Parse(n.Root)
+	if err != nil {
+		return unixfsstore.Name{}, fmt.Errorf("parsing root CID '%s': %w", n.Root, err)
+	}
+	return unixfsstore.Name{Name: n.Name, Root: root, Source: n.Source, Fingerprint: n.Fingerprint, Updated: n.Updated}, nil
+}
+
+func tokenFromAccessToken(token unixfsstore.AccessToken) Token {
+	return Token{
+		ID:      token.ID,
+		Root:    token.Root.String(),
+		Name:    token.Name,
+		Created: token.Created,
+		Expires: token.Expires,
+		Revoked: token.Revoked,
+	}
+}
+
+func (t Token) accessToken() (unixfsstore.AccessToken, error) {
+	root, err := cid.Parse(t.Root)
+	if err != nil {
+		return unixfsstore.AccessToken{}, fmt.Errorf("parsing root CID '%s': %w", t.Root, err)
+	}
+	return unixfsstore.AccessToken{
+		ID:         t.ID,
+		Root:       root,
+		Name:       t.Name,
+		SecretHash: t.SecretHash,
+		Created:    t.Created,
+		Expires:    t.Expires,
+		Revoked:    t.Revoked,
+	}, nil
+}
+
+// NewToken generates a random admin token
+func NewToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// Handler serves the admin API
+type Handler struct {
+	importer *importer.Importer
+	store    *sql.SQLUnixFSStore
+	token    string
+}
+
+var _ http.Handler = (*Handler)(nil)
+
+// NewHandler constructs a Handler managing content through an importer, and access to it in the importer's store,
+// for requests presenting token. The token can't be empty, as that would let requests without one through
+func NewHandler(imp *importer.Importer, store *sql.SQLUnixFSStore, token string) (*Handler, error) {
+	if token == "" {
+		return nil, errors.New("admin token is empty")
+	}
+	return &Handler{importer: imp, store: store, token: token}, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bearer, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(bearer), []byte(h.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="stargate-admin"`)
+		writeError(w, http.StatusUnauthorized, errors.New("invalid admin token"))
+		return
+	}
+	path, ok := strings.CutPrefix(r.URL.Path, PathPrefix)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no endpoint %s", r.URL.Path))
+		return
+	}
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(segments) == 1 && segments[0] == "import":
+		h.serveImport(w, r)
+	case len(segments) == 1 && segments[0] == "roots":
+		h.serveRoots(w, r)
+	case len(segments) == 2 && segments[0] == "roots":
+		h.serveRoot(w, r, segments[1], "")
+	case len(segments) == 3 && segments[0] == "roots":
+		h.serveRoot(w, r, segments[1], segments[2])
+	case len(segments) == 1 && segments[0] == "tokens":
+		h.serveTokens(w, r)
+	case len(segments) == 2 && segments[0] == "tokens":
+		h.serveToken(w, r, segments[1])
+	case len(segments) == 1 && segments[0] == "names":
+		h.serveNames(w, r)
+	case len(segments) == 2 && segments[0] == "names":
+		h.serveName(w, r, segments[1])
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no endpoint %s", r.URL.Path))
+	}
+}
+
+func (h *Handler) serveImport(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	settings, err := settingsFromQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var importFn func(context.Context, io.Reader, importer.ProgressFunc) (cid.Cid, error)
+	switch importType := r.URL.Query().Get("type"); importType {
+	case TypeFile, "":
+		name := r.URL.Query().Get("name")
+		importFn = func(ctx context.Context, src io.Reader, progress importer.ProgressFunc) (cid.Cid, error) {
+			return h.importer.ImportReader(ctx, src, name, settings, progress)
+		}
+	case TypeTar:
+		importFn = func(ctx context.Context, src io.Reader, progress importer.ProgressFunc) (cid.Cid, error) {
+			return h.importer.ImportTar(ctx, src, settings, progress)
+		}
+	case TypeCAR:
+		importFn = h.importer.ImportCAR
+	case TypePath:
+		if !fromUnixSocket(r) {
+			writeError(w, http.StatusForbidden, errors.New("path imports are only accepted over a Unix socket"))
+			return
+		}
+		srcPath := r.URL.Query().Get("path")
+		if !filepath.IsAbs(srcPath) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("path '%s' is not absolute", srcPath))
+			return
+		}
+		importFn = func(ctx context.Context, _ io.Reader, progress importer.ProgressFunc) (cid.Cid, error) {
+			return h.importer.ImportPath(ctx, srcPath, settings, progress)
+		}
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown import type '%s'", importType))
+		return
+	}
+	body := &trackingBody{ReadCloser: r.Body}
+	canWrite := body.read
+	if r.URL.Query().Get("type") == TypePath {
+		// there is no body to wait for
+		canWrite = nil
+	}
+	streamProgress(w, canWrite, func(progress importer.ProgressFunc) error {
+		root, err := importFn(r.Context(), body, progress)
+		if err == nil {
+			log.Infof("imported %s", root)
+		}
+		if errors.Is(err, importer.ErrAlreadyImported) {
+			// the root is sent along with the error
+			progress(importer.Progress{Stage: importer.StageDone, Root: root.String()})
+		}
+		return err
+	})
+}
+
+// settingsFromQuery reads the settings of an import from query parameters
+func settingsFromQuery(query url.Values) (importer.Settings, error) {
+	settings := importer.Settings{Chunker: query.Get("chunker")}
+	if value := query.Get("concurrency"); value != "" {
+		var err error
+		if settings.Concurrency, err = strconv.Atoi(value); err != nil {
+			return importer.Settings{}, fmt.Errorf("parsing concurrency: %w", err)
+		}
+	}
+	for param, setting := range map[string]*bool{
+		"preserveMode":  &settings.PreserveMode,
+		"preserveMtime": &settings.PreserveMtime,
+		"nocopy":        &settings.NoCopy,
+	} {
+		if value := query.Get(param); value != "" {
+			var err error
+			if *setting, err = strconv.ParseBool(value); err != nil {
+				return importer.Settings{}, fmt.Errorf("parsing %s: %w", param, err)
+			}
+		}
+	}
+	return settings, nil
+}
+
+// settingsQuery encodes the settings of an import as query parameters
+func settingsQuery(settings importer.Settings) url.Values {
+	query := url.Values{}
+	if settings.Chunker != "" {
+		query.Set("chunker", settings.Chunker)
+	}
+	if settings.PreserveMode {
+		query.Set("preserveMode", "true")
+	}
+	if settings.PreserveMtime {
+		query.Set("preserveMtime", "true")
+	}
+	if settings.NoCopy {
+		query.Set("nocopy", "true")
+	}
+	if settings.Concurrency != 0 {
+		query.Set("concurrency", strconv.Itoa(settings.Concurrency))
+	}
+	return query
+}
+
+// fromUnixSocket returns whether a request was received over a Unix socket
+func fromUnixSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
+
+// trackingBody records when a request body has been read to the end. An HTTP/1.x server may close the body once
+// the response is written to, so progress can only be streamed from then
+type trackingBody struct {
+	io.ReadCloser
+	eof atomic.Bool
+}
+
+func (tb *trackingBody) Read(p []byte) (int, error) {
+	n, err := tb.ReadCloser.Read(p)
+	if errors.Is(err, io.EOF) {
+		tb.eof.Store(true)
+	}
+	return n, err
+}
+
+func (tb *trackingBody) read() bool {
+	return tb.eof.Load()
+}
+
+func (h *Handler) serveRoots(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	rootCIDs, err := h.importer.Roots(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	roots := make([]Root, 0, len(rootCIDs))
+	for _, rootCID := range rootCIDs {
+		kind, ok := data.DataTypeNames[rootCID.Kind]
+		if !ok {
+			kind = "Unknown"
+		}
+		roots = append(roots, Root{CID: rootCID.CID.String(), Kind: kind, CAR: string(rootCID.Metadata)})
+	}
+	writeJSON(w, roots)
+}
+
+func (h *Handler) serveRoot(w http.ResponseWriter, r *http.Request, cidString string, action string) {
+	root, err := cid.Parse(cidString)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("parsing CID '%s': %w", cidString, err))
+		return
+	}
+	switch action {
+	case "":
+		if !allowMethod(w, r, http.MethodDelete) {
+			return
+		}
+		if err := h.importer.Remove(r.Context(), root); err != nil {
+			writeImportError(w, err)
+			return
+		}
+		log.Infof("removed %s", root)
+		w.WriteHeader(http.StatusNoContent)
+	case "reindex":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		// check before streaming, so a missing root gets an error status
+		if err := h.importer.Imported(r.Context(), root); err != nil {
+			writeImportError(w, err)
+			return
+		}
+		streamProgress(w, nil, func(progress importer.ProgressFunc) error {
+			return h.importer.Reindex(r.Context(), root, progress)
+		})
+	case "verify":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		verification, err := h.importer.Verify(r.Context(), root)
+		if errors.Is(err, importer.ErrNotImported) {
+			writeImportError(w, err)
+			return
+		}
+		result := struct {
+			importer.Verification
+			OK    bool   `json:"ok"`
+			Error string `json:"error,omitempty"`
+		}{Verification: verification, OK: err == nil}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		writeJSON(w, result)
+	case "private", "public":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		err := h.store.SetRootPrivate(r.Context(), root, action == "private")
+		if errors.Is(err, sql.ErrNotFound) {
+			err = fmt.Errorf("%s: %w", root, importer.ErrNotImported)
+		}
+		if err != nil {
+			writeImportError(w, err)
+			return
+		}
+		log.Infof("made %s %s", root, action)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no action '%s'", action))
+	}
+}
+
+func (h *Handler) serveTokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		root := cid.Undef
+		if rootString := r.URL.Query().Get("root"); rootString != "" {
+			var err error
+			if root, err = cid.Parse(rootString); err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("parsing CID '%s': %w", rootString, err))
+				return
+			}
+		}
+		accessTokens, err := h.store.AccessTokens(r.Context(), root)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		tokens := make([]Token, 0, len(accessTokens))
+		for _, accessToken := range accessTokens {
+			tokens = append(tokens, tokenFromAccessToken(accessToken))
+		}
+		writeJSON(w, tokens)
+	case http.MethodPost:
+		var token Token
+		if err := json.NewDecoder(r.Body).Decode(&token); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("reading token: %w", err))
+			return
+		}
+		accessToken, err := token.accessToken()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if accessToken.ID == "" || len(accessToken.SecretHash) == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("a token needs an ID and a secret hash"))
+			return
+		}
+		if err := h.store.AddAccessToken(r.Context(), accessToken); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		log.Infof("added token %s for %s", accessToken.ID, accessToken.Root)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (h *Handler) serveToken(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		accessToken, err := h.store.AccessToken(r.Context(), id)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if accessToken == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no token %s", id))
+			return
+		}
+		writeJSON(w, tokenFromAccessToken(*accessToken))
+	case http.MethodDelete:
+		err := h.store.RevokeAccessToken(r.Context(), id)
+		if errors.Is(err, sql.ErrNotFound) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no token %s", id))
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		log.Infof("revoked token %s", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (h *Handler) serveNames(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	storeNames, err := h.store.Names(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	names := make([]Name, 0, len(storeNames))
+	for _, name := range storeNames {
+		names = append(names, nameFromStore(name))
+	}
+	writeJSON(w, names)
+}
+
+func (h *Handler) serveName(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		storeName, err := h.store.Name(r.Context(), name)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if storeName == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no name %s", name))
+			return
+		}
+		writeJSON(w, nameFromStore(*storeName))
+	case http.MethodPut:
+		var body Name
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("reading name: %w", err))
+			return
+		}
+		body.Name = name
+		storeName, err := body.storeName()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if storeName.Updated.IsZero() {
+			storeName.Updated = time.Now()
+		}
+		if err := h.store.SetName(r.Context(), storeName); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		log.Infof("pointed %s at %s", name, storeName.Root)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		err := h.store.RemoveName(r.Context(), name)
+		if errors.Is(err, sql.ErrNotFound) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no name %s", name))
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		log.Infof("removed name %s", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPut+", "+http.MethodDelete)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// streamProgress runs an import, streaming its progress, and ends with an event holding the error if it fails. If
+// canWrite is set, progress is held back until it returns true, leaving only the latest event to send
+func streamProgress(w http.ResponseWriter, canWrite func() bool, run func(importer.ProgressFunc) error) {
+	w.Header().Set("Content-Type", ContentTypeProgress)
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	send := func(event Event) {
+		if err := encoder.Encode(event); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	var last importer.Progress
+	var lastSent bool
+	err := run(func(progress importer.Progress) {
+		last, lastSent = progress, false
+		if canWrite == nil || canWrite() {
+			send(Event{Progress: progress})
+			lastSent = true
+		}
+	})
+	if err != nil {
+		send(Event{Progress: last, Error: err.Error()})
+	} else if !lastSent {
+		send(Event{Progress: last})
+	}
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+func writeImportError(w http.ResponseWriter, err error) {
+	if errors.Is(err, importer.ErrNotImported) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Warnf("writing response: %s", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
@@ -0,0 +1,330 @@
+package admin_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-unixfsnode/data"
+	"github.com/ipfs/stargate/internal/admin"
+	"github.com/ipfs/stargate/internal/importer"
+	"github.com/ipfs/stargate/internal/testutil"
+	"github.com/ipfs/stargate/pkg/access"
+	"github.com/ipfs/stargate/pkg/unixfsstore"
+	"github.com/ipfs/stargate/pkg/unixfsstore/sql"
+	"github.com/stretchr/testify/require"
+)
+
+const testToken = "open-sesame"
+
+func newTestRepo(t *testing.T) (*importer.Importer, *sql.SQLUnixFSStore) {
+	sqldb, err := sql.SqlDB(filepath.Join(t.TempDir(), "db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = sqldb.Close() })
+	require.NoError(t, sql.CreateTables(context.Background(), sqldb))
+	carDir := filepath.Join(t.TempDir(), "carstore")
+	require.NoError(t, os.Mkdir(carDir, 0755))
+	store := sql.NewSQLUnixFSStore(sqldb)
+	return importer.New(carDir, store), store
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	imp, store := newTestRepo(t)
+	h, err := admin.NewHandler(imp, store, testToken)
+	require.NoError(t, err)
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func do(t *testing.T, srv *httptest.Server, method string, path string, token string, body []byte) *http.Response {
+	req, err := http.NewRequest(method, srv.URL+admin.PathPrefix+path, bytes.NewReader(body))
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+func readEvents(t *testing.T, resp *http.Response) []admin.Event {
+	require.Equal(t, admin.ContentTypeProgress, resp.Header.Get("Content-Type"))
+	var events []admin.Event
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var event admin.Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	require.NoError(t, scanner.Err())
+	require.NotEmpty(t, events)
+	return events
+}
+
+func TestAdmin(t *testing.T) {
+	srv := newTestServer(t)
+	data := testutil.RandomBytes(1000000)
+
+	// an empty token would admit requests without one
+	imp, store := newTestRepo(t)
+	_, err := admin.NewHandler(imp, store, "")
+	require.Error(t, err)
+
+	for _, token := range []string{"", "wrong"} {
+		resp := do(t, srv, http.MethodGet, "roots", token, nil)
+		require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		require.NotEmpty(t, resp.Header.Get("WWW-Authenticate"))
+	}
+
+	resp := do(t, srv, http.MethodPost, "import?type=file", testToken, data)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	events := readEvents(t, resp)
+	last := events[len(events)-1]
+	require.Empty(t, last.Error)
+	require.Equal(t, importer.StageDone, last.Stage)
+	require.NotEmpty(t, last.Root)
+	root := last.Root
+
+	// importing the same content again fails in the final event
+	resp = do(t, srv, http.MethodPost, "import", testToken, data)
+	events = readEvents(t, resp)
+	require.Contains(t, events[len(events)-1].Error, importer.ErrAlreadyImported.Error())
+
+	resp = do(t, srv, http.MethodPost, "import?type=zip", testToken, data)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = do(t, srv, http.MethodGet, "roots", testToken, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var roots []admin.Root
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&roots))
+	require.Len(t, roots, 1)
+	require.Equal(t, root, roots[0].CID)
+	require.Equal(t, "File", roots[0].Kind)
+
+	resp = do(t, srv, http.MethodPost, "roots/"+root+"/verify", testToken, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var verification struct {
+		Blocks int64 `json:"blocks"`
+		OK     bool  `json:"ok"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&verification))
+	require.True(t, verification.OK)
+	require.Equal(t, int64(5), verification.Blocks)
+
+	resp = do(t, srv, http.MethodPost, "roots/"+root+"/reindex", testToken, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	events = readEvents(t, resp)
+	require.Equal(t, root, events[len(events)-1].Root)
+
+	resp = do(t, srv, http.MethodGet, "roots/"+root, testToken, nil)
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	require.Equal(t, http.MethodDelete, resp.Header.Get("Allow"))
+
+	resp = do(t, srv, http.MethodDelete, "roots/"+root, testToken, nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	for path, method := range map[string]string{
+		"roots/" + root:              http.MethodDelete,
+		"roots/" + root + "/verify":  http.MethodPost,
+		"roots/" + root + "/reindex": http.MethodPost,
+	} {
+		resp = do(t, srv, method, path, testToken, nil)
+		require.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+	}
+
+	resp = do(t, srv, http.MethodDelete, "roots/apples", testToken, nil)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = do(t, srv, http.MethodGet, "bananas", testToken, nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `"error"`)
+}
+
+func TestClient(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	srv := newTestServer(t)
+	client := admin.NewClient(srv.URL, testToken)
+
+	src := t.TempDir()
+	req.NoError(os.Mkdir(filepath.Join(src, "sub"), 0755))
+	req.NoError(os.WriteFile(filepath.Join(src, "sub", "a.txt"), []byte("apples"), 0644))
+	req.NoError(os.WriteFile(filepath.Join(src, "b.bin"), testutil.RandomBytes(500000), 0644))
+	req.NoError(os.Symlink("b.bin", filepath.Join(src, "link")))
+
+	// the same content imported directly has the same roots
+	direct, _ := newTestRepo(t)
+	dirRoot, err := direct.ImportPath(ctx, src, importer.Settings{}, nil)
+	req.NoError(err)
+	fileRoot, err := direct.ImportPath(ctx, filepath.Join(src, "b.bin"), importer.Settings{}, nil)
+	req.NoError(err)
+
+	var last importer.Progress
+	root, err := client.ImportPath(ctx, src, importer.Settings{}, func(progress importer.Progress) {
+		last = progress
+	})
+	req.NoError(err)
+	req.Equal(dirRoot, root)
+	req.Equal(importer.StageDone, last.Stage)
+	root, err = client.ImportPath(ctx, filepath.Join(src, "b.bin"), importer.Settings{}, nil)
+	req.NoError(err)
+	req.Equal(fileRoot, root)
+	// content already imported comes back with its root
+	root, err = client.ImportPath(ctx, src, importer.Settings{}, nil)
+	req.ErrorIs(err, importer.ErrAlreadyImported)
+	req.Equal(dirRoot, root)
+
+	// settings are sent along with the content
+	settings := importer.Settings{Chunker: "size-65536"}
+	smallChunksRoot, err := direct.ImportPath(ctx, filepath.Join(src, "b.bin"), settings, nil)
+	req.NoError(err)
+	req.NotEqual(fileRoot, smallChunksRoot)
+	root, err = client.ImportPath(ctx, filepath.Join(src, "b.bin"), settings, nil)
+	req.NoError(err)
+	req.Equal(smallChunksRoot, root)
+	req.NoError(client.Remove(ctx, smallChunksRoot))
+	_, err = client.ImportPath(ctx, filepath.Join(src, "b.bin"), importer.Settings{Chunker: "apples"}, nil)
+	req.Error(err)
+
+	roots, err := client.Roots(ctx)
+	req.NoError(err)
+	req.Len(roots, 2)
+	for _, root := range roots {
+		if root.CID.Equals(dirRoot) {
+			req.Equal(data.Data_Directory, root.Kind)
+		} else {
+			req.Equal(fileRoot, root.CID)
+			req.Equal(data.Data_File, root.Kind)
+		}
+	}
+
+	req.NoError(client.Remove(ctx, fileRoot))
+	req.ErrorIs(client.Remove(ctx, fileRoot), importer.ErrNotImported)
+
+	// metadata is sent along with a directory
+	settings = importer.Settings{PreserveMode: true, PreserveMtime: true}
+	preservedRoot, err := direct.ImportPath(ctx, src, settings, nil)
+	req.NoError(err)
+	req.NotEqual(dirRoot, preservedRoot)
+	root, err = client.ImportPath(ctx, src, settings, nil)
+	req.NoError(err)
+	req.Equal(preservedRoot, root)
+
+	// and the name of a stream
+	namedRoot, err := direct.ImportReader(ctx, bytes.NewReader([]byte("apples")), "a.txt", importer.Settings{}, nil)
+	req.NoError(err)
+	root, err = client.ImportReader(ctx, bytes.NewReader([]byte("apples")), "a.txt", importer.Settings{}, nil)
+	req.NoError(err)
+	req.Equal(namedRoot, root)
+
+	req.NoError(client.SetRootPrivate(ctx, dirRoot, true))
+	req.NoError(client.SetRootPrivate(ctx, dirRoot, false))
+	req.ErrorIs(client.SetRootPrivate(ctx, testutil.GenerateCid(), true), sql.ErrNotFound)
+
+	_, token, err := access.NewToken(dirRoot, "ci", time.Time{})
+	req.NoError(err)
+	req.NoError(client.AddAccessToken(ctx, token))
+	got, err := client.AccessToken(ctx, token.ID)
+	req.NoError(err)
+	req.Equal(dirRoot, got.Root)
+	req.Equal("ci", got.Name)
+	req.True(got.Expires.IsZero())
+	// the hash of the secret never leaves the server
+	req.Empty(got.SecretHash)
+	tokens, err := client.AccessTokens(ctx, dirRoot)
+	req.NoError(err)
+	req.Len(tokens, 1)
+	tokens, err = client.AccessTokens(ctx, fileRoot)
+	req.NoError(err)
+	req.Empty(tokens)
+	req.NoError(client.RevokeAccessToken(ctx, token.ID))
+	got, err = client.AccessToken(ctx, token.ID)
+	req.NoError(err)
+	req.True(got.Revoked)
+	req.ErrorIs(client.RevokeAccessToken(ctx, "missing"), sql.ErrNotFound)
+	got, err = client.AccessToken(ctx, "missing")
+	req.NoError(err)
+	req.Nil(got)
+
+	updated := time.Unix(time.Now().Unix(), 0)
+	req.NoError(client.SetName(ctx, unixfsstore.Name{Name: "site", Root: dirRoot, Source: src, Fingerprint: []byte("apples"), Updated: updated}))
+	req.NoError(client.SetName(ctx, unixfsstore.Name{Name: "named", Root: namedRoot, Updated: updated}))
+	name, err := client.Name(ctx, "site")
+	req.NoError(err)
+	req.Equal(dirRoot, name.Root)
+	req.Equal(src, name.Source)
+	req.Equal([]byte("apples"), name.Fingerprint)
+	req.True(updated.Equal(name.Updated))
+	names, err := client.Names(ctx)
+	req.NoError(err)
+	req.Len(names, 2)
+	req.Equal("named", names[0].Name)
+	req.NoError(client.RemoveName(ctx, "named"))
+	req.ErrorIs(client.RemoveName(ctx, "named"), sql.ErrNotFound)
+	name, err = client.Name(ctx, "named")
+	req.NoError(err)
+	req.Nil(name)
+
+	_, err = admin.NewClient(srv.URL, "wrong").Roots(ctx)
+	req.ErrorContains(err, "invalid admin token")
+}
+
+func TestClientNoCopy(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	src := t.TempDir()
+	req.NoError(os.WriteFile(filepath.Join(src, "b.bin"), testutil.RandomBytes(500000), 0644))
+	direct, _ := newTestRepo(t)
+	dirRoot, err := direct.ImportPath(ctx, src, importer.Settings{}, nil)
+	req.NoError(err)
+
+	// the path is sent instead of the content, which only a client on the same host can do
+	settings := importer.Settings{NoCopy: true}
+	_, err = admin.NewClient(newTestServer(t).URL, testToken).ImportPath(ctx, src, settings, nil)
+	req.ErrorContains(err, "Unix socket")
+
+	// socket paths are short, so not under the test's temporary directory
+	sockDir, err := os.MkdirTemp("", "stargate-admin-")
+	req.NoError(err)
+	t.Cleanup(func() { _ = os.RemoveAll(sockDir) })
+	sockPath := filepath.Join(sockDir, "admin.sock")
+	listener, err := net.Listen("unix", sockPath)
+	req.NoError(err)
+	imp, store := newTestRepo(t)
+	h, err := admin.NewHandler(imp, store, testToken)
+	req.NoError(err)
+	srv := httptest.NewUnstartedServer(h)
+	srv.Listener = listener
+	srv.Start()
+	t.Cleanup(srv.Close)
+	client := admin.NewClient("unix:"+sockPath, testToken)
+
+	var stages []string
+	root, err := client.ImportPath(ctx, src, settings, func(progress importer.Progress) {
+		stages = append(stages, progress.Stage)
+	})
+	req.NoError(err)
+	req.Equal(dirRoot, root)
+	req.Contains(stages, importer.StageWriting)
+	roots, err := client.Roots(ctx)
+	req.NoError(err)
+	req.Len(roots, 1)
+	info, err := os.Stat(string(roots[0].Metadata))
+	req.NoError(err)
+	req.Less(info.Size(), int64(10000))
+
+	_, err = client.ImportPath(ctx, filepath.Join(src, "missing"), settings, nil)
+	req.Error(err)
+}
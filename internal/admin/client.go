@@ -0,0 +1,436 @@
+package admin
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data"
+	"github.com/ipfs/stargate/internal/importer"
+	"github.com/ipfs/stargate/pkg/unixfsstore"
+	"github.com/ipfs/stargate/pkg/unixfsstore/sql"
+)
+
+// unixPrefix marks an address as a Unix socket path
+const unixPrefix = "unix:"
+
+// Client calls the admin API of a running server, with the same methods as the Importer and UnixFS store it wraps
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// NewClient constructs a Client for the admin API at an address -- a URL, a host and port served over HTTP, or a
+// Unix socket such as "unix:/run/stargate-admin.sock"
+func NewClient(address string, token string) *Client {
+	c := &Client{baseURL: address, token: token, httpClient: &http.Client{}}
+	if path, ok := strings.CutPrefix(address, unixPrefix); ok {
+		c.baseURL = "http://stargate"
+		c.httpClient.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		}
+	} else if !strings.Contains(address, "://") {
+		c.baseURL = "http://" + address
+	}
+	c.baseURL = strings.TrimSuffix(c.baseURL, "/")
+	return c
+}
+
+// ImportPath imports a file or directory tree, sending a directory as a tar stream. An import without copying sends
+// only the path, for the server to read, and must be made over a Unix socket
+func (c *Client) ImportPath(ctx context.Context, srcPath string, settings importer.Settings, progress importer.ProgressFunc) (cid.Cid, error) {
+	if settings.NoCopy {
+		absPath, err := filepath.Abs(srcPath)
+		if err != nil {
+			return cid.Undef, err
+		}
+		return c.importContent(ctx, TypePath, url.Values{"path": {absPath}}, settings, nil, progress)
+	}
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if !info.IsDir() {
+		f, err := os.Open(srcPath)
+		if err != nil {
+			return cid.Undef, err
+		}
+		defer f.Close()
+		return c.importContent(ctx, TypeFile, url.Values{}, settings, f, progress)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTar(pw, srcPath))
+	}()
+	defer pr.Close()
+	return c.importContent(ctx, TypeTar, url.Values{}, settings, pr, progress)
+}
+
+// ImportReader imports a stream as a single file, wrapped in a directory as the entry called name if it is set
+func (c *Client) ImportReader(ctx context.Context, src io.Reader, name string, settings importer.Settings, progress importer.ProgressFunc) (cid.Cid, error) {
+	query := url.Values{}
+	if name != "" {
+		query.Set("name", name)
+	}
+	return c.importContent(ctx, TypeFile, query, settings, src, progress)
+}
+
+// ImportTar imports the files in a tar stream as a directory
+func (c *Client) ImportTar(ctx context.Context, src io.Reader, settings importer.Settings, progress importer.ProgressFunc) (cid.Cid, error) {
+	return c.importContent(ctx, TypeTar, url.Values{}, settings, src, progress)
+}
+
+// ImportCAR imports the blocks of a CAR stream
+func (c *Client) ImportCAR(ctx context.Context, src io.Reader, progress importer.ProgressFunc) (cid.Cid, error) {
+	return c.importContent(ctx, TypeCAR, url.Values{}, importer.Settings{}, src, progress)
+}
+
+func (c *Client) importContent(ctx context.Context, importType string, query url.Values, settings importer.Settings, body io.Reader, progress importer.ProgressFunc) (cid.Cid, error) {
+	for param, values := range settingsQuery(settings) {
+		query[param] = values
+	}
+	query.Set("type", importType)
+	resp, err := c.do(ctx, http.MethodPost, "import?"+query.Encode(), body)
+	if err != nil {
+		return cid.Undef, err
+	}
+	defer resp.Body.Close()
+	var last Event
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		last = Event{}
+		if err := json.Unmarshal(scanner.Bytes(), &last); err != nil {
+			return cid.Undef, fmt.Errorf("reading progress: %w", err)
+		}
+		if last.Error != "" {
+			if last.Root != "" && strings.HasSuffix(last.Error, importer.ErrAlreadyImported.Error()) {
+				root, err := cid.Parse(last.Root)
+				if err != nil {
+					return cid.Undef, fmt.Errorf("reading progress: %w", err)
+				}
+				return root, importer.ErrAlreadyImported
+			}
+			return cid.Undef, errors.New(last.Error)
+		}
+		if progress != nil {
+			progress(last.Progress)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return cid.Undef, fmt.Errorf("reading progress: %w", err)
+	}
+	if last.Root == "" {
+		return cid.Undef, errors.New("import ended without a root")
+	}
+	return cid.Parse(last.Root)
+}
+
+// Roots lists the roots of each import
+func (c *Client) Roots(ctx context.Context) ([]unixfsstore.RootCID, error) {
+	resp, err := c.do(ctx, http.MethodGet, "roots", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var roots []Root
+	if err := json.NewDecoder(resp.Body).Decode(&roots); err != nil {
+		return nil, fmt.Errorf("reading roots: %w", err)
+	}
+	rootCIDs := make([]unixfsstore.RootCID, 0, len(roots))
+	for _, root := range roots {
+		c, err := cid.Parse(root.CID)
+		if err != nil {
+			return nil, fmt.Errorf("reading roots: %w", err)
+		}
+		rootCIDs = append(rootCIDs, unixfsstore.RootCID{CID: c, Kind: data.DataTypeValues[root.Kind], Metadata: []byte(root.CAR)})
+	}
+	return rootCIDs, nil
+}
+
+// Remove removes an import
+func (c *Client) Remove(ctx context.Context, root cid.Cid) error {
+	resp, err := c.do(ctx, http.MethodDelete, "roots/"+url.PathEscape(root.String()), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// SetRootPrivate sets whether a root is private, returning sql.ErrNotFound if the root has not been imported
+func (c *Client) SetRootPrivate(ctx context.Context, root cid.Cid, private bool) error {
+	action := "public"
+	if private {
+		action = "private"
+	}
+	resp, err := c.do(ctx, http.MethodPost, "roots/"+url.PathEscape(root.String())+"/"+action, nil)
+	if errors.Is(err, importer.ErrNotImported) {
+		return sql.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// AddAccessToken adds an access token
+func (c *Client) AddAccessToken(ctx context.Context, token unixfsstore.AccessToken) error {
+	body, err := json.Marshal(Token{
+		ID:         token.ID,
+		Root:       token.Root.String(),
+		Name:       token.Name,
+		SecretHash: token.SecretHash,
+		Created:    token.Created,
+		Expires:    token.Expires,
+		Revoked:    token.Revoked,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPost, "tokens", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// AccessToken gets an access token, without the hash of its secret. It returns nil if there is no such token
+func (c *Client) AccessToken(ctx context.Context, id string) (*unixfsstore.AccessToken, error) {
+	resp, err := c.do(ctx, http.MethodGet, "tokens/"+url.PathEscape(id), nil)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var token Token
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("reading token: %w", err)
+	}
+	accessToken, err := token.accessToken()
+	if err != nil {
+		return nil, fmt.Errorf("reading token: %w", err)
+	}
+	return &accessToken, nil
+}
+
+// AccessTokens lists the access tokens for a root, or all tokens if root is undefined, without the hashes of their
+// secrets
+func (c *Client) AccessTokens(ctx context.Context, root cid.Cid) ([]unixfsstore.AccessToken, error) {
+	path := "tokens"
+	if root.Defined() {
+		path += "?root=" + url.QueryEscape(root.String())
+	}
+	resp, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tokens []Token
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("reading tokens: %w", err)
+	}
+	accessTokens := make([]unixfsstore.AccessToken, 0, len(tokens))
+	for _, token := range tokens {
+		accessToken, err := token.accessToken()
+		if err != nil {
+			return nil, fmt.Errorf("reading tokens: %w", err)
+		}
+		accessTokens = append(accessTokens, accessToken)
+	}
+	return accessTokens, nil
+}
+
+// RevokeAccessToken revokes an access token, returning sql.ErrNotFound if there is no such token
+func (c *Client) RevokeAccessToken(ctx context.Context, id string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "tokens/"+url.PathEscape(id), nil)
+	if isNotFound(err) {
+		return sql.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// SetName points a name at a root
+func (c *Client) SetName(ctx context.Context, name unixfsstore.Name) error {
+	body, err := json.Marshal(nameFromStore(name))
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, http.MethodPut, "names/"+url.PathEscape(name.Name), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Name gets the root a name points at. It returns nil if there is no such name
+func (c *Client) Name(ctx context.Context, name string) (*unixfsstore.Name, error) {
+	resp, err := c.do(ctx, http.MethodGet, "names/"+url.PathEscape(name), nil)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var returned Name
+	if err := json.NewDecoder(resp.Body).Decode(&returned); err != nil {
+		return nil, fmt.Errorf("reading name: %w", err)
+	}
+	storeName, err := returned.storeName()
+	if err != nil {
+		return nil, fmt.Errorf("reading name: %w", err)
+	}
+	return &storeName, nil
+}
+
+// Names lists every name
+func (c *Client) Names(ctx context.Context) ([]unixfsstore.Name, error) {
+	resp, err := c.do(ctx, http.MethodGet, "names", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var names []Name
+	if err := json.NewDecoder(resp.Body).Decode(&names); err != nil {
+		return nil, fmt.Errorf("reading names: %w", err)
+	}
+	storeNames := make([]unixfsstore.Name, 0, len(names))
+	for _, name := range names {
+		storeName, err := name.storeName()
+		if err != nil {
+			return nil, fmt.Errorf("reading names: %w", err)
+		}
+		storeNames = append(storeNames, storeName)
+	}
+	return storeNames, nil
+}
+
+// RemoveName removes a name, returning sql.ErrNotFound if there is no such name
+func (c *Client) RemoveName(ctx context.Context, name string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "names/"+url.PathEscape(name), nil)
+	if isNotFound(err) {
+		return sql.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// apiError is an error response from the admin API
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func isNotFound(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) && apiErr.status == http.StatusNotFound
+}
+
+// do sends a request to the admin API, turning error responses into errors
+func (c *Client) do(ctx context.Context, method string, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+PathPrefix+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var errResponse struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&errResponse); err != nil || errResponse.Error == "" {
+		return nil, fmt.Errorf("admin API: %s", resp.Status)
+	}
+	if resp.StatusCode == http.StatusNotFound && strings.HasSuffix(errResponse.Error, importer.ErrNotImported.Error()) {
+		return nil, fmt.Errorf("%s: %w", strings.TrimSuffix(errResponse.Error, ": "+importer.ErrNotImported.Error()), importer.ErrNotImported)
+	}
+	return nil, &apiError{status: resp.StatusCode, message: errResponse.Error}
+}
+
+// writeTar writes a directory tree as a tar stream, keeping symlinks as they are. The top directory is the entry "./",
+// so its mode and modification time are sent too
+func writeTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			// devices, fifos and the like have no UnixFS representation
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if path == dir {
+			header.Name = "."
+		}
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
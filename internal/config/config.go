@@ -0,0 +1,242 @@
+/*
+Package config reads and writes the configuration file of a StarGate repo. The file is JSON, carrying a version so
+the format can change without breaking repos written by older releases. Command line flags override its settings.
+*/
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	chunk "github.com/ipfs/go-ipfs-chunker"
+	"github.com/ipfs/stargate/pkg/server"
+)
+
+// Version is the version of the configuration format written by this release
+const Version = 1
+
+// FileName is the name of the configuration file in a repo
+const FileName = "config.json"
+
+// Duration is a time.Duration written as a string, such as "30s"
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// Config is the configuration of a repo
+type Config struct {
+	Version int
+	Server  Server
+	Import  Import
+}
+
+// Server configures the stargate server
+type Server struct {
+	// Listen lists the addresses to listen on -- TCP addresses, or Unix sockets as "unix:<path>"
+	Listen []string
+	// AdminListen is an address to serve the admin API on, besides the repo's local socket
+	AdminListen string `json:",omitempty"`
+	// Apps lists the URL prefixes UnixFS content is served under
+	Apps []string
+	// TLSCert and TLSKey are PEM files to serve HTTPS with
+	TLSCert string `json:",omitempty"`
+	TLSKey  string `json:",omitempty"`
+
+	ReadHeaderTimeout Duration
+	ReadTimeout       Duration
+	WriteTimeout      Duration
+	IdleTimeout       Duration
+	ShutdownTimeout   Duration
+
+	MaxHeaderBytes        int
+	MaxConcurrentRequests int
+	ClientLimits          ClientLimits
+
+	Cache     Cache
+	AccessLog AccessLog
+	// TraceExporter is where to send traces: "stdout", "file:<path>" or "otlp". Requests are not traced when empty
+	TraceExporter string `json:",omitempty"`
+}
+
+// ClientLimits limit each client of the server. Zero values mean no limit
+type ClientLimits struct {
+	RateLimit             float64
+	RateBurst             int
+	MaxConcurrentRequests int
+	BytesPerSecond        int
+	// Key is how clients are told apart: "ip", or "header:<name>"
+	Key string
+}
+
+// Cache configures the response cache
+type Cache struct {
+	// Dir is the directory to cache responses in. Responses are not cached when empty
+	Dir  string `json:",omitempty"`
+	Size int64
+}
+
+// AccessLog configures the access log
+type AccessLog struct {
+	// Path is a file to write to, rotated by size, or "stdout"
+	Path string
+	// Format is "json", "logfmt" or "color". Empty means color on a terminal and JSON otherwise
+	Format     string `json:",omitempty"`
+	MaxSize    int
+	MaxBackups int
+}
+
+// Import configures how content is imported
+type Import struct {
+	// Chunker splits files into blocks: "size-<bytes>", or "rabin-<min>-<avg>-<max>"
+	Chunker string
+	// PreserveMode and PreserveMtime record the permissions and modification times of the entries of directories
+	// and tar archives
+	PreserveMode  bool
+	PreserveMtime bool
+	// Concurrency is how many files of a directory tree are read and hashed at once. Zero uses one per CPU
+	Concurrency int `json:",omitempty"`
+}
+
+// Default returns the configuration of a new repo
+func Default() *Config {
+	return &Config{
+		Version: Version,
+		Server: Server{
+			Listen:            []string{":7777"},
+			Apps:              []string{"ipfs"},
+			ReadHeaderTimeout: Duration(server.DefaultReadHeaderTimeout),
+			IdleTimeout:       Duration(2 * time.Minute),
+			ShutdownTimeout:   Duration(30 * time.Second),
+			MaxHeaderBytes:    64 << 10,
+			ClientLimits: ClientLimits{
+				RateBurst: 10,
+				Key:       "ip",
+			},
+			Cache: Cache{
+				Size: 1 << 30,
+			},
+			AccessLog: AccessLog{
+				Path:       "stdout",
+				MaxSize:    100,
+				MaxBackups: 10,
+			},
+		},
+		Import: Import{
+			Chunker: fmt.Sprintf("size-%d", chunk.DefaultBlockSize),
+		},
+	}
+}
+
+// Path returns the path of the configuration file in a repo
+func Path(repoDir string) string {
+	return filepath.Join(repoDir, FileName)
+}
+
+// Load reads the configuration file of a repo. Repos without one, created before configuration files were
+// written, get the default configuration. Settings missing from the file keep their defaults
+func Load(repoDir string) (*Config, error) {
+	raw, err := os.ReadFile(Path(repoDir))
+	if os.IsNotExist(err) {
+		return Default(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+	var versioned struct {
+		Version int
+	}
+	if err := json.Unmarshal(raw, &versioned); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", Path(repoDir), err)
+	}
+	switch {
+	case versioned.Version == 0:
+		return nil, fmt.Errorf("config %s has no version", Path(repoDir))
+	case versioned.Version > Version:
+		return nil, fmt.Errorf("config %s is version %d, newer than this stargate supports (%d)", Path(repoDir),
+			versioned.Version, Version)
+	}
+	cfg := Default()
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	// catch misspelled settings rather than silently ignoring them
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", Path(repoDir), err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("config %s: %w", Path(repoDir), err)
+	}
+	return cfg, nil
+}
+
+// Save writes the configuration file of a repo, replacing any there
+func (c *Config) Save(repoDir string) error {
+	raw, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first, so the config is never left half written
+	f, err := os.CreateTemp(repoDir, FileName+"-")
+	if err != nil {
+		return fmt.Errorf("writing config: %w", err)
+	}
+	_, err = f.Write(append(raw, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), Path(repoDir))
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return fmt.Errorf("writing config: %w", err)
+	}
+	return nil
+}
+
+// Validate checks settings that can be checked without starting anything
+func (c *Config) Validate() error {
+	if len(c.Server.Listen) == 0 {
+		return errors.New("Server.Listen has no addresses")
+	}
+	if len(c.Server.Apps) == 0 {
+		return errors.New("Server.Apps has no prefixes")
+	}
+	for _, prefix := range c.Server.Apps {
+		if prefix == "" || strings.Contains(prefix, "/") {
+			return fmt.Errorf("Server.Apps: invalid prefix '%s'", prefix)
+		}
+	}
+	if (c.Server.TLSCert == "") != (c.Server.TLSKey == "") {
+		return errors.New("Server.TLSCert and Server.TLSKey must be set together")
+	}
+	if key := c.Server.ClientLimits.Key; key != "ip" && !strings.HasPrefix(key, "header:") {
+		return fmt.Errorf("Server.ClientLimits.Key: unknown client key '%s'", key)
+	}
+	if _, err := chunk.FromString(bytes.NewReader(nil), c.Import.Chunker); err != nil {
+		return fmt.Errorf("Import.Chunker: %w", err)
+	}
+	if c.Import.Concurrency < 0 {
+		return errors.New("Import.Concurrency must not be negative")
+	}
+	return nil
+}
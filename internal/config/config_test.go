@@ -0,0 +1,68 @@
+package config
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadAndSave(t *testing.T) {
+	req := require.New(t)
+	repoDir := t.TempDir()
+
+	// a repo without a config gets the defaults
+	cfg, err := Load(repoDir)
+	req.NoError(err)
+	req.Equal(Default(), cfg)
+	req.NoError(cfg.Validate())
+
+	cfg.Server.Listen = []string{"127.0.0.1:8080", "unix:/run/stargate.sock"}
+	cfg.Server.Apps = []string{"ipfs", "files"}
+	cfg.Server.ReadTimeout = Duration(time.Minute)
+	cfg.Import.Chunker = "rabin-131072-262144-524288"
+	req.NoError(cfg.Save(repoDir))
+	loaded, err := Load(repoDir)
+	req.NoError(err)
+	req.Equal(cfg, loaded)
+	raw, err := os.ReadFile(Path(repoDir))
+	req.NoError(err)
+	req.Contains(string(raw), `"ReadTimeout": "1m0s"`)
+
+	// settings missing from the file keep their defaults
+	req.NoError(os.WriteFile(Path(repoDir), []byte(`{"Version": 1, "Server": {"Listen": [":9999"]}}`), 0644))
+	cfg, err = Load(repoDir)
+	req.NoError(err)
+	req.Equal([]string{":9999"}, cfg.Server.Listen)
+	req.Equal(Default().Server.Apps, cfg.Server.Apps)
+	req.Equal(Default().Import, cfg.Import)
+
+	for name, contents := range map[string]string{
+		"no version":      `{"Server": {"Listen": [":9999"]}}`,
+		"newer version":   `{"Version": 2}`,
+		"unknown setting": `{"Version": 1, "Server": {"Lisen": [":9999"]}}`,
+		"bad duration":    `{"Version": 1, "Server": {"IdleTimeout": "forever"}}`,
+		"invalid":         `{"Version": 1, "Import": {"Chunker": "apples"}}`,
+	} {
+		req.NoError(os.WriteFile(Path(repoDir), []byte(contents), 0644))
+		_, err := Load(repoDir)
+		req.Error(err, name)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for name, change := range map[string]func(*Config){
+		"no listen addresses":  func(cfg *Config) { cfg.Server.Listen = nil },
+		"no apps":              func(cfg *Config) { cfg.Server.Apps = nil },
+		"nested app":           func(cfg *Config) { cfg.Server.Apps = []string{"ipfs/files"} },
+		"cert without key":     func(cfg *Config) { cfg.Server.TLSCert = "cert.pem" },
+		"unknown client key":   func(cfg *Config) { cfg.Server.ClientLimits.Key = "cookie" },
+		"unknown chunker":      func(cfg *Config) { cfg.Import.Chunker = "apples" },
+		"negative concurrency": func(cfg *Config) { cfg.Import.Concurrency = -1 },
+	} {
+		cfg := Default()
+		change(cfg)
+		require.Error(t, cfg.Validate(), name)
+	}
+}
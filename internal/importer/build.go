@@ -0,0 +1,271 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	"github.com/ipfs/stargate/internal/stores"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// buildRecursive builds the UnixFS DAG of a file or directory tree, as builder.BuildUnixFSRecursive does but
+// splitting files with the chunker in settings, and keeping the metadata settings ask for. A file imported on its
+// own is only its bytes, as it would be read from a stream. Without copying, the leaves of files are put to bs as
+// positional mappings. Files are read and hashed by as many goroutines at once as settings allow, so their blocks
+// are stored in no particular order, but the DAG is the same
+func buildRecursive(ctx context.Context, srcPath string, settings Settings, lsys *ipld.LinkSystem, bs bstore.Blockstore, reporter *reporter) (ipld.Link, uint64, error) {
+	info, err := os.Lstat(srcPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !info.IsDir() {
+		settings.PreserveMode, settings.PreserveMtime = false, false
+	}
+	concurrency := settings.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	running, cancel := context.WithCancel(ctx)
+	defer cancel()
+	b := &pathBuilder{
+		ctx:      ctx,
+		running:  running,
+		cancel:   cancel,
+		settings: settings,
+		lsys:     lsys,
+		bs:       bs,
+		reporter: reporter,
+		slots:    make(chan struct{}, concurrency),
+	}
+	built := b.buildPath(srcPath, info)
+	// entries left building when another fails still store blocks until they stop
+	b.building.Wait()
+	// entries fail with the context once another has failed, so the first failure is the one that matters
+	if err := b.failure(); err != nil {
+		return nil, 0, err
+	}
+	return built.link, built.size, built.err
+}
+
+// pathBuilder builds the UnixFS DAG of a path in the filesystem. It walks directories as it goes, while files are
+// built in goroutines of their own, one for each of its slots
+type pathBuilder struct {
+	ctx context.Context
+	// running is cancelled once building fails. Blocks are put with ctx, as the positional mappings are written in a
+	// transaction that ends with the context it began with
+	running  context.Context
+	cancel   context.CancelFunc
+	settings Settings
+	lsys     *ipld.LinkSystem
+	bs       bstore.Blockstore
+	reporter *reporter
+	slots    chan struct{}
+	building sync.WaitGroup
+
+	lk  sync.Mutex
+	err error
+}
+
+// builtPath is the DAG of a path, which is set once done is closed
+type builtPath struct {
+	done chan struct{}
+	link ipld.Link
+	size uint64
+	err  error
+}
+
+// fail records the first failure building the DAG, and stops the rest
+func (b *pathBuilder) fail(err error) {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	if b.err == nil {
+		b.err = err
+		b.cancel()
+	}
+}
+
+func (b *pathBuilder) failure() error {
+	b.lk.Lock()
+	defer b.lk.Unlock()
+	return b.err
+}
+
+// buildPath starts building the DAG of a path, returning before it is done. The entries of a directory are walked
+// before returning, and its node is built once they are done
+func (b *pathBuilder) buildPath(srcPath string, info fs.FileInfo) *builtPath {
+	built := &builtPath{done: make(chan struct{})}
+	if err := b.running.Err(); err != nil {
+		built.err = err
+		close(built.done)
+		return built
+	}
+	if info.IsDir() {
+		entries, err := b.startEntries(srcPath)
+		if err != nil {
+			b.fail(err)
+			built.err = err
+			close(built.done)
+			return built
+		}
+		b.building.Add(1)
+		go func() {
+			defer b.building.Done()
+			b.finish(built, info, func(h *holdingStore) (ipld.Link, uint64, error) {
+				return b.buildDir(entries, h)
+			})
+		}()
+		return built
+	}
+	select {
+	case b.slots <- struct{}{}:
+	case <-b.running.Done():
+		built.err = b.running.Err()
+		close(built.done)
+		return built
+	}
+	b.building.Add(1)
+	go func() {
+		defer b.building.Done()
+		defer func() { <-b.slots }()
+		b.finish(built, info, func(h *holdingStore) (ipld.Link, uint64, error) {
+			return b.buildFile(srcPath, info, h)
+		})
+	}()
+	return built
+}
+
+// finish builds the DAG of a path with a holdingStore of its own, records the metadata of the path in its root, and
+// marks it done
+func (b *pathBuilder) finish(built *builtPath, info fs.FileInfo, build func(*holdingStore) (ipld.Link, uint64, error)) {
+	defer close(built.done)
+	h := newHoldingStore(b.lsys)
+	link, size, err := build(h)
+	if err == nil {
+		link, size, err = h.withMetadata(link, size, newMetadata(b.settings, unixMode(info.Mode()), info.ModTime()))
+	}
+	if err == nil {
+		err = h.release()
+	}
+	if err != nil {
+		b.fail(err)
+	}
+	built.link, built.size, built.err = link, size, err
+}
+
+// dirEntry is an entry of a directory being built
+type dirEntry struct {
+	name  string
+	built *builtPath
+}
+
+// startEntries starts building the entries of a directory
+func (b *pathBuilder) startEntries(srcPath string) ([]dirEntry, error) {
+	entries, err := os.ReadDir(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	started := make([]dirEntry, 0, len(entries))
+	for _, entry := range entries {
+		entryPath := filepath.Join(srcPath, entry.Name())
+		entryInfo, err := os.Lstat(entryPath)
+		if err != nil {
+			return nil, err
+		}
+		started = append(started, dirEntry{name: entry.Name(), built: b.buildPath(entryPath, entryInfo)})
+	}
+	return started, nil
+}
+
+// buildDir builds the node of a directory once its entries are done
+func (b *pathBuilder) buildDir(entries []dirEntry, h *holdingStore) (ipld.Link, uint64, error) {
+	links := make([]dagpb.PBLink, 0, len(entries))
+	for _, entry := range entries {
+		<-entry.built.done
+		if entry.built.err != nil {
+			return nil, 0, entry.built.err
+		}
+		dirEntry, err := builder.BuildUnixFSDirectoryEntry(entry.name, int64(entry.built.size), entry.built.link)
+		if err != nil {
+			return nil, 0, err
+		}
+		links = append(links, dirEntry)
+	}
+	return builder.BuildUnixFSDirectory(links, h.linkSystem())
+}
+
+// buildFile builds the DAG of a file or symlink
+func (b *pathBuilder) buildFile(srcPath string, info fs.FileInfo, h *holdingStore) (ipld.Link, uint64, error) {
+	switch mode := info.Mode(); {
+	case mode.Type() == fs.ModeSymlink:
+		target, err := os.Readlink(srcPath)
+		if err != nil {
+			return nil, 0, err
+		}
+		return builder.BuildUnixFSSymlink(target, h.linkSystem())
+	case mode.IsRegular():
+		f, err := os.Open(srcPath)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer f.Close()
+		lsys := h.linkSystem()
+		if b.settings.NoCopy {
+			lsys = b.noCopyLinkSystem(lsys, srcPath)
+		}
+		link, size, err := builder.BuildUnixFSFile(f, b.settings.Chunker, lsys)
+		if err != nil {
+			return nil, 0, err
+		}
+		b.reporter.file()
+		return link, size, nil
+	default:
+		return nil, 0, fmt.Errorf("cannot import %s: not a regular file, directory or symlink", srcPath)
+	}
+}
+
+// noCopyLinkSystem returns a link system storing the raw leaves of the file at srcPath, as it is read from start to
+// end, as positional mappings into the file, and every other block through lsys
+func (b *pathBuilder) noCopyLinkSystem(lsys *ipld.LinkSystem, srcPath string) *ipld.LinkSystem {
+	var offset uint64
+	noCopy := *lsys
+	noCopy.StorageWriteOpener = func(lctx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		var buf bytes.Buffer
+		return &buf, func(link ipld.Link) error {
+			c := link.(cidlink.Link).Cid
+			if c.Prefix().Codec != cid.Raw {
+				w, commit, err := lsys.StorageWriteOpener(lctx)
+				if err != nil {
+					return err
+				}
+				if _, err := w.Write(buf.Bytes()); err != nil {
+					return err
+				}
+				return commit(link)
+			}
+			block, err := blocks.NewBlockWithCid(buf.Bytes(), c)
+			if err != nil {
+				return err
+			}
+			leaf, err := stores.NoCopyBlock(block, srcPath, offset)
+			if err != nil {
+				return err
+			}
+			offset += uint64(buf.Len())
+			return b.bs.Put(b.ctx, leaf)
+		}, nil
+	}
+	return &noCopy
+}
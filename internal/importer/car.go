@@ -0,0 +1,147 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode"
+	"github.com/ipfs/stargate/internal/stores"
+	"github.com/ipfs/stargate/internal/storeutil"
+	"github.com/ipfs/stargate/pkg/unixfsstore/traversal"
+	carv2 "github.com/ipld/go-car/v2"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/datamodel"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// ImportCAR imports the blocks of a CARv1 or CARv2 stream, returning the first root in its header. A CAR without
+// roots in its header, such as one written by an import, must hold a single UnixFS DAG, whose root is returned.
+// Every UnixFS root among the blocks is indexed
+func (imp *Importer) ImportCAR(ctx context.Context, src io.Reader, progress ProgressFunc) (_ cid.Cid, err error) {
+	reporter := newReporter(progress)
+	reporter.stage(StageWriting)
+	f, err := os.CreateTemp(imp.carDir, "stargate-tmp-")
+	if err != nil {
+		return cid.Undef, fmt.Errorf("creating CAR: %w", err)
+	}
+	carFileName := f.Name()
+	defer func() {
+		if err != nil {
+			_ = os.Remove(carFileName)
+		}
+	}()
+	_, err = io.Copy(f, &countingReader{src, reporter})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return cid.Undef, fmt.Errorf("receiving CAR: %w", err)
+	}
+
+	reader, err := carv2.OpenReader(carFileName)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("reading CAR: %w", err)
+	}
+	version := reader.Version
+	roots, err := reader.Roots()
+	if closeErr := reader.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return cid.Undef, fmt.Errorf("reading CAR roots: %w", err)
+	}
+	// a CARv1 has no index, so add one rather than build it whenever the file is opened
+	if version == 1 {
+		indexed, err := os.CreateTemp(imp.carDir, "stargate-tmp-")
+		if err != nil {
+			return cid.Undef, fmt.Errorf("creating CAR: %w", err)
+		}
+		_ = indexed.Close()
+		if err := carv2.WrapV1File(carFileName, indexed.Name()); err != nil {
+			_ = os.Remove(indexed.Name())
+			return cid.Undef, fmt.Errorf("indexing CAR: %w", err)
+		}
+		_ = os.Remove(carFileName)
+		carFileName = indexed.Name()
+	}
+	root := cid.Undef
+	if len(roots) > 0 {
+		root = roots[0]
+	} else if root, err = topLevelRoot(ctx, carFileName); err != nil {
+		return cid.Undef, err
+	}
+	return root, imp.storeCAR(ctx, root, carFileName, nil, reporter)
+}
+
+// topLevelRoot finds the one UnixFS root in a CAR file that is not an entry of a directory in it
+func topLevelRoot(ctx context.Context, carFileName string) (cid.Cid, error) {
+	bs, err := stores.ReadOnlyFilestore(carFileName)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("opening CAR: %w", err)
+	}
+	defer bs.Close()
+	allKeys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("fetching all block keys: %w", err)
+	}
+	lsys := storeutil.LinkSystemForBlockstore(bs)
+	roots, err := traversal.DiscoverRoots(ctx, allKeys, &lsys)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("discovering roots: %w", err)
+	}
+	entries := make(map[cid.Cid]struct{})
+	for _, root := range roots {
+		if root.Prefix().Codec != cid.DagProtobuf {
+			continue
+		}
+		nd, err := lsys.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: root}, dagpb.Type.PBNode)
+		if err != nil {
+			return cid.Undef, err
+		}
+		ufn, err := unixfsnode.Reify(ipld.LinkContext{Ctx: ctx}, nd, &lsys)
+		if err != nil {
+			return cid.Undef, err
+		}
+		if ufn.Kind() != datamodel.Kind_Map {
+			continue
+		}
+		iter := ufn.MapIterator()
+		for !iter.Done() {
+			_, entry, err := iter.Next()
+			if err != nil {
+				return cid.Undef, err
+			}
+			lnk, err := entry.AsLink()
+			if err != nil {
+				return cid.Undef, err
+			}
+			entries[lnk.(cidlink.Link).Cid] = struct{}{}
+		}
+	}
+	var topLevel []cid.Cid
+	for _, root := range roots {
+		if _, ok := entries[root]; !ok {
+			topLevel = append(topLevel, root)
+		}
+	}
+	if len(topLevel) != 1 {
+		return cid.Undef, fmt.Errorf("CAR has no roots in its header, and %d top level UnixFS roots", len(topLevel))
+	}
+	return topLevel[0], nil
+}
+
+// countingReader reports the bytes read through it
+type countingReader struct {
+	io.Reader
+	reporter *reporter
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.Reader.Read(p)
+	cr.reporter.addBytes(n)
+	return n, err
+}
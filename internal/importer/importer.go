@@ -0,0 +1,433 @@
+/*
+Package importer adds content to a StarGate repo -- CAR files kept in a directory and indexed in a UnixFS store --
+and manages what has been added. The CLI and the admin API both import through it
+*/
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	"github.com/ipfs/stargate/internal/stores"
+	"github.com/ipfs/stargate/internal/storeutil"
+	"github.com/ipfs/stargate/pkg/unixfsstore"
+	"github.com/ipfs/stargate/pkg/unixfsstore/sql"
+	"github.com/ipfs/stargate/pkg/unixfsstore/traversal"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+var (
+	// ErrAlreadyImported is returned when importing content whose root is already in the repo
+	ErrAlreadyImported = errors.New("file or directory already imported")
+	// ErrNotImported is returned when managing a root that was not imported -- including one that is only part
+	// of another import
+	ErrNotImported = errors.New("not imported")
+)
+
+// Stages of an import, reported in Progress
+const (
+	StageWriting  = "writing"
+	StageIndexing = "indexing"
+	StageDone     = "done"
+)
+
+// progressInterval is the most often progress is reported while a stage runs
+const progressInterval = 250 * time.Millisecond
+
+// Progress reports on an import as it runs
+type Progress struct {
+	Stage string `json:"stage"`
+	// Files counts the regular files built, which a CAR import has none of
+	Files  int64 `json:"files"`
+	Blocks int64 `json:"blocks"`
+	Bytes  int64 `json:"bytes"`
+	// Elapsed is the seconds since the import began
+	Elapsed float64 `json:"elapsed"`
+	// Root is set once the import is done
+	Root string `json:"root,omitempty"`
+}
+
+// ProgressFunc receives progress reports. It may be nil
+type ProgressFunc func(Progress)
+
+// Settings are the choices made when building the UnixFS DAG of an import. The zero value uses the defaults
+type Settings struct {
+	// Chunker splits files into blocks, such as "size-262144" or "rabin-131072-262144-524288"
+	Chunker string
+	// PreserveMode and PreserveMtime record the permissions and modification times of the files, directories and
+	// symlinks in a directory tree, whether read from the filesystem or from a tar archive
+	PreserveMode  bool
+	PreserveMtime bool
+	// NoCopy leaves the bytes of files in the files they are imported from, storing only the other blocks of the
+	// DAG and the position of each leaf in its file. Blocks of a file that has changed since can no longer be read.
+	// Only imports from the filesystem can be made without copying
+	NoCopy bool
+	// Concurrency is how many files of a directory tree are read and hashed at once. Zero uses one per CPU
+	Concurrency int
+}
+
+// errNoCopyStream is returned asking for a stream to be imported without copying it
+var errNoCopyStream = errors.New("only files and directories on disk can be imported without copying")
+
+// Importer imports content into a directory of CAR files and the UnixFS store indexing them
+type Importer struct {
+	carDir string
+	store  *sql.SQLUnixFSStore
+}
+
+// New constructs an Importer writing CAR files to carDir and indexing them in store
+func New(carDir string, store *sql.SQLUnixFSStore) *Importer {
+	return &Importer{carDir: carDir, store: store}
+}
+
+// carFile returns the path of the CAR file holding a root
+func (imp *Importer) carFile(root cid.Cid) string {
+	return filepath.Join(imp.carDir, root.String()+".car")
+}
+
+// ImportPath imports a file or directory tree from the filesystem, returning its root
+func (imp *Importer) ImportPath(ctx context.Context, srcPath string, settings Settings, progress ProgressFunc) (cid.Cid, error) {
+	if settings.NoCopy {
+		// positional mappings are kept as absolute paths
+		var err error
+		if srcPath, err = filepath.Abs(srcPath); err != nil {
+			return cid.Undef, err
+		}
+	}
+	reporter := newReporter(progress)
+	root, carFileName, written, err := imp.writeRawCarFile(reporter, func(lsys *ipld.LinkSystem, bs bstore.Blockstore) (ipld.Link, error) {
+		root, _, err := buildRecursive(ctx, srcPath, settings, lsys, bs, reporter)
+		return root, err
+	})
+	if err != nil {
+		return cid.Undef, err
+	}
+	return root, imp.storeCAR(ctx, root, carFileName, written, reporter)
+}
+
+// ImportReader imports a stream as a single file, returning its root. If name is set, the file is wrapped in a
+// directory as its only entry, and the directory's root is returned
+func (imp *Importer) ImportReader(ctx context.Context, src io.Reader, name string, settings Settings, progress ProgressFunc) (cid.Cid, error) {
+	if strings.Contains(name, "/") || name == "." || name == ".." {
+		return cid.Undef, fmt.Errorf("invalid file name '%s'", name)
+	}
+	if settings.NoCopy {
+		return cid.Undef, errNoCopyStream
+	}
+	reporter := newReporter(progress)
+	root, carFileName, written, err := imp.writeRawCarFile(reporter, func(lsys *ipld.LinkSystem, _ bstore.Blockstore) (ipld.Link, error) {
+		root, size, err := builder.BuildUnixFSFile(src, settings.Chunker, lsys)
+		if err != nil {
+			return nil, err
+		}
+		reporter.file()
+		if name == "" {
+			return root, nil
+		}
+		entry, err := builder.BuildUnixFSDirectoryEntry(name, int64(size), root)
+		if err != nil {
+			return nil, err
+		}
+		root, _, err = builder.BuildUnixFSDirectory([]dagpb.PBLink{entry}, lsys)
+		return root, err
+	})
+	if err != nil {
+		return cid.Undef, err
+	}
+	return root, imp.storeCAR(ctx, root, carFileName, written, reporter)
+}
+
+// storeCAR moves a newly written CAR file into place for its root and indexes it, removing it on failure. The roots
+// found while writing it are indexed from written, or if it is nil, found by reading the CAR file
+func (imp *Importer) storeCAR(ctx context.Context, root cid.Cid, carFileName string, written *importStore, reporter *reporter) (err error) {
+	defer func() {
+		if err != nil {
+			_ = stores.RemoveCAR(carFileName)
+		}
+	}()
+	newLocale := imp.carFile(root)
+	if _, err := os.Stat(newLocale); err == nil {
+		return ErrAlreadyImported
+	}
+	if err := stores.RenameCAR(carFileName, newLocale); err != nil {
+		return fmt.Errorf("renaming file: %w", err)
+	}
+	carFileName = newLocale
+	reporter.stage(StageIndexing)
+	if written != nil {
+		err = imp.store.ReplaceRoots(ctx, []byte(carFileName), written.finder.Roots(), &written.nodesLsys)
+	} else {
+		err = imp.index(ctx, carFileName)
+	}
+	if err != nil {
+		return fmt.Errorf("indexing the imported data: %w", err)
+	}
+	reporter.done(root)
+	return nil
+}
+
+// writeRawCarFile writes the blocks of the UnixFS DAG created by build to a new CAR file, returning the store they
+// were written through to index them. build stores blocks through the link system, or puts them to the blockstore --
+// which can take positional mappings -- from as many goroutines as it likes
+func (imp *Importer) writeRawCarFile(reporter *reporter, build func(*ipld.LinkSystem, bstore.Blockstore) (ipld.Link, error)) (_ cid.Cid, _ string, _ *importStore, err error) {
+	f, err := os.CreateTemp(imp.carDir, "stargate-tmp-")
+	if err != nil {
+		return cid.Undef, "", nil, fmt.Errorf("creating CAR: %w", err)
+	}
+	var bs stores.ClosableBlockstore
+	defer func() {
+		if err != nil {
+			if bs != nil {
+				_ = bs.Close()
+			}
+			f.Close()
+			_ = stores.RemoveCAR(f.Name())
+		}
+	}()
+
+	bs, err = stores.ReadWriteFilestoreFile(f)
+	if err != nil {
+		return cid.Undef, "", nil, fmt.Errorf("opening CAR Blockstore: %w", err)
+	}
+	reporter.stage(StageWriting)
+	written := newImportStore(bs, reporter)
+	lsys := storeutil.LinkSystemForBlockstore(written)
+	root, err := build(&lsys, written)
+	if err != nil {
+		return cid.Undef, "", nil, fmt.Errorf("importing data: %w", err)
+	}
+	if err = bs.Close(); err != nil {
+		return cid.Undef, "", nil, fmt.Errorf("finalizing CAR file: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return cid.Undef, "", nil, fmt.Errorf("closing car file: %w", err)
+	}
+	return root.(cidlink.Link).Cid, f.Name(), written, nil
+}
+
+// index discovers the roots in a CAR file and indexes them, replacing anything indexed from it before
+func (imp *Importer) index(ctx context.Context, carFileName string) error {
+	bs, err := stores.ReadOnlyFilestore(carFileName)
+	if err != nil {
+		return fmt.Errorf("reopening file store: %w", err)
+	}
+	defer bs.Close()
+	allKeys, err := bs.AllKeysChan(ctx)
+	if err != nil {
+		return fmt.Errorf("fetching all block keys: %w", err)
+	}
+	lsys := storeutil.LinkSystemForBlockstore(bs)
+
+	roots, err := traversal.DiscoverRoots(ctx, allKeys, &lsys)
+	if err != nil {
+		return fmt.Errorf("discovering roots: %w", err)
+	}
+	return imp.store.ReplaceRoots(ctx, []byte(carFileName), roots, &lsys)
+}
+
+// Roots lists the roots of each import
+func (imp *Importer) Roots(ctx context.Context) ([]unixfsstore.RootCID, error) {
+	return imp.store.TopLevelRootCIDs(ctx)
+}
+
+// imported returns the metadata of every import with the given root
+func (imp *Importer) imported(ctx context.Context, root cid.Cid) ([][]byte, error) {
+	roots, err := imp.Roots(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var imports [][]byte
+	for _, rootCID := range roots {
+		if rootCID.CID.Equals(root) {
+			imports = append(imports, rootCID.Metadata)
+		}
+	}
+	if len(imports) == 0 {
+		return nil, fmt.Errorf("%s: %w", root, ErrNotImported)
+	}
+	return imports, nil
+}
+
+// Imported returns nil if root is the root of an import, or an error wrapping ErrNotImported if not
+func (imp *Importer) Imported(ctx context.Context, root cid.Cid) error {
+	_, err := imp.imported(ctx, root)
+	return err
+}
+
+// Remove removes an import from the index, and deletes its CAR file
+func (imp *Importer) Remove(ctx context.Context, root cid.Cid) error {
+	imports, err := imp.imported(ctx, root)
+	if err != nil {
+		return err
+	}
+	for _, metadata := range imports {
+		if err := imp.store.RemoveMetadata(ctx, metadata); err != nil {
+			return fmt.Errorf("removing %s from index: %w", root, err)
+		}
+		// only delete files this importer manages
+		if carFileName := string(metadata); filepath.Dir(carFileName) == filepath.Clean(imp.carDir) {
+			if err := stores.RemoveCAR(carFileName); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("deleting CAR file: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Reindex indexes an import again from its CAR file
+func (imp *Importer) Reindex(ctx context.Context, root cid.Cid, progress ProgressFunc) error {
+	imports, err := imp.imported(ctx, root)
+	if err != nil {
+		return err
+	}
+	reporter := newReporter(progress)
+	reporter.stage(StageIndexing)
+	for _, metadata := range imports {
+		if err := imp.index(ctx, string(metadata)); err != nil {
+			return fmt.Errorf("reindexing %s: %w", root, err)
+		}
+	}
+	reporter.done(root)
+	return nil
+}
+
+// reporter counts the files, blocks and bytes written by an import, and reports them periodically. Blocks may be
+// counted from several goroutines, but progress is reported from one at a time
+type reporter struct {
+	fn         ProgressFunc
+	reporting  sync.Mutex
+	start      time.Time
+	files      atomic.Int64
+	blocks     atomic.Int64
+	bytes      atomic.Int64
+	current    atomic.Value // string
+	lastReport atomic.Int64
+}
+
+func newReporter(fn ProgressFunc) *reporter {
+	r := &reporter{fn: fn, start: time.Now()}
+	r.current.Store("")
+	return r
+}
+
+func (r *reporter) report(root cid.Cid) {
+	if r.fn == nil {
+		return
+	}
+	r.reporting.Lock()
+	defer r.reporting.Unlock()
+	progress := Progress{
+		Stage:   r.current.Load().(string),
+		Files:   r.files.Load(),
+		Blocks:  r.blocks.Load(),
+		Bytes:   r.bytes.Load(),
+		Elapsed: time.Since(r.start).Seconds(),
+	}
+	if root.Defined() {
+		progress.Root = root.String()
+	}
+	r.lastReport.Store(time.Now().UnixNano())
+	r.fn(progress)
+}
+
+func (r *reporter) stage(stage string) {
+	r.current.Store(stage)
+	r.report(cid.Undef)
+}
+
+func (r *reporter) done(root cid.Cid) {
+	r.current.Store(StageDone)
+	r.report(root)
+}
+
+func (r *reporter) file() {
+	r.files.Add(1)
+}
+
+func (r *reporter) block(size int) {
+	r.blocks.Add(1)
+	r.addBytes(size)
+}
+
+func (r *reporter) addBytes(size int) {
+	r.bytes.Add(int64(size))
+	if time.Since(time.Unix(0, r.lastReport.Load())) >= progressInterval {
+		r.report(cid.Undef)
+	}
+}
+
+// importStore writes the blocks of an import to its CAR file one at a time, as they may be put from several
+// goroutines, and reports each. It finds the UnixFS roots among them as they are written, keeping a copy of the dag-pb
+// nodes so the roots can be indexed without reading the CAR file back. Leaves, which make up nearly all of the bytes,
+// are never read to index a DAG, so are not kept
+type importStore struct {
+	bstore.Blockstore
+	reporter *reporter
+
+	lk        sync.Mutex
+	finder    *traversal.RootFinder
+	nodes     bstore.Blockstore
+	nodesLsys ipld.LinkSystem
+}
+
+func newImportStore(bs bstore.Blockstore, reporter *reporter) *importStore {
+	nodes := bstore.NewBlockstore(datastore.NewMapDatastore())
+	return &importStore{
+		Blockstore: bs,
+		reporter:   reporter,
+		finder:     traversal.NewRootFinder(),
+		nodes:      nodes,
+		nodesLsys:  storeutil.LinkSystemForBlockstore(nodes),
+	}
+}
+
+func (is *importStore) Put(ctx context.Context, block blocks.Block) error {
+	if err := is.put(ctx, block); err != nil {
+		return err
+	}
+	is.reporter.block(len(block.RawData()))
+	return nil
+}
+
+func (is *importStore) put(ctx context.Context, block blocks.Block) error {
+	is.lk.Lock()
+	defer is.lk.Unlock()
+	if err := is.Blockstore.Put(ctx, block); err != nil {
+		return err
+	}
+	if block.Cid().Prefix().Codec == cid.DagProtobuf {
+		// the copy only holds the bytes, rather than anything else the block carries
+		node, err := blocks.NewBlockWithCid(block.RawData(), block.Cid())
+		if err != nil {
+			return err
+		}
+		if err := is.nodes.Put(ctx, node); err != nil {
+			return err
+		}
+	}
+	return is.finder.Add(ctx, block.Cid(), &is.nodesLsys)
+}
+
+func (is *importStore) PutMany(ctx context.Context, blks []blocks.Block) error {
+	for _, block := range blks {
+		if err := is.Put(ctx, block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,482 @@
+package importer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data"
+	"github.com/ipfs/stargate/internal/stores"
+	"github.com/ipfs/stargate/internal/testutil"
+	"github.com/ipfs/stargate/pkg/unixfsstore/sql"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestImporter(t *testing.T) *Importer {
+	ctx := context.Background()
+	sqldb, err := sql.SqlDB(filepath.Join(t.TempDir(), "db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = sqldb.Close() })
+	require.NoError(t, sql.CreateTables(ctx, sqldb))
+	carDir := filepath.Join(t.TempDir(), "carstore")
+	require.NoError(t, os.Mkdir(carDir, 0755))
+	return New(carDir, sql.NewSQLUnixFSStore(sqldb))
+}
+
+func TestImport(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	imp := newTestImporter(t)
+
+	src := t.TempDir()
+	req.NoError(os.MkdirAll(filepath.Join(src, "sub"), 0755))
+	req.NoError(os.WriteFile(filepath.Join(src, "a.txt"), testutil.RandomBytes(1000), 0644))
+	req.NoError(os.WriteFile(filepath.Join(src, "sub", "b.bin"), testutil.RandomBytes(3000000), 0644))
+
+	var stages []string
+	var last Progress
+	root, err := imp.ImportPath(ctx, src, Settings{}, func(progress Progress) {
+		if len(stages) == 0 || stages[len(stages)-1] != progress.Stage {
+			stages = append(stages, progress.Stage)
+		}
+		last = progress
+	})
+	req.NoError(err)
+	req.Equal([]string{StageWriting, StageIndexing, StageDone}, stages)
+	req.Equal(int64(2), last.Files)
+	req.Equal(int64(16), last.Blocks)
+	req.Greater(last.Elapsed, 0.0)
+
+	// only the directory is listed, not the file and subdirectory inside it
+	roots, err := imp.Roots(ctx)
+	req.NoError(err)
+	req.Len(roots, 1)
+	req.Equal(root, roots[0].CID)
+	req.Equal(imp.carFile(root), string(roots[0].Metadata))
+
+	_, err = imp.ImportPath(ctx, src, Settings{}, nil)
+	req.ErrorIs(err, ErrAlreadyImported)
+
+	verification, err := imp.Verify(ctx, root)
+	req.NoError(err)
+	// 12 chunks and a root for b.bin, then a.txt, sub and the directory
+	req.Equal(int64(16), verification.Blocks)
+	req.Greater(verification.Bytes, int64(3001000))
+
+	req.NoError(imp.Reindex(ctx, root, nil))
+	roots, err = imp.Roots(ctx)
+	req.NoError(err)
+	req.Len(roots, 1)
+
+	// a corrupt block fails verification
+	carBytes, err := os.ReadFile(imp.carFile(root))
+	req.NoError(err)
+	corrupted := bytes.Replace(carBytes, []byte("sub"), []byte("bus"), 1)
+	req.NotEqual(carBytes, corrupted)
+	req.NoError(os.WriteFile(imp.carFile(root), corrupted, 0644))
+	_, err = imp.Verify(ctx, root)
+	req.Error(err)
+	req.NoError(os.WriteFile(imp.carFile(root), carBytes, 0644))
+
+	_, err = imp.Verify(ctx, testutil.GenerateCid())
+	req.ErrorIs(err, ErrNotImported)
+
+	req.NoError(imp.Remove(ctx, root))
+	roots, err = imp.Roots(ctx)
+	req.NoError(err)
+	req.Empty(roots)
+	req.NoFileExists(imp.carFile(root))
+	req.ErrorIs(imp.Remove(ctx, root), ErrNotImported)
+}
+
+func TestImportReaderAndCAR(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	imp := newTestImporter(t)
+
+	data := testutil.RandomBytes(2000000)
+	root, err := imp.ImportReader(ctx, bytes.NewReader(data), "", Settings{}, nil)
+	req.NoError(err)
+	carBytes, err := os.ReadFile(imp.carFile(root))
+	req.NoError(err)
+	req.NoError(imp.Remove(ctx, root))
+
+	// CARs written by imports have no roots in their header
+	var last Progress
+	carRoot, err := imp.ImportCAR(ctx, bytes.NewReader(carBytes), func(progress Progress) {
+		last = progress
+	})
+	req.NoError(err)
+	req.Equal(root, carRoot)
+	req.Equal(StageDone, last.Stage)
+	req.Equal(root.String(), last.Root)
+	req.Equal(int64(len(carBytes)), last.Bytes)
+	_, err = imp.Verify(ctx, root)
+	req.NoError(err)
+
+	_, err = imp.ImportCAR(ctx, bytes.NewReader([]byte("not a CAR")), nil)
+	req.Error(err)
+	entries, err := os.ReadDir(imp.carDir)
+	req.NoError(err)
+	req.Len(entries, 1)
+}
+
+func TestImportNoCopy(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	imp := newTestImporter(t)
+
+	src := t.TempDir()
+	req.NoError(os.MkdirAll(filepath.Join(src, "sub"), 0755))
+	aData := testutil.RandomBytes(1000)
+	req.NoError(os.WriteFile(filepath.Join(src, "a.txt"), aData, 0644))
+	req.NoError(os.WriteFile(filepath.Join(src, "sub", "b.bin"), testutil.RandomBytes(3000000), 0644))
+
+	// the DAG is the same as when copying, with a.txt wrapped to keep its mode
+	settings := Settings{PreserveMode: true}
+	copied, err := imp.ImportPath(ctx, src, settings, nil)
+	req.NoError(err)
+	req.NoError(imp.Remove(ctx, copied))
+	settings.NoCopy = true
+	root, err := imp.ImportPath(ctx, src, settings, nil)
+	req.NoError(err)
+	req.Equal(copied, root)
+
+	info, err := os.Stat(imp.carFile(root))
+	req.NoError(err)
+	req.Less(info.Size(), int64(100000))
+	verification, err := imp.Verify(ctx, root)
+	req.NoError(err)
+	req.Equal(int64(17), verification.Blocks)
+	req.Greater(verification.Bytes, int64(3001000))
+	req.FileExists(stores.MappingsPath(imp.carFile(root)))
+	// the leaves are not roots, while a file of a single block, which is only a positional mapping, is
+	roots, err := imp.Roots(ctx)
+	req.NoError(err)
+	req.Len(roots, 1)
+	fileRoot, err := imp.ImportPath(ctx, filepath.Join(src, "a.txt"), settings, nil)
+	req.NoError(err)
+	roots, err = imp.Roots(ctx)
+	req.NoError(err)
+	req.Len(roots, 2)
+	_, err = imp.Verify(ctx, fileRoot)
+	req.NoError(err)
+	// as is a file of a single block in a directory, so it can be found by its CID
+	smallDir := t.TempDir()
+	cData := []byte("apples")
+	req.NoError(os.WriteFile(filepath.Join(smallDir, "c.txt"), cData, 0644))
+	_, err = imp.ImportPath(ctx, smallDir, Settings{NoCopy: true}, nil)
+	req.NoError(err)
+	cLeaf, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum(cData)
+	req.NoError(err)
+	indexed, err := imp.store.RootCID(ctx, cLeaf)
+	req.NoError(err)
+	req.Len(indexed, 1)
+
+	// blocks of a changed file can't be read, while those of the other files still can
+	bin := filepath.Join(src, "sub", "b.bin")
+	req.NoError(os.Chtimes(bin, time.Now(), time.Now().Add(time.Hour)))
+	_, err = imp.Verify(ctx, root)
+	req.ErrorIs(err, stores.ErrSourceChanged)
+	aLeaf, err := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}.Sum(aData)
+	req.NoError(err)
+	req.Equal(aLeaf, fileRoot)
+	bs, err := stores.ReadOnlyFilestore(imp.carFile(root))
+	req.NoError(err)
+	block, err := bs.Get(ctx, aLeaf)
+	req.NoError(err)
+	req.Equal(aData, block.RawData())
+	req.NoError(bs.Close())
+	req.NoError(os.Remove(bin))
+	_, err = imp.Verify(ctx, root)
+	req.ErrorIs(err, stores.ErrSourceChanged)
+	req.NoError(imp.Remove(ctx, root))
+	req.NoFileExists(stores.MappingsPath(imp.carFile(root)))
+
+	_, err = imp.ImportReader(ctx, bytes.NewReader([]byte("data")), "", Settings{NoCopy: true}, nil)
+	req.Error(err)
+	_, err = imp.ImportTar(ctx, bytes.NewReader(nil), Settings{NoCopy: true}, nil)
+	req.Error(err)
+}
+
+func TestImportConcurrently(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	imp := newTestImporter(t)
+
+	src := t.TempDir()
+	for _, dir := range []string{"a", "b/c", "empty"} {
+		req.NoError(os.MkdirAll(filepath.Join(src, dir), 0755))
+	}
+	for i := 0; i < 10; i++ {
+		for _, dir := range []string{"a", "b", "b/c"} {
+			name := filepath.Join(src, dir, fmt.Sprintf("%d.bin", i))
+			req.NoError(os.WriteFile(name, testutil.RandomBytes(int64(1000+i*100000)), 0644))
+		}
+	}
+	req.NoError(os.Symlink("a/1.bin", filepath.Join(src, "link")))
+
+	// the DAG is the same however many files are built at once
+	root, err := imp.ImportPath(ctx, src, Settings{Concurrency: 1}, nil)
+	req.NoError(err)
+	req.NoError(imp.Remove(ctx, root))
+	var last Progress
+	concurrentRoot, err := imp.ImportPath(ctx, src, Settings{Concurrency: 8}, func(progress Progress) {
+		last = progress
+	})
+	req.NoError(err)
+	req.Equal(root, concurrentRoot)
+	req.Equal(int64(30), last.Files)
+	_, err = imp.Verify(ctx, root)
+	req.NoError(err)
+
+	// what was indexed while writing is what is found reading the CAR back
+	nested, err := imp.store.DirPath(ctx, root, []byte(imp.carFile(root)), "link")
+	req.NoError(err)
+	req.Len(nested, 1)
+	dirLs, err := imp.store.DirLs(ctx, root, []byte(imp.carFile(root)))
+	req.NoError(err)
+	indexed, err := imp.store.TopLevelRootCIDs(ctx)
+	req.NoError(err)
+	req.NoError(imp.Reindex(ctx, root, nil))
+	reindexedLs, err := imp.store.DirLs(ctx, root, []byte(imp.carFile(root)))
+	req.NoError(err)
+	req.Equal(dirLs, reindexedLs)
+	reindexed, err := imp.store.TopLevelRootCIDs(ctx)
+	req.NoError(err)
+	req.Equal(indexed, reindexed)
+	req.NoError(imp.Remove(ctx, root))
+
+	// a failure stops the import, leaving nothing behind
+	req.NoError(syscall.Mkfifo(filepath.Join(src, "b", "fifo"), 0644))
+	_, err = imp.ImportPath(ctx, src, Settings{Concurrency: 8}, nil)
+	req.ErrorContains(err, "not a regular file")
+	entries, err := os.ReadDir(imp.carDir)
+	req.NoError(err)
+	req.Empty(entries)
+}
+
+func TestImportSettings(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	imp := newTestImporter(t)
+
+	data := testutil.RandomBytes(1000000)
+	root, err := imp.ImportReader(ctx, bytes.NewReader(data), "", Settings{}, nil)
+	req.NoError(err)
+	smallChunksRoot, err := imp.ImportReader(ctx, bytes.NewReader(data), "", Settings{Chunker: "size-65536"}, nil)
+	req.NoError(err)
+	req.NotEqual(root, smallChunksRoot)
+	verification, err := imp.Verify(ctx, smallChunksRoot)
+	req.NoError(err)
+	// 16 chunks and a root
+	req.Equal(int64(17), verification.Blocks)
+
+	_, err = imp.ImportReader(ctx, bytes.NewReader(data), "", Settings{Chunker: "apples"}, nil)
+	req.Error(err)
+}
+
+func TestImportNamedReader(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	imp := newTestImporter(t)
+
+	// a named stream is the same as a directory holding the file
+	data := testutil.RandomBytes(300000)
+	root, err := imp.ImportReader(ctx, bytes.NewReader(data), "data.bin", Settings{}, nil)
+	req.NoError(err)
+	src := t.TempDir()
+	req.NoError(os.WriteFile(filepath.Join(src, "data.bin"), data, 0644))
+	_, err = imp.ImportPath(ctx, src, Settings{}, nil)
+	req.ErrorIs(err, ErrAlreadyImported)
+
+	_, err = imp.ImportReader(ctx, bytes.NewReader(data), "../data.bin", Settings{}, nil)
+	req.Error(err)
+	roots, err := imp.Roots(ctx)
+	req.NoError(err)
+	req.Len(roots, 1)
+	req.Equal(root, roots[0].CID)
+}
+
+// unixFSData decodes the UnixFS data of a node in an import, following a path of entry names from its root
+func unixFSData(t *testing.T, imp *Importer, root cid.Cid, names ...string) data.UnixFSData {
+	bs, err := stores.ReadOnlyFilestore(imp.carFile(root))
+	require.NoError(t, err)
+	defer bs.Close()
+	c := root
+	for {
+		block, err := bs.Get(context.Background(), c)
+		require.NoError(t, err)
+		nb := dagpb.Type.PBNode.NewBuilder()
+		require.NoError(t, dagpb.DecodeBytes(nb, block.RawData()))
+		node := nb.Build().(dagpb.PBNode)
+		if len(names) == 0 {
+			ufsData, err := data.DecodeUnixFSData(node.Data.Must().Bytes())
+			require.NoError(t, err)
+			return ufsData
+		}
+		found := false
+		iter := node.Links.Iterator()
+		for !iter.Done() {
+			_, link := iter.Next()
+			if link.Name.Must().String() == names[0] {
+				c, found = link.Hash.Link().(cidlink.Link).Cid, true
+			}
+		}
+		require.True(t, found, names[0])
+		names = names[1:]
+	}
+}
+
+func TestImportMetadata(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	imp := newTestImporter(t)
+
+	mtime := time.Unix(1700000000, 0)
+	big := testutil.RandomBytes(600000)
+	archive := writeTar(t, []tarEntry{
+		{header: tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0750, ModTime: mtime}},
+		{header: tar.Header{Name: "bin/run.sh", Typeflag: tar.TypeReg, Mode: 0755, ModTime: mtime}, body: []byte("#!/bin/sh")},
+		{header: tar.Header{Name: "big.bin", Typeflag: tar.TypeReg, Mode: 0600, ModTime: mtime}, body: big},
+		{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0700, ModTime: mtime}},
+		{header: tar.Header{Name: "run", Typeflag: tar.TypeLink, Linkname: "bin/run.sh"}},
+	})
+	settings := Settings{PreserveMode: true, PreserveMtime: true}
+	root, err := imp.ImportTar(ctx, bytes.NewReader(archive), settings, nil)
+	req.NoError(err)
+
+	rootData := unixFSData(t, imp, root)
+	req.Equal(int64(0750), rootData.FieldMode().Must().Int())
+	req.Equal(mtime.Unix(), rootData.FieldMtime().Must().FieldSeconds().Int())
+	req.Equal(int64(0700), unixFSData(t, imp, root, "bin").FieldMode().Must().Int())
+	// a file small enough for a single raw block is wrapped in a node keeping its metadata
+	runData := unixFSData(t, imp, root, "bin", "run.sh")
+	req.Equal(int64(0755), runData.FieldMode().Must().Int())
+	req.Equal(int64(len("#!/bin/sh")), runData.FieldFileSize().Must().Int())
+	req.Equal(runData, unixFSData(t, imp, root, "run"))
+	bigData := unixFSData(t, imp, root, "big.bin")
+	req.Equal(int64(0600), bigData.FieldMode().Must().Int())
+	req.Equal(int64(600000), bigData.FieldFileSize().Must().Int())
+
+	// the nodes replaced by ones with metadata are not left in the import
+	verification, err := imp.Verify(ctx, root)
+	req.NoError(err)
+	roots, err := imp.Roots(ctx)
+	req.NoError(err)
+	req.Len(roots, 1)
+	bs, err := stores.ReadOnlyFilestore(imp.carFile(root))
+	req.NoError(err)
+	defer bs.Close()
+	keys, err := bs.AllKeysChan(ctx)
+	req.NoError(err)
+	var blocks int64
+	for range keys {
+		blocks++
+	}
+	req.Equal(verification.Blocks, blocks)
+
+	// the same tree on disk gives the same root
+	src := t.TempDir()
+	req.NoError(os.Mkdir(filepath.Join(src, "bin"), 0700))
+	req.NoError(os.WriteFile(filepath.Join(src, "bin", "run.sh"), []byte("#!/bin/sh"), 0755))
+	req.NoError(os.WriteFile(filepath.Join(src, "run"), []byte("#!/bin/sh"), 0755))
+	req.NoError(os.WriteFile(filepath.Join(src, "big.bin"), big, 0600))
+	for name, mode := range map[string]fs.FileMode{"bin/run.sh": 0755, "run": 0755, "big.bin": 0600, "bin": 0700, ".": 0750} {
+		req.NoError(os.Chmod(filepath.Join(src, name), mode))
+		req.NoError(os.Chtimes(filepath.Join(src, name), mtime, mtime))
+	}
+	_, err = imp.ImportPath(ctx, src, settings, nil)
+	req.ErrorIs(err, ErrAlreadyImported)
+	// and without metadata, a different one
+	plainRoot, err := imp.ImportPath(ctx, src, Settings{}, nil)
+	req.NoError(err)
+	req.NotEqual(root, plainRoot)
+}
+
+type tarEntry struct {
+	header tar.Header
+	body   []byte
+}
+
+func writeTar(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		entry.header.Size = int64(len(entry.body))
+		if entry.header.Mode == 0 {
+			entry.header.Mode = 0644
+		}
+		require.NoError(t, tw.WriteHeader(&entry.header))
+		_, err := tw.Write(entry.body)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestImportTar(t *testing.T) {
+	ctx := context.Background()
+	imp := newTestImporter(t)
+
+	archive := writeTar(t, []tarEntry{
+		{header: tar.Header{Name: "dir/", Typeflag: tar.TypeDir}},
+		{header: tar.Header{Name: "dir/a.txt", Typeflag: tar.TypeReg}, body: []byte("apples")},
+		{header: tar.Header{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "a.txt"}},
+		{header: tar.Header{Name: "b.txt", Typeflag: tar.TypeReg}, body: []byte("bananas")},
+	})
+	root, err := imp.ImportTar(ctx, bytes.NewReader(archive), Settings{}, nil)
+	require.NoError(t, err)
+	_, err = imp.Verify(ctx, root)
+	require.NoError(t, err)
+
+	// the same files on disk give the same root
+	src := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(src, "dir"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "dir", "a.txt"), []byte("apples"), 0644))
+	require.NoError(t, os.Symlink("a.txt", filepath.Join(src, "dir", "link")))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "b.txt"), []byte("bananas"), 0644))
+	_, err = imp.ImportPath(ctx, src, Settings{}, nil)
+	require.ErrorIs(t, err, ErrAlreadyImported)
+
+	testCases := map[string][]tarEntry{
+		"absolute path": {
+			{header: tar.Header{Name: "/etc/passwd", Typeflag: tar.TypeReg}, body: []byte("x")},
+		},
+		"parent directory": {
+			{header: tar.Header{Name: "dir/../../escape", Typeflag: tar.TypeReg}, body: []byte("x")},
+		},
+		"through symlink": {
+			{header: tar.Header{Name: "out", Typeflag: tar.TypeSymlink, Linkname: "/tmp"}},
+			{header: tar.Header{Name: "out/escape", Typeflag: tar.TypeReg}, body: []byte("x")},
+		},
+		"hard link outside": {
+			{header: tar.Header{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}},
+		},
+	}
+	for testCase, entries := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			_, err := imp.ImportTar(ctx, bytes.NewReader(writeTar(t, entries)), Settings{}, nil)
+			require.ErrorContains(t, err, "reading tar")
+		})
+	}
+	roots, err := imp.Roots(ctx)
+	require.NoError(t, err)
+	require.Len(t, roots, 1)
+	require.Equal(t, root, roots[0].CID)
+	// failed imports leave nothing behind
+	entries, err := os.ReadDir(imp.carDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
@@ -0,0 +1,259 @@
+package importer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/multiformats/go-multicodec"
+	"github.com/multiformats/go-multihash"
+)
+
+var dagPBLinkPrototype = cidlink.LinkPrototype{Prefix: cid.Prefix{
+	Version:  1,
+	Codec:    uint64(multicodec.DagPb),
+	MhType:   multihash.SHA2_256,
+	MhLength: 32,
+}}
+
+// metadata is the mode and modification time recorded in the UnixFS node of a file, directory or symlink, when an
+// import keeps them. Modification times are kept to the second, as tar archives have them
+type metadata struct {
+	hasMode  bool
+	mode     int
+	hasMtime bool
+	mtime    int64
+}
+
+func (m metadata) empty() bool {
+	return !m.hasMode && !m.hasMtime
+}
+
+// newMetadata returns the metadata settings ask to keep, from a Unix mode and a modification time
+func newMetadata(settings Settings, mode int, mtime time.Time) metadata {
+	var m metadata
+	if settings.PreserveMode {
+		m.hasMode, m.mode = true, mode
+	}
+	if settings.PreserveMtime {
+		m.hasMtime, m.mtime = true, mtime.Round(time.Second).Unix()
+	}
+	return m
+}
+
+// unixMode converts a Go file mode to the permission bits of a Unix mode, as tar archives have them
+func unixMode(mode fs.FileMode) int {
+	unix := int(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		unix |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		unix |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		unix |= 01000
+	}
+	return unix
+}
+
+// heldBlock is a block a holdingStore has not yet written
+type heldBlock struct {
+	link ipld.Link
+	data []byte
+}
+
+// holdingStore holds back the last block stored through its link system until the next one is stored or it is
+// released. The builders store the root of a DAG last, so the root can be replaced with a node carrying metadata
+// without the original being left in the import
+type holdingStore struct {
+	lsys *ipld.LinkSystem
+	held *heldBlock
+}
+
+func newHoldingStore(lsys *ipld.LinkSystem) *holdingStore {
+	return &holdingStore{lsys: lsys}
+}
+
+// linkSystem returns a link system storing through the holdingStore
+func (h *holdingStore) linkSystem() *ipld.LinkSystem {
+	lsys := *h.lsys
+	lsys.StorageWriteOpener = func(ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		var buf bytes.Buffer
+		return &buf, func(link ipld.Link) error {
+			if err := h.release(); err != nil {
+				return err
+			}
+			h.held = &heldBlock{link: link, data: buf.Bytes()}
+			return nil
+		}, nil
+	}
+	return &lsys
+}
+
+// release writes the held block, if there is one
+func (h *holdingStore) release() error {
+	if h.held == nil {
+		return nil
+	}
+	held := h.held
+	h.held = nil
+	w, commit, err := h.lsys.StorageWriteOpener(ipld.LinkContext{})
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(held.data); err != nil {
+		return err
+	}
+	return commit(held.link)
+}
+
+// withMetadata records metadata in the root of a DAG just built through the holdingStore, returning the new root and
+// the new size of the DAG. A raw root is wrapped in a file node, as raw blocks have nowhere to keep metadata
+func (h *holdingStore) withMetadata(root ipld.Link, size uint64, meta metadata) (ipld.Link, uint64, error) {
+	if meta.empty() {
+		return root, size, nil
+	}
+	var pbNode dagpb.PBNode
+	if root.(cidlink.Link).Cid.Prefix().Codec == cid.Raw {
+		// the raw block stays, under the new file node. It may not have been stored through the holdingStore, as
+		// leaves imported without copying are not
+		if err := h.release(); err != nil {
+			return nil, 0, err
+		}
+		ufsData, err := builder.BuildUnixFS(func(b *builder.Builder) {
+			builder.DataType(b, data.Data_File)
+			builder.FileSize(b, size)
+			builder.BlockSizes(b, []uint64{size})
+			addMetadata(b, meta)
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		link, err := builder.BuildUnixFSDirectoryEntry("", int64(size), root)
+		if err != nil {
+			return nil, 0, err
+		}
+		if pbNode, err = buildPBNode(ufsData, []dagpb.PBLink{link}); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		// the original node is dropped, and replaced by one with the same links
+		if h.held == nil || h.held.link.String() != root.String() {
+			return nil, 0, fmt.Errorf("root %s was not the last block built", root)
+		}
+		original := h.held
+		h.held = nil
+		size -= uint64(len(original.data))
+		nb := dagpb.Type.PBNode.NewBuilder()
+		if err := dagpb.DecodeBytes(nb, original.data); err != nil {
+			return nil, 0, err
+		}
+		originalNode := nb.Build().(dagpb.PBNode)
+		if !originalNode.FieldData().Exists() {
+			return nil, 0, fmt.Errorf("root %s is not a UnixFS node", root)
+		}
+		originalData, err := data.DecodeUnixFSData(originalNode.FieldData().Must().Bytes())
+		if err != nil {
+			return nil, 0, err
+		}
+		ufsData, err := builder.BuildUnixFS(func(b *builder.Builder) {
+			copyUnixFSData(b, originalData)
+			addMetadata(b, meta)
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+		links := make([]dagpb.PBLink, 0, originalNode.FieldLinks().Length())
+		iter := originalNode.FieldLinks().Iterator()
+		for !iter.Done() {
+			_, link := iter.Next()
+			links = append(links, link)
+		}
+		if pbNode, err = buildPBNode(ufsData, links); err != nil {
+			return nil, 0, err
+		}
+	}
+	link, err := h.linkSystem().Store(ipld.LinkContext{}, dagPBLinkPrototype, pbNode)
+	if err != nil {
+		return nil, 0, err
+	}
+	return link, size + uint64(len(h.held.data)), nil
+}
+
+// copyUnixFSData copies every field of UnixFS data but its metadata
+func copyUnixFSData(b *builder.Builder, ufsData data.UnixFSData) {
+	builder.DataType(b, ufsData.FieldDataType().Int())
+	if ufsData.FieldData().Exists() {
+		builder.Data(b, ufsData.FieldData().Must().Bytes())
+	}
+	if ufsData.FieldFileSize().Exists() {
+		builder.FileSize(b, uint64(ufsData.FieldFileSize().Must().Int()))
+	}
+	blockSizes := make([]uint64, 0, ufsData.FieldBlockSizes().Length())
+	iter := ufsData.FieldBlockSizes().Iterator()
+	for !iter.Done() {
+		_, blockSize := iter.Next()
+		blockSizes = append(blockSizes, uint64(blockSize.Int()))
+	}
+	builder.BlockSizes(b, blockSizes)
+	if ufsData.FieldHashType().Exists() {
+		builder.HashType(b, uint64(ufsData.FieldHashType().Must().Int()))
+	}
+	if ufsData.FieldFanout().Exists() {
+		builder.Fanout(b, uint64(ufsData.FieldFanout().Must().Int()))
+	}
+}
+
+func addMetadata(b *builder.Builder, meta metadata) {
+	if meta.hasMode {
+		builder.Permissions(b, meta.mode)
+	}
+	if meta.hasMtime {
+		builder.Mtime(b, func(tb builder.TimeBuilder) {
+			builder.Seconds(tb, meta.mtime)
+		})
+	}
+}
+
+// buildPBNode builds a dag-pb node from UnixFS data and links
+func buildPBNode(ufsData data.UnixFSData, links []dagpb.PBLink) (dagpb.PBNode, error) {
+	nb := dagpb.Type.PBNode.NewBuilder()
+	pbm, err := nb.BeginMap(2)
+	if err != nil {
+		return nil, err
+	}
+	pbla, err := pbm.AssembleEntry("Links")
+	if err != nil {
+		return nil, err
+	}
+	pbl, err := pbla.BeginList(int64(len(links)))
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range links {
+		if err := pbl.AssembleValue().AssignNode(link); err != nil {
+			return nil, err
+		}
+	}
+	if err := pbl.Finish(); err != nil {
+		return nil, err
+	}
+	if err := pbm.AssembleKey().AssignString("Data"); err != nil {
+		return nil, err
+	}
+	if err := pbm.AssembleValue().AssignBytes(data.EncodeUnixFSData(ufsData)); err != nil {
+		return nil, err
+	}
+	if err := pbm.Finish(); err != nil {
+		return nil, err
+	}
+	return nb.Build().(dagpb.PBNode), nil
+}
@@ -0,0 +1,223 @@
+package importer
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+)
+
+// ImportTar imports the files in a tar stream as a directory, returning the directory's root. The tree is built from
+// the entries as they are read, without extracting them
+func (imp *Importer) ImportTar(ctx context.Context, src io.Reader, settings Settings, progress ProgressFunc) (cid.Cid, error) {
+	if settings.NoCopy {
+		return cid.Undef, errNoCopyStream
+	}
+	reporter := newReporter(progress)
+	root, carFileName, written, err := imp.writeRawCarFile(reporter, func(lsys *ipld.LinkSystem, _ bstore.Blockstore) (ipld.Link, error) {
+		root, _, err := buildTar(src, settings, lsys, reporter)
+		if err != nil {
+			return nil, fmt.Errorf("reading tar: %w", err)
+		}
+		return root, nil
+	})
+	if err != nil {
+		return cid.Undef, err
+	}
+	return root, imp.storeCAR(ctx, root, carFileName, written, reporter)
+}
+
+// treeNode is a file, symlink or directory read from a tar archive. Files and symlinks are built as soon as they are
+// read, and directories once the whole archive has been
+type treeNode struct {
+	// children is set for directories
+	children map[string]*treeNode
+	// link and size are set for files and symlinks
+	link   ipld.Link
+	size   uint64
+	isFile bool
+	// meta is recorded in a directory when it is built
+	meta metadata
+}
+
+func newTreeDir() *treeNode {
+	return &treeNode{children: make(map[string]*treeNode)}
+}
+
+// buildTar builds the UnixFS DAG of the directory tree in a tar archive, reporting each regular file
+func buildTar(src io.Reader, settings Settings, lsys *ipld.LinkSystem, reporter *reporter) (ipld.Link, uint64, error) {
+	h := newHoldingStore(lsys)
+	root := newTreeDir()
+	tr := tar.NewReader(src)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := addTarEntry(root, header, tr, settings, h); err != nil {
+			return nil, 0, err
+		}
+		if header.Typeflag == tar.TypeReg {
+			reporter.file()
+		}
+	}
+	// the padding after the end of the archive is unread, so read it, freeing a writer waiting on the other end of
+	// a pipe
+	if _, err := io.Copy(io.Discard, src); err != nil {
+		return nil, 0, err
+	}
+	link, size, err := buildTreeDir(root, h)
+	if err != nil {
+		return nil, 0, err
+	}
+	return link, size, h.release()
+}
+
+// entryPath splits the name of a tar entry into path components, refusing entries outside the archive. The
+// archive's top directory has no components
+func entryPath(name string) ([]string, error) {
+	cleaned := path.Clean(name)
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return nil, fmt.Errorf("entry '%s' is outside the archive", name)
+	}
+	if cleaned == "." {
+		return nil, nil
+	}
+	return strings.Split(cleaned, "/"), nil
+}
+
+// lookupDir returns the directory at a path in the tree, creating any directories missing on the way
+func lookupDir(root *treeNode, name string, components []string) (*treeNode, error) {
+	dir := root
+	for _, component := range components {
+		child, ok := dir.children[component]
+		if !ok {
+			child = newTreeDir()
+			dir.children[component] = child
+		}
+		if child.children == nil {
+			return nil, fmt.Errorf("entry '%s' is inside a file or symlink", name)
+		}
+		dir = child
+	}
+	return dir, nil
+}
+
+func addTarEntry(root *treeNode, header *tar.Header, content io.Reader, settings Settings, h *holdingStore) error {
+	components, err := entryPath(header.Name)
+	if err != nil {
+		return err
+	}
+	meta := newMetadata(settings, int(header.Mode), header.ModTime)
+	if len(components) == 0 {
+		if header.Typeflag != tar.TypeDir {
+			return fmt.Errorf("entry '%s' is not a directory", header.Name)
+		}
+		root.meta = meta
+		return nil
+	}
+	parent, err := lookupDir(root, header.Name, components[:len(components)-1])
+	if err != nil {
+		return err
+	}
+	name := components[len(components)-1]
+	var node *treeNode
+	switch header.Typeflag {
+	case tar.TypeDir:
+		dir, err := lookupDir(root, header.Name, components)
+		if err != nil {
+			return err
+		}
+		// an entry for a directory can come after its contents
+		dir.meta = meta
+		return nil
+	case tar.TypeReg:
+		link, size, err := builder.BuildUnixFSFile(content, settings.Chunker, h.linkSystem())
+		if err != nil {
+			return err
+		}
+		node = &treeNode{isFile: true}
+		node.link, node.size, err = h.withMetadata(link, size, meta)
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		// symlinks are imported as they are, never followed
+		link, size, err := builder.BuildUnixFSSymlink(header.Linkname, h.linkSystem())
+		if err != nil {
+			return err
+		}
+		node = &treeNode{}
+		node.link, node.size, err = h.withMetadata(link, size, meta)
+		if err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		linkedComponents, err := entryPath(header.Linkname)
+		if err != nil {
+			return err
+		}
+		linked := root
+		for _, component := range linkedComponents {
+			if linked = linked.children[component]; linked == nil {
+				break
+			}
+		}
+		if linked == nil || !linked.isFile {
+			return fmt.Errorf("entry '%s' links to '%s', which is not a file earlier in the archive", header.Name,
+				header.Linkname)
+		}
+		node = linked
+	default:
+		// devices, fifos and the like have no UnixFS representation
+		return nil
+	}
+	if existing, ok := parent.children[name]; ok && existing.children != nil {
+		return fmt.Errorf("entry '%s' replaces a directory", header.Name)
+	}
+	parent.children[name] = node
+	return nil
+}
+
+// buildTreeDir builds the UnixFS DAG of a directory read from a tar archive
+func buildTreeDir(dir *treeNode, h *holdingStore) (ipld.Link, uint64, error) {
+	names := make([]string, 0, len(dir.children))
+	for name := range dir.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]dagpb.PBLink, 0, len(names))
+	for _, name := range names {
+		child := dir.children[name]
+		link, size := child.link, child.size
+		if child.children != nil {
+			var err error
+			if link, size, err = buildTreeDir(child, h); err != nil {
+				return nil, 0, err
+			}
+		}
+		entry, err := builder.BuildUnixFSDirectoryEntry(name, int64(size), link)
+		if err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, entry)
+	}
+	link, size, err := builder.BuildUnixFSDirectory(entries, h.linkSystem())
+	if err != nil {
+		return nil, 0, err
+	}
+	return h.withMetadata(link, size, dir.meta)
+}
@@ -0,0 +1,99 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/stargate/internal/stores"
+	"github.com/ipfs/stargate/internal/storeutil"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/node/basicnode"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	selectorparse "github.com/ipld/go-ipld-prime/traversal/selector/parse"
+)
+
+// Verification is the outcome of verifying an import
+type Verification struct {
+	Blocks int64 `json:"blocks"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// Verify reads every block of an import from its CAR file, checking each against its CID. It fails on the first
+// block that is missing or corrupt
+func (imp *Importer) Verify(ctx context.Context, root cid.Cid) (Verification, error) {
+	imports, err := imp.imported(ctx, root)
+	if err != nil {
+		return Verification{}, err
+	}
+	var verification Verification
+	for _, metadata := range imports {
+		if err := verifyCAR(ctx, string(metadata), root, &verification); err != nil {
+			return verification, err
+		}
+	}
+	return verification, nil
+}
+
+func verifyCAR(ctx context.Context, carFileName string, root cid.Cid, verification *Verification) error {
+	bs, err := stores.ReadOnlyFilestore(carFileName)
+	if err != nil {
+		return fmt.Errorf("opening CAR file: %w", err)
+	}
+	defer bs.Close()
+	lsys := storeutil.LinkSystemForBlockstore(bs)
+	// hash every block as it is loaded
+	lsys.TrustedStorage = false
+	readOpener := lsys.StorageReadOpener
+	lsys.StorageReadOpener = func(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		r, err := readOpener(lnkCtx, lnk)
+		if err != nil {
+			return nil, err
+		}
+		verification.Blocks++
+		return &countingBytesReader{r, &verification.Bytes}, nil
+	}
+	chooser := dagpb.AddSupportToChooser(basicnode.Chooser)
+	rootLink := cidlink.Link{Cid: root}
+	prototype, err := chooser(rootLink, ipld.LinkContext{Ctx: ctx})
+	if err != nil {
+		return err
+	}
+	rootNode, err := lsys.Load(ipld.LinkContext{Ctx: ctx}, rootLink, prototype)
+	if err != nil {
+		return fmt.Errorf("loading root %s: %w", root, err)
+	}
+	sel, err := selector.CompileSelector(selectorparse.CommonSelector_ExploreAllRecursively)
+	if err != nil {
+		return err
+	}
+	progress := traversal.Progress{
+		Cfg: &traversal.Config{
+			Ctx:                            ctx,
+			LinkSystem:                     lsys,
+			LinkTargetNodePrototypeChooser: chooser,
+			LinkVisitOnlyOnce:              true,
+		},
+	}
+	err = progress.WalkAdv(rootNode, sel, func(traversal.Progress, ipld.Node, traversal.VisitReason) error { return nil })
+	if err != nil {
+		return fmt.Errorf("verifying %s: %w", root, err)
+	}
+	return nil
+}
+
+// countingBytesReader adds the bytes read through it to a total
+type countingBytesReader struct {
+	io.Reader
+	total *int64
+}
+
+func (cbr *countingBytesReader) Read(p []byte) (int, error) {
+	n, err := cbr.Reader.Read(p)
+	*cbr.total += int64(n)
+	return n, err
+}
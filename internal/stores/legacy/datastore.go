@@ -0,0 +1,100 @@
+/*
+Package legacy reads and writes CAR files in the format of repos whose positional mappings were stored inside their
+CAR files, as blocks under CIDs hashed from their datastore keys rather than from their data. It is only used to
+migrate such repos
+*/
+package legacy
+
+import (
+	"context"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	bstore "github.com/ipfs/go-ipfs-blockstore"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/xerrors"
+)
+
+var cidBuilder = cid.V1Builder{Codec: cid.Raw, MhType: mh.SHA2_256}
+
+// KeyCID returns the CID the value under a datastore key was stored as
+func KeyCID(key datastore.Key) (cid.Cid, error) {
+	return cidBuilder.Sum(key.Bytes())
+}
+
+// Datastore presents a blockstore as a datastore, storing each value as a block under the CID of its key. Queries
+// return nothing, as keys can't be recovered from their CIDs
+func Datastore(bs bstore.Blockstore) datastore.Batching {
+	return &dsCoercer{bs}
+}
+
+// dsCoercer coerces a Blockstore to present a datastore interface, apt for
+// usage with the Filestore/FileManager. Only PosInfos will be written through
+// this path.
+type dsCoercer struct {
+	bstore.Blockstore
+}
+
+var _ datastore.Batching = (*dsCoercer)(nil)
+
+func (crcr *dsCoercer) Get(ctx context.Context, key datastore.Key) (value []byte, err error) {
+	c, err := KeyCID(key)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create cid: %w", err)
+	}
+
+	blk, err := crcr.Blockstore.Get(ctx, c)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to get cid %s: %w", c, err)
+	}
+	return blk.RawData(), nil
+}
+
+func (crcr *dsCoercer) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	c, err := KeyCID(key)
+	if err != nil {
+		return xerrors.Errorf("failed to create cid: %w", err)
+	}
+	blk, err := blocks.NewBlockWithCid(value, c)
+	if err != nil {
+		return xerrors.Errorf("failed to create block: %w", err)
+	}
+	if err := crcr.Blockstore.Put(ctx, blk); err != nil {
+		return xerrors.Errorf("failed to put block: %w", err)
+	}
+	return nil
+}
+
+func (crcr *dsCoercer) Has(ctx context.Context, key datastore.Key) (exists bool, err error) {
+	c, err := KeyCID(key)
+	if err != nil {
+		return false, xerrors.Errorf("failed to create cid: %w", err)
+	}
+	return crcr.Blockstore.Has(ctx, c)
+}
+
+func (crcr *dsCoercer) Batch(_ context.Context) (datastore.Batch, error) {
+	return datastore.NewBasicBatch(crcr), nil
+}
+
+func (crcr *dsCoercer) GetSize(_ context.Context, _ datastore.Key) (size int, err error) {
+	return 0, xerrors.New("operation NOT supported: GetSize")
+}
+
+func (crcr *dsCoercer) Query(_ context.Context, q query.Query) (query.Results, error) {
+	return query.ResultsWithEntries(q, nil), nil
+}
+
+func (crcr *dsCoercer) Delete(_ context.Context, _ datastore.Key) error {
+	return xerrors.New("operation NOT supported: Delete")
+}
+
+func (crcr *dsCoercer) Sync(_ context.Context, _ datastore.Key) error {
+	return xerrors.New("operation NOT supported: Sync")
+}
+
+func (crcr *dsCoercer) Close() error {
+	return nil
+}
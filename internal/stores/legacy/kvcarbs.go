@@ -1,4 +1,4 @@
-package stores
+package legacy
 
 import (
 	"bytes"
@@ -34,14 +34,11 @@ import (
 
 	This was allowed by go-car prior to v2.1.0, but newer go-car releases
 	require that data matches the multihash, which means that the library can
-	no longer be exploited as a KV store as is done in filestore.go.
+	no longer be exploited as a KV store as filestore.go used to do.
 
-	We duplicate the code here temporarily, as an alternative to breaking
-	existing nodes, or adding an option to go-car which would break the CAR spec
-	(it also contains this hack to a single repo).
-
-	Ideally we should migrate to a real KV store, but even for that we'll still
-	need this code for the migration process.
+	Positional mappings are now kept in a database beside each CAR file, and
+	CAR files are read and written with go-car. This code is only kept so
+	stores.MigrateCAR can read the CAR files written before.
 
 */
 
@@ -0,0 +1,224 @@
+package stores
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// MappingsSuffix is added to the path of a CAR file to name the database holding the positional mappings of its
+// leaves, when it has any
+const MappingsSuffix = ".mappings"
+
+// MappingsPath returns the path of the database holding the positional mappings of a CAR file
+func MappingsPath(carPath string) string {
+	return carPath + MappingsSuffix
+}
+
+const createMappingsSQL = `CREATE TABLE IF NOT EXISTS Mappings (
+  Key TEXT PRIMARY KEY,
+  Value BLOB NOT NULL
+) WITHOUT ROWID`
+
+// execQuerier is either a database or a transaction
+type execQuerier interface {
+	ExecContext(context.Context, string, ...any) (sql.Result, error)
+	QueryContext(context.Context, string, ...any) (*sql.Rows, error)
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}
+
+// mappingStore is a datastore kept in a sqlite database beside a CAR file, for the positional mappings of its
+// leaves. A read-only mappingStore of a CAR without mappings is empty. A writable one only creates its database once
+// something is put to it, and writes everything in a single transaction, committed when it is closed
+type mappingStore struct {
+	path     string
+	readOnly bool
+	db       *sql.DB
+	tx       *sql.Tx
+}
+
+var _ datastore.Batching = (*mappingStore)(nil)
+
+// openMappings opens the positional mappings of a CAR file
+func openMappings(carPath string, readOnly bool) (*mappingStore, error) {
+	ms := &mappingStore{path: MappingsPath(carPath), readOnly: readOnly}
+	if !readOnly {
+		return ms, nil
+	}
+	if _, err := os.Stat(ms.path); os.IsNotExist(err) {
+		return ms, nil
+	}
+	db, err := sql.Open("sqlite3", "file:"+ms.path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	ms.db = db
+	return ms, nil
+}
+
+// store returns what to run statements on, or nil if there is no database yet
+func (ms *mappingStore) store() execQuerier {
+	if ms.tx != nil {
+		return ms.tx
+	}
+	if ms.db != nil {
+		return ms.db
+	}
+	return nil
+}
+
+// create creates the database of a writable mappingStore, and begins its transaction
+func (ms *mappingStore) create(ctx context.Context) error {
+	if ms.readOnly {
+		return errors.New("positional mappings are read-only")
+	}
+	db, err := sql.Open("sqlite3", "file:"+ms.path)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.ExecContext(ctx, createMappingsSQL); err != nil {
+		_ = db.Close()
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		_ = db.Close()
+		return err
+	}
+	ms.db, ms.tx = db, tx
+	return nil
+}
+
+func (ms *mappingStore) Get(ctx context.Context, key datastore.Key) ([]byte, error) {
+	store := ms.store()
+	if store == nil {
+		return nil, datastore.ErrNotFound
+	}
+	var value []byte
+	err := store.QueryRowContext(ctx, `SELECT Value FROM Mappings WHERE Key = ?`, key.String()).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, datastore.ErrNotFound
+	}
+	return value, err
+}
+
+func (ms *mappingStore) Has(ctx context.Context, key datastore.Key) (bool, error) {
+	_, err := ms.Get(ctx, key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (ms *mappingStore) GetSize(ctx context.Context, key datastore.Key) (int, error) {
+	value, err := ms.Get(ctx, key)
+	if err != nil {
+		return -1, err
+	}
+	return len(value), nil
+}
+
+func (ms *mappingStore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	if ms.tx == nil {
+		if err := ms.create(ctx); err != nil {
+			return err
+		}
+	}
+	_, err := ms.tx.ExecContext(ctx, `INSERT OR REPLACE INTO Mappings (Key, Value) VALUES (?, ?)`, key.String(), value)
+	return err
+}
+
+func (ms *mappingStore) Delete(ctx context.Context, key datastore.Key) error {
+	if ms.tx == nil {
+		return nil
+	}
+	_, err := ms.tx.ExecContext(ctx, `DELETE FROM Mappings WHERE Key = ?`, key.String())
+	return err
+}
+
+// Query reads every matching entry before returning, so no statement is left running
+func (ms *mappingStore) Query(ctx context.Context, q query.Query) (query.Results, error) {
+	store := ms.store()
+	if store == nil {
+		return query.ResultsWithEntries(q, nil), nil
+	}
+	prefix := datastore.NewKey(q.Prefix).String()
+	if prefix != "/" {
+		prefix += "/"
+	}
+	// keys under the prefix sort between it and the prefix with its final "/" replaced by the next character
+	rows, err := store.QueryContext(ctx, `SELECT Key, Value FROM Mappings WHERE Key >= ? AND Key < ? ORDER BY Key`,
+		prefix, prefix[:len(prefix)-1]+"0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []query.Entry
+	for rows.Next() {
+		var entry query.Entry
+		if err := rows.Scan(&entry.Key, &entry.Value); err != nil {
+			return nil, err
+		}
+		entry.Size = len(entry.Value)
+		if q.KeysOnly {
+			entry.Value = nil
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return query.NaiveQueryApply(q, query.ResultsWithEntries(q, entries)), nil
+}
+
+func (ms *mappingStore) Batch(_ context.Context) (datastore.Batch, error) {
+	return datastore.NewBasicBatch(ms), nil
+}
+
+func (ms *mappingStore) Sync(_ context.Context, _ datastore.Key) error {
+	return nil
+}
+
+// Close commits what was put to a writable mappingStore
+func (ms *mappingStore) Close() error {
+	if ms.db == nil {
+		return nil
+	}
+	var err error
+	if ms.tx != nil {
+		err = ms.tx.Commit()
+	}
+	return errors.Join(err, ms.db.Close())
+}
+
+// discard closes a writable mappingStore without committing, removing its database
+func (ms *mappingStore) discard() error {
+	if ms.db == nil {
+		return nil
+	}
+	_ = ms.tx.Rollback()
+	_ = ms.db.Close()
+	return os.Remove(ms.path)
+}
+
+// RenameCAR renames a CAR file along with the positional mappings of its leaves, if it has any
+func RenameCAR(oldPath string, newPath string) error {
+	if err := os.Rename(MappingsPath(oldPath), MappingsPath(newPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// RemoveCAR deletes a CAR file along with the positional mappings of its leaves, if it has any
+func RemoveCAR(path string) error {
+	if err := os.Remove(MappingsPath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(path)
+}
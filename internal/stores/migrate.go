@@ -0,0 +1,159 @@
+package stores
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-filestore"
+	dshelp "github.com/ipfs/go-ipfs-ds-help"
+	"github.com/ipfs/stargate/internal/stores/legacy"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/blockstore"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// MigrateCAR rewrites a CAR file from a repo that kept positional mappings inside its CAR files, moving them to the
+// database beside it, so the CAR only holds blocks whose data matches their CID. It returns whether there were
+// positional mappings to move. A CAR file without any is left as it is.
+//
+// The keys of mappings are not kept, only hashes of them, so the keys of the leaves linked to from the CAR and of
+// the root it is named for are tried. If any can't be recovered that way, the migration fails and the CAR file is
+// left as it is, rather than lose the mappings.
+func MigrateCAR(ctx context.Context, path string) (bool, error) {
+	ro, err := legacy.OpenReadOnly(path, carv2.ZeroLengthSectionAsEOF(true), legacy.UseWholeCIDs(true))
+	if err != nil {
+		return false, fmt.Errorf("opening CAR file: %w", err)
+	}
+	defer ro.Close()
+	keys, err := ro.AllKeysChan(ctx)
+	if err != nil {
+		return false, err
+	}
+	var blockCIDs []cid.Cid
+	// stray holds the blocks whose data does not hash to their CID, which are values kept under a key
+	stray := make(map[cid.Cid][]byte)
+	candidates := make(map[cid.Cid]struct{})
+	if root, err := cid.Parse(strings.TrimSuffix(filepath.Base(path), ".car")); err == nil {
+		candidates[root] = struct{}{}
+	}
+	for c := range keys {
+		block, err := ro.Get(ctx, c)
+		if err != nil {
+			return false, err
+		}
+		switch c.Prefix().Codec {
+		case cid.Raw:
+			if sum, err := c.Prefix().Sum(block.RawData()); err != nil || !sum.Equals(c) {
+				stray[c] = block.RawData()
+				continue
+			}
+		case cid.DagProtobuf:
+			nb := dagpb.Type.PBNode.NewBuilder()
+			if err := dagpb.DecodeBytes(nb, block.RawData()); err != nil {
+				return false, fmt.Errorf("decoding %s: %w", c, err)
+			}
+			links := nb.Build().(dagpb.PBNode).FieldLinks()
+			iter := links.Iterator()
+			for !iter.Done() {
+				_, link := iter.Next()
+				candidates[link.FieldHash().Link().(cidlink.Link).Cid] = struct{}{}
+			}
+		}
+		blockCIDs = append(blockCIDs, c)
+	}
+	if len(stray) == 0 {
+		return false, nil
+	}
+
+	values := make(map[datastore.Key][]byte)
+	recoverValue := func(key datastore.Key) ([]byte, error) {
+		kc, err := legacy.KeyCID(key)
+		if err != nil {
+			return nil, err
+		}
+		value, ok := stray[kc]
+		if ok {
+			values[key] = value
+			delete(stray, kc)
+		}
+		return value, nil
+	}
+	for c := range candidates {
+		mapping, err := recoverValue(filestore.FilestorePrefix.Child(dshelp.MultihashToDsKey(c.Hash())))
+		if err != nil {
+			return false, err
+		}
+		if mapping == nil {
+			continue
+		}
+		source, err := sourcePath(mapping)
+		if err != nil {
+			return false, err
+		}
+		if source != "" {
+			if _, err := recoverValue(sourceKey(source)); err != nil {
+				return false, err
+			}
+		}
+	}
+	if len(stray) > 0 {
+		return false, fmt.Errorf("the keys of %d positional mappings could not be recovered, so the CAR file was left as it is", len(stray))
+	}
+
+	// write the blocks to a new CAR, which replaces the old one once the mappings are written beside it
+	f, err := os.CreateTemp(filepath.Dir(path), "stargate-tmp-")
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	roots, err := ro.Roots()
+	if err != nil {
+		return false, err
+	}
+	rw, err := blockstore.OpenReadWriteFile(f, roots,
+		carv2.ZeroLengthSectionAsEOF(true),
+		carv2.StoreIdentityCIDs(true),
+		blockstore.UseWholeCIDs(true),
+	)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range blockCIDs {
+		block, err := ro.Get(ctx, c)
+		if err != nil {
+			return false, err
+		}
+		if err := rw.Put(ctx, block); err != nil {
+			return false, err
+		}
+	}
+	if err := rw.Finalize(); err != nil {
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		return false, err
+	}
+	mappings, err := openMappings(path, false)
+	if err != nil {
+		return false, err
+	}
+	for key, value := range values {
+		if err := mappings.Put(ctx, key, value); err != nil {
+			_ = mappings.discard()
+			return false, err
+		}
+	}
+	if err := mappings.Close(); err != nil {
+		return false, err
+	}
+	return true, os.Rename(f.Name(), path)
+}
@@ -0,0 +1,111 @@
+package stores
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/stargate/internal/stores/legacy"
+	"github.com/ipfs/stargate/internal/testutil"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/blockstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrateCAR(t *testing.T) {
+	ctx := context.Background()
+	normalFilePath, origBytes := createFile(t, 10, 1048576)
+	root := writeUnixfsDAGInmemory(t, normalFilePath)
+
+	// write the DAG the way older repos did, with the positional mappings inside the CAR file
+	carPath := filepath.Join(t.TempDir(), root.String()+".car")
+	f, err := os.Create(carPath)
+	require.NoError(t, err)
+	rw, err := legacy.OpenReadWriteFile(f, []cid.Cid{root},
+		carv2.ZeroLengthSectionAsEOF(true),
+		carv2.StoreIdentityCIDs(true),
+		legacy.UseWholeCIDs(true),
+	)
+	require.NoError(t, err)
+	fs, err := FilestoreOf(rw, legacy.Datastore(rw))
+	require.NoError(t, err)
+	dagSvc := merkledag.NewDAGService(blockservice.New(fs, offline.Exchange(fs)))
+	require.Equal(t, root, testutil.WriteUnixfsDAGTo(t, normalFilePath, dagSvc))
+	require.NoError(t, rw.Finalize())
+	require.NoError(t, f.Close())
+
+	migrated, err := MigrateCAR(ctx, carPath)
+	require.NoError(t, err)
+	require.True(t, migrated)
+	require.FileExists(t, MappingsPath(carPath))
+
+	// the CAR only holds the intermediate nodes now
+	ro, err := blockstore.OpenReadOnly(carPath, blockstore.UseWholeCIDs(true))
+	require.NoError(t, err)
+	keys, err := ro.AllKeysChan(ctx)
+	require.NoError(t, err)
+	for c := range keys {
+		require.Equal(t, uint64(cid.DagProtobuf), c.Prefix().Codec)
+	}
+	require.NoError(t, ro.Close())
+
+	bs, err := ReadOnlyFilestore(carPath)
+	require.NoError(t, err)
+	fbz, err := dagToNormalFile(t, ctx, root, bs)
+	require.NoError(t, err)
+	require.NoError(t, bs.Close())
+	require.EqualValues(t, origBytes, fbz)
+
+	// the record of the source file was moved too
+	mappings, err := openMappings(carPath, true)
+	require.NoError(t, err)
+	has, err := mappings.Has(ctx, sourceKey(normalFilePath))
+	require.NoError(t, err)
+	require.True(t, has)
+	require.NoError(t, mappings.Close())
+
+	// a migrated CAR file has nothing left to move
+	migrated, err = MigrateCAR(ctx, carPath)
+	require.NoError(t, err)
+	require.False(t, migrated)
+}
+
+func TestMigrateCARUnrecoverableKeys(t *testing.T) {
+	ctx := context.Background()
+	normalFilePath, _ := createFile(t, 10, 1048576)
+	root := writeUnixfsDAGInmemory(t, normalFilePath)
+
+	// a legacy CAR file with a value kept under a key that is not derived from its blocks
+	carPath := filepath.Join(t.TempDir(), root.String()+".car")
+	f, err := os.Create(carPath)
+	require.NoError(t, err)
+	rw, err := legacy.OpenReadWriteFile(f, []cid.Cid{root},
+		carv2.ZeroLengthSectionAsEOF(true),
+		carv2.StoreIdentityCIDs(true),
+		legacy.UseWholeCIDs(true),
+	)
+	require.NoError(t, err)
+	ds := legacy.Datastore(rw)
+	fs, err := FilestoreOf(rw, ds)
+	require.NoError(t, err)
+	dagSvc := merkledag.NewDAGService(blockservice.New(fs, offline.Exchange(fs)))
+	require.Equal(t, root, testutil.WriteUnixfsDAGTo(t, normalFilePath, dagSvc))
+	require.NoError(t, ds.Put(ctx, datastore.NewKey("/unknown"), []byte("apples")))
+	require.NoError(t, rw.Finalize())
+	require.NoError(t, f.Close())
+	before, err := os.ReadFile(carPath)
+	require.NoError(t, err)
+
+	_, err = MigrateCAR(ctx, carPath)
+	require.ErrorContains(t, err, "could not be recovered")
+	after, err := os.ReadFile(carPath)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+	require.NoFileExists(t, MappingsPath(carPath))
+}
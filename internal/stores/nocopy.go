@@ -0,0 +1,143 @@
+package stores
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-filestore"
+	pb "github.com/ipfs/go-filestore/pb"
+	posinfo "github.com/ipfs/go-ipfs-posinfo"
+	"github.com/ipfs/go-merkledag"
+)
+
+// ErrSourceChanged is returned reading a block that references a file which has changed or been removed since it
+// was imported
+var ErrSourceChanged = errors.New("source file changed since it was imported")
+
+// sourcePrefix namespaces the records of the files referenced by positional mappings, kept beside the mappings
+var sourcePrefix = datastore.NewKey("/stargate/sources")
+
+// sourceRecord is the size and modification time of a referenced file when it was imported
+type sourceRecord struct {
+	Size    int64
+	ModTime int64
+}
+
+func sourceKey(path string) datastore.Key {
+	return sourcePrefix.Child(datastore.NewKey(path))
+}
+
+// NoCopyBlock returns a raw block which, put to a Filestore, is stored as a positional mapping to its bytes at
+// offset in the file at path, rather than as the bytes themselves. path must be absolute
+func NoCopyBlock(block blocks.Block, path string, offset uint64) (blocks.Block, error) {
+	node, err := merkledag.DecodeRawBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	return &posinfo.FilestoreNode{
+		Node:    node,
+		PosInfo: &posinfo.PosInfo{FullPath: path, Offset: offset},
+	}, nil
+}
+
+// sourceCheckingDatastore keeps the positional mappings of a FileManager along with a record of the size and
+// modification time of each file they reference, taken when the first mapping to it is put. Reading a mapping to a
+// file that no longer matches its record fails with ErrSourceChanged. Mappings without a record are not checked
+type sourceCheckingDatastore struct {
+	datastore.Batching
+	recorded map[string]struct{}
+}
+
+func (scd *sourceCheckingDatastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	if key.IsDescendantOf(filestore.FilestorePrefix) {
+		if err := scd.recordSource(ctx, value); err != nil {
+			return err
+		}
+	}
+	return scd.Batching.Put(ctx, key, value)
+}
+
+func (scd *sourceCheckingDatastore) Get(ctx context.Context, key datastore.Key) ([]byte, error) {
+	value, err := scd.Batching.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if key.IsDescendantOf(filestore.FilestorePrefix) {
+		if err := scd.checkSource(ctx, value); err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+func (scd *sourceCheckingDatastore) Batch(_ context.Context) (datastore.Batch, error) {
+	return datastore.NewBasicBatch(scd), nil
+}
+
+// sourcePath returns the path of the file a positional mapping references, or "" for a URL
+func sourcePath(mapping []byte) (string, error) {
+	var dobj pb.DataObj
+	if err := dobj.Unmarshal(mapping); err != nil {
+		return "", err
+	}
+	if filestore.IsURL(dobj.GetFilePath()) {
+		return "", nil
+	}
+	// mappings are relative to the root of the FileManager
+	return filepath.Join("/", filepath.FromSlash(dobj.GetFilePath())), nil
+}
+
+func (scd *sourceCheckingDatastore) recordSource(ctx context.Context, mapping []byte) error {
+	path, err := sourcePath(mapping)
+	if err != nil || path == "" {
+		return err
+	}
+	if _, ok := scd.recorded[path]; ok {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	record, err := json.Marshal(sourceRecord{Size: info.Size(), ModTime: info.ModTime().UnixNano()})
+	if err != nil {
+		return err
+	}
+	if err := scd.Batching.Put(ctx, sourceKey(path), record); err != nil {
+		return err
+	}
+	if scd.recorded == nil {
+		scd.recorded = make(map[string]struct{})
+	}
+	scd.recorded[path] = struct{}{}
+	return nil
+}
+
+func (scd *sourceCheckingDatastore) checkSource(ctx context.Context, mapping []byte) error {
+	path, err := sourcePath(mapping)
+	if err != nil || path == "" {
+		return err
+	}
+	raw, err := scd.Batching.Get(ctx, sourceKey(path))
+	if errors.Is(err, datastore.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var record sourceRecord
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return fmt.Errorf("reading record of source file %s: %w", path, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != record.Size || info.ModTime().UnixNano() != record.ModTime {
+		return fmt.Errorf("%s: %w", path, ErrSourceChanged)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package storeutil
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 
@@ -22,7 +23,7 @@ func LinkSystemForBlockstore(bs bstore.Blockstore) ipld.LinkSystem {
 			return nil, fmt.Errorf("unsupported link type")
 		}
 
-		block, err := bs.Get(lnkCtx.Ctx, asCidLink.Cid)
+		block, err := bs.Get(linkContext(lnkCtx), asCidLink.Cid)
 		if err != nil {
 			return nil, err
 		}
@@ -39,7 +40,7 @@ func LinkSystemForBlockstore(bs bstore.Blockstore) ipld.LinkSystem {
 			if err != nil {
 				return err
 			}
-			return bs.Put(lnkCtx.Ctx, block)
+			return bs.Put(linkContext(lnkCtx), block)
 		}
 		return &buffer, committer, nil
 	}
@@ -47,6 +48,14 @@ func LinkSystemForBlockstore(bs bstore.Blockstore) ipld.LinkSystem {
 	return lsys
 }
 
+// linkContext returns the context of a link context, which builders such as go-unixfsnode's leave unset
+func linkContext(lnkCtx ipld.LinkContext) context.Context {
+	if lnkCtx.Ctx == nil {
+		return context.Background()
+	}
+	return lnkCtx.Ctx
+}
+
 type settableBuffer struct {
 	bytes.Buffer
 	didSetData bool
@@ -0,0 +1,240 @@
+/*
+Package watch publishes the top-level entries of a directory, such as a shared drop folder. Each time it polls, it
+imports every new or changed entry as a new root, and points a name -- the name of the entry -- at it. An entry is
+only imported once it has stayed the same from one poll to the next, so files still being written are left for
+later. Names keep a fingerprint of the entry they were published from, so entries that have not changed are not
+imported again after a restart. Optionally, the roots that entries no longer have, because they changed or were deleted, are removed.
+
+Entries whose names start with a dot are ignored.
+*/
+package watch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/stargate/internal/importer"
+	"github.com/ipfs/stargate/pkg/unixfsstore"
+	"github.com/ipfs/stargate/pkg/unixfsstore/sql"
+)
+
+// Content imports and removes the content of a repo
+type Content interface {
+	ImportPath(ctx context.Context, srcPath string, settings importer.Settings, progress importer.ProgressFunc) (cid.Cid, error)
+	Remove(ctx context.Context, root cid.Cid) error
+}
+
+// Names keeps the names of a repo
+type Names interface {
+	SetName(ctx context.Context, name unixfsstore.Name) error
+	Names(ctx context.Context) ([]unixfsstore.Name, error)
+	RemoveName(ctx context.Context, name string) error
+}
+
+// Event reports a change a poll made, or failed to make, to an entry
+type Event struct {
+	Name string
+	// Root is the root the name points at now, undefined if it was removed
+	Root cid.Cid
+	// Previous is the root the name pointed at before, if any
+	Previous cid.Cid
+	// RemovedPrevious is set if the previous root was removed
+	RemovedPrevious bool
+	Err             error
+}
+
+// fingerprint identifies the state of an entry, from the paths, modes, sizes and modification times of everything
+// in it
+type fingerprint [sha256.Size]byte
+
+// Watcher publishes the entries of a directory
+type Watcher struct {
+	dir      string
+	settings importer.Settings
+	remove   bool
+	// seen holds the fingerprint of each entry at the last poll
+	seen map[string]fingerprint
+}
+
+// New constructs a Watcher publishing the entries of dir, importing them with settings. If remove is set, roots
+// that entries no longer have are removed, unless another name points at them
+func New(dir string, settings importer.Settings, remove bool) (*Watcher, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &Watcher{
+		dir:      dir,
+		settings: settings,
+		remove:   remove,
+		seen:     make(map[string]fingerprint),
+	}, nil
+}
+
+// Dir returns the absolute path of the directory watched
+func (w *Watcher) Dir() string {
+	return w.dir
+}
+
+// Poll looks for entries that have changed since the last poll, publishing them, and for entries published from
+// the directory that have been deleted. It returns an error if the directory or the names can't be read, and
+// otherwise reports failures for single entries as events
+func (w *Watcher) Poll(ctx context.Context, content Content, names Names) ([]Event, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	allNames, err := names.Names(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading names: %w", err)
+	}
+	published := make(map[string]unixfsstore.Name)
+	// the root of every name, kept current as the poll changes them
+	named := make(map[string]cid.Cid, len(allNames))
+	for _, name := range allNames {
+		if name.Source == w.dir {
+			published[name.Name] = name
+		}
+		named[name.Name] = name.Root
+	}
+
+	var events []Event
+	present := make(map[string]struct{}, len(entries))
+	seen := make(map[string]fingerprint, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		present[name] = struct{}{}
+		fp, err := entryFingerprint(filepath.Join(w.dir, name))
+		if err != nil {
+			// the entry may be changing, so it is looked at again on the next poll
+			continue
+		}
+		seen[name] = fp
+		if bytes.Equal(published[name].Fingerprint, fp[:]) {
+			continue
+		}
+		if previous, ok := w.seen[name]; !ok || previous != fp {
+			continue
+		}
+		event, changed := w.publish(ctx, content, names, named, name, published[name], fp)
+		if changed || event.Err != nil {
+			events = append(events, event)
+		}
+	}
+	w.seen = seen
+
+	for name, previous := range published {
+		if _, ok := present[name]; ok || !w.remove {
+			continue
+		}
+		event := Event{Name: name, Previous: previous.Root}
+		if event.Err = names.RemoveName(ctx, name); event.Err == nil {
+			delete(named, name)
+			event.RemovedPrevious, event.Err = removeUnnamed(ctx, content, named, previous.Root)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// publish imports an entry and points its name at the root, recording the fingerprint of the entry imported and
+// updating named. It returns whether the name changed
+func (w *Watcher) publish(ctx context.Context, content Content, names Names, named map[string]cid.Cid, name string, previous unixfsstore.Name, fp fingerprint) (Event, bool) {
+	event := Event{Name: name, Previous: previous.Root}
+	root, err := content.ImportPath(ctx, filepath.Join(w.dir, name), w.settings, nil)
+	if err != nil && !errors.Is(err, importer.ErrAlreadyImported) {
+		event.Err = fmt.Errorf("importing: %w", err)
+		return event, false
+	}
+	event.Root = root
+	changed := !root.Equals(previous.Root)
+	updated := time.Now()
+	if !changed {
+		// the entry was touched without changing its content, so only its fingerprint is updated
+		updated = previous.Updated
+	}
+	if err := names.SetName(ctx, unixfsstore.Name{Name: name, Root: root, Source: w.dir, Fingerprint: fp[:], Updated: updated}); err != nil {
+		event.Err = fmt.Errorf("setting name: %w", err)
+		return event, false
+	}
+	named[name] = root
+	if changed && w.remove && previous.Root.Defined() {
+		event.RemovedPrevious, event.Err = removeUnnamed(ctx, content, named, previous.Root)
+	}
+	return event, changed
+}
+
+// removeUnnamed removes a root a name no longer points at, unless one of the names still does
+func removeUnnamed(ctx context.Context, content Content, named map[string]cid.Cid, root cid.Cid) (bool, error) {
+	for _, other := range named {
+		if other.Equals(root) {
+			return false, nil
+		}
+	}
+	err := content.Remove(ctx, root)
+	if errors.Is(err, importer.ErrNotImported) || errors.Is(err, sql.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("removing %s: %w", root, err)
+	}
+	return true, nil
+}
+
+// entryFingerprint fingerprints a file or directory tree, without following symlinks
+func entryFingerprint(path string) (fingerprint, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(path, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		var fields [24]byte
+		binary.BigEndian.PutUint64(fields[0:], uint64(info.Mode()))
+		binary.BigEndian.PutUint64(fields[8:], uint64(info.Size()))
+		binary.BigEndian.PutUint64(fields[16:], uint64(info.ModTime().UnixNano()))
+		// names and link targets are NUL terminated, as neither can contain a NUL
+		_, _ = h.Write([]byte(rel + "\x00" + link + "\x00"))
+		_, _ = h.Write(fields[:])
+		return nil
+	})
+	var fp fingerprint
+	if err != nil {
+		return fp, err
+	}
+	copy(fp[:], h.Sum(nil))
+	return fp, nil
+}
@@ -0,0 +1,181 @@
+package watch
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/stargate/internal/importer"
+	"github.com/ipfs/stargate/internal/testutil"
+	"github.com/ipfs/stargate/pkg/unixfsstore"
+	"github.com/ipfs/stargate/pkg/unixfsstore/sql"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRepo(t *testing.T) (*importer.Importer, *sql.SQLUnixFSStore) {
+	ctx := context.Background()
+	sqldb, err := sql.SqlDB(filepath.Join(t.TempDir(), "db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = sqldb.Close() })
+	require.NoError(t, sql.CreateTables(ctx, sqldb))
+	carDir := filepath.Join(t.TempDir(), "carstore")
+	require.NoError(t, os.Mkdir(carDir, 0755))
+	store := sql.NewSQLUnixFSStore(sqldb)
+	return importer.New(carDir, store), store
+}
+
+func rootOf(t *testing.T, store *sql.SQLUnixFSStore, name string) cid.Cid {
+	published, err := store.Name(context.Background(), name)
+	require.NoError(t, err)
+	if published == nil {
+		return cid.Undef
+	}
+	return published.Root
+}
+
+// failingContent fails the test if any content is imported or removed
+type failingContent struct {
+	t *testing.T
+}
+
+func (fc failingContent) ImportPath(ctx context.Context, srcPath string, settings importer.Settings, progress importer.ProgressFunc) (cid.Cid, error) {
+	fc.t.Fatalf("unexpected import of %s", srcPath)
+	return cid.Undef, nil
+}
+
+func (fc failingContent) Remove(ctx context.Context, root cid.Cid) error {
+	fc.t.Fatalf("unexpected removal of %s", root)
+	return nil
+}
+
+func TestWatcher(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	imp, store := newTestRepo(t)
+
+	dir := t.TempDir()
+	req.NoError(os.WriteFile(filepath.Join(dir, "a.txt"), []byte("apples"), 0644))
+	req.NoError(os.Mkdir(filepath.Join(dir, "site"), 0755))
+	req.NoError(os.WriteFile(filepath.Join(dir, "site", "index.html"), testutil.RandomBytes(300000), 0644))
+	req.NoError(os.WriteFile(filepath.Join(dir, ".partial"), []byte("skipped"), 0644))
+
+	w, err := New(dir, importer.Settings{}, true)
+	req.NoError(err)
+	// entries are only imported once they stay the same from one poll to the next
+	events, err := w.Poll(ctx, imp, store)
+	req.NoError(err)
+	req.Empty(events)
+	events, err = w.Poll(ctx, imp, store)
+	req.NoError(err)
+	req.Len(events, 2)
+	for _, event := range events {
+		req.NoError(event.Err)
+		req.Equal(event.Root, rootOf(t, store, event.Name))
+	}
+	names, err := store.Names(ctx)
+	req.NoError(err)
+	req.Len(names, 2)
+	req.Equal(w.Dir(), names[0].Source)
+	events, err = w.Poll(ctx, imp, store)
+	req.NoError(err)
+	req.Empty(events)
+
+	// a changed entry is published again, and its previous root removed
+	aRoot := rootOf(t, store, "a.txt")
+	later := time.Now().Add(time.Minute)
+	req.NoError(os.WriteFile(filepath.Join(dir, "a.txt"), []byte("oranges"), 0644))
+	req.NoError(os.Chtimes(filepath.Join(dir, "a.txt"), later, later))
+	events, err = w.Poll(ctx, imp, store)
+	req.NoError(err)
+	req.Empty(events)
+	events, err = w.Poll(ctx, imp, store)
+	req.NoError(err)
+	req.Len(events, 1)
+	req.NoError(events[0].Err)
+	req.Equal(aRoot, events[0].Previous)
+	req.True(events[0].RemovedPrevious)
+	req.NotEqual(aRoot, rootOf(t, store, "a.txt"))
+	req.ErrorIs(imp.Imported(ctx, aRoot), importer.ErrNotImported)
+
+	// a deleted entry loses its name and root, unless another name points at the root
+	siteRoot := rootOf(t, store, "site")
+	req.NoError(store.SetName(ctx, unixfsstore.Name{Name: "release", Root: siteRoot, Updated: time.Now()}))
+	req.NoError(os.RemoveAll(filepath.Join(dir, "site")))
+	events, err = w.Poll(ctx, imp, store)
+	req.NoError(err)
+	req.Len(events, 1)
+	req.NoError(events[0].Err)
+	req.Equal("site", events[0].Name)
+	req.False(events[0].RemovedPrevious)
+	req.Equal(cid.Undef, rootOf(t, store, "site"))
+	req.NoError(imp.Imported(ctx, siteRoot))
+
+	// touching an entry without changing it records its new fingerprint, without publishing it again
+	aRoot = rootOf(t, store, "a.txt")
+	later = later.Add(time.Minute)
+	req.NoError(os.Chtimes(filepath.Join(dir, "a.txt"), later, later))
+	for i := 0; i < 2; i++ {
+		events, err = w.Poll(ctx, imp, store)
+		req.NoError(err)
+		req.Empty(events)
+	}
+	req.Equal(aRoot, rootOf(t, store, "a.txt"))
+
+	// a new watcher picks up where the last one left off, without importing unchanged entries again
+	w, err = New(dir, importer.Settings{}, true)
+	req.NoError(err)
+	for i := 0; i < 2; i++ {
+		events, err = w.Poll(ctx, failingContent{t}, store)
+		req.NoError(err)
+		req.Empty(events)
+	}
+
+	_, err = New(filepath.Join(dir, "a.txt"), importer.Settings{}, true)
+	req.Error(err)
+}
+
+func TestWatcherSharedContent(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	imp, store := newTestRepo(t)
+
+	dir := t.TempDir()
+	req.NoError(os.WriteFile(filepath.Join(dir, "b.txt"), []byte("apples"), 0644))
+	w, err := New(dir, importer.Settings{}, true)
+	req.NoError(err)
+	for i := 0; i < 2; i++ {
+		_, err = w.Poll(ctx, imp, store)
+		req.NoError(err)
+	}
+	applesRoot := rootOf(t, store, "b.txt")
+	req.True(applesRoot.Defined())
+
+	// a copy of an entry is published to the same root in the same poll the entry changes, so the root is kept
+	req.NoError(os.WriteFile(filepath.Join(dir, "a.txt"), []byte("apples"), 0644))
+	later := time.Now().Add(time.Minute)
+	req.NoError(os.WriteFile(filepath.Join(dir, "b.txt"), []byte("oranges"), 0644))
+	req.NoError(os.Chtimes(filepath.Join(dir, "b.txt"), later, later))
+	_, err = w.Poll(ctx, imp, store)
+	req.NoError(err)
+	events, err := w.Poll(ctx, imp, store)
+	req.NoError(err)
+	req.Len(events, 2)
+	req.Equal(Event{Name: "a.txt", Root: applesRoot}, events[0])
+	req.Equal("b.txt", events[1].Name)
+	req.Equal(applesRoot, events[1].Previous)
+	req.False(events[1].RemovedPrevious)
+	req.NoError(events[1].Err)
+	req.Equal(applesRoot, rootOf(t, store, "a.txt"))
+	rootCIDs, err := store.RootCID(ctx, applesRoot)
+	req.NoError(err)
+	req.NotEmpty(rootCIDs)
+
+	// once the copy is deleted too, nothing points at the root and it is removed
+	req.NoError(os.Remove(filepath.Join(dir, "a.txt")))
+	events, err = w.Poll(ctx, imp, store)
+	req.NoError(err)
+	req.Equal([]Event{{Name: "a.txt", Previous: applesRoot, RemovedPrevious: true}}, events)
+}
@@ -0,0 +1,197 @@
+/*
+Package access controls who may retrieve private roots, with bearer tokens scoped to a root and URLs signed with
+an expiry time
+*/
+package access
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/ipfs/stargate/pkg/handler"
+	"github.com/ipfs/stargate/pkg/unixfsstore"
+)
+
+// KeySize is the size in bytes of the key URLs are signed with
+const KeySize = 32
+
+// Store holds the visibility of roots and the tokens granting access to them
+type Store interface {
+	// PrivateRoots returns the private roots access to a root is governed by -- the root itself or directories
+	// containing it -- or none if the root is public
+	PrivateRoots(ctx context.Context, root cid.Cid) ([]cid.Cid, error)
+	// PathCIDs returns the CIDs of the entries a path under a root resolves through, as far as it resolves
+	PathCIDs(ctx context.Context, root cid.Cid, path []string) ([]cid.Cid, error)
+	// AccessToken returns the token with the given ID, or nil if there is none
+	AccessToken(ctx context.Context, id string) (*unixfsstore.AccessToken, error)
+}
+
+// NewKey generates a random key to sign URLs with
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// NewToken creates a token granting access to a root, returning the bearer token to give the client and the record
+// to store. A zero expires means the token does not expire
+func NewToken(root cid.Cid, name string, expires time.Time) (string, unixfsstore.AccessToken, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", unixfsstore.AccessToken{}, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", unixfsstore.AccessToken{}, err
+	}
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+	token := unixfsstore.AccessToken{
+		ID:         hex.EncodeToString(id),
+		Root:       root,
+		Name:       name,
+		SecretHash: hashSecret(encodedSecret),
+		Created:    time.Now(),
+		Expires:    expires,
+	}
+	return token.ID + "." + encodedSecret, token, nil
+}
+
+func hashSecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// SignURL returns the query parameters that grant access to a root until expires, through the given token. The
+// URL stops working if the token is revoked or expires first
+func SignURL(key []byte, tokenID string, root cid.Cid, expires time.Time) url.Values {
+	expiresParam := strconv.FormatInt(expires.Unix(), 10)
+	return url.Values{
+		handler.QueryToken:     []string{tokenID},
+		handler.QueryExpires:   []string{expiresParam},
+		handler.QuerySignature: []string{signature(key, tokenID, root, expiresParam)},
+	}
+}
+
+func signature(key []byte, tokenID string, root cid.Cid, expires string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(tokenID + "\n" + root.String() + "\n" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Controller authorizes requests for private roots and everything inside them, which must present a bearer token for
+// the private root in an Authorization header or be a URL signed through one. Other roots are public
+type Controller struct {
+	store Store
+	key   []byte
+}
+
+var _ handler.Authorizer = (*Controller)(nil)
+
+// NewController constructs a Controller checking roots and tokens in store, and URLs signed with key
+func NewController(store Store, key []byte) *Controller {
+	return &Controller{store: store, key: key}
+}
+
+// Authorize implements handler.Authorizer
+func (c *Controller) Authorize(r *http.Request, root cid.Cid, path stargate.PathSegments) (handler.Grant, error) {
+	ctx := r.Context()
+	pathCIDs, err := c.store.PathCIDs(ctx, root, path)
+	if err != nil {
+		return handler.Grant{}, fmt.Errorf("resolving %s/%s: %w", root, strings.Join(path, "/"), err)
+	}
+	// a private directory is as private when reached through a public one containing it, so the root and every
+	// entry along the path must each be accessible
+	var governing [][]cid.Cid
+	for _, entry := range append([]cid.Cid{root}, pathCIDs...) {
+		privateRoots, err := c.store.PrivateRoots(ctx, entry)
+		if err != nil {
+			return handler.Grant{}, fmt.Errorf("checking visibility of %s: %w", entry, err)
+		}
+		if len(privateRoots) > 0 {
+			governing = append(governing, privateRoots)
+		}
+	}
+	if len(governing) == 0 {
+		return handler.Grant{}, nil
+	}
+	var tokenID, secret string
+	params := r.URL.Query()
+	signed := params.Has(handler.QuerySignature)
+	if signed {
+		tokenID = params.Get(handler.QueryToken)
+	} else if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		tokenID, secret, ok = strings.Cut(strings.TrimSpace(bearer), ".")
+		if !ok {
+			return handler.Grant{}, fmt.Errorf("%w: malformed token", handler.ErrForbidden)
+		}
+	} else {
+		return handler.Grant{}, fmt.Errorf("%w: %s is private", handler.ErrUnauthorized, root)
+	}
+	token, err := c.store.AccessToken(ctx, tokenID)
+	if err != nil {
+		return handler.Grant{}, fmt.Errorf("looking up token: %w", err)
+	}
+	if token == nil {
+		return handler.Grant{}, fmt.Errorf("%w: invalid token", handler.ErrForbidden)
+	}
+	// a signed URL is signed for the root of its token, so it proves it was issued for the token without a secret
+	if signed {
+		if err := c.verifySignature(params, tokenID, token.Root); err != nil {
+			return handler.Grant{}, err
+		}
+	} else if subtle.ConstantTimeCompare(hashSecret(secret), token.SecretHash) != 1 {
+		return handler.Grant{}, fmt.Errorf("%w: invalid token", handler.ErrForbidden)
+	}
+	for _, privateRoots := range governing {
+		if !containsRoot(privateRoots, token.Root) {
+			return handler.Grant{}, fmt.Errorf("%w: token %s is not valid for %s", handler.ErrForbidden, token.ID, root)
+		}
+	}
+	switch {
+	case token.Revoked:
+		return handler.Grant{}, fmt.Errorf("%w: token %s is revoked", handler.ErrForbidden, token.ID)
+	case !token.Expires.IsZero() && time.Now().After(token.Expires):
+		return handler.Grant{}, fmt.Errorf("%w: token %s has expired", handler.ErrForbidden, token.ID)
+	}
+	return handler.Grant{Private: true, TokenID: token.ID}, nil
+}
+
+func containsRoot(roots []cid.Cid, root cid.Cid) bool {
+	for _, r := range roots {
+		if r.Equals(root) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Controller) verifySignature(params url.Values, tokenID string, root cid.Cid) error {
+	expiresParam := params.Get(handler.QueryExpires)
+	expires, err := strconv.ParseInt(expiresParam, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: malformed signed URL", handler.ErrForbidden)
+	}
+	expected := signature(c.key, tokenID, root, expiresParam)
+	if !hmac.Equal([]byte(expected), []byte(params.Get(handler.QuerySignature))) {
+		return fmt.Errorf("%w: invalid signature", handler.ErrForbidden)
+	}
+	if time.Now().After(time.Unix(expires, 0)) {
+		return fmt.Errorf("%w: signed URL has expired", handler.ErrForbidden)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package access_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/stargate/internal/testutil"
+	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/ipfs/stargate/pkg/access"
+	"github.com/ipfs/stargate/pkg/handler"
+	"github.com/ipfs/stargate/pkg/unixfsstore"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/stretchr/testify/require"
+)
+
+type memoryStore struct {
+	private map[cid.Cid][]cid.Cid
+	// entries along paths, keyed by root and path
+	paths  map[string][]cid.Cid
+	tokens map[string]*unixfsstore.AccessToken
+}
+
+func (ms *memoryStore) PrivateRoots(ctx context.Context, root cid.Cid) ([]cid.Cid, error) {
+	return ms.private[root], nil
+}
+
+func (ms *memoryStore) PathCIDs(ctx context.Context, root cid.Cid, path []string) ([]cid.Cid, error) {
+	return ms.paths[root.String()+"/"+strings.Join(path, "/")], nil
+}
+
+func (ms *memoryStore) AccessToken(ctx context.Context, id string) (*unixfsstore.AccessToken, error) {
+	return ms.tokens[id], nil
+}
+
+func TestAuthorize(t *testing.T) {
+	publicRoot := testutil.GenerateCid()
+	privateRoot := testutil.GenerateCid()
+	otherPrivateRoot := testutil.GenerateCid()
+	// a file inside the private root
+	privateChild := testutil.GenerateCid()
+	store := &memoryStore{
+		private: map[cid.Cid][]cid.Cid{
+			privateRoot:      {privateRoot},
+			otherPrivateRoot: {otherPrivateRoot},
+			privateChild:     {privateRoot},
+		},
+		// the private root is also a directory inside the public root
+		paths: map[string][]cid.Cid{
+			publicRoot.String() + "/private":      {privateRoot},
+			publicRoot.String() + "/private/file": {privateRoot, privateChild},
+		},
+		tokens: make(map[string]*unixfsstore.AccessToken),
+	}
+	mint := func(root cid.Cid, expires time.Time) (string, *unixfsstore.AccessToken) {
+		bearer, token, err := access.NewToken(root, "partner", expires)
+		require.NoError(t, err)
+		store.tokens[token.ID] = &token
+		return bearer, &token
+	}
+	validBearer, valid := mint(privateRoot, time.Now().Add(time.Hour))
+	expiredBearer, _ := mint(privateRoot, time.Now().Add(-time.Hour))
+	revokedBearer, revoked := mint(privateRoot, time.Time{})
+	revoked.Revoked = true
+	otherRootBearer, _ := mint(otherPrivateRoot, time.Time{})
+
+	key, err := access.NewKey()
+	require.NoError(t, err)
+	controller := access.NewController(store, key)
+
+	testCases := []struct {
+		name          string
+		root          cid.Cid
+		path          stargate.PathSegments
+		bearer        string
+		query         string
+		expectedGrant handler.Grant
+		expectedErr   error
+	}{
+		{
+			name: "public root",
+			root: publicRoot,
+		},
+		{
+			name:        "private root without credentials",
+			root:        privateRoot,
+			expectedErr: handler.ErrUnauthorized,
+		},
+		{
+			name:          "valid bearer token",
+			root:          privateRoot,
+			bearer:        validBearer,
+			expectedGrant: handler.Grant{Private: true, TokenID: valid.ID},
+		},
+		{
+			name:        "wrong secret",
+			root:        privateRoot,
+			bearer:      valid.ID + ".wrong",
+			expectedErr: handler.ErrForbidden,
+		},
+		{
+			name:        "missing secret",
+			root:        privateRoot,
+			bearer:      valid.ID + ".",
+			expectedErr: handler.ErrForbidden,
+		},
+		{
+			name:        "expired token",
+			root:        privateRoot,
+			bearer:      expiredBearer,
+			expectedErr: handler.ErrForbidden,
+		},
+		{
+			name:        "revoked token",
+			root:        privateRoot,
+			bearer:      revokedBearer,
+			expectedErr: handler.ErrForbidden,
+		},
+		{
+			name:        "token for another root",
+			root:        privateRoot,
+			bearer:      otherRootBearer,
+			expectedErr: handler.ErrForbidden,
+		},
+		{
+			name:        "child of a private root without credentials",
+			root:        privateChild,
+			expectedErr: handler.ErrUnauthorized,
+		},
+		{
+			name:          "child of a private root with a token for the root",
+			root:          privateChild,
+			bearer:        validBearer,
+			expectedGrant: handler.Grant{Private: true, TokenID: valid.ID},
+		},
+		{
+			name:        "child of a private root with a token for another root",
+			root:        privateChild,
+			bearer:      otherRootBearer,
+			expectedErr: handler.ErrForbidden,
+		},
+		{
+			name:        "private directory through a public root without credentials",
+			root:        publicRoot,
+			path:        stargate.PathSegments{"private", "file"},
+			expectedErr: handler.ErrUnauthorized,
+		},
+		{
+			name:          "private directory through a public root with a token for the directory",
+			root:          publicRoot,
+			path:          stargate.PathSegments{"private", "file"},
+			bearer:        validBearer,
+			expectedGrant: handler.Grant{Private: true, TokenID: valid.ID},
+		},
+		{
+			name:        "private directory through a public root with a token for another root",
+			root:        publicRoot,
+			path:        stargate.PathSegments{"private"},
+			bearer:      otherRootBearer,
+			expectedErr: handler.ErrForbidden,
+		},
+		{
+			name:          "signed URL",
+			root:          privateRoot,
+			query:         access.SignURL(key, valid.ID, privateRoot, time.Now().Add(time.Minute)).Encode(),
+			expectedGrant: handler.Grant{Private: true, TokenID: valid.ID},
+		},
+		{
+			name:        "expired signed URL",
+			root:        privateRoot,
+			query:       access.SignURL(key, valid.ID, privateRoot, time.Now().Add(-time.Minute)).Encode(),
+			expectedErr: handler.ErrForbidden,
+		},
+		{
+			name:        "URL signed for another root",
+			root:        privateRoot,
+			query:       access.SignURL(key, valid.ID, otherPrivateRoot, time.Now().Add(time.Minute)).Encode(),
+			expectedErr: handler.ErrForbidden,
+		},
+		{
+			name:        "URL signed with another key",
+			root:        privateRoot,
+			query:       access.SignURL([]byte("other key"), valid.ID, privateRoot, time.Now().Add(time.Minute)).Encode(),
+			expectedErr: handler.ErrForbidden,
+		},
+		{
+			name:        "URL signed through a revoked token",
+			root:        privateRoot,
+			query:       access.SignURL(key, revoked.ID, privateRoot, time.Now().Add(time.Minute)).Encode(),
+			expectedErr: handler.ErrForbidden,
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/ipfs/"+testCase.root.String()+"?"+testCase.query, nil)
+			if testCase.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+testCase.bearer)
+			}
+			grant, err := controller.Authorize(r, testCase.root, testCase.path)
+			if testCase.expectedErr != nil {
+				require.True(t, errors.Is(err, testCase.expectedErr), "expected %s, got %v", testCase.expectedErr, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, testCase.expectedGrant, grant)
+		})
+	}
+}
+
+// notFoundAppResolver has no content, so requests it is asked about were authorized
+type notFoundAppResolver struct{}
+
+func (notFoundAppResolver) GetResolver(ctx context.Context, root cid.Cid) (*ipld.LinkSystem, stargate.PathResolver, error) {
+	return nil, nil, stargate.ErrNotFound{Cid: root}
+}
+
+func TestHandlerPrivateDirectory(t *testing.T) {
+	publicRoot := testutil.GenerateCid()
+	privateDir := testutil.GenerateCid()
+	store := &memoryStore{
+		private: map[cid.Cid][]cid.Cid{privateDir: {privateDir}},
+		paths: map[string][]cid.Cid{
+			publicRoot.String() + "/private/file": {privateDir, testutil.GenerateCid()},
+		},
+		tokens: make(map[string]*unixfsstore.AccessToken),
+	}
+	bearer, token, err := access.NewToken(privateDir, "partner", time.Time{})
+	require.NoError(t, err)
+	store.tokens[token.ID] = &token
+	key, err := access.NewKey()
+	require.NoError(t, err)
+	h := handler.NewHandler("ipfs", notFoundAppResolver{}, handler.WithAuthorizer(access.NewController(store, key)))
+
+	// both StarGate and deserialized responses are refused without a token for the private directory
+	target := "/ipfs/" + publicRoot.String() + "/private/file"
+	for _, accept := range []string{"", "*/*"} {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		require.Equal(t, http.StatusUnauthorized, w.Code, "Accept %q", accept)
+	}
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("Authorization", "Bearer "+bearer)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,196 @@
+/*
+Package carreader reads StarGate CAR responses, verifying every block against its CID
+
+A response is a CAR header followed by a sequence of StarGate messages, each followed by the blocks it lists as
+Present, in order. The response always ends with a Summary message. An Error message may appear between messages,
+or interrupt the blocks of a message -- it is recognized because its CID does not match the next expected block.
+
+A client that sent the blocks it already has with its request can read the response with a local store, so that
+blocks listed but not sent are filled in from it.
+*/
+package carreader
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/ipld/go-car"
+	"github.com/ipld/go-car/util"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+)
+
+// ErrTruncated means the response ended before its Summary message
+var ErrTruncated = errors.New("stargate response ended without a summary")
+
+// ErrUnexpectedBlock means a block did not match the CID listed for it in the preceding message
+type ErrUnexpectedBlock struct {
+	Expected cid.Cid
+	Received cid.Cid
+}
+
+func (e ErrUnexpectedBlock) Error() string {
+	return fmt.Sprintf("expected block %s, received %s", e.Expected, e.Received)
+}
+
+// LocalStore holds blocks a client already has
+type LocalStore interface {
+	Has(ctx context.Context, c cid.Cid) (bool, error)
+	Get(ctx context.Context, c cid.Cid) (blocks.Block, error)
+}
+
+// Reader reads messages from a StarGate CAR response
+type Reader struct {
+	br      *bufio.Reader
+	roots   []cid.Cid
+	summary *stargate.Summary
+	ctx     context.Context
+	local   LocalStore
+}
+
+// NewReader reads the CAR header of a StarGate response and returns a reader for its messages
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := car.ReadHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("reading car header: %w", err)
+	}
+	if len(header.Roots) != 1 {
+		return nil, fmt.Errorf("expected a single root, got %d", len(header.Roots))
+	}
+	return &Reader{br: br, roots: header.Roots}, nil
+}
+
+// NewReaderWithLocalStore returns a reader that also returns blocks listed but not sent in the response, when they
+// are in the local store
+func NewReaderWithLocalStore(ctx context.Context, r io.Reader, local LocalStore) (*Reader, error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	reader.ctx, reader.local = ctx, local
+	return reader, nil
+}
+
+// Root returns the root CID of the response
+func (r *Reader) Root() cid.Cid {
+	return r.roots[0]
+}
+
+// Summary returns the summary message that ended the response, or nil if it has not been read yet
+func (r *Reader) Summary() *stargate.Summary {
+	return r.summary
+}
+
+// Next returns the next message and the blocks sent with it, in the order they were listed, including any found in
+// the local store. Compact block metadata in DAG messages is expanded into the message's Blocks.
+// An Error message is returned as the error value, along with any blocks received before it.
+// After the Summary message is read, Next returns io.EOF.
+func (r *Reader) Next() (*stargate.StarGateMessage, []blocks.Block, error) {
+	if r.summary != nil {
+		return nil, nil, io.EOF
+	}
+	c, data, err := r.readFrame()
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := decodeMessage(c, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch msg.Kind {
+	case stargate.KindSummary:
+		r.summary = msg.Summary
+		return msg, nil, nil
+	case stargate.KindError:
+		return msg, nil, *msg.Error
+	}
+	blockMetadata, err := msg.BlockMetadata()
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding block metadata: %w", err)
+	}
+	if msg.Kind == stargate.KindDAG && msg.DAG.Compact != nil {
+		msg.DAG.Blocks, msg.DAG.Compact = blockMetadata, nil
+	}
+	var received []blocks.Block
+	for _, blockMetadatum := range blockMetadata {
+		if blockMetadatum.Status != stargate.BlockStatusPresent {
+			blk, err := r.localBlock(blockMetadatum.Link)
+			if err != nil {
+				return msg, received, err
+			}
+			if blk != nil {
+				received = append(received, blk)
+			}
+			continue
+		}
+		c, data, err := r.readFrame()
+		if err != nil {
+			return msg, received, err
+		}
+		if !c.Equals(blockMetadatum.Link) {
+			// an error message may interrupt a sequence of blocks
+			if interrupt, decodeErr := decodeMessage(c, data); decodeErr == nil && interrupt.Kind == stargate.KindError {
+				return msg, received, *interrupt.Error
+			}
+			return msg, received, ErrUnexpectedBlock{Expected: blockMetadatum.Link, Received: c}
+		}
+		blk, err := verifiedBlock(c, data)
+		if err != nil {
+			return msg, received, err
+		}
+		received = append(received, blk)
+	}
+	return msg, received, nil
+}
+
+// localBlock returns a block from the local store, or nil if it is not there
+func (r *Reader) localBlock(c cid.Cid) (blocks.Block, error) {
+	if r.local == nil {
+		return nil, nil
+	}
+	has, err := r.local.Has(r.ctx, c)
+	if err != nil || !has {
+		return nil, err
+	}
+	return r.local.Get(r.ctx, c)
+}
+
+func (r *Reader) readFrame() (cid.Cid, []byte, error) {
+	c, data, err := util.ReadNode(r.br)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return cid.Undef, nil, ErrTruncated
+	}
+	if err != nil {
+		return cid.Undef, nil, fmt.Errorf("parsing response: %w", err)
+	}
+	return c, data, nil
+}
+
+func decodeMessage(c cid.Cid, data []byte) (*stargate.StarGateMessage, error) {
+	if _, err := verifiedBlock(c, data); err != nil {
+		return nil, err
+	}
+	msg, err := stargate.BindnodeRegistry.TypeFromBytes(data, (*stargate.StarGateMessage)(nil), dagcbor.Decode)
+	if err != nil {
+		return nil, fmt.Errorf("parsing stargate message: %w", err)
+	}
+	return msg.(*stargate.StarGateMessage), nil
+}
+
+// verifiedBlock constructs a block, checking the data hashes to the CID
+func verifiedBlock(c cid.Cid, data []byte) (blocks.Block, error) {
+	actual, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, err
+	}
+	if !actual.Equals(c) {
+		return nil, fmt.Errorf("block data does not match CID %s", c)
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
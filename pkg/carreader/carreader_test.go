@@ -0,0 +1,243 @@
+package carreader_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/ipfs/stargate/internal/testutil"
+	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/ipfs/stargate/pkg/carreader"
+	"github.com/ipfs/stargate/pkg/carwriter.go"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver serves a fixed sequence of DAG messages, optionally failing after them
+type fakeResolver struct {
+	lsys    *ipld.LinkSystem
+	dags    []*stargate.DAG
+	lastErr error
+}
+
+func (fr *fakeResolver) GetResolver(ctx context.Context, root cid.Cid) (*ipld.LinkSystem, stargate.PathResolver, error) {
+	return fr.lsys, fr, nil
+}
+
+func (fr *fakeResolver) ResolvePathSegments(ctx context.Context, path stargate.PathSegments) (*stargate.Path, stargate.PathSegments, stargate.PathResolver, error) {
+	return nil, nil, nil, errors.New("not implemented")
+}
+
+func (fr *fakeResolver) ResolveQuery(ctx context.Context, query stargate.Query, haves *stargate.HaveSet) (stargate.QueryResolver, error) {
+	return &fakeQueryResolver{dags: fr.dags, lastErr: fr.lastErr}, nil
+}
+
+type fakeQueryResolver struct {
+	dags    []*stargate.DAG
+	lastErr error
+}
+
+func (fqr *fakeQueryResolver) Next() (*stargate.DAG, error) {
+	if len(fqr.dags) == 0 {
+		err := fqr.lastErr
+		fqr.lastErr = nil
+		return nil, err
+	}
+	next := fqr.dags[0]
+	fqr.dags = fqr.dags[1:]
+	return next, nil
+}
+
+func (fqr *fakeQueryResolver) Done() bool {
+	return len(fqr.dags) == 0 && fqr.lastErr == nil
+}
+
+func TestReadWrittenResponse(t *testing.T) {
+	ctx := context.Background()
+	ls := cidlink.DefaultLinkSystem()
+	store := memstore.Store{Bag: make(map[string][]byte)}
+	ls.SetReadStorage(&store)
+	blks := testutil.GenerateBlocksOfSize(4, 100)
+	for _, blk := range blks {
+		require.NoError(t, store.Put(ctx, string(blk.Cid().Bytes()), blk.RawData()))
+	}
+	dags := []*stargate.DAG{
+		{
+			Ordering: stargate.OrderingBreadthFirst,
+			Blocks: stargate.BlockMetadata{
+				{Link: blks[0].Cid(), Status: stargate.BlockStatusPresent},
+				{Link: blks[1].Cid(), Status: stargate.BlockStatusNotSent},
+			},
+		},
+		{
+			Ordering: stargate.OrderingBreadthFirst,
+			Blocks: stargate.BlockMetadata{
+				{Link: blks[2].Cid(), Status: stargate.BlockStatusPresent},
+				{Link: blks[3].Cid(), Status: stargate.BlockStatusPresent},
+			},
+		},
+	}
+	missingBlock := testutil.GenerateCid()
+
+	testCases := []struct {
+		name            string
+		dags            []*stargate.DAG
+		lastErr         error
+		expectedBlocks  [][]cid.Cid
+		expectedErr     bool
+		expectedSummary stargate.Summary
+	}{
+		{
+			name:           "complete response",
+			dags:           dags,
+			expectedBlocks: [][]cid.Cid{{blks[0].Cid()}, {blks[2].Cid(), blks[3].Cid()}},
+			expectedSummary: stargate.Summary{
+				Present:  3,
+				NotSent:  1,
+				Bytes:    300,
+				Complete: true,
+			},
+		},
+		{
+			name:           "error between messages",
+			dags:           dags[:1],
+			lastErr:        stargate.ErrNotFound{Cid: missingBlock},
+			expectedBlocks: [][]cid.Cid{{blks[0].Cid()}},
+			expectedErr:    true,
+			expectedSummary: stargate.Summary{
+				Present: 1,
+				NotSent: 1,
+				Bytes:   100,
+			},
+		},
+		{
+			name: "error interrupting blocks",
+			dags: []*stargate.DAG{
+				{
+					Ordering: stargate.OrderingBreadthFirst,
+					Blocks: stargate.BlockMetadata{
+						{Link: blks[0].Cid(), Status: stargate.BlockStatusPresent},
+						{Link: missingBlock, Status: stargate.BlockStatusPresent},
+						{Link: blks[2].Cid(), Status: stargate.BlockStatusPresent},
+					},
+				},
+			},
+			expectedBlocks: [][]cid.Cid{{blks[0].Cid()}},
+			expectedErr:    true,
+			expectedSummary: stargate.Summary{
+				Present: 2,
+				Bytes:   100,
+			},
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			req := require.New(t)
+			root := blks[0].Cid()
+			buf := new(bytes.Buffer)
+			err := carwriter.WriteCar(ctx, buf, root, nil, nil, nil, &fakeResolver{&ls, testCase.dags, testCase.lastErr})
+			if testCase.expectedErr {
+				req.Error(err)
+			} else {
+				req.NoError(err)
+			}
+
+			reader, err := carreader.NewReader(buf)
+			req.NoError(err)
+			req.Equal(root, reader.Root())
+			var receivedBlocks [][]cid.Cid
+			var receivedErr error
+			for {
+				msg, received, err := reader.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				var blockCids []cid.Cid
+				for _, blk := range received {
+					blockCids = append(blockCids, blk.Cid())
+				}
+				if len(blockCids) > 0 {
+					receivedBlocks = append(receivedBlocks, blockCids)
+				}
+				if err != nil {
+					receivedErr = err
+					continue
+				}
+				req.NotNil(msg)
+			}
+			req.Equal(testCase.expectedBlocks, receivedBlocks)
+			if testCase.expectedErr {
+				req.ErrorAs(receivedErr, &stargate.Error{})
+			} else {
+				req.NoError(receivedErr)
+			}
+			req.Equal(&testCase.expectedSummary, reader.Summary())
+		})
+	}
+}
+
+func TestTruncatedResponse(t *testing.T) {
+	ctx := context.Background()
+	ls := cidlink.DefaultLinkSystem()
+	store := memstore.Store{Bag: make(map[string][]byte)}
+	ls.SetReadStorage(&store)
+	blk := testutil.GenerateBlocksOfSize(1, 100)[0]
+	require.NoError(t, store.Put(ctx, string(blk.Cid().Bytes()), blk.RawData()))
+
+	buf := new(bytes.Buffer)
+	err := carwriter.WriteCar(ctx, buf, blk.Cid(), nil, nil, nil, &fakeResolver{lsys: &ls, dags: []*stargate.DAG{
+		{
+			Ordering: stargate.OrderingBreadthFirst,
+			Blocks:   stargate.BlockMetadata{{Link: blk.Cid(), Status: stargate.BlockStatusPresent}},
+		},
+	}})
+	require.NoError(t, err)
+	// cut off the summary
+	truncated := bytes.NewReader(buf.Bytes()[:buf.Len()-10])
+	reader, err := carreader.NewReader(truncated)
+	require.NoError(t, err)
+	_, _, err = reader.Next()
+	require.NoError(t, err)
+	_, _, err = reader.Next()
+	require.ErrorIs(t, err, carreader.ErrTruncated)
+}
+
+func TestLocalStore(t *testing.T) {
+	ctx := context.Background()
+	ls := cidlink.DefaultLinkSystem()
+	store := memstore.Store{Bag: make(map[string][]byte)}
+	ls.SetReadStorage(&store)
+	blks := testutil.GenerateBlocksOfSize(3, 100)
+	for _, blk := range blks {
+		require.NoError(t, store.Put(ctx, string(blk.Cid().Bytes()), blk.RawData()))
+	}
+	local := blockstore.NewBlockstore(dssync.MutexWrap(datastore.NewMapDatastore()))
+	require.NoError(t, local.Put(ctx, blks[1]))
+
+	buf := new(bytes.Buffer)
+	err := carwriter.WriteCar(ctx, buf, blks[0].Cid(), nil, nil, nil, &fakeResolver{lsys: &ls, dags: []*stargate.DAG{
+		{
+			Ordering: stargate.OrderingBreadthFirst,
+			Blocks: stargate.BlockMetadata{
+				{Link: blks[0].Cid(), Status: stargate.BlockStatusPresent},
+				{Link: blks[1].Cid(), Status: stargate.BlockStatusDuplicate},
+				{Link: blks[2].Cid(), Status: stargate.BlockStatusNotSent},
+			},
+		},
+	}})
+	require.NoError(t, err)
+	reader, err := carreader.NewReaderWithLocalStore(ctx, buf, local)
+	require.NoError(t, err)
+	_, received, err := reader.Next()
+	require.NoError(t, err)
+	// the block not sent is filled from the local store, the one not held locally is skipped
+	require.Equal(t, blks[:2], received)
+}
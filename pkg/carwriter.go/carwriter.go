@@ -2,11 +2,15 @@ package carwriter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/ipfs/go-cid"
 	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/ipfs/stargate/pkg/metrics"
+	"github.com/ipfs/stargate/pkg/tracing"
 	"github.com/ipld/go-car"
 	"github.com/ipld/go-car/util"
 	"github.com/ipld/go-ipld-prime"
@@ -15,53 +19,134 @@ import (
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/multiformats/go-multicodec"
 	"github.com/multiformats/go-multihash"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // WriteCar traverses a StarGate query using a resolver to write StarGate CAR response to the given writer
-func WriteCar(ctx context.Context, w io.Writer, root cid.Cid, paths stargate.PathSegments, query stargate.Query, appResolver stargate.AppResolver) error {
+// Every response ends with a Summary message. If the response fails after the CAR header is written, an Error
+// message precedes the summary, and the error is also returned.
+// If a path segment is proven not to exist, the proof is written before the error
+// haves, which may be nil, are the blocks the client already has
+func WriteCar(ctx context.Context, w io.Writer, root cid.Cid, paths stargate.PathSegments, query stargate.Query, haves *stargate.HaveSet, appResolver stargate.AppResolver) error {
+	_, err := WriteCarWithSummary(ctx, w, root, paths, query, haves, appResolver)
+	return err
+}
+
+// WriteCarWithSummary writes a StarGate CAR response like WriteCar, and also returns the summary sent at the end of
+// it. The summary is nil if the response failed before any messages were written
+func WriteCarWithSummary(ctx context.Context, w io.Writer, root cid.Cid, paths stargate.PathSegments, query stargate.Query, haves *stargate.HaveSet, appResolver stargate.AppResolver) (_ *stargate.Summary, err error) {
+	ctx, span := tracing.StartSpan(ctx, "WriteCar", trace.WithAttributes(
+		attribute.String("stargate.root", root.String()),
+		attribute.StringSlice("stargate.path", paths),
+	))
+	defer func() {
+		tracing.EndSpan(span, err)
+	}()
 	// write CAR header
 	header := car.CarHeader{
 		Version: 1,
 		Roots:   []cid.Cid{root},
 	}
-	err := car.WriteHeader(&header, w)
+	err = car.WriteHeader(&header, w)
+	if err != nil {
+		return nil, fmt.Errorf("writing car header: %w", err)
+	}
+	summary := &stargate.Summary{}
+	err = writeMessages(ctx, w, root, paths, query, haves, appResolver, summary)
+	if err != nil {
+		// report the failure in the response itself, ignoring further write errors since we're already failing
+		_ = writeStarGateMessage(w, stargate.StarGateMessage{
+			Kind:  stargate.KindError,
+			Error: errorMessage(err),
+		})
+	}
+	summary.Complete = err == nil
+	span.SetAttributes(
+		attribute.Int64("stargate.blocks.present", summary.Present),
+		attribute.Int64("stargate.blocks.duplicate", summary.Duplicate),
+		attribute.Int64("stargate.bytes", summary.Bytes),
+	)
+	summaryErr := writeStarGateMessage(w, stargate.StarGateMessage{
+		Kind:    stargate.KindSummary,
+		Summary: summary,
+	})
 	if err != nil {
-		return fmt.Errorf("writing car header: %w", err)
+		return summary, err
 	}
+	if summaryErr != nil {
+		return summary, fmt.Errorf("encoding stargate summary: %w", summaryErr)
+	}
+	return summary, nil
+}
+
+// writeMessages writes all Path and DAG messages for a query, with their blocks
+func writeMessages(ctx context.Context, w io.Writer, root cid.Cid, paths stargate.PathSegments, query stargate.Query, haves *stargate.HaveSet, appResolver stargate.AppResolver, summary *stargate.Summary) error {
+	phases := make(phaseTimes)
+	defer phases.observe()
 	// resolve root
-	lsys, resolver, err := appResolver.GetResolver(ctx, root)
+	spanCtx, end := phases.start(ctx, metrics.PhasePathResolution, "GetResolver")
+	lsys, resolver, err := appResolver.GetResolver(spanCtx, root)
+	end(err)
 	if err != nil {
 		return fmt.Errorf("error loading root resolver: %w", err)
 	}
 	// resolve all path segments
 	for len(paths) != 0 {
 		var path *stargate.Path
-		path, paths, resolver, err = resolver.ResolvePathSegments(ctx, paths)
+		spanCtx, end = phases.start(ctx, metrics.PhasePathResolution, "ResolvePathSegments")
+		path, paths, resolver, err = resolver.ResolvePathSegments(spanCtx, paths)
+		end(err)
 		if err != nil {
+			// if the resolver can prove the path does not exist, include the proof in the response
+			var errPathError stargate.ErrPathError
+			if errors.As(err, &errPathError) && errPathError.Proof != nil {
+				spanCtx, end = phases.start(ctx, metrics.PhaseBlockWriting, "WriteMessage")
+				proofErr := writeStarGateMessageAndBlocks(spanCtx, w, stargate.StarGateMessage{
+					Kind: stargate.KindPath,
+					Path: errPathError.Proof,
+				}, lsys, summary)
+				end(proofErr)
+				if proofErr != nil {
+					return fmt.Errorf("encoding stargate message and blocks: %w", proofErr)
+				}
+			}
 			return fmt.Errorf("resolving path segments: %w", err)
 		}
-		err = writeStarGateMessageAndBlocks(ctx, w, stargate.StarGateMessage{
+		spanCtx, end = phases.start(ctx, metrics.PhaseBlockWriting, "WriteMessage")
+		err = writeStarGateMessageAndBlocks(spanCtx, w, stargate.StarGateMessage{
 			Kind: stargate.KindPath,
 			Path: path,
-		}, lsys)
+		}, lsys, summary)
+		end(err)
 		if err != nil {
 			return fmt.Errorf("encoding stargate message and blocks: %w", err)
 		}
 	}
 	// resolve query
-	queryResolver, err := resolver.ResolveQuery(ctx, query)
+	// the query resolver keeps the context it is given for its later steps, so the context passed covers the whole
+	// query rather than only this call
+	queryCtx, querySpan := tracing.StartSpan(ctx, "Query")
+	defer querySpan.End()
+	_, end = phases.start(queryCtx, metrics.PhaseQueryResolution, "ResolveQuery")
+	queryResolver, err := resolver.ResolveQuery(queryCtx, query, haves)
+	end(err)
 	if err != nil {
 		return fmt.Errorf("resolving Query: %w", err)
 	}
 	for !queryResolver.Done() {
+		_, end = phases.start(queryCtx, metrics.PhaseQueryResolution, "QueryResolver.Next")
 		dag, err := queryResolver.Next()
+		end(err)
 		if err != nil {
 			return fmt.Errorf("resolving Query Step: %w", err)
 		}
-		err = writeStarGateMessageAndBlocks(ctx, w, stargate.StarGateMessage{
+		spanCtx, end = phases.start(queryCtx, metrics.PhaseBlockWriting, "WriteMessage")
+		err = writeStarGateMessageAndBlocks(spanCtx, w, stargate.StarGateMessage{
 			Kind: stargate.KindDAG,
 			DAG:  dag,
-		}, lsys)
+		}, lsys, summary)
+		end(err)
 		if err != nil {
 			return fmt.Errorf("encoding stargate message and blocks: %w", err)
 		}
@@ -69,37 +154,68 @@ func WriteCar(ctx context.Context, w io.Writer, root cid.Cid, paths stargate.Pat
 	return nil
 }
 
+// phaseTimes accumulates the time spent in each phase of writing a response
+type phaseTimes map[string]time.Duration
+
+// start begins a step in a phase of the response, with a span of the given name. The returned function ends the
+// step, adding its duration to the phase
+func (pt phaseTimes) start(ctx context.Context, phase string, name string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracing.StartSpan(ctx, name, trace.WithAttributes(attribute.String("stargate.phase", phase)))
+	return ctx, func(err error) {
+		pt[phase] += time.Since(start)
+		tracing.EndSpan(span, err)
+	}
+}
+
+func (pt phaseTimes) observe() {
+	for phase, duration := range pt {
+		metrics.PhaseDuration.WithLabelValues(phase).Observe(duration.Seconds())
+	}
+}
+
+// errorMessage converts an error into a StarGate error message
+func errorMessage(err error) *stargate.Error {
+	code := stargate.ErrorCodeInternal
+	var errNotFound stargate.ErrNotFound
+	var errPathError stargate.ErrPathError
+	switch {
+	case errors.As(err, &errNotFound):
+		code = stargate.ErrorCodeNotFound
+	case errors.As(err, &errPathError):
+		code = stargate.ErrorCodePathError
+	}
+	return &stargate.Error{
+		Code:        code,
+		Description: err.Error(),
+	}
+}
+
 type bytesReader interface {
 	Bytes() []byte
 }
 
-// writeStarGateMessageAndBlocks serializes a StarGate message and its associate blocks
-func writeStarGateMessageAndBlocks(ctx context.Context, w io.Writer, msg stargate.StarGateMessage, lsys *ipld.LinkSystem) error {
-	raw, err := stargate.BindnodeRegistry.TypeToBytes(&msg, dagcbor.Encode)
-	if err != nil {
-		return err
-	}
-	messageLink, err := cid.Prefix{
-		Version:  1,
-		Codec:    uint64(multicodec.DagCbor),
-		MhType:   multihash.SHA2_256,
-		MhLength: -1,
-	}.Sum(raw)
+// writeStarGateMessageAndBlocks serializes a StarGate message and its associate blocks, adding them to the summary
+func writeStarGateMessageAndBlocks(ctx context.Context, w io.Writer, msg stargate.StarGateMessage, lsys *ipld.LinkSystem, summary *stargate.Summary) error {
+	blockMetadata, err := msg.BlockMetadata()
 	if err != nil {
 		return err
 	}
-	err = util.LdWrite(w, messageLink.Bytes(), raw)
+	err = writeStarGateMessage(w, msg)
 	if err != nil {
 		return err
 	}
-	var blockMetadata stargate.BlockMetadata
-	if msg.Kind == stargate.KindPath {
-		blockMetadata = msg.Path.Blocks
-	} else {
-		blockMetadata = msg.DAG.Blocks
-	}
 	for _, blockMetadatum := range blockMetadata {
-		if blockMetadatum.Status == stargate.BlockStatusPresent {
+		metrics.Blocks.WithLabelValues(string(blockMetadatum.Status)).Inc()
+		switch blockMetadatum.Status {
+		case stargate.BlockStatusNotSent:
+			summary.NotSent++
+		case stargate.BlockStatusMissing:
+			summary.Missing++
+		case stargate.BlockStatusDuplicate:
+			summary.Duplicate++
+		case stargate.BlockStatusPresent:
+			summary.Present++
 			reader, err := lsys.StorageReadOpener(linking.LinkContext{
 				Ctx: ctx,
 			}, cidlink.Link{Cid: blockMetadatum.Link})
@@ -119,7 +235,27 @@ func writeStarGateMessageAndBlocks(ctx context.Context, w io.Writer, msg stargat
 			if err != nil {
 				return err
 			}
+			summary.Bytes += int64(len(data))
+			metrics.BlockBytes.Add(float64(len(data)))
 		}
 	}
 	return nil
 }
+
+// writeStarGateMessage serializes a StarGate message
+func writeStarGateMessage(w io.Writer, msg stargate.StarGateMessage) error {
+	raw, err := stargate.BindnodeRegistry.TypeToBytes(&msg, dagcbor.Encode)
+	if err != nil {
+		return err
+	}
+	messageLink, err := cid.Prefix{
+		Version:  1,
+		Codec:    uint64(multicodec.DagCbor),
+		MhType:   multihash.SHA2_256,
+		MhLength: -1,
+	}.Sum(raw)
+	if err != nil {
+		return err
+	}
+	return util.LdWrite(w, messageLink.Bytes(), raw)
+}
@@ -0,0 +1,128 @@
+package stargate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multihash"
+)
+
+// CompactBlocks encodes block metadata in its compact form, sharing CID prefixes and run-length encoding statuses
+func CompactBlocks(blockMetadata BlockMetadata) *CompactBlockMetadata {
+	compact := &CompactBlockMetadata{
+		Prefixes:   [][]byte{},
+		PrefixRuns: []PrefixRun{},
+		StatusRuns: []StatusRun{},
+	}
+	digests := new(bytes.Buffer)
+	prefixIndexes := make(map[string]int64)
+	for _, blockMetadatum := range blockMetadata {
+		prefix := blockMetadatum.Link.Prefix().Bytes()
+		index, ok := prefixIndexes[string(prefix)]
+		if !ok {
+			index = int64(len(compact.Prefixes))
+			prefixIndexes[string(prefix)] = index
+			compact.Prefixes = append(compact.Prefixes, prefix)
+		}
+		if last := len(compact.PrefixRuns) - 1; last >= 0 && compact.PrefixRuns[last].Prefix == index {
+			compact.PrefixRuns[last].Count++
+		} else {
+			compact.PrefixRuns = append(compact.PrefixRuns, PrefixRun{Prefix: index, Count: 1})
+		}
+		if last := len(compact.StatusRuns) - 1; last >= 0 && compact.StatusRuns[last].Status == blockMetadatum.Status {
+			compact.StatusRuns[last].Count++
+		} else {
+			compact.StatusRuns = append(compact.StatusRuns, StatusRun{Status: blockMetadatum.Status, Count: 1})
+		}
+		// CIDs are always valid multihashes, so decoding can't fail
+		decoded, _ := multihash.Decode(blockMetadatum.Link.Hash())
+		digests.Write(decoded.Digest)
+	}
+	compact.Digests = digests.Bytes()
+	return compact
+}
+
+// Expand decodes compact block metadata to a regular list of block metadata
+func (c *CompactBlockMetadata) Expand() (BlockMetadata, error) {
+	prefixes := make([]cid.Prefix, 0, len(c.Prefixes))
+	for _, prefixBytes := range c.Prefixes {
+		prefix, err := cid.PrefixFromBytes(prefixBytes)
+		if err != nil {
+			return nil, fmt.Errorf("decoding prefix: %w", err)
+		}
+		if prefix.MhLength <= 0 {
+			return nil, errors.New("prefix must specify a digest length")
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	// every block takes at least a byte of the digests, so the runs are checked against the digests before
+	// anything is allocated for them
+	var total int64
+	available := int64(len(c.Digests))
+	for _, prefixRun := range c.PrefixRuns {
+		if prefixRun.Prefix < 0 || prefixRun.Prefix >= int64(len(prefixes)) {
+			return nil, fmt.Errorf("prefix index %d out of range", prefixRun.Prefix)
+		}
+		if prefixRun.Count < 0 {
+			return nil, errors.New("negative run length")
+		}
+		mhLength := int64(prefixes[prefixRun.Prefix].MhLength)
+		if prefixRun.Count > available/mhLength {
+			return nil, errors.New("not enough digest bytes")
+		}
+		available -= prefixRun.Count * mhLength
+		total += prefixRun.Count
+	}
+	var statusTotal int64
+	for _, statusRun := range c.StatusRuns {
+		if statusRun.Count < 0 {
+			return nil, errors.New("negative run length")
+		}
+		if statusRun.Count > total-statusTotal {
+			return nil, fmt.Errorf("status runs cover more than the %d blocks of the prefix runs", total)
+		}
+		statusTotal += statusRun.Count
+	}
+	if statusTotal != total {
+		return nil, fmt.Errorf("status runs cover %d blocks but prefix runs cover %d", statusTotal, total)
+	}
+
+	blockMetadata := make(BlockMetadata, 0, total)
+	digests := c.Digests
+	statusRuns := c.StatusRuns
+	var statusUsed int64
+	for _, prefixRun := range c.PrefixRuns {
+		prefix := prefixes[prefixRun.Prefix]
+		for i := int64(0); i < prefixRun.Count; i++ {
+			if len(digests) < prefix.MhLength {
+				return nil, errors.New("not enough digest bytes")
+			}
+			mh, err := multihash.Encode(digests[:prefix.MhLength], prefix.MhType)
+			if err != nil {
+				return nil, err
+			}
+			digests = digests[prefix.MhLength:]
+			var link cid.Cid
+			if prefix.Version == 0 {
+				link = cid.NewCidV0(mh)
+			} else {
+				link = cid.NewCidV1(prefix.Codec, mh)
+			}
+			for statusUsed == statusRuns[0].Count {
+				statusRuns = statusRuns[1:]
+				statusUsed = 0
+			}
+			statusUsed++
+			blockMetadata = append(blockMetadata, BlockMetadatum{
+				Link:   link,
+				Status: statusRuns[0].Status,
+			})
+		}
+	}
+	if len(digests) != 0 {
+		return nil, errors.New("unused digest bytes")
+	}
+	return blockMetadata, nil
+}
@@ -0,0 +1,117 @@
+package stargate_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/stargate/internal/testutil"
+	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/multiformats/go-multihash"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactBlocksRoundtrip(t *testing.T) {
+	rawPrefix := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: multihash.SHA2_256, MhLength: -1}
+	blakePrefix := cid.Prefix{Version: 1, Codec: cid.DagProtobuf, MhType: multihash.BLAKE2B_MIN + 31, MhLength: -1}
+	v0Prefix := cid.Prefix{Version: 0, Codec: cid.DagProtobuf, MhType: multihash.SHA2_256, MhLength: -1}
+	blockMetadata := stargate.BlockMetadata{}
+	addBlocks := func(prefix cid.Prefix, status stargate.BlockStatus, count int) {
+		for _, blk := range testutil.GenerateBlocksOfSize(count, 100) {
+			c, err := prefix.Sum(blk.RawData())
+			require.NoError(t, err)
+			blockMetadata = append(blockMetadata, stargate.BlockMetadatum{Link: c, Status: status})
+		}
+	}
+	addBlocks(v0Prefix, stargate.BlockStatusPresent, 1)
+	addBlocks(blakePrefix, stargate.BlockStatusPresent, 10)
+	addBlocks(rawPrefix, stargate.BlockStatusPresent, 100)
+	addBlocks(rawPrefix, stargate.BlockStatusNotSent, 100)
+	addBlocks(blakePrefix, stargate.BlockStatusMissing, 5)
+	addBlocks(rawPrefix, stargate.BlockStatusDuplicate, 1)
+
+	compact := stargate.CompactBlocks(blockMetadata)
+	require.Len(t, compact.Prefixes, 3)
+	require.Len(t, compact.PrefixRuns, 5)
+	require.Len(t, compact.StatusRuns, 4)
+
+	msg := stargate.StarGateMessage{
+		Kind: stargate.KindDAG,
+		DAG: &stargate.DAG{
+			Ordering: stargate.OrderingBreadthFirst,
+			Compact:  compact,
+		},
+	}
+	data, err := stargate.BindnodeRegistry.TypeToBytes(&msg, dagcbor.Encode)
+	require.NoError(t, err)
+	result, err := stargate.BindnodeRegistry.TypeFromBytes(data, (*stargate.StarGateMessage)(nil), dagcbor.Decode)
+	require.NoError(t, err)
+	require.Equal(t, &msg, result)
+
+	expanded, err := result.(*stargate.StarGateMessage).BlockMetadata()
+	require.NoError(t, err)
+	require.Equal(t, blockMetadata, expanded)
+
+	full := stargate.StarGateMessage{
+		Kind: stargate.KindDAG,
+		DAG: &stargate.DAG{
+			Ordering: stargate.OrderingBreadthFirst,
+			Blocks:   blockMetadata,
+		},
+	}
+	fullData, err := stargate.BindnodeRegistry.TypeToBytes(&full, dagcbor.Encode)
+	require.NoError(t, err)
+	require.Less(t, len(data), len(fullData))
+}
+
+func TestCompactBlocksInvalid(t *testing.T) {
+	blockMetadata := stargate.BlockMetadata{
+		{Link: testutil.GenerateCid(), Status: stargate.BlockStatusPresent},
+		{Link: testutil.GenerateCid(), Status: stargate.BlockStatusNotSent},
+	}
+	testCases := []struct {
+		name   string
+		mutate func(*stargate.CompactBlockMetadata)
+	}{
+		{
+			name:   "prefix out of range",
+			mutate: func(c *stargate.CompactBlockMetadata) { c.PrefixRuns[0].Prefix = 5 },
+		},
+		{
+			name:   "status count mismatch",
+			mutate: func(c *stargate.CompactBlockMetadata) { c.StatusRuns[0].Count++ },
+		},
+		{
+			name:   "short digests",
+			mutate: func(c *stargate.CompactBlockMetadata) { c.Digests = c.Digests[:len(c.Digests)-1] },
+		},
+		{
+			name:   "run longer than digests",
+			mutate: func(c *stargate.CompactBlockMetadata) { c.PrefixRuns[0].Count = math.MaxInt64 },
+		},
+		{
+			name: "runs overflowing",
+			mutate: func(c *stargate.CompactBlockMetadata) {
+				c.PrefixRuns = append(c.PrefixRuns, stargate.PrefixRun{Prefix: 0, Count: math.MaxInt64})
+				c.StatusRuns = append(c.StatusRuns, stargate.StatusRun{Status: stargate.BlockStatusPresent, Count: math.MaxInt64})
+			},
+		},
+		{
+			name:   "status runs overflowing",
+			mutate: func(c *stargate.CompactBlockMetadata) { c.StatusRuns[0].Count = math.MaxInt64 },
+		},
+		{
+			name:   "extra digests",
+			mutate: func(c *stargate.CompactBlockMetadata) { c.Digests = append(c.Digests, 0) },
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			compact := stargate.CompactBlocks(blockMetadata)
+			testCase.mutate(compact)
+			_, err := compact.Expand()
+			require.Error(t, err)
+		})
+	}
+}
@@ -18,6 +18,8 @@ type ErrPathError struct {
 	Cid  cid.Cid
 	Path string
 	Err  error
+	// Proof, if set, is a path message proving the failing segment does not exist
+	Proof *Path
 }
 
 func (e ErrPathError) Unwrap() error {
@@ -33,3 +35,12 @@ type ErrNoMoreMessages struct{}
 func (e ErrNoMoreMessages) Error() string {
 	return "query resolution already complete"
 }
+
+// ErrRangeNotSatisfiable means none of the requested byte ranges start within the file
+type ErrRangeNotSatisfiable struct {
+	Size uint64
+}
+
+func (e ErrRangeNotSatisfiable) Error() string {
+	return fmt.Sprintf("no requested byte range starts within the file of size %d", e.Size)
+}
@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/ipfs/go-cid"
+	stargate "github.com/ipfs/stargate/pkg"
+)
+
+// Query parameters of a signed URL, granting access to a private root until an expiry time. They are not part of
+// the StarGate query
+const (
+	QueryToken     = "sg-token"
+	QueryExpires   = "sg-expires"
+	QuerySignature = "sg-signature"
+)
+
+var accessParams = []string{QueryToken, QueryExpires, QuerySignature}
+
+var (
+	// ErrUnauthorized is returned by an Authorizer when a request for a private root presents no credentials
+	ErrUnauthorized = errors.New("authorization required")
+	// ErrForbidden is returned by an Authorizer when a request's credentials do not grant access to a root
+	ErrForbidden = errors.New("access denied")
+)
+
+// Grant describes the access an Authorizer allowed a request
+type Grant struct {
+	// Private is true if the root is not public, so responses must not be kept by shared caches
+	Private bool
+	// TokenID identifies the token that granted access, if any
+	TokenID string
+}
+
+// Authorizer decides whether a request may retrieve a path under a root, before the root is resolved
+type Authorizer interface {
+	// Authorize returns an error wrapping ErrUnauthorized or ErrForbidden if the request may not retrieve the root,
+	// or any directory the path resolves through
+	Authorize(r *http.Request, root cid.Cid, path stargate.PathSegments) (Grant, error)
+}
+
+// WithAuthorizer checks every request with the given Authorizer. Without one, all roots are public
+func WithAuthorizer(authorizer Authorizer) Option {
+	return func(h *Handler) {
+		h.authorizer = authorizer
+	}
+}
+
+// authorize checks that a request may retrieve a path under a root, writing an error response and returning false if
+// not
+func (h *Handler) authorize(w http.ResponseWriter, r *http.Request, root cid.Cid, path stargate.PathSegments) (Grant, bool) {
+	if h.authorizer == nil {
+		return Grant{}, true
+	}
+	grant, err := h.authorizer.Authorize(r, root, path)
+	switch {
+	case err == nil:
+		accessLogEntry(r).Token = grant.TokenID
+		return grant, true
+	case errors.Is(err, ErrUnauthorized):
+		w.Header().Set("WWW-Authenticate", `Bearer realm="stargate"`)
+		writeError(w, r, http.StatusUnauthorized, err.Error())
+	case errors.Is(err, ErrForbidden):
+		writeError(w, r, http.StatusForbidden, err.Error())
+	default:
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+	}
+	return Grant{}, false
+}
+
+// withoutAccessParams returns a copy of the values without the parameters of a signed URL
+func withoutAccessParams(values url.Values) url.Values {
+	stripped := make(url.Values, len(values))
+	for key, value := range values {
+		stripped[key] = value
+	}
+	for _, param := range accessParams {
+		delete(stripped, param)
+	}
+	return stripped
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/stretchr/testify/require"
+)
+
+// staticAuthorizer answers every request the same way
+type staticAuthorizer struct {
+	grant Grant
+	err   error
+}
+
+func (sa staticAuthorizer) Authorize(r *http.Request, root cid.Cid, path stargate.PathSegments) (Grant, error) {
+	return sa.grant, sa.err
+}
+
+// privateDirAuthorizer refuses requests for paths through a private directory under a public root
+type privateDirAuthorizer struct {
+	dir string
+}
+
+func (pa privateDirAuthorizer) Authorize(r *http.Request, root cid.Cid, path stargate.PathSegments) (Grant, error) {
+	for _, segment := range path {
+		if segment == pa.dir {
+			return Grant{}, ErrUnauthorized
+		}
+	}
+	return Grant{}, nil
+}
+
+func TestAuthorization(t *testing.T) {
+	root := cid.MustParse("bafybeiesvqd2m3zrbdzbzqgolzgpvz3zdsvmwma2gwjihya44systqf3my")
+	target := "/ipfs/" + root.String() + "?" + QueryToken + "=apples&" + QueryExpires + "=1&" + QuerySignature + "=sig"
+
+	testCases := []struct {
+		name           string
+		authorizer     staticAuthorizer
+		expectedStatus int
+	}{
+		{"unauthorized", staticAuthorizer{err: ErrUnauthorized}, http.StatusUnauthorized},
+		{"forbidden", staticAuthorizer{err: ErrForbidden}, http.StatusForbidden},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			logger := &recordingLogger{}
+			h := NewHandler("ipfs", failingAppResolver{t}, WithAuthorizer(testCase.authorizer), WithAccessLogger(logger))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+			require.Equal(t, testCase.expectedStatus, w.Code)
+			require.Empty(t, w.Header().Get("Cache-Control"))
+			if testCase.expectedStatus == http.StatusUnauthorized {
+				require.Equal(t, `Bearer realm="stargate"`, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	// private responses are only cached by the client, and signed URL parameters are not part of the query
+	logger := &recordingLogger{}
+	h := NewHandler("ipfs", failingAppResolver{t}, WithAuthorizer(staticAuthorizer{grant: Grant{Private: true, TokenID: "apples"}}), WithAccessLogger(logger))
+	etag := entityTag(root, stargate.PathSegments{}, stargate.Query{}, FormatStarGate, "")
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("If-None-Match", etag)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusNotModified, w.Code)
+	require.Equal(t, privateCacheControl, w.Header().Get("Cache-Control"))
+	require.Equal(t, "apples", logger.entries[0].Token)
+
+	// a private directory can't be reached through the public root containing it
+	h = NewHandler("ipfs", failingAppResolver{t}, WithAuthorizer(privateDirAuthorizer{dir: "private"}))
+	for _, target := range []string{"/ipfs/" + root.String() + "/private", "/ipfs/" + root.String() + "/private/file"} {
+		for _, accept := range []string{"", "*/*"} {
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+			r.Header.Set("Accept", accept)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			require.Equal(t, http.StatusUnauthorized, w.Code, "%s with Accept %q", target, accept)
+		}
+	}
+	public := "/ipfs/" + root.String() + "/public"
+	r = httptest.NewRequest(http.MethodGet, public, nil)
+	r.Header.Set("If-None-Match", entityTag(root, stargate.PathSegments{"public"}, stargate.Query{}, FormatStarGate, ""))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusNotModified, w.Code)
+}
@@ -0,0 +1,203 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+	stargate "github.com/ipfs/stargate/pkg"
+)
+
+// AccessLogEntry describes a completed request
+type AccessLogEntry struct {
+	Time     time.Time     `json:"time"`
+	App      string        `json:"app"`
+	Method   string        `json:"method"`
+	Root     string        `json:"root,omitempty"`
+	Path     string        `json:"path,omitempty"`
+	Query    string        `json:"query,omitempty"`
+	Format   string        `json:"format,omitempty"`
+	Status   int           `json:"status"`
+	Bytes    uint64        `json:"bytes"`
+	Blocks   *BlockCounts  `json:"blocks,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Client   string        `json:"client"`
+	Token    string        `json:"token,omitempty"`
+	Cached   bool          `json:"cached,omitempty"`
+	Gzipped  bool          `json:"gzipped,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// BlockCounts are the number of blocks listed in a response, by status
+type BlockCounts struct {
+	Present   int64 `json:"present"`
+	NotSent   int64 `json:"notSent"`
+	Missing   int64 `json:"missing"`
+	Duplicate int64 `json:"duplicate"`
+}
+
+func blockCounts(summary *stargate.Summary) *BlockCounts {
+	return &BlockCounts{
+		Present:   summary.Present,
+		NotSent:   summary.NotSent,
+		Missing:   summary.Missing,
+		Duplicate: summary.Duplicate,
+	}
+}
+
+// AccessLogger records completed requests
+type AccessLogger interface {
+	LogAccess(entry *AccessLogEntry)
+}
+
+// WithAccessLogger sends an entry for each request to the given logger, rather than printing colored lines to
+// stdout
+func WithAccessLogger(logger AccessLogger) Option {
+	return func(h *Handler) {
+		h.accessLogger = logger
+	}
+}
+
+type accessLogKey struct{}
+
+// accessLogEntry returns the entry for the request being served, for handlers to add details to
+func accessLogEntry(r *http.Request) *AccessLogEntry {
+	if entry, ok := r.Context().Value(accessLogKey{}).(*AccessLogEntry); ok {
+		return entry
+	}
+	// not logged
+	return &AccessLogEntry{}
+}
+
+func withAccessLogEntry(r *http.Request, entry *AccessLogEntry) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry))
+}
+
+// writerLogger serializes writes of formatted entries to a sink
+type writerLogger struct {
+	lk     sync.Mutex
+	w      io.Writer
+	format func(entry *AccessLogEntry) []byte
+}
+
+func (wl *writerLogger) LogAccess(entry *AccessLogEntry) {
+	line := wl.format(entry)
+	wl.lk.Lock()
+	defer wl.lk.Unlock()
+	_, _ = wl.w.Write(line)
+}
+
+// NewJSONAccessLogger writes each entry to w as a line of JSON, with durations in seconds
+func NewJSONAccessLogger(w io.Writer) AccessLogger {
+	return &writerLogger{w: w, format: func(entry *AccessLogEntry) []byte {
+		type jsonEntry AccessLogEntry
+		line, err := json.Marshal(struct {
+			*jsonEntry
+			Duration float64 `json:"duration"`
+		}{(*jsonEntry)(entry), entry.Duration.Seconds()})
+		if err != nil {
+			// an entry is only strings and numbers, so this cannot happen
+			panic(err)
+		}
+		return append(line, '\n')
+	}}
+}
+
+// NewLogfmtAccessLogger writes each entry to w as a line of logfmt key=value pairs, with durations in seconds
+func NewLogfmtAccessLogger(w io.Writer) AccessLogger {
+	return &writerLogger{w: w, format: func(entry *AccessLogEntry) []byte {
+		var sb strings.Builder
+		field := func(key string, value string) {
+			if sb.Len() > 0 {
+				sb.WriteByte(' ')
+			}
+			sb.WriteString(key)
+			sb.WriteByte('=')
+			if value == "" || strings.ContainsAny(value, " =\"\\\t\n") {
+				value = strconv.Quote(value)
+			}
+			sb.WriteString(value)
+		}
+		field("time", entry.Time.Format(time.RFC3339Nano))
+		field("app", entry.App)
+		field("method", entry.Method)
+		field("root", entry.Root)
+		field("path", entry.Path)
+		field("query", entry.Query)
+		field("format", entry.Format)
+		field("status", strconv.Itoa(entry.Status))
+		field("bytes", strconv.FormatUint(entry.Bytes, 10))
+		if entry.Blocks != nil {
+			field("blocks_present", strconv.FormatInt(entry.Blocks.Present, 10))
+			field("blocks_not_sent", strconv.FormatInt(entry.Blocks.NotSent, 10))
+			field("blocks_missing", strconv.FormatInt(entry.Blocks.Missing, 10))
+			field("blocks_duplicate", strconv.FormatInt(entry.Blocks.Duplicate, 10))
+		}
+		field("duration", strconv.FormatFloat(entry.Duration.Seconds(), 'f', -1, 64))
+		field("client", entry.Client)
+		if entry.Token != "" {
+			field("token", entry.Token)
+		}
+		field("cached", strconv.FormatBool(entry.Cached))
+		field("gzipped", strconv.FormatBool(entry.Gzipped))
+		if entry.Error != "" {
+			field("error", entry.Error)
+		}
+		sb.WriteByte('\n')
+		return []byte(sb.String())
+	}}
+}
+
+const timeFmt = "2006-01-02T15:04:05.000Z0700"
+
+// NewColorAccessLogger writes human readable, colored entries to w, for interactive use
+func NewColorAccessLogger(w io.Writer) AccessLogger {
+	return &writerLogger{w: w, format: func(entry *AccessLogEntry) []byte {
+		end := entry.Time.Add(entry.Duration)
+		statusColor := color.FgGreen
+		switch {
+		case entry.Status >= http.StatusInternalServerError:
+			statusColor = color.FgRed
+		case entry.Status >= http.StatusBadRequest:
+			statusColor = color.FgYellow
+		}
+		uri := "/" + entry.App + "/" + entry.Root
+		if entry.Path != "" {
+			uri += "/" + entry.Path
+		}
+		if entry.Query != "" {
+			uri += "?" + entry.Query
+		}
+		line := fmt.Sprintf("%s\t%s\t%s %s\n%s - %s: %s / %s bytes transferred",
+			end.Format(timeFmt), color.New(statusColor).Sprintf("%d", entry.Status), entry.Method, uri,
+			entry.Time.Format(timeFmt), end.Format(timeFmt), entry.Duration, addCommas(entry.Bytes))
+		if entry.Cached {
+			line += " (cached)"
+		}
+		if entry.Gzipped {
+			line += " (gzipped)"
+		}
+		if entry.Token != "" {
+			line += " (token " + entry.Token + ")"
+		}
+		if entry.Error != "" {
+			line += "\n" + color.New(color.FgRed).Sprint(entry.Error)
+		}
+		return []byte(line + "\n")
+	}}
+}
+
+func addCommas(count uint64) string {
+	str := fmt.Sprintf("%d", count)
+	for i := len(str) - 3; i > 0; i -= 3 {
+		str = str[:i] + "," + str[i:]
+	}
+	return str
+}
@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	entry := &AccessLogEntry{
+		Time:     time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+		App:      "ipfs",
+		Method:   "GET",
+		Root:     "bafybeiesvqd2m3zrbdzbzqgolzgpvz3zdsvmwma2gwjihya44systqf3my",
+		Path:     "a b/c",
+		Query:    "bytes=0-10",
+		Format:   FormatStarGate,
+		Status:   200,
+		Bytes:    1234,
+		Blocks:   &BlockCounts{Present: 3, Duplicate: 1},
+		Duration: 1500 * time.Millisecond,
+		Client:   "127.0.0.1:1234",
+	}
+
+	buf := &bytes.Buffer{}
+	NewJSONAccessLogger(buf).LogAccess(entry)
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	require.Equal(t, 1.5, decoded["duration"])
+	require.Equal(t, "a b/c", decoded["path"])
+	require.Equal(t, 200.0, decoded["status"])
+	require.Equal(t, map[string]interface{}{"present": 3.0, "notSent": 0.0, "missing": 0.0, "duplicate": 1.0}, decoded["blocks"])
+	require.NotContains(t, decoded, "error")
+
+	buf.Reset()
+	NewLogfmtAccessLogger(buf).LogAccess(entry)
+	require.Equal(t, `time=2023-01-02T03:04:05Z app=ipfs method=GET root=bafybeiesvqd2m3zrbdzbzqgolzgpvz3zdsvmwma2gwjihya44systqf3my path="a b/c" query="bytes=0-10" format=stargate status=200 bytes=1234 blocks_present=3 blocks_not_sent=0 blocks_missing=0 blocks_duplicate=1 duration=1.5 client=127.0.0.1:1234 cached=false gzipped=false`+"\n", buf.String())
+}
+
+// recordingLogger keeps the entries it is sent
+type recordingLogger struct {
+	entries []*AccessLogEntry
+}
+
+func (rl *recordingLogger) LogAccess(entry *AccessLogEntry) {
+	rl.entries = append(rl.entries, entry)
+}
+
+func TestAccessLogEntries(t *testing.T) {
+	logger := &recordingLogger{}
+	h := NewHandler("ipfs", failingAppResolver{t}, WithAccessLogger(logger))
+
+	r := httptest.NewRequest(http.MethodGet, "/ipfs/nope/path?proof", nil)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	require.Len(t, logger.entries, 1)
+	entry := logger.entries[0]
+	require.Equal(t, http.StatusBadRequest, entry.Status)
+	require.Equal(t, "ipfs", entry.App)
+	require.Equal(t, "proof=", entry.Query)
+	require.Equal(t, r.RemoteAddr, entry.Client)
+	require.Contains(t, entry.Error, "parsing  CID 'nope'")
+	require.Equal(t, uint64(len("Error: "+entry.Error)), entry.Bytes)
+
+	target := "/ipfs/bafybeiesvqd2m3zrbdzbzqgolzgpvz3zdsvmwma2gwjihya44systqf3my/file"
+	r = httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("If-None-Match", "*")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	require.Len(t, logger.entries, 2)
+	entry = logger.entries[1]
+	require.Equal(t, http.StatusNotModified, entry.Status)
+	require.Equal(t, "bafybeiesvqd2m3zrbdzbzqgolzgpvz3zdsvmwma2gwjihya44systqf3my", entry.Root)
+	require.Equal(t, "file", entry.Path)
+	require.Equal(t, FormatStarGate, entry.Format)
+	require.Empty(t, entry.Error)
+
+	// signed URL parameters are not logged
+	r = httptest.NewRequest(http.MethodGet, target+"?"+QueryToken+"=apples&"+QueryExpires+"=1&"+QuerySignature+"=sig&bytes=0-10", nil)
+	r.Header.Set("If-None-Match", "*")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	require.Len(t, logger.entries, 3)
+	require.Equal(t, "bytes=0-10", logger.entries[2].Query)
+}
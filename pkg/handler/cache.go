@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tempPrefix marks responses still being written in a cache directory
+const tempPrefix = "tmp-"
+
+// ResponseCache keeps complete StarGate responses on disk so repeated identical queries are served without
+// resolving them again. Responses are immutable, so entries never go stale -- once the cache is over its size
+// budget, the least recently used are evicted.
+type ResponseCache struct {
+	dir     string
+	maxSize int64
+
+	lk      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+
+	hits   uint64
+	misses uint64
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// CacheStats are counters describing the use of a ResponseCache
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int
+	Size    int64
+}
+
+// NewResponseCache opens a response cache in the given directory, which is created if needed, keeping at most
+// maxSize bytes of responses. Responses left in the directory by a previous run are kept, oldest first in line for
+// eviction.
+func NewResponseCache(dir string, maxSize int64) (*ResponseCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating cache directory: %w", err)
+	}
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading cache directory: %w", err)
+	}
+	rc := &ResponseCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	existing := make([]os.FileInfo, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(dirEntry.Name(), tempPrefix) {
+			// an incomplete response
+			_ = os.Remove(filepath.Join(dir, dirEntry.Name()))
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("reading cache directory: %w", err)
+		}
+		existing = append(existing, info)
+	}
+	sort.Slice(existing, func(i, j int) bool {
+		return existing[i].ModTime().Before(existing[j].ModTime())
+	})
+	rc.lk.Lock()
+	defer rc.lk.Unlock()
+	for _, info := range existing {
+		rc.entries[info.Name()] = rc.lru.PushFront(&cacheEntry{key: info.Name(), size: info.Size()})
+		rc.size += info.Size()
+	}
+	rc.evict()
+	return rc, nil
+}
+
+// Get opens the response cached under the given key, if present. The caller must close it
+func (rc *ResponseCache) Get(key string) (*os.File, bool) {
+	rc.lk.Lock()
+	defer rc.lk.Unlock()
+	elem, ok := rc.entries[key]
+	if !ok {
+		atomic.AddUint64(&rc.misses, 1)
+		return nil, false
+	}
+	// once open, the file remains readable even if evicted
+	file, err := os.Open(filepath.Join(rc.dir, key))
+	if err != nil {
+		rc.remove(elem)
+		atomic.AddUint64(&rc.misses, 1)
+		return nil, false
+	}
+	rc.lru.MoveToFront(elem)
+	atomic.AddUint64(&rc.hits, 1)
+	return file, true
+}
+
+// CreateTemp creates a file to write a response into, that can be added to the cache with Put
+func (rc *ResponseCache) CreateTemp(name string) (*os.File, error) {
+	return os.CreateTemp(rc.dir, tempPrefix+name+"-")
+}
+
+// Put adds a complete response, written to a file from CreateTemp, to the cache under the given key. The file is
+// linked into the cache, so the caller still removes the file it created. Responses larger than the whole cache
+// are not kept.
+func (rc *ResponseCache) Put(key string, file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > rc.maxSize {
+		return nil
+	}
+	rc.lk.Lock()
+	defer rc.lk.Unlock()
+	if _, ok := rc.entries[key]; ok {
+		return nil
+	}
+	if err := os.Link(file.Name(), filepath.Join(rc.dir, key)); err != nil {
+		return fmt.Errorf("adding response to cache: %w", err)
+	}
+	rc.entries[key] = rc.lru.PushFront(&cacheEntry{key: key, size: info.Size()})
+	rc.size += info.Size()
+	rc.evict()
+	return nil
+}
+
+// Stats returns the current counters for the cache
+func (rc *ResponseCache) Stats() CacheStats {
+	rc.lk.Lock()
+	defer rc.lk.Unlock()
+	return CacheStats{
+		Hits:    atomic.LoadUint64(&rc.hits),
+		Misses:  atomic.LoadUint64(&rc.misses),
+		Entries: len(rc.entries),
+		Size:    rc.size,
+	}
+}
+
+// evict removes least recently used responses until the cache is within its budget. It must be called with the
+// lock held
+func (rc *ResponseCache) evict() {
+	for rc.size > rc.maxSize {
+		rc.remove(rc.lru.Back())
+	}
+}
+
+func (rc *ResponseCache) remove(elem *list.Element) {
+	entry := rc.lru.Remove(elem).(*cacheEntry)
+	delete(rc.entries, entry.key)
+	rc.size -= entry.size
+	_ = os.Remove(filepath.Join(rc.dir, entry.key))
+}
+
+// Collectors returns Prometheus collectors reporting the cache's hits, misses and size
+func (rc *ResponseCache) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "stargate",
+			Name:      "response_cache_hits_total",
+			Help:      "Requests served from the response cache",
+		}, func() float64 { return float64(rc.Stats().Hits) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "stargate",
+			Name:      "response_cache_misses_total",
+			Help:      "Cacheable requests not found in the response cache",
+		}, func() float64 { return float64(rc.Stats().Misses) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "stargate",
+			Name:      "response_cache_entries",
+			Help:      "Responses in the response cache",
+		}, func() float64 { return float64(rc.Stats().Entries) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "stargate",
+			Name:      "response_cache_bytes",
+			Help:      "Size of the responses in the response cache",
+		}, func() float64 { return float64(rc.Stats().Size) }),
+	}
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseCache(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+	cache, err := NewResponseCache(dir, 250)
+	req.NoError(err)
+
+	put := func(key string, size int) {
+		file, err := cache.CreateTemp("test")
+		req.NoError(err)
+		defer func() {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}()
+		_, err = file.WriteString(strings.Repeat(key, size))
+		req.NoError(err)
+		req.NoError(cache.Put(key, file))
+	}
+	get := func(key string) (string, bool) {
+		file, ok := cache.Get(key)
+		if !ok {
+			return "", false
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		req.NoError(err)
+		return string(data), true
+	}
+
+	_, ok := get("a")
+	req.False(ok)
+	put("a", 100)
+	put("b", 100)
+	data, ok := get("a")
+	req.True(ok)
+	req.Equal(strings.Repeat("a", 100), data)
+
+	// b is least recently used, so is evicted to make room for c
+	put("c", 100)
+	_, ok = get("b")
+	req.False(ok)
+	_, ok = get("a")
+	req.True(ok)
+	_, ok = get("c")
+	req.True(ok)
+
+	// responses larger than the cache are not kept
+	put("d", 300)
+	_, ok = get("d")
+	req.False(ok)
+
+	req.Equal(CacheStats{Hits: 3, Misses: 3, Entries: 2, Size: 200}, cache.Stats())
+
+	// cached responses survive a restart, while incomplete ones are removed
+	incomplete, err := cache.CreateTemp("test")
+	req.NoError(err)
+	req.NoError(incomplete.Close())
+	reopened, err := NewResponseCache(dir, 250)
+	req.NoError(err)
+	req.Equal(CacheStats{Entries: 2, Size: 200}, reopened.Stats())
+	_, err = os.Stat(incomplete.Name())
+	req.True(os.IsNotExist(err))
+}
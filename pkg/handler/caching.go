@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	stargate "github.com/ipfs/stargate/pkg"
+)
+
+// immutableCacheControl is sent with successful responses. Responses are addressed by CID, so their content never
+// changes and can be cached for as long as a cache is willing to keep it
+const immutableCacheControl = "public, max-age=29030400, immutable"
+
+// privateCacheControl is sent with successful responses for private roots, which only the client may keep
+const privateCacheControl = "private, max-age=29030400, immutable"
+
+// entityTag returns a strong entity tag for a response, derived from everything that determines its content:
+// the root CID, the path, the query, the representation sent and the content coding it is sent with, if any
+func entityTag(root cid.Cid, pathSegments stargate.PathSegments, query stargate.Query, representation string, coding string) string {
+	key := url.Values{
+		"root":           []string{root.String()},
+		"path":           pathSegments,
+		"query":          []string{url.Values(query).Encode()},
+		"representation": []string{representation},
+	}
+	// responses sent without a coding keep the tags they had before codings were distinguished
+	if coding != "" {
+		key.Set("coding", coding)
+	}
+	sum := sha256.Sum256([]byte(key.Encode()))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// acceptsGzip reports whether a client accepts responses compressed with gzip
+func acceptsGzip(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+}
+
+// contentCoding returns the content coding a response in a representation is sent with: gzip for StarGate responses
+// to clients accepting it, and none otherwise
+func contentCoding(r *http.Request, representation string) string {
+	if representation == FormatStarGate && acceptsGzip(r) {
+		return "gzip"
+	}
+	return ""
+}
+
+// noneMatch reports whether an If-None-Match header matches the given entity tag. As required for If-None-Match,
+// the comparison is weak, so weak forms of the tag also match
+func noneMatch(header string, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeApplies reports whether a Range header applies to a response, given its If-Range header and the entity tag of
+// the full representation. As required for If-Range, the comparison is strong, so weak tags never match. Responses
+// carry no modification date, so neither do dates
+func rangeApplies(ifRange string, etag string) bool {
+	return ifRange == "" || strings.TrimSpace(ifRange) == etag
+}
+
+// setCacheHeaders marks a response as cacheable with the given entity tag, only by the client if it is private
+func setCacheHeaders(w http.ResponseWriter, etag string, private bool) {
+	w.Header().Set("Etag", etag)
+	if private {
+		w.Header().Set("Cache-Control", privateCacheControl)
+		return
+	}
+	w.Header().Set("Cache-Control", immutableCacheControl)
+}
+
+// clearCacheHeaders removes cache headers from a response, so failures are not cached
+func clearCacheHeaders(w http.ResponseWriter) {
+	w.Header().Del("Etag")
+	w.Header().Del("Cache-Control")
+}
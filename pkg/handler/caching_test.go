@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEntityTag(t *testing.T) {
+	root := cid.MustParse("bafybeiesvqd2m3zrbdzbzqgolzgpvz3zdsvmwma2gwjihya44systqf3my")
+	other := cid.MustParse("bafybeic5sjwqhszguixjsinb7dmxllhnkpph6kbhnwujmpwghaq6zdfdqe")
+	base := entityTag(root, stargate.PathSegments{"a", "b"}, stargate.Query{"bytes": {"0-10"}}, FormatStarGate, "")
+	require.Equal(t, base, entityTag(root, stargate.PathSegments{"a", "b"}, stargate.Query{"bytes": {"0-10"}}, FormatStarGate, ""))
+	for _, different := range []string{
+		entityTag(other, stargate.PathSegments{"a", "b"}, stargate.Query{"bytes": {"0-10"}}, FormatStarGate, ""),
+		entityTag(root, stargate.PathSegments{"a/b"}, stargate.Query{"bytes": {"0-10"}}, FormatStarGate, ""),
+		entityTag(root, stargate.PathSegments{"a", "b"}, stargate.Query{"bytes": {"0-11"}}, FormatStarGate, ""),
+		entityTag(root, stargate.PathSegments{"a", "b"}, stargate.Query{"bytes": {"0-10"}, "compact": {""}}, FormatStarGate, ""),
+		entityTag(root, stargate.PathSegments{"a", "b"}, stargate.Query{"bytes": {"0-10"}}, FormatDeserialized, ""),
+		entityTag(root, stargate.PathSegments{"a", "b"}, stargate.Query{"bytes": {"0-10"}}, FormatStarGate, "gzip"),
+	} {
+		require.NotEqual(t, base, different)
+	}
+	require.True(t, noneMatch(base, base))
+	require.True(t, noneMatch(`"other", W/`+base, base))
+	require.True(t, noneMatch("*", base))
+	require.False(t, noneMatch(`"other"`, base))
+	require.False(t, noneMatch("", base))
+}
+
+// failingAppResolver fails the test if any resolution is attempted
+type failingAppResolver struct {
+	t *testing.T
+}
+
+func (far failingAppResolver) GetResolver(ctx context.Context, root cid.Cid) (*ipld.LinkSystem, stargate.PathResolver, error) {
+	far.t.Fatal("unexpected resolution")
+	return nil, nil, nil
+}
+
+func TestNotModified(t *testing.T) {
+	h := NewHandler("ipfs", failingAppResolver{t})
+	target := "/ipfs/bafybeiesvqd2m3zrbdzbzqgolzgpvz3zdsvmwma2gwjihya44systqf3my/file?maxblocks=10"
+	root := cid.MustParse("bafybeiesvqd2m3zrbdzbzqgolzgpvz3zdsvmwma2gwjihya44systqf3my")
+	etag := entityTag(root, stargate.PathSegments{"file"}, stargate.Query{"maxblocks": {"10"}, "bytes": {"0-100"}}, FormatStarGate, "")
+
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	r.Header.Set("Range", "bytes=0-99")
+	r.Header.Set("If-None-Match", etag)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusNotModified, w.Code)
+	require.Equal(t, etag, w.Header().Get("Etag"))
+	require.Equal(t, immutableCacheControl, w.Header().Get("Cache-Control"))
+	require.Equal(t, []string{"Accept", "Accept-Encoding"}, w.Header().Values("Vary"))
+
+	// the gzipped response is a different representation, with its own tag
+	gzipEtag := entityTag(root, stargate.PathSegments{"file"}, stargate.Query{"maxblocks": {"10"}, "bytes": {"0-100"}}, FormatStarGate, "gzip")
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("If-None-Match", gzipEtag)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal(t, http.StatusNotModified, w.Code)
+	require.Equal(t, gzipEtag, w.Header().Get("Etag"))
+
+	// a range conditional on the representation served applies, and one conditional on another is ignored
+	fullEtag := entityTag(root, stargate.PathSegments{"file"}, stargate.Query{"maxblocks": {"10"}}, FormatStarGate, "")
+	for _, testCase := range []struct {
+		ifRange  string
+		expected string
+	}{
+		{fullEtag, etag},
+		{`"other"`, fullEtag},
+		{"W/" + fullEtag, fullEtag},
+		{"Wed, 21 Oct 2015 07:28:00 GMT", fullEtag},
+	} {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Range", "bytes=0-99")
+		r.Header.Set("If-Range", testCase.ifRange)
+		r.Header.Set("If-None-Match", testCase.expected)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		require.Equal(t, http.StatusNotModified, w.Code, "If-Range %s", testCase.ifRange)
+		require.Equal(t, testCase.expected, w.Header().Get("Etag"))
+	}
+}
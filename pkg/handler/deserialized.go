@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	stargate "github.com/ipfs/stargate/pkg"
+)
+
+// QueryFormat is the query parameter selecting the response format, overriding the Accept header
+const QueryFormat = "format"
+
+const (
+	// FormatStarGate selects a StarGate response
+	FormatStarGate = "stargate"
+	// FormatDeserialized selects the content itself -- the bytes of a file, or a listing of a directory
+	FormatDeserialized = "deserialized"
+)
+
+// wantsDeserialized decides whether a request is for the content itself rather than a StarGate response. Absent
+// a format parameter, requests that accept HTML or JSON but not StarGate responses, such as those from web
+// browsers, receive the content itself, as do requests accepting just */*, such as those from curl and wget
+func wantsDeserialized(r *http.Request) (bool, error) {
+	if format := r.URL.Query().Get(QueryFormat); format != "" {
+		switch format {
+		case FormatStarGate:
+			return false, nil
+		case FormatDeserialized:
+			return true, nil
+		default:
+			return false, fmt.Errorf("unknown format '%s'", format)
+		}
+	}
+	accepts := acceptedTypes(r)
+	if accepts[ContentType] {
+		return false, nil
+	}
+	anything := len(accepts) == 1 && accepts["*/*"]
+	return anything || accepts["text/html"] || accepts["application/json"], nil
+}
+
+// acceptedTypes returns the media types in the Accept header, ignoring their parameters
+func acceptedTypes(r *http.Request) map[string]bool {
+	accepts := make(map[string]bool)
+	for _, header := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(header, ",") {
+			mediaType, _, err := mime.ParseMediaType(mediaRange)
+			if err == nil {
+				accepts[mediaType] = true
+			}
+		}
+	}
+	return accepts
+}
+
+// listingJSON decides whether a directory listing is sent as JSON rather than HTML
+func listingJSON(r *http.Request) bool {
+	accepts := acceptedTypes(r)
+	return accepts["application/json"] && !accepts["text/html"]
+}
+
+// serveDeserialized resolves the path and sends the content at the end of it
+func (h *Handler) serveDeserialized(w http.ResponseWriter, r *http.Request, root cid.Cid, pathSegments stargate.PathSegments) {
+	// ignore empty segments, as from the trailing slash on a directory URL
+	segments := make(stargate.PathSegments, 0, len(pathSegments))
+	for _, segment := range pathSegments {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	_, resolver, err := h.appResolver.GetResolver(r.Context(), root)
+	for err == nil && len(segments) != 0 {
+		_, segments, resolver, err = resolver.ResolvePathSegments(r.Context(), segments)
+	}
+	var content *stargate.Deserialized
+	if err == nil {
+		deserializer, ok := resolver.(stargate.Deserializer)
+		if !ok {
+			writeError(w, r, http.StatusNotAcceptable, "content cannot be deserialized")
+			return
+		}
+		content, err = deserializer.Deserialize(r.Context())
+	}
+	if err != nil {
+		var errNotFound stargate.ErrNotFound
+		var errPathError stargate.ErrPathError
+		if errors.As(err, &errNotFound) || errors.As(err, &errPathError) {
+			writeError(w, r, http.StatusNotFound, err.Error())
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if content.Directory != nil {
+		serveDirectory(w, r, content.Directory)
+		return
+	}
+	serveFile(w, r, content.File)
+}
+
+// serveFile sends the bytes of a file. http.ServeContent sets the content type from the name or by sniffing, and
+// handles range requests, which load only the blocks holding the requested bytes
+func serveFile(w http.ResponseWriter, r *http.Request, file io.ReadSeeker) {
+	entry := accessLogEntry(r)
+	writeErrWatcher := &writeErrorWatcher{ResponseWriter: w, onError: func(e error) {
+		entry.Error = e.Error()
+	}}
+	name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	http.ServeContent(writeErrWatcher, r, name, time.Time{}, file)
+}
+
+// directoryListing is an entry in a JSON directory listing
+type directoryListing struct {
+	Name        string `json:"name"`
+	Cid         string `json:"cid"`
+	IsDirectory bool   `json:"directory"`
+}
+
+var directoryTemplate = template.Must(template.New("directory").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Path}}</title></head>
+<body>
+<h1>{{.Path}}</h1>
+<ul>
+{{if .Parent}}<li><a href="{{.Parent}}">..</a></li>
+{{end}}`))
+
+var entryTemplate = template.Must(template.New("entry").Parse(`<li><a href="{{.Href}}">{{.Name}}{{if .IsDirectory}}/{{end}}</a> <small>{{.Cid}}</small></li>
+`))
+
+const directoryFooter = "</ul>\n</body>\n</html>\n"
+
+// serveDirectory streams a listing of a directory, as JSON if requested, otherwise HTML
+func serveDirectory(w http.ResponseWriter, r *http.Request, entries stargate.DirectoryIterator) {
+	asJSON := listingJSON(r)
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	var err error
+	if asJSON {
+		err = writeJSONListing(w, entries)
+	} else {
+		err = writeHTMLListing(w, r.URL, entries)
+	}
+	if err != nil {
+		accessLogEntry(r).Error = err.Error()
+	}
+}
+
+func writeJSONListing(w io.Writer, entries stargate.DirectoryIterator) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for first := true; !entries.Done(); first = false {
+		entry, err := entries.Next()
+		if err != nil {
+			return err
+		}
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		bz, err := json.Marshal(directoryListing{Name: entry.Name, Cid: entry.Link.String(), IsDirectory: entry.IsDirectory})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(bz); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]\n")
+	return err
+}
+
+func writeHTMLListing(w io.Writer, u *url.URL, entries stargate.DirectoryIterator) error {
+	dirPath := strings.TrimSuffix(u.Path, "/")
+	// links keep the requested format, if one was set, and the signature of a signed URL
+	var suffix string
+	kept := url.Values{}
+	for _, param := range append([]string{QueryFormat}, accessParams...) {
+		if value := u.Query().Get(param); value != "" {
+			kept.Set(param, value)
+		}
+	}
+	if len(kept) > 0 {
+		suffix = "?" + kept.Encode()
+	}
+	var parent string
+	if strings.Count(dirPath, "/") > 2 {
+		// below the root CID
+		parent = dirPath[:strings.LastIndex(dirPath, "/")] + "/" + suffix
+	}
+	err := directoryTemplate.Execute(w, struct {
+		Path   string
+		Parent string
+	}{dirPath, parent})
+	if err != nil {
+		return err
+	}
+	for !entries.Done() {
+		entry, err := entries.Next()
+		if err != nil {
+			return err
+		}
+		err = entryTemplate.Execute(w, struct {
+			Href        string
+			Name        string
+			IsDirectory bool
+			Cid         string
+		}{dirPath + "/" + url.PathEscape(entry.Name) + suffix, entry.Name, entry.IsDirectory, entry.Link.String()})
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, directoryFooter)
+	return err
+}
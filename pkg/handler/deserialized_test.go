@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWantsDeserialized(t *testing.T) {
+	testCases := []struct {
+		name     string
+		target   string
+		accept   string
+		expected bool
+		err      bool
+	}{
+		{name: "no accept", target: "/ipfs/cid"},
+		{name: "any", target: "/ipfs/cid", accept: "*/*", expected: true},
+		{name: "stargate or any", target: "/ipfs/cid", accept: ContentType + ", */*"},
+		{name: "browser", target: "/ipfs/cid", accept: "text/html,application/xhtml+xml,*/*;q=0.8", expected: true},
+		{name: "json", target: "/ipfs/cid", accept: "application/json", expected: true},
+		{name: "stargate", target: "/ipfs/cid", accept: ContentType + ", text/html", expected: false},
+		{name: "format deserialized", target: "/ipfs/cid?format=deserialized", expected: true},
+		{name: "format stargate", target: "/ipfs/cid?format=stargate", accept: "text/html"},
+		{name: "unknown format", target: "/ipfs/cid?format=tar", err: true},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", testCase.target, nil)
+			if testCase.accept != "" {
+				r.Header.Set("Accept", testCase.accept)
+			}
+			deserialized, err := wantsDeserialized(r)
+			if testCase.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, testCase.expected, deserialized)
+		})
+	}
+}
@@ -11,28 +11,65 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/NYTimes/gziphandler"
-	"github.com/fatih/color"
 	"github.com/ipfs/go-cid"
+	logging "github.com/ipfs/go-log/v2"
 	stargate "github.com/ipfs/stargate/pkg"
 	"github.com/ipfs/stargate/pkg/carwriter.go"
+	"github.com/ipfs/stargate/pkg/metrics"
+	"github.com/ipfs/stargate/pkg/tracing"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var log = logging.Logger("stargatehandler")
+
+// ContentType is the content type of a StarGate response
+const ContentType = "application/vnd.ipld.car+stargate"
+
+// QueryProof is the query parameter requesting that a missing path be answered with a proof of its absence
+// rather than a plain error
+const QueryProof = "proof"
+
+// MaxHavesSize is the largest request body accepted when a client sends the blocks it already has
+const MaxHavesSize = 32 << 20
+
 // Handler is a an HTTP Handler for a given StarGate AppResolver
 type Handler struct {
-	prefix      string
-	appResolver stargate.AppResolver
+	prefix       string
+	appResolver  stargate.AppResolver
+	cache        *ResponseCache
+	accessLogger AccessLogger
+	authorizer   Authorizer
+}
+
+// Option configures a Handler
+type Option func(*Handler)
+
+// WithResponseCache serves repeated identical queries from the given cache. A cache may be shared between handlers
+func WithResponseCache(cache *ResponseCache) Option {
+	return func(h *Handler) {
+		h.cache = cache
+	}
 }
 
 // NewHandler constructs an http Handler for given prefix + appResolver
-func NewHandler(prefix string, appResolver stargate.AppResolver) *Handler {
-	return &Handler{
-		prefix:      prefix,
-		appResolver: appResolver,
+func NewHandler(prefix string, appResolver stargate.AppResolver, options ...Option) *Handler {
+	h := &Handler{
+		prefix:       prefix,
+		appResolver:  appResolver,
+		accessLogger: NewColorAccessLogger(os.Stdout),
+	}
+	for _, option := range options {
+		option(h)
 	}
+	return h
 }
 
 var _ http.Handler = (*Handler)(nil)
@@ -40,7 +77,6 @@ var _ http.Handler = (*Handler)(nil)
 // writeErrorWatcher calls onError if there is an error writing to the writer
 type writeErrorWatcher struct {
 	http.ResponseWriter
-	count   uint64
 	onError func(err error)
 }
 
@@ -49,42 +85,28 @@ func (w *writeErrorWatcher) Write(bz []byte) (int, error) {
 	if err != nil {
 		w.onError(err)
 	}
-	w.count += uint64(count)
 	return count, err
 }
 
-const timeFmt = "2006-01-02T15:04:05.000Z0700"
-
-func alog(l string, args ...interface{}) {
-	alogAt(time.Now(), l, args...)
-}
-
-func alogAt(at time.Time, l string, args ...interface{}) {
-	fmt.Printf(at.Format(timeFmt)+"\t"+l+"\n", args...)
-}
-
 func serveContent(w http.ResponseWriter, r *http.Request, content io.ReadSeeker) {
 	// Set the Content-Type header explicitly so that http.ServeContent doesn't
 	// try to do it implicitly
-	w.Header().Set("Content-Type", "application/vnd.ipld.car+stargate")
+	w.Header().Set("Content-Type", ContentType)
+	// the response depends on the range requested
+	w.Header().Add("Vary", "Range")
 
 	var writer http.ResponseWriter
 
 	// http.ServeContent ignores errors when writing to the stream, so we
 	// replace the writer with a class that watches for errors
-	var err error
+	entry := accessLogEntry(r)
 	writeErrWatcher := &writeErrorWatcher{ResponseWriter: w, onError: func(e error) {
-		err = e
+		entry.Error = e.Error()
 	}}
+	writer = writeErrWatcher
 
-	writer = writeErrWatcher //Need writeErrWatcher to be of type writeErrorWatcher for addCommas()
-
-	// Note that the last modified time is a constant value because the data
-	// in a piece identified by a cid will never change.
-	start := time.Now()
-	alogAt(start, "%s\tGET %s", color.New(color.FgGreen).Sprintf("%d", http.StatusOK), r.URL)
-	isGzipped := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
-	if isGzipped {
+	entry.Gzipped = acceptsGzip(r)
+	if entry.Gzipped {
 		// If Accept-Encoding header contains gzip then send a gzipped response
 
 		gzwriter := gziphandler.GzipResponseWriter{
@@ -95,52 +117,99 @@ func serveContent(w http.ResponseWriter, r *http.Request, content io.ReadSeeker)
 		writer = &gzwriter
 	}
 
-	if r.Method == "HEAD" {
-		// For an HTTP HEAD request ServeContent doesn't send any data (just headers)
-		http.ServeContent(writer, r, "", time.Time{}, content)
-		alog("%s\tHEAD %s", color.New(color.FgGreen).Sprintf("%d", http.StatusOK), r.URL)
-		return
-	}
-
-	// Send the content
-	http.ServeContent(writer, r, "", lastModified, content)
+	// Send the content -- for an HTTP HEAD request ServeContent doesn't send any data (just headers)
+	http.ServeContent(writer, r, "", time.Time{}, content)
+}
 
-	// Write a line to the log
-	end := time.Now()
-	completeMsg := fmt.Sprintf("GET %s\n%s - %s: %s / %s bytes transferred",
-		r.URL, end.Format(timeFmt), start.Format(timeFmt), time.Since(start), addCommas(writeErrWatcher.count))
-	if isGzipped {
-		completeMsg += " (gzipped)"
+// serveProof sends a response proving a path does not exist, with a not found status
+func serveProof(w http.ResponseWriter, r *http.Request, content io.ReadSeeker, pathErr error) {
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "error reading response")
+		return
 	}
-	if err == nil {
-		alogAt(end, "%s\t%s", color.New(color.FgGreen).Sprint("DONE"), completeMsg)
-	} else {
-		alogAt(end, "%s\t%s\n%s",
-			color.New(color.FgRed).Sprint("FAIL"), completeMsg, err)
+	entry := accessLogEntry(r)
+	entry.Error = pathErr.Error() + " (proof sent)"
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(http.StatusNotFound)
+	if r.Method != "HEAD" {
+		if _, err := io.Copy(w, content); err != nil {
+			entry.Error = err.Error()
+		}
 	}
 }
 
 func writeError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	clearCacheHeaders(w)
 	w.WriteHeader(status)
 	w.Write([]byte("Error: " + msg)) //nolint:errcheck
-	alog("%s\tGET %s\n%s",
-		color.New(color.FgRed).Sprintf("%d", status), r.URL, msg)
+	accessLogEntry(r).Error = msg
 }
 
-// For data served by the endpoints in the HTTP server that never changes
-// (eg pieces identified by a piece CID) send a cache header with a constant,
-// non-zero last modified time.
-var lastModified = time.UnixMilli(1)
+// statusRecorder remembers the status and number of bytes sent in a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  uint64
+}
 
-func addCommas(count uint64) string {
-	str := fmt.Sprintf("%d", count)
-	for i := len(str) - 3; i > 0; i -= 3 {
-		str = str[:i] + "," + str[i:]
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
 	}
-	return str
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(bz []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	count, err := sr.ResponseWriter.Write(bz)
+	sr.bytes += uint64(count)
+	return count, err
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	// signed URL parameters are credentials, and are kept out of traces and logs
+	query := withoutAccessParams(r.URL.Query()).Encode()
+	target := r.URL.EscapedPath()
+	if query != "" {
+		target += "?" + query
+	}
+	// continue any trace the client started
+	ctx, span := tracing.StartSpan(tracing.Extract(r.Context(), r.Header), "StarGate "+r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", target),
+			attribute.String("stargate.app", h.prefix),
+		))
+	defer span.End()
+	entry := &AccessLogEntry{
+		Time:   start,
+		App:    h.prefix,
+		Method: r.Method,
+		Query:  query,
+		Client: r.RemoteAddr,
+	}
+	recorder := &statusRecorder{ResponseWriter: w}
+	h.serve(recorder, withAccessLogEntry(r.WithContext(ctx), entry))
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	entry.Status = recorder.status
+	entry.Bytes = recorder.bytes
+	entry.Duration = time.Since(start)
+	h.accessLogger.LogAccess(entry)
+	span.SetAttributes(attribute.Int("http.status_code", recorder.status))
+	if recorder.status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(recorder.status))
+	}
+	metrics.Requests.WithLabelValues(h.prefix, strconv.Itoa(recorder.status)).Inc()
+	metrics.Since(metrics.RequestDuration.WithLabelValues(h.prefix), start)
+}
+
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) {
 	// remove paths that are too short
 	if len(r.URL.Path) <= len(h.prefix)+1 {
 		msg := fmt.Sprintf("path '%s' is missing CID", r.URL.Path)
@@ -164,9 +233,85 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		writeError(w, r, http.StatusBadRequest, msg)
 		return
 	}
+	entry := accessLogEntry(r)
+	entry.Root = rootCid.String()
+	entry.Path = strings.Join(pathSegments, "/")
+	grant, ok := h.authorize(w, r, rootCid, pathSegments)
+	if !ok {
+		return
+	}
+	// browsers and other clients that want the content itself are sent it directly
+	deserialized, err := wantsDeserialized(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	// the response depends on the format accepted, and on whether it may be compressed
+	w.Header().Set("Vary", "Accept")
+	w.Header().Add("Vary", "Accept-Encoding")
+	query := stargate.Query(withoutAccessParams(r.URL.Query()))
+	representation := FormatStarGate
+	if deserialized {
+		representation = FormatDeserialized
+		if listingJSON(r) {
+			representation += "+json"
+		}
+	} else if byteRanges, ok := rangeParams(r.Header.Get("Range")); ok {
+		// a byte range header selects bytes of the requested file, unless it is conditional on another
+		// representation than the one served
+		fullEtag := entityTag(rootCid, pathSegments, query, representation, contentCoding(r, representation))
+		if rangeApplies(r.Header.Get("If-Range"), fullEtag) {
+			query["bytes"] = byteRanges
+		}
+	}
+	entry.Format = representation
+	// responses to POST requests depend on the haves in the body, so only other responses are cacheable
+	var etag string
+	if r.Method != http.MethodPost {
+		etag = entityTag(rootCid, pathSegments, query, representation, contentCoding(r, representation))
+		setCacheHeaders(w, etag, grant.Private)
+		if noneMatch(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	if deserialized {
+		h.serveDeserialized(w, r, rootCid, pathSegments)
+		return
+	}
+	// the range header is applied to the file, so it must not also slice the response
+	servedRequest := r
+	if r.Header.Get("Range") != "" {
+		servedRequest = r.Clone(r.Context())
+		servedRequest.Header.Del("Range")
+		servedRequest.Header.Del("If-Range")
+	}
+	// serve a cached copy of the response if there is one. Copies are kept uncompressed, so they are shared by
+	// every content coding
+	cacheKey := h.prefix + "-" + strings.Trim(entityTag(rootCid, pathSegments, query, representation, ""), `"`)
+	cacheable := h.cache != nil && etag != ""
+	if cacheable {
+		if cached, ok := h.cache.Get(cacheKey); ok {
+			defer cached.Close()
+			entry.Cached = true
+			serveContent(w, servedRequest, cached)
+			return
+		}
+	}
+	// a POST body carries the blocks the client already has
+	haves, err := readHaves(w, r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
 	// create a temporary file for the response (we want to serialize the whole thing to know
 	// if it will be a success)
-	responseFile, err := os.CreateTemp("", cidString+"-")
+	var responseFile *os.File
+	if cacheable {
+		responseFile, err = h.cache.CreateTemp(cidString)
+	} else {
+		responseFile, err = os.CreateTemp("", cidString+"-")
+	}
 	if err != nil {
 		writeError(w, r, http.StatusInternalServerError, "error setting up response")
 		return
@@ -178,7 +323,10 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}()
 
 	// write the response
-	err = carwriter.WriteCar(r.Context(), responseFile, rootCid, pathSegments, stargate.Query(r.URL.Query()), h.appResolver)
+	summary, err := carwriter.WriteCarWithSummary(r.Context(), responseFile, rootCid, pathSegments, query, haves, h.appResolver)
+	if summary != nil {
+		entry.Blocks = blockCounts(summary)
+	}
 
 	if err != nil {
 		// check for not found errors while writing response
@@ -187,8 +335,19 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			writeError(w, r, http.StatusNotFound, err.Error())
 			return
 		}
+		var errRangeNotSatisfiable stargate.ErrRangeNotSatisfiable
+		if errors.As(err, &errRangeNotSatisfiable) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", errRangeNotSatisfiable.Size))
+			writeError(w, r, http.StatusRequestedRangeNotSatisfiable, err.Error())
+			return
+		}
 		var errPathError stargate.ErrPathError
 		if errors.As(err, &errPathError) {
+			// when requested, send the response containing the proof the path does not exist
+			if _, ok := r.URL.Query()[QueryProof]; ok && errPathError.Proof != nil {
+				serveProof(w, r, responseFile, err)
+				return
+			}
 			writeError(w, r, http.StatusNotFound, err.Error())
 			return
 		}
@@ -196,6 +355,27 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		writeError(w, r, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if cacheable {
+		if err := h.cache.Put(cacheKey, responseFile); err != nil {
+			log.Warnf("caching response for %s: %s", r.URL, err)
+		}
+	}
 	// serve the completed response with an OK status
-	serveContent(w, r, responseFile)
+	serveContent(w, servedRequest, responseFile)
+}
+
+// readHaves decodes the haves in the body of a POST request
+func readHaves(w http.ResponseWriter, r *http.Request) (*stargate.HaveSet, error) {
+	if r.Method != http.MethodPost {
+		return nil, nil
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxHavesSize))
+	if err != nil {
+		return nil, fmt.Errorf("reading request body: %w", err)
+	}
+	haves, err := stargate.BindnodeRegistry.TypeFromBytes(data, (*stargate.Haves)(nil), dagcbor.Decode)
+	if err != nil {
+		return nil, fmt.Errorf("parsing haves: %w", err)
+	}
+	return stargate.NewHaveSet(haves.(*stargate.Haves))
 }
@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"strconv"
+	"strings"
+)
+
+// maxRanges is the most ranges accepted in a Range header -- headers with more are ignored
+const maxRanges = 64
+
+// rangeParams translates an HTTP Range header into 'bytes' query params, so that ranges select bytes of the UnixFS
+// file being requested rather than bytes of the response. Inclusive range ends become exclusive, while open ended
+// and suffix ranges pass through as is.
+// As permitted by RFC 9110, headers in units other than bytes or that cannot be parsed are ignored, and ok is false.
+func rangeParams(header string) (params []string, ok bool) {
+	unit, rangeSet, found := strings.Cut(header, "=")
+	if !found || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, false
+	}
+	specs := strings.Split(rangeSet, ",")
+	if len(specs) > maxRanges {
+		return nil, false
+	}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			// empty list elements are allowed
+			continue
+		}
+		first, last, found := strings.Cut(spec, "-")
+		if !found {
+			return nil, false
+		}
+		if first == "" {
+			// suffix range
+			if _, err := strconv.ParseUint(last, 10, 63); err != nil {
+				return nil, false
+			}
+			params = append(params, "-"+last)
+			continue
+		}
+		start, err := strconv.ParseUint(first, 10, 63)
+		if err != nil {
+			return nil, false
+		}
+		if last == "" {
+			params = append(params, strconv.FormatUint(start, 10)+"-")
+			continue
+		}
+		end, err := strconv.ParseUint(last, 10, 63)
+		if err != nil || end < start || end+1 > 1<<63-1 {
+			return nil, false
+		}
+		params = append(params, strconv.FormatUint(start, 10)+"-"+strconv.FormatUint(end+1, 10))
+	}
+	if len(params) == 0 {
+		return nil, false
+	}
+	return params, true
+}
@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeParams(t *testing.T) {
+	testCases := []struct {
+		header   string
+		expected []string
+	}{
+		{header: "bytes=0-499", expected: []string{"0-500"}},
+		{header: "bytes=500-", expected: []string{"500-"}},
+		{header: "bytes=-500", expected: []string{"-500"}},
+		{header: "Bytes=0-0, 10-19,,-1", expected: []string{"0-1", "10-20", "-1"}},
+		{header: ""},
+		{header: "items=0-10"},
+		{header: "bytes=10-5"},
+		{header: "bytes=abc"},
+		{header: "bytes=1-2-3"},
+		{header: "bytes=,"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.header, func(t *testing.T) {
+			params, ok := rangeParams(testCase.header)
+			require.Equal(t, testCase.expected != nil, ok)
+			require.Equal(t, testCase.expected, params)
+		})
+	}
+}
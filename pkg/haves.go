@@ -0,0 +1,92 @@
+package stargate
+
+import (
+	"errors"
+	"math"
+
+	"github.com/ipfs/go-cid"
+	"github.com/spaolacci/murmur3"
+)
+
+// MaxBloomHashCount is the largest number of hash functions accepted for a bloom filter
+const MaxBloomHashCount = 32
+
+// NewBloom returns an empty bloom filter sized for the given number of CIDs and false positive rate
+func NewBloom(count int, falsePositiveRate float64) *Bloom {
+	if count < 1 {
+		count = 1
+	}
+	bits := math.Ceil(-float64(count) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashCount := int64(math.Round(bits / float64(count) * math.Ln2))
+	if hashCount < 1 {
+		hashCount = 1
+	}
+	if hashCount > MaxBloomHashCount {
+		hashCount = MaxBloomHashCount
+	}
+	return &Bloom{
+		Bits:      make([]byte, int(math.Ceil(bits/8))),
+		HashCount: hashCount,
+	}
+}
+
+// Add adds a CID to the bloom filter
+func (b *Bloom) Add(c cid.Cid) {
+	size := uint64(len(b.Bits)) * 8
+	h1, h2 := murmur3.Sum128(c.Bytes())
+	for i := uint64(0); i < uint64(b.HashCount); i++ {
+		n := (h1 + i*h2) % size
+		b.Bits[n/8] |= 1 << (n % 8)
+	}
+}
+
+// Has returns true if the CID may have been added to the bloom filter
+func (b *Bloom) Has(c cid.Cid) bool {
+	size := uint64(len(b.Bits)) * 8
+	h1, h2 := murmur3.Sum128(c.Bytes())
+	for i := uint64(0); i < uint64(b.HashCount); i++ {
+		n := (h1 + i*h2) % size
+		if b.Bits[n/8]&(1<<(n%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// HaveSet answers whether a client has a block, from the haves it sent with its request
+// A nil HaveSet has no blocks
+type HaveSet struct {
+	cids  map[cid.Cid]struct{}
+	bloom *Bloom
+}
+
+// NewHaveSet validates haves sent by a client and returns a set to check blocks against
+func NewHaveSet(haves *Haves) (*HaveSet, error) {
+	if haves == nil {
+		return nil, nil
+	}
+	if haves.Bloom != nil {
+		if len(haves.Bloom.Bits) == 0 {
+			return nil, errors.New("bloom filter must not be empty")
+		}
+		if haves.Bloom.HashCount < 1 || haves.Bloom.HashCount > MaxBloomHashCount {
+			return nil, errors.New("bloom filter hash count out of range")
+		}
+	}
+	cids := make(map[cid.Cid]struct{}, len(haves.Cids))
+	for _, c := range haves.Cids {
+		cids[c] = struct{}{}
+	}
+	return &HaveSet{cids: cids, bloom: haves.Bloom}, nil
+}
+
+// Has returns true if the client has (or, when it sent a bloom filter, probably has) the given block
+func (hs *HaveSet) Has(c cid.Cid) bool {
+	if hs == nil {
+		return false
+	}
+	if _, ok := hs.cids[c]; ok {
+		return true
+	}
+	return hs.bloom != nil && hs.bloom.Has(c)
+}
@@ -0,0 +1,54 @@
+package stargate_test
+
+import (
+	"testing"
+
+	"github.com/ipfs/stargate/internal/testutil"
+	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHaveSet(t *testing.T) {
+	req := require.New(t)
+	listed := testutil.GenerateCids(10)
+	filtered := testutil.GenerateCids(1000)
+	others := testutil.GenerateCids(1000)
+
+	bloom := stargate.NewBloom(len(filtered), 0.01)
+	for _, c := range filtered {
+		bloom.Add(c)
+	}
+	haves := &stargate.Haves{Cids: listed, Bloom: bloom}
+
+	// haves survive encoding as a request body
+	data, err := stargate.BindnodeRegistry.TypeToBytes(haves, dagcbor.Encode)
+	req.NoError(err)
+	decoded, err := stargate.BindnodeRegistry.TypeFromBytes(data, (*stargate.Haves)(nil), dagcbor.Decode)
+	req.NoError(err)
+	req.Equal(haves, decoded)
+
+	haveSet, err := stargate.NewHaveSet(decoded.(*stargate.Haves))
+	req.NoError(err)
+	for _, c := range listed {
+		req.True(haveSet.Has(c))
+	}
+	for _, c := range filtered {
+		req.True(haveSet.Has(c))
+	}
+	falsePositives := 0
+	for _, c := range others {
+		if haveSet.Has(c) {
+			falsePositives++
+		}
+	}
+	req.Less(falsePositives, 50)
+
+	var noHaves *stargate.HaveSet
+	req.False(noHaves.Has(listed[0]))
+
+	_, err = stargate.NewHaveSet(&stargate.Haves{Bloom: &stargate.Bloom{HashCount: 3}})
+	req.Error(err)
+	_, err = stargate.NewHaveSet(&stargate.Haves{Bloom: &stargate.Bloom{Bits: []byte{0}, HashCount: 0}})
+	req.Error(err)
+}
@@ -0,0 +1,119 @@
+/*
+Package metrics defines the Prometheus metrics collected by a StarGate server, and serves them
+*/
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "stargate"
+
+// Phases of a request timed by PhaseDuration
+const (
+	PhasePathResolution  = "path_resolution"
+	PhaseQueryResolution = "query_resolution"
+	PhaseBlockWriting    = "block_writing"
+)
+
+// Reasons requests are rejected, counted by RejectedRequests
+const (
+	RejectedConcurrency       = "concurrency"
+	RejectedClientConcurrency = "client_concurrency"
+	RejectedRateLimit         = "rate_limit"
+)
+
+var (
+	// Requests counts HTTP requests by app prefix and response status
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "HTTP requests, by app prefix and response status",
+	}, []string{"app", "status"})
+
+	// RequestDuration times HTTP requests from start to finish, by app prefix
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time to serve an HTTP request, by app prefix",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	}, []string{"app"})
+
+	// PhaseDuration times the parts of producing a StarGate response -- path resolution, query resolution and
+	// block writing -- summed over each response
+	PhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "phase_duration_seconds",
+		Help:      "Time spent on each phase of producing a response",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"phase"})
+
+	// Blocks counts blocks listed in responses, by BlockStatus
+	Blocks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blocks_total",
+		Help:      "Blocks listed in responses, by status",
+	}, []string{"status"})
+
+	// BlockBytes counts the bytes of blocks sent in responses
+	BlockBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "block_bytes_total",
+		Help:      "Bytes of block data sent in responses",
+	})
+
+	// RejectedRequests counts requests turned away before being served, by reason
+	RejectedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rejected_requests_total",
+		Help:      "Requests rejected before being served, by reason",
+	}, []string{"reason"})
+
+	// SQLQueryDuration times queries to the UnixFS store, by operation
+	SQLQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sql_query_duration_seconds",
+		Help:      "Time to run queries against the UnixFS store, by operation",
+		Buckets:   prometheus.ExponentialBuckets(0.00005, 4, 10),
+	}, []string{"operation"})
+
+	// OpenCARs is the number of CAR files currently open for reading blocks
+	OpenCARs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "open_car_files",
+		Help:      "CAR files currently open to read blocks",
+	})
+)
+
+// Registry holds all StarGate metrics, along with Go runtime and process metrics
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		Requests,
+		RequestDuration,
+		PhaseDuration,
+		Blocks,
+		BlockBytes,
+		RejectedRequests,
+		SQLQueryDuration,
+		OpenCARs,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Since records the time elapsed since start in an observer, typically with defer
+func Since(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
+
+// Handler serves the metrics in Registry in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
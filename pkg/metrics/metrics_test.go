@@ -0,0 +1,27 @@
+package metrics_test
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/stargate/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	metrics.Requests.WithLabelValues("test", "200").Inc()
+	metrics.Since(metrics.PhaseDuration.WithLabelValues(metrics.PhasePathResolution), time.Now().Add(-time.Second))
+	require.Equal(t, 1.0, testutil.ToFloat64(metrics.Requests.WithLabelValues("test", "200")))
+
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(w.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `stargate_requests_total{app="test",status="200"} 1`)
+	require.Contains(t, string(body), `stargate_phase_duration_seconds_count{phase="path_resolution"} 1`)
+	require.True(t, strings.Contains(string(body), "go_goroutines"))
+}
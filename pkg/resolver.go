@@ -2,6 +2,7 @@ package stargate
 
 import (
 	"context"
+	"io"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipld/go-ipld-prime"
@@ -33,8 +34,9 @@ type PathResolver interface {
 	ResolvePathSegments(ctx context.Context, path PathSegments) (*Path, PathSegments, PathResolver, error)
 
 	// ResolverQuery returns a resolver to fulfill the remaining portion of a request after path resolution with the
-	// given query string.
-	ResolveQuery(ctx context.Context, query Query) (QueryResolver, error)
+	// given query string. Blocks in haves, which may be nil, are already held by the client and should not be
+	// sent again.
+	ResolveQuery(ctx context.Context, query Query, haves *HaveSet) (QueryResolver, error)
 }
 
 // QueryResolver produces one or more stargate DAG messages to fulfill the request at the end of the path
@@ -44,3 +46,33 @@ type QueryResolver interface {
 	// done indicates where the query is fully resolved or there are more messages
 	Done() bool
 }
+
+// Deserializer is implemented by PathResolvers that can also return the content at their root in its original form,
+// for clients such as web browsers that do not read StarGate responses
+type Deserializer interface {
+	// Deserialize returns the content at the root of the resolver. Exactly one of File or Directory is set
+	Deserialize(ctx context.Context) (*Deserialized, error)
+}
+
+// Deserialized is the original form of the content at the root of a resolver
+type Deserialized struct {
+	// File reads the bytes of a file
+	File io.ReadSeeker
+	// Directory iterates the entries of a directory
+	Directory DirectoryIterator
+}
+
+// DirectoryEntry is a named link in a directory
+type DirectoryEntry struct {
+	Name        string
+	Link        cid.Cid
+	IsDirectory bool
+}
+
+// DirectoryIterator iterates the entries of a directory in order
+type DirectoryIterator interface {
+	// Next returns the next entry
+	Next() (*DirectoryEntry, error)
+	// Done indicates whether all entries have been returned
+	Done() bool
+}
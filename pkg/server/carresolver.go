@@ -0,0 +1,30 @@
+package server
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/stargate/internal/stores"
+	"github.com/ipfs/stargate/internal/storeutil"
+	"github.com/ipld/go-ipld-prime"
+)
+
+// CARLinkSystemResolver loads blocks from CAR files, for UnixFS stores whose root metadata is the path of the CAR
+// file holding the root's blocks -- as in repos built by the stargate CLI
+type CARLinkSystemResolver struct{}
+
+// ResolveLinkSystem opens the CAR file named by the metadata. The CAR file is closed once ctx is done, so the link
+// system must not be used after
+func (CARLinkSystemResolver) ResolveLinkSystem(ctx context.Context, root cid.Cid, metadata []byte) (*ipld.LinkSystem, error) {
+	carFile := string(metadata)
+	bs, err := stores.ReadOnlyFilestore(carFile)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = bs.Close()
+	}()
+	ls := storeutil.LinkSystemForBlockstore(bs)
+	return &ls, nil
+}
@@ -0,0 +1,43 @@
+package server_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/stargate/internal/testutil"
+	"github.com/ipfs/stargate/pkg/metrics"
+	"github.com/ipfs/stargate/pkg/server"
+	"github.com/ipld/go-car/v2/blockstore"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCARLinkSystemResolverCloses(t *testing.T) {
+	ctx := context.Background()
+	blk := testutil.GenerateBlocksOfSize(1, 100)[0]
+	carFile := filepath.Join(t.TempDir(), "blocks.car")
+	rw, err := blockstore.OpenReadWrite(carFile, []cid.Cid{blk.Cid()})
+	require.NoError(t, err)
+	require.NoError(t, rw.Put(ctx, blk))
+	require.NoError(t, rw.Finalize())
+
+	open := promtestutil.ToFloat64(metrics.OpenCARs)
+	reqCtx, cancel := context.WithCancel(ctx)
+	lsys, err := server.CARLinkSystemResolver{}.ResolveLinkSystem(reqCtx, blk.Cid(), []byte(carFile))
+	require.NoError(t, err)
+	require.Equal(t, open+1, promtestutil.ToFloat64(metrics.OpenCARs))
+	data, err := lsys.LoadRaw(ipld.LinkContext{Ctx: reqCtx}, cidlink.Link{Cid: blk.Cid()})
+	require.NoError(t, err)
+	require.Equal(t, blk.RawData(), data)
+
+	// the CAR file is closed once the request is done
+	cancel()
+	require.Eventually(t, func() bool {
+		return promtestutil.ToFloat64(metrics.OpenCARs) == open
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/ipfs/stargate/pkg/metrics"
+)
+
+// limitConcurrency rejects requests with 503 Service Unavailable while max requests are already in progress
+func limitConcurrency(next http.Handler, max int) http.Handler {
+	inProgress := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case inProgress <- struct{}{}:
+			defer func() { <-inProgress }()
+			next.ServeHTTP(w, r)
+		default:
+			metrics.RejectedRequests.WithLabelValues(metrics.RejectedConcurrency).Inc()
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many requests in progress", http.StatusServiceUnavailable)
+		}
+	})
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/stargate/pkg/metrics"
+	"golang.org/x/time/rate"
+)
+
+// clientIdleTimeout is how long a client's limits are remembered after its last request completes
+const clientIdleTimeout = 10 * time.Minute
+
+// throttleChunk is the most response bytes written at once by a throttled client, to keep its rate smooth
+const throttleChunk = 32 << 10
+
+// ClientLimits bound what a single client can take from the server, so one heavy consumer cannot starve the rest.
+// Zero values mean no limit
+type ClientLimits struct {
+	// RequestsPerSecond is the sustained rate of requests each client may make
+	RequestsPerSecond float64
+	// RequestBurst is how many requests a client may make at once, ahead of the sustained rate. Defaults to 1
+	RequestBurst int
+	// MaxConcurrentRequests caps each client's requests in progress
+	MaxConcurrentRequests int
+	// BytesPerSecond throttles how fast each client receives responses, shared across all its requests
+	BytesPerSecond int
+	// ClientKey identifies the client making a request. Defaults to ClientIP
+	ClientKey func(r *http.Request) string
+}
+
+// ClientIP identifies clients by the address they connect from
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ClientHeader identifies clients by the value of a request header, such as X-Forwarded-For behind a proxy or
+// Authorization for per-token limits, falling back to ClientIP when the header is absent.
+//
+// Clients can send any X-Forwarded-For they like, and a proxy appends the address it sees to it, so only the last
+// address in the header is used: the one added by the proxy in front of the server. Behind more than one proxy, the
+// proxy facing clients must overwrite the header rather than append to it, and the others pass it on unchanged
+func ClientHeader(name string) func(r *http.Request) string {
+	forwardedFor := http.CanonicalHeaderKey(name) == "X-Forwarded-For"
+	return func(r *http.Request) string {
+		value := r.Header.Get(name)
+		if forwardedFor {
+			value = lastForwardedFor(r.Header.Values(name))
+		}
+		if value != "" {
+			return name + ":" + value
+		}
+		return ClientIP(r)
+	}
+}
+
+// lastForwardedFor returns the last address in X-Forwarded-For headers, which may be repeated or hold a list
+func lastForwardedFor(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	last := values[len(values)-1]
+	if i := strings.LastIndex(last, ","); i >= 0 {
+		last = last[i+1:]
+	}
+	return strings.TrimSpace(last)
+}
+
+// WithClientLimits limits the requests and bandwidth of each client of the apps. Requests over a limit are rejected
+// with 429 Too Many Requests and a Retry-After header. Metrics are not limited
+func WithClientLimits(limits ClientLimits) Option {
+	return func(s *Server) error {
+		if limits.RequestsPerSecond < 0 || limits.RequestBurst < 0 || limits.MaxConcurrentRequests < 0 ||
+			limits.BytesPerSecond < 0 {
+			return errors.New("client limits cannot be negative")
+		}
+		if limits.ClientKey == nil {
+			limits.ClientKey = ClientIP
+		}
+		if limits.RequestBurst == 0 {
+			limits.RequestBurst = 1
+		}
+		s.clientLimits = &limits
+		return nil
+	}
+}
+
+// client is the state of a client's limits
+type client struct {
+	requests   *rate.Limiter
+	bytes      *rate.Limiter
+	inProgress int
+	lastSeen   time.Time
+}
+
+// clientLimiter applies ClientLimits to requests to a handler
+type clientLimiter struct {
+	limits ClientLimits
+	next   http.Handler
+
+	lk        sync.Mutex
+	clients   map[string]*client
+	lastSweep time.Time
+}
+
+func limitClients(next http.Handler, limits ClientLimits) http.Handler {
+	return &clientLimiter{
+		limits:    limits,
+		next:      next,
+		clients:   make(map[string]*client),
+		lastSweep: time.Now(),
+	}
+}
+
+func (cl *clientLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, retryAfter, reason := cl.admit(cl.limits.ClientKey(r))
+	if c == nil {
+		metrics.RejectedRequests.WithLabelValues(reason).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	defer cl.release(c)
+	if c.bytes != nil {
+		w = &throttledWriter{ResponseWriter: w, ctx: r.Context(), limiter: c.bytes}
+	}
+	cl.next.ServeHTTP(w, r)
+}
+
+// admit returns the client's state if it may make a request now, or otherwise the seconds until it should retry and
+// why it was rejected
+func (cl *clientLimiter) admit(key string) (*client, int, string) {
+	cl.lk.Lock()
+	defer cl.lk.Unlock()
+	now := time.Now()
+	cl.sweep(now)
+	c, ok := cl.clients[key]
+	if !ok {
+		c = &client{}
+		if cl.limits.RequestsPerSecond > 0 {
+			c.requests = rate.NewLimiter(rate.Limit(cl.limits.RequestsPerSecond), cl.limits.RequestBurst)
+		}
+		if cl.limits.BytesPerSecond > 0 {
+			c.bytes = rate.NewLimiter(rate.Limit(cl.limits.BytesPerSecond), cl.limits.BytesPerSecond)
+		}
+		cl.clients[key] = c
+	}
+	c.lastSeen = now
+	if cl.limits.MaxConcurrentRequests > 0 && c.inProgress >= cl.limits.MaxConcurrentRequests {
+		return nil, 1, metrics.RejectedClientConcurrency
+	}
+	if c.requests != nil {
+		reservation := c.requests.ReserveN(now, 1)
+		if delay := reservation.DelayFrom(now); delay > 0 {
+			reservation.CancelAt(now)
+			return nil, int(math.Ceil(delay.Seconds())), metrics.RejectedRateLimit
+		}
+	}
+	c.inProgress++
+	return c, 0, ""
+}
+
+func (cl *clientLimiter) release(c *client) {
+	cl.lk.Lock()
+	defer cl.lk.Unlock()
+	c.inProgress--
+	c.lastSeen = time.Now()
+}
+
+// sweep forgets clients that have been idle a while, so state does not grow with every address ever seen
+func (cl *clientLimiter) sweep(now time.Time) {
+	if now.Sub(cl.lastSweep) < clientIdleTimeout {
+		return
+	}
+	cl.lastSweep = now
+	for key, c := range cl.clients {
+		if c.inProgress == 0 && now.Sub(c.lastSeen) > clientIdleTimeout {
+			delete(cl.clients, key)
+		}
+	}
+}
+
+// throttledWriter waits for a client's bandwidth before writing each chunk of a response
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > throttleChunk {
+			n = throttleChunk
+		}
+		if burst := tw.limiter.Burst(); n > burst {
+			n = burst
+		}
+		if err := tw.limiter.WaitN(tw.ctx, n); err != nil {
+			return written, err
+		}
+		n, err := tw.ResponseWriter.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (tw *throttledWriter) Flush() {
+	if flusher, ok := tw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientRateLimit(t *testing.T) {
+	req := require.New(t)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := limitClients(ok, ClientLimits{RequestsPerSecond: 0.5, RequestBurst: 2, ClientKey: ClientHeader("Authorization")})
+	get := func(token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/ipfs/", nil)
+		if token != "" {
+			r.Header.Set("Authorization", token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	req.Equal(http.StatusOK, get("a").Code)
+	req.Equal(http.StatusOK, get("a").Code)
+	limited := get("a")
+	req.Equal(http.StatusTooManyRequests, limited.Code)
+	req.Equal("2", limited.Header().Get("Retry-After"))
+	// other clients are not affected
+	req.Equal(http.StatusOK, get("b").Code)
+	req.Equal(http.StatusOK, get("").Code)
+}
+
+func TestClientHeaderForwardedFor(t *testing.T) {
+	req := require.New(t)
+	key := ClientHeader("X-Forwarded-For")
+	forwarded := func(values ...string) string {
+		r := httptest.NewRequest(http.MethodGet, "/ipfs/", nil)
+		for _, value := range values {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		return key(r)
+	}
+	// addresses a client puts ahead of the one the proxy appends do not change its key
+	req.Equal("X-Forwarded-For:10.0.0.1", forwarded("10.0.0.1"))
+	req.Equal("X-Forwarded-For:10.0.0.1", forwarded("1.2.3.4, 10.0.0.1"))
+	req.Equal("X-Forwarded-For:10.0.0.1", forwarded("5.6.7.8", "10.0.0.1"))
+	req.Equal(ClientIP(httptest.NewRequest(http.MethodGet, "/ipfs/", nil)), forwarded())
+}
+
+func TestClientConcurrency(t *testing.T) {
+	req := require.New(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	blocking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	h := limitClients(blocking, ClientLimits{MaxConcurrentRequests: 1, ClientKey: ClientIP})
+	get := func(remoteAddr string) int {
+		r := httptest.NewRequest(http.MethodGet, "/ipfs/", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	done := make(chan int)
+	go func() { done <- get("10.0.0.1:1000") }()
+	<-started
+	// the same address on another port is the same client
+	req.Equal(http.StatusTooManyRequests, get("10.0.0.1:1001"))
+	go func() { done <- get("10.0.0.2:1000") }()
+	<-started
+	close(release)
+	req.Equal(http.StatusOK, <-done)
+	req.Equal(http.StatusOK, <-done)
+}
+
+func TestClientBandwidth(t *testing.T) {
+	req := require.New(t)
+	body := make([]byte, 96<<10)
+	write := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body)
+	})
+	// the first 64KiB is the burst, and the rest should take half a second
+	h := limitClients(write, ClientLimits{BytesPerSecond: 64 << 10, ClientKey: ClientIP})
+	w := httptest.NewRecorder()
+	start := time.Now()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ipfs/", nil))
+	elapsed := time.Since(start)
+	req.Equal(len(body), w.Body.Len())
+	req.GreaterOrEqual(elapsed, 400*time.Millisecond)
+	req.Less(elapsed, 2*time.Second)
+}
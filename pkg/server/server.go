@@ -0,0 +1,405 @@
+/*
+Package server runs a StarGate HTTP gateway, serving one or more AppResolvers under URL prefixes. It can be embedded
+in any Go program -- the stargate CLI is built on it.
+*/
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/ipfs/stargate/pkg/handler"
+	"github.com/ipfs/stargate/pkg/metrics"
+)
+
+var log = logging.Logger("stargateserver")
+
+// DefaultReadHeaderTimeout is the default time allowed to read a request's headers
+const DefaultReadHeaderTimeout = 10 * time.Second
+
+// unixPrefix marks an address as a Unix socket path
+const unixPrefix = "unix:"
+
+// Middleware wraps the handler for all requests to the server
+type Middleware func(http.Handler) http.Handler
+
+// Timeouts bound the time spent on parts of each connection. Zero values mean no timeout
+type Timeouts struct {
+	// ReadHeader is the time allowed to read a request's headers
+	ReadHeader time.Duration
+	// Read is the time allowed to read a whole request, including the body
+	Read time.Duration
+	// Write is the time allowed to write a response. Responses can be large, so this is best left unset
+	Write time.Duration
+	// Idle is how long to keep an idle keep-alive connection open
+	Idle time.Duration
+}
+
+// Option configures a Server
+type Option func(*Server) error
+
+// WithApp serves the given AppResolver under a URL prefix, so that requests to /<prefix>/<cid>/... are resolved by it
+func WithApp(prefix string, appResolver stargate.AppResolver) Option {
+	return func(s *Server) error {
+		if _, ok := s.apps[prefix]; ok {
+			return fmt.Errorf("prefix '%s' is already served", prefix)
+		}
+		s.apps[prefix] = appResolver
+		return nil
+	}
+}
+
+// WithAddress listens on an address when the server starts -- either a TCP address, such as ":7777" or
+// "127.0.0.1:7777", or a Unix socket, such as "unix:/run/stargate.sock". A stale socket file left at the path is
+// replaced
+func WithAddress(address string) Option {
+	return func(s *Server) error {
+		s.addresses = append(s.addresses, address)
+		return nil
+	}
+}
+
+// WithListener serves requests accepted by a listener the caller has already opened
+func WithListener(listener net.Listener) Option {
+	return func(s *Server) error {
+		s.listeners = append(s.listeners, listener)
+		return nil
+	}
+}
+
+// WithHandlerOptions configures the handler for every app, for example to cache responses or log requests
+func WithHandlerOptions(options ...handler.Option) Option {
+	return func(s *Server) error {
+		s.handlerOptions = append(s.handlerOptions, options...)
+		return nil
+	}
+}
+
+// WithMiddleware wraps the handler for all requests. Middlewares run in the order given, the first outermost
+func WithMiddleware(middleware Middleware) Option {
+	return func(s *Server) error {
+		s.middlewares = append(s.middlewares, middleware)
+		return nil
+	}
+}
+
+// WithTimeouts sets the timeouts for each connection, replacing the default header timeout
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(s *Server) error {
+		s.timeouts = timeouts
+		return nil
+	}
+}
+
+// WithMaxHeaderBytes limits the size of a request's headers, rather than using net/http's default of 1MB
+func WithMaxHeaderBytes(maxHeaderBytes int) Option {
+	return func(s *Server) error {
+		s.maxHeaderBytes = maxHeaderBytes
+		return nil
+	}
+}
+
+// WithMaxConcurrentRequests limits the number of app requests served at once. Requests over the limit are rejected
+// with 503 Service Unavailable. Metrics are always served
+func WithMaxConcurrentRequests(max int) Option {
+	return func(s *Server) error {
+		if max < 0 {
+			return errors.New("max concurrent requests cannot be negative")
+		}
+		s.maxConcurrentRequests = max
+		return nil
+	}
+}
+
+// WithTLSConfig serves HTTPS on all listeners using the given configuration
+func WithTLSConfig(config *tls.Config) Option {
+	return func(s *Server) error {
+		s.tlsConfig = config
+		return nil
+	}
+}
+
+// WithTLSFiles serves HTTPS on all listeners with a certificate and key loaded from PEM files. The files are checked
+// for changes periodically and reloaded, so a renewed certificate is picked up without a restart
+func WithTLSFiles(certFile string, keyFile string) Option {
+	return func(s *Server) error {
+		reloader, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		s.tlsConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
+		return nil
+	}
+}
+
+// WithMetrics serves Prometheus metrics at the given path
+func WithMetrics(path string) Option {
+	return func(s *Server) error {
+		s.metricsPath = path
+		return nil
+	}
+}
+
+// WithAdmin serves an administrative handler on addresses of its own, kept apart from the public listeners. It
+// shares the server's TLS configuration on TCP addresses -- Unix sockets are local, and served without TLS -- but
+// none of its limits or middlewares
+func WithAdmin(admin http.Handler, addresses ...string) Option {
+	return func(s *Server) error {
+		if len(addresses) == 0 {
+			return errors.New("no addresses to serve the admin handler on")
+		}
+		s.adminHandler = admin
+		s.adminAddresses = append(s.adminAddresses, addresses...)
+		return nil
+	}
+}
+
+// WithBaseContext sets the context the contexts of all requests derive from
+func WithBaseContext(ctx context.Context) Option {
+	return func(s *Server) error {
+		s.baseContext = ctx
+		return nil
+	}
+}
+
+// Server serves StarGate requests for a set of apps
+type Server struct {
+	apps           map[string]stargate.AppResolver
+	addresses      []string
+	listeners      []net.Listener
+	handlerOptions []handler.Option
+	middlewares    []Middleware
+	timeouts       Timeouts
+	maxHeaderBytes int
+	tlsConfig      *tls.Config
+	metricsPath    string
+	baseContext    context.Context
+
+	maxConcurrentRequests int
+	clientLimits          *ClientLimits
+
+	adminAddresses []string
+	adminHandler   http.Handler
+	adminListeners []net.Listener
+
+	httpServer  *http.Server
+	adminServer *http.Server
+	serveErrs   chan error
+	wg          sync.WaitGroup
+}
+
+// New constructs a server with the given options. It must serve at least one app
+func New(options ...Option) (*Server, error) {
+	s := &Server{
+		apps:        make(map[string]stargate.AppResolver),
+		timeouts:    Timeouts{ReadHeader: DefaultReadHeaderTimeout},
+		baseContext: context.Background(),
+	}
+	for _, option := range options {
+		if err := option(s); err != nil {
+			return nil, err
+		}
+	}
+	if len(s.apps) == 0 {
+		return nil, errors.New("no apps to serve")
+	}
+	return s, nil
+}
+
+// Handler returns the handler for all requests, with middlewares applied. Programs with their own HTTP server can
+// mount it rather than calling Start
+func (s *Server) Handler() http.Handler {
+	// limits are shared by all apps, so a client's requests to each count together
+	appMux := http.NewServeMux()
+	for prefix, appResolver := range s.apps {
+		appMux.Handle("/"+prefix+"/", handler.NewHandler(prefix, appResolver, s.handlerOptions...))
+	}
+	var apps http.Handler = appMux
+	if s.maxConcurrentRequests > 0 {
+		apps = limitConcurrency(apps, s.maxConcurrentRequests)
+	}
+	if s.clientLimits != nil {
+		apps = limitClients(apps, *s.clientLimits)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", apps)
+	if s.metricsPath != "" {
+		mux.Handle(s.metricsPath, metrics.Handler())
+	}
+	var h http.Handler = mux
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		h = s.middlewares[i](h)
+	}
+	return h
+}
+
+// Start opens any addresses and begins serving on all listeners. It returns once the server is accepting requests
+func (s *Server) Start() error {
+	if s.httpServer != nil {
+		return errors.New("server already started")
+	}
+	if len(s.addresses) == 0 && len(s.listeners) == 0 {
+		return errors.New("no addresses or listeners to serve on")
+	}
+	closeOpened := func() {
+		for _, opened := range append(s.listeners, s.adminListeners...) {
+			_ = opened.Close()
+		}
+	}
+	for _, address := range s.addresses {
+		listener, err := listen(address)
+		if err != nil {
+			closeOpened()
+			return fmt.Errorf("listening on %s: %w", address, err)
+		}
+		s.listeners = append(s.listeners, listener)
+	}
+	for _, address := range s.adminAddresses {
+		listener, err := listen(address)
+		if err != nil {
+			closeOpened()
+			return fmt.Errorf("listening on admin address %s: %w", address, err)
+		}
+		s.adminListeners = append(s.adminListeners, listener)
+	}
+	s.httpServer = &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: s.timeouts.ReadHeader,
+		ReadTimeout:       s.timeouts.Read,
+		WriteTimeout:      s.timeouts.Write,
+		IdleTimeout:       s.timeouts.Idle,
+		MaxHeaderBytes:    s.maxHeaderBytes,
+		TLSConfig:         s.tlsConfig,
+		// This context will be the parent of the context associated with all
+		// incoming requests
+		BaseContext: func(listener net.Listener) context.Context {
+			return s.baseContext
+		},
+	}
+	s.serveErrs = make(chan error, len(s.listeners)+len(s.adminListeners))
+	for _, listener := range s.listeners {
+		s.serve(s.httpServer, listener, s.tlsConfig != nil)
+	}
+	if len(s.adminListeners) > 0 {
+		// uploads can take a long time, so only reading headers is bounded
+		s.adminServer = &http.Server{
+			Handler:           s.adminHandler,
+			ReadHeaderTimeout: s.timeouts.ReadHeader,
+			TLSConfig:         s.tlsConfig,
+			BaseContext: func(listener net.Listener) context.Context {
+				return s.baseContext
+			},
+		}
+		for _, listener := range s.adminListeners {
+			s.serve(s.adminServer, listener, s.tlsConfig != nil && listener.Addr().Network() != "unix")
+		}
+	}
+	return nil
+}
+
+// serve serves requests on a listener in the background, sending any error that stops it to serveErrs
+func (s *Server) serve(httpServer *http.Server, listener net.Listener, useTLS bool) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		var err error
+		if useTLS {
+			// certificates come from the config, and ServeTLS also sets up HTTP/2
+			err = httpServer.ServeTLS(listener, "", "")
+		} else {
+			err = httpServer.Serve(listener)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			s.serveErrs <- err
+		}
+	}()
+}
+
+// listen opens a TCP or Unix socket listener for an address passed to WithAddress
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixPrefix) {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, unixPrefix)
+	// a socket left by a process that did not shut down cleanly prevents listening, but anything else at the path
+	// is not ours to remove
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("socket %s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// Addrs returns the addresses the server is listening on, once started
+func (s *Server) Addrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for _, listener := range s.listeners {
+		addrs = append(addrs, listener.Addr())
+	}
+	return addrs
+}
+
+// AdminAddrs returns the addresses the admin handler is served on, once started, in the order given
+func (s *Server) AdminAddrs() []net.Addr {
+	addrs := make([]net.Addr, 0, len(s.adminListeners))
+	for _, listener := range s.adminListeners {
+		addrs = append(addrs, listener.Addr())
+	}
+	return addrs
+}
+
+// Prefixes returns the URL prefixes of the apps the server serves, in order
+func (s *Server) Prefixes() []string {
+	prefixes := make([]string, 0, len(s.apps))
+	for prefix := range s.apps {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// Errors receives any error that stops the server serving on a listener
+func (s *Server) Errors() <-chan error {
+	return s.serveErrs
+}
+
+// Shutdown stops accepting requests and waits for requests in flight to complete. If ctx ends first, remaining
+// connections are closed and the context's error is returned
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.httpServer == nil {
+		return nil
+	}
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		_ = s.httpServer.Close()
+	}
+	if s.adminServer != nil {
+		if adminErr := s.adminServer.Shutdown(ctx); adminErr != nil {
+			_ = s.adminServer.Close()
+			if err == nil {
+				err = adminErr
+			}
+		}
+	}
+	s.wg.Wait()
+	return err
+}
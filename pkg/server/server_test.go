@@ -0,0 +1,235 @@
+package server_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/ipfs/stargate/pkg/handler"
+	"github.com/ipfs/stargate/pkg/server"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingAppResolver waits for a release before reporting every root as not found
+type blockingAppResolver struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (bar *blockingAppResolver) GetResolver(ctx context.Context, root cid.Cid) (*ipld.LinkSystem, stargate.PathResolver, error) {
+	bar.started <- struct{}{}
+	<-bar.release
+	return nil, nil, stargate.ErrNotFound{Cid: root}
+}
+
+type discardLogger struct{}
+
+func (discardLogger) LogAccess(*handler.AccessLogEntry) {}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	req := require.New(t)
+	appResolver := &blockingAppResolver{started: make(chan struct{}), release: make(chan struct{})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	req.NoError(err)
+	var order []string
+	srv, err := server.New(
+		server.WithApp("ipfs", appResolver),
+		server.WithListener(listener),
+		server.WithHandlerOptions(handler.WithAccessLogger(discardLogger{})),
+		server.WithMetrics("/metrics"),
+		server.WithMiddleware(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, "first")
+				next.ServeHTTP(w, r)
+			})
+		}),
+		server.WithMiddleware(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, "second")
+				next.ServeHTTP(w, r)
+			})
+		}),
+	)
+	req.NoError(err)
+	req.NoError(srv.Start())
+	url := "http://" + srv.Addrs()[0].String()
+
+	resp, err := http.Get(url + "/metrics")
+	req.NoError(err)
+	req.Equal(http.StatusOK, resp.StatusCode)
+	_ = resp.Body.Close()
+	req.Equal([]string{"first", "second"}, order)
+
+	// start a request, and shut down while it is in flight
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get(url + "/ipfs/bafybeiesvqd2m3zrbdzbzqgolzgpvz3zdsvmwma2gwjihya44systqf3my")
+		if err == nil {
+			responses <- resp
+		}
+		close(responses)
+	}()
+	<-appResolver.started
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown completed with a request in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(appResolver.release)
+	req.NoError(<-shutdown)
+	resp, ok := <-responses
+	req.True(ok, "in flight request should complete")
+	body, err := io.ReadAll(resp.Body)
+	req.NoError(err)
+	req.Equal(http.StatusNotFound, resp.StatusCode, string(body))
+
+	// no longer serving
+	_, err = http.Get(url + "/metrics")
+	req.Error(err)
+}
+
+func TestNoApps(t *testing.T) {
+	_, err := server.New(server.WithAddress(":0"))
+	require.Error(t, err)
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	req := require.New(t)
+	appResolver := &blockingAppResolver{started: make(chan struct{}), release: make(chan struct{})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	req.NoError(err)
+	srv, err := server.New(
+		server.WithApp("ipfs", appResolver),
+		server.WithListener(listener),
+		server.WithHandlerOptions(handler.WithAccessLogger(discardLogger{})),
+		server.WithMetrics("/metrics"),
+		server.WithMaxConcurrentRequests(1),
+	)
+	req.NoError(err)
+	req.NoError(srv.Start())
+	defer func() { _ = srv.Shutdown(context.Background()) }()
+	url := "http://" + srv.Addrs()[0].String()
+	root := "/ipfs/bafybeiesvqd2m3zrbdzbzqgolzgpvz3zdsvmwma2gwjihya44systqf3my"
+
+	statuses := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(url + root)
+		if err == nil {
+			_ = resp.Body.Close()
+			statuses <- resp.StatusCode
+		}
+		close(statuses)
+	}()
+	<-appResolver.started
+
+	// over the limit
+	resp, err := http.Get(url + root)
+	req.NoError(err)
+	_ = resp.Body.Close()
+	req.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	req.Equal("1", resp.Header.Get("Retry-After"))
+
+	// metrics are not limited
+	resp, err = http.Get(url + "/metrics")
+	req.NoError(err)
+	_ = resp.Body.Close()
+	req.Equal(http.StatusOK, resp.StatusCode)
+
+	close(appResolver.release)
+	req.Equal(http.StatusNotFound, <-statuses)
+}
+
+func TestUnixSocket(t *testing.T) {
+	req := require.New(t)
+	// keep the path short, as socket paths are limited to about 100 bytes
+	dir, err := os.MkdirTemp("", "sg")
+	req.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stargate.sock")
+
+	// a stale socket, left without being cleaned up
+	stale, err := net.Listen("unix", path)
+	req.NoError(err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	req.NoError(stale.Close())
+
+	srv, err := server.New(
+		server.WithApp("ipfs", &blockingAppResolver{}),
+		server.WithAddress("unix:"+path),
+		server.WithMetrics("/metrics"),
+	)
+	req.NoError(err)
+	req.NoError(srv.Start())
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://stargate/metrics")
+	req.NoError(err)
+	_ = resp.Body.Close()
+	req.Equal(http.StatusOK, resp.StatusCode)
+
+	// a socket in use is not replaced
+	second, err := server.New(
+		server.WithApp("ipfs", &blockingAppResolver{}),
+		server.WithAddress("unix:"+path),
+	)
+	req.NoError(err)
+	req.Error(second.Start())
+
+	req.NoError(srv.Shutdown(context.Background()))
+	_, err = os.Stat(path)
+	req.True(os.IsNotExist(err), "socket should be removed on shutdown")
+}
+
+func TestStartError(t *testing.T) {
+	req := require.New(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	req.NoError(err)
+	defer listener.Close()
+	srv, err := server.New(
+		server.WithApp("ipfs", &blockingAppResolver{}),
+		server.WithAddress(listener.Addr().String()),
+	)
+	req.NoError(err)
+	req.Error(srv.Start())
+}
+
+func TestAdmin(t *testing.T) {
+	req := require.New(t)
+	admin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	srv, err := server.New(
+		server.WithApp("ipfs", &blockingAppResolver{}),
+		server.WithAddress("127.0.0.1:0"),
+		server.WithMetrics("/metrics"),
+		server.WithAdmin(admin, "127.0.0.1:0"),
+	)
+	req.NoError(err)
+	req.NoError(srv.Start())
+	defer srv.Shutdown(context.Background())
+
+	// the admin handler is only served on its own address
+	resp, err := http.Get("http://" + srv.AdminAddrs()[0].String() + "/metrics")
+	req.NoError(err)
+	_ = resp.Body.Close()
+	req.Equal(http.StatusTeapot, resp.StatusCode)
+	resp, err = http.Get("http://" + srv.Addrs()[0].String() + "/metrics")
+	req.NoError(err)
+	_ = resp.Body.Close()
+	req.Equal(http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often certificate files are checked for changes
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves a certificate from files, loading it again when the files change, so certificates can be
+// renewed without restarting the server
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	lk       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+	checked  time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) modified() ([2]time.Time, error) {
+	var modTimes [2]time.Time
+	for i, file := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTimes, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (cr *certReloader) load() error {
+	modTimes, err := cr.modified()
+	if err != nil {
+		return fmt.Errorf("reading TLS certificate: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	cr.cert = &cert
+	cr.modTimes = modTimes
+	cr.checked = time.Now()
+	return nil
+}
+
+// GetCertificate returns the current certificate, first reloading it if the files have changed. If reloading
+// fails, the previous certificate is kept
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lk.Lock()
+	defer cr.lk.Unlock()
+	if time.Since(cr.checked) < certCheckInterval {
+		return cr.cert, nil
+	}
+	cr.checked = time.Now()
+	modTimes, err := cr.modified()
+	if err != nil {
+		log.Warnf("checking TLS certificate files: %s", err)
+		return cr.cert, nil
+	}
+	if modTimes != cr.modTimes {
+		if err := cr.load(); err != nil {
+			log.Warnf("reloading TLS certificate: %s", err)
+		} else {
+			log.Infof("reloaded TLS certificate from %s", cr.certFile)
+		}
+	}
+	return cr.cert, nil
+}
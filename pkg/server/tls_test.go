@@ -0,0 +1,69 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// writeCert writes a self-signed certificate for a common name, with its key
+func writeCert(t *testing.T, certFile string, keyFile string, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+}
+
+func TestCertReloader(t *testing.T) {
+	req := require.New(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	commonName := func(cr *certReloader) string {
+		cert, err := cr.GetCertificate(nil)
+		req.NoError(err)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		req.NoError(err)
+		return parsed.Subject.CommonName
+	}
+
+	_, err := newCertReloader(certFile, keyFile)
+	req.Error(err)
+
+	writeCert(t, certFile, keyFile, "first")
+	cr, err := newCertReloader(certFile, keyFile)
+	req.NoError(err)
+	req.Equal("first", commonName(cr))
+
+	// changes are picked up on the next check
+	writeCert(t, certFile, keyFile, "second")
+	later := time.Now().Add(time.Minute)
+	req.NoError(os.Chtimes(certFile, later, later))
+	req.Equal("first", commonName(cr))
+	cr.checked = time.Time{}
+	req.Equal("second", commonName(cr))
+
+	// a broken certificate keeps the last good one
+	req.NoError(os.WriteFile(keyFile, []byte("not a key"), 0600))
+	cr.checked = time.Time{}
+	req.Equal("second", commonName(cr))
+}
@@ -2,6 +2,7 @@ package stargate
 
 import (
 	_ "embed"
+	"fmt"
 
 	"github.com/ipfs/go-cid"
 	bindnoderegistry "github.com/ipld/go-ipld-prime/node/bindnode/registry"
@@ -41,6 +42,9 @@ type Path struct {
 	Segments []string
 	// CIDs required, in order, to verify this segment of the path
 	Blocks BlockMetadata
+	// Missing, if set, is a path segment that does not exist in the directory at the end of Segments
+	// -- Blocks then contain every directory block (and HAMT shard) needed to prove its absence
+	Missing *string
 }
 
 // Ordering is a traversal order for transmitting blocks
@@ -53,13 +57,75 @@ const (
 	OrderingBreadthFirst Ordering = "BreadthFirst"
 )
 
+// PrefixRun is a run of consecutive blocks whose CIDs share a prefix
+type PrefixRun struct {
+	// Prefix is an index into the list of prefixes
+	Prefix int64
+	Count  int64
+}
+
+// StatusRun is a run of consecutive blocks sharing a status
+type StatusRun struct {
+	Status BlockStatus
+	Count  int64
+}
+
+// CompactBlockMetadata is an alternate encoding of BlockMetadata for long lists of blocks
+type CompactBlockMetadata struct {
+	// distinct CID prefixes (version, codec, multihash type and length) of the blocks
+	Prefixes   [][]byte
+	PrefixRuns []PrefixRun
+	// multihash digests of every block, concatenated in order -- the length of each is given by its prefix
+	Digests    []byte
+	StatusRuns []StatusRun
+}
+
 // Path is a StarGate message that provides information about resolution of the DAG at the end of a query
+// A single DAG may be split across several consecutive DAG messages, each followed by its own blocks
 type DAG struct {
 	Ordering Ordering
 	Blocks   BlockMetadata
+	// Compact, if set, replaces Blocks, which is then empty
+	Compact *CompactBlockMetadata
+}
+
+// ErrorCode classifies the failure reported by an Error message
+type ErrorCode string
+
+const (
+	// ErrorCodeNotFound means the requested root or a block needed to serve it could not be found
+	ErrorCodeNotFound ErrorCode = "NotFound"
+	// ErrorCodePathError means the requested path could not be traversed
+	ErrorCodePathError ErrorCode = "PathError"
+	// ErrorCodeInternal means the response failed for any other reason
+	ErrorCodeInternal ErrorCode = "Internal"
+)
+
+// Error is a StarGate message that ends a response that failed after it started
+type Error struct {
+	Code        ErrorCode
+	Description string
 }
 
-// Kind indicates whether a generic StarGate message is for a Path or a DAG
+func (e Error) Error() string {
+	return fmt.Sprintf("stargate error (%s): %s", e.Code, e.Description)
+}
+
+// Summary is a StarGate message that ends every response
+type Summary struct {
+	// number of blocks listed in Path and DAG messages, by status
+	Present   int64
+	NotSent   int64
+	Missing   int64
+	Duplicate int64
+	// total bytes of block data sent
+	Bytes int64
+	// Complete is true if the response contains every message needed to fulfill the request -- it is false after
+	// an error
+	Complete bool
+}
+
+// Kind indicates the type of a generic StarGate message
 type Kind string
 
 const (
@@ -67,13 +133,47 @@ const (
 	KindPath Kind = "Path"
 	// KindDAG indicates a DAG block
 	KindDAG Kind = "DAG"
+	// KindError indicates the response failed
+	KindError Kind = "Error"
+	// KindSummary indicates the end of the response
+	KindSummary Kind = "Summary"
 )
 
 // StarGateMessage is a complete StarGate message ahead of a block sequence
 type StarGateMessage struct {
-	Kind Kind
-	Path *Path
-	DAG  *DAG
+	Kind    Kind
+	Path    *Path
+	DAG     *DAG
+	Error   *Error
+	Summary *Summary
+}
+
+// Bloom is a bloom filter over the binary form of CIDs (see types.ipldsch for the exact hashing)
+type Bloom struct {
+	Bits      []byte
+	HashCount int64
+}
+
+// Haves describes the blocks a client already has, so they need not be sent again
+type Haves struct {
+	Cids  []cid.Cid
+	Bloom *Bloom
+}
+
+// BlockMetadata returns metadata for the blocks that follow this message -- only Path and DAG messages are
+// followed by blocks
+func (sgm *StarGateMessage) BlockMetadata() (BlockMetadata, error) {
+	switch sgm.Kind {
+	case KindPath:
+		return sgm.Path.Blocks, nil
+	case KindDAG:
+		if sgm.DAG.Compact != nil {
+			return sgm.DAG.Compact.Expand()
+		}
+		return sgm.DAG.Blocks, nil
+	default:
+		return nil, nil
+	}
 }
 
 //go:embed types.ipldsch
@@ -85,4 +185,7 @@ func init() {
 	if err := BindnodeRegistry.RegisterType((*StarGateMessage)(nil), string(embedSchema), "StarGateMessage"); err != nil {
 		panic(err.Error())
 	}
+	if err := BindnodeRegistry.RegisterType((*Haves)(nil), string(embedSchema), "Haves"); err != nil {
+		panic(err.Error())
+	}
 }
@@ -10,6 +10,7 @@ import (
 )
 
 func TestStarGateMessageRoundtrip(t *testing.T) {
+	missing := "bananas"
 	testCases := []struct {
 		name            string
 		starGateMessage stargate.StarGateMessage
@@ -33,6 +34,22 @@ func TestStarGateMessageRoundtrip(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "Path Message With Missing Segment",
+			starGateMessage: stargate.StarGateMessage{
+				Kind: stargate.KindPath,
+				Path: &stargate.Path{
+					Segments: []string{"apples"},
+					Blocks: stargate.BlockMetadata{
+						{
+							Link:   testutil.GenerateCid(),
+							Status: stargate.BlockStatusPresent,
+						},
+					},
+					Missing: &missing,
+				},
+			},
+		},
 		{
 			name: "Path Message",
 			starGateMessage: stargate.StarGateMessage{
@@ -52,6 +69,30 @@ func TestStarGateMessageRoundtrip(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "Error Message",
+			starGateMessage: stargate.StarGateMessage{
+				Kind: stargate.KindError,
+				Error: &stargate.Error{
+					Code:        stargate.ErrorCodePathError,
+					Description: "no such path",
+				},
+			},
+		},
+		{
+			name: "Summary Message",
+			starGateMessage: stargate.StarGateMessage{
+				Kind: stargate.KindSummary,
+				Summary: &stargate.Summary{
+					Present:   10,
+					NotSent:   5,
+					Missing:   1,
+					Duplicate: 2,
+					Bytes:     1 << 20,
+					Complete:  true,
+				},
+			},
+		},
 	}
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
@@ -0,0 +1,131 @@
+package unixfsresolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode"
+	"github.com/ipfs/go-unixfsnode/data"
+	stargate "github.com/ipfs/stargate/pkg"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/schema"
+)
+
+// errNoEntry indicates a directory does not contain a requested name
+var errNoEntry = errors.New("no file or folder")
+
+// ErrNotAbsent is returned when verifying a proof of absence for a path segment that actually exists
+type ErrNotAbsent struct {
+	Segment string
+}
+
+func (e ErrNotAbsent) Error() string {
+	return fmt.Sprintf("path segment %s exists, cannot prove it absent", e.Segment)
+}
+
+// proveAbsence loads every block needed to show that missing does not exist in the directory found by following
+// segments from the root, and returns a path message containing them
+func proveAbsence(ctx context.Context, lsys *ipld.LinkSystem, root cid.Cid, segments []string, missing string) (*stargate.Path, error) {
+	var loaded []cid.Cid
+	seen := make(map[cid.Cid]struct{})
+	recording := *lsys
+	recording.StorageReadOpener = func(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		c := lnk.(cidlink.Link).Cid
+		if _, ok := seen[c]; !ok {
+			seen[c] = struct{}{}
+			loaded = append(loaded, c)
+		}
+		return lsys.StorageReadOpener(lnkCtx, lnk)
+	}
+	if err := checkAbsent(ctx, &recording, root, segments, missing); err != nil {
+		return nil, err
+	}
+	blockMetadata := make(stargate.BlockMetadata, 0, len(loaded))
+	for _, c := range loaded {
+		blockMetadata = append(blockMetadata, stargate.BlockMetadatum{
+			Link:   c,
+			Status: stargate.BlockStatusPresent,
+		})
+	}
+	return &stargate.Path{
+		Segments: segments,
+		Blocks:   blockMetadata,
+		Missing:  &missing,
+	}, nil
+}
+
+// VerifyAbsence checks a path message proving a path segment does not exist. The link system should be backed only
+// by the blocks received with the path message. The root is the CID the path is resolved from.
+func VerifyAbsence(ctx context.Context, lsys *ipld.LinkSystem, root cid.Cid, path *stargate.Path) error {
+	if path.Missing == nil {
+		return errors.New("path message does not claim a missing segment")
+	}
+	return checkAbsent(ctx, lsys, root, path.Segments, *path.Missing)
+}
+
+// checkAbsent follows segments from the root through UnixFS directories, then confirms missing is not present in
+// the final directory
+func checkAbsent(ctx context.Context, lsys *ipld.LinkSystem, root cid.Cid, segments []string, missing string) error {
+	dir, err := loadDirectory(ctx, lsys, root)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		next, err := lookupLink(dir, segment)
+		if err != nil {
+			return err
+		}
+		dir, err = loadDirectory(ctx, lsys, next)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = dir.LookupByString(missing)
+	if err == nil {
+		return ErrNotAbsent{Segment: missing}
+	}
+	if errors.As(err, &schema.ErrNoSuchField{}) {
+		return nil
+	}
+	return err
+}
+
+func lookupLink(dir ipld.Node, segment string) (cid.Cid, error) {
+	nd, err := dir.LookupByString(segment)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("looking up %s: %w", segment, err)
+	}
+	lnk, err := nd.AsLink()
+	if err != nil {
+		return cid.Undef, err
+	}
+	return lnk.(cidlink.Link).Cid, nil
+}
+
+// loadDirectory loads a UnixFS directory or HAMT shard, erroring on any other kind of node
+func loadDirectory(ctx context.Context, lsys *ipld.LinkSystem, c cid.Cid) (ipld.Node, error) {
+	if c.Prefix().Codec != cid.DagProtobuf {
+		return nil, fmt.Errorf("%s is not a directory", c)
+	}
+	nd, err := lsys.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c}, dagpb.Type.PBNode)
+	if err != nil {
+		return nil, err
+	}
+	pbnd := nd.(dagpb.PBNode)
+	if !pbnd.FieldData().Exists() {
+		return nil, fmt.Errorf("%s is not a directory", c)
+	}
+	ufsdata, err := data.DecodeUnixFSData(pbnd.FieldData().Must().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if kind := ufsdata.FieldDataType().Int(); kind != data.Data_Directory && kind != data.Data_HAMTShard {
+		return nil, fmt.Errorf("%s is not a directory", c)
+	}
+	return unixfsnode.Reify(ipld.LinkContext{Ctx: ctx}, pbnd, lsys)
+}
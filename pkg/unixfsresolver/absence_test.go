@@ -0,0 +1,105 @@
+package unixfsresolver_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	quickbuilder "github.com/ipfs/go-unixfsnode/data/builder/quick"
+	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/ipfs/stargate/pkg/unixfsresolver"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAbsenceProofs(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	ls := cidlink.DefaultLinkSystem()
+	store := memstore.Store{Bag: make(map[string][]byte)}
+	ls.SetReadStorage(&store)
+	ls.SetWriteStorage(&store)
+
+	var root cid.Cid
+	err := quickbuilder.Store(&ls, func(b *quickbuilder.Builder) error {
+		hamtDir := map[string]quickbuilder.Node{}
+		for i := 0; i < 10000; i++ {
+			hamtDir[fmt.Sprintf("file%d.txt", i)] = b.NewBytesFile([]byte(fmt.Sprintf("data%d", i)))
+		}
+		root = b.NewMapDirectory(map[string]quickbuilder.Node{
+			"basic": b.NewMapDirectory(map[string]quickbuilder.Node{
+				"file.txt": b.NewBytesFile([]byte("data")),
+			}),
+			"hamt": b.NewMapDirectory(hamtDir),
+		}).Link().(cidlink.Link).Cid
+		return nil
+	})
+	req.NoError(err)
+
+	db := createTestStore(t)
+	req.NoError(db.AddRootRecursive(ctx, root, nil, &ls))
+
+	appResolver := unixfsresolver.NewUnixFSAppResolver(db, fixedLinkSystem{&ls})
+
+	testCases := []struct {
+		name     string
+		path     stargate.PathSegments
+		resolved []string
+		missing  string
+		existing string
+	}{
+		{
+			name:     "missing at root",
+			path:     stargate.PathSegments{"nope"},
+			resolved: []string{},
+			missing:  "nope",
+			existing: "basic",
+		},
+		{
+			name:     "basic directory",
+			path:     stargate.PathSegments{"basic", "nope.txt"},
+			resolved: []string{"basic"},
+			missing:  "nope.txt",
+			existing: "file.txt",
+		},
+		{
+			name:     "hamt directory",
+			path:     stargate.PathSegments{"hamt", "file10000.txt"},
+			resolved: []string{"hamt"},
+			missing:  "file10000.txt",
+			existing: "file1.txt",
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			req := require.New(t)
+			_, pathResolver, err := appResolver.GetResolver(ctx, root)
+			req.NoError(err)
+			_, _, _, err = pathResolver.ResolvePathSegments(ctx, testCase.path)
+			var errPathError stargate.ErrPathError
+			req.ErrorAs(err, &errPathError)
+			req.NotNil(errPathError.Proof)
+			req.Equal(testCase.resolved, errPathError.Proof.Segments)
+			req.Equal(testCase.missing, *errPathError.Proof.Missing)
+
+			// verify with a link system that only has access to the proof blocks
+			proofStore := memstore.Store{Bag: make(map[string][]byte)}
+			for _, block := range errPathError.Proof.Blocks {
+				req.Equal(stargate.BlockStatusPresent, block.Status)
+				data, err := store.Get(ctx, string(block.Link.Bytes()))
+				req.NoError(err)
+				req.NoError(proofStore.Put(ctx, string(block.Link.Bytes()), data))
+			}
+			proofLs := cidlink.DefaultLinkSystem()
+			proofLs.SetReadStorage(&proofStore)
+			req.NoError(unixfsresolver.VerifyAbsence(ctx, &proofLs, root, errPathError.Proof))
+
+			// a proof claiming an existing entry is absent must fail
+			falseProof := *errPathError.Proof
+			falseProof.Missing = &testCase.existing
+			req.ErrorAs(unixfsresolver.VerifyAbsence(ctx, &ls, root, &falseProof), &unixfsresolver.ErrNotAbsent{})
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package unixfsresolver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data"
+	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/ipfs/stargate/pkg/unixfsstore"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+)
+
+// entriesPageSize is the number of directory entries read from the store at a time
+const entriesPageSize = 256
+
+var _ stargate.Deserializer = (*UnixFSResolver)(nil)
+
+// Deserialize returns the content at the root of the resolver -- a reader for files, that loads only the blocks
+// holding the bytes read, or an iterator over the entries of a directory
+func (ufsr *UnixFSResolver) Deserialize(ctx context.Context) (*stargate.Deserialized, error) {
+	switch ufsr.root.Kind {
+	case data.Data_Directory, data.Data_HAMTShard:
+		return &stargate.Deserialized{
+			Directory: &directoryIterator{ctx: ctx, entries: ufsr.store.DirEntries(ctx, ufsr.root.CID, ufsr.root.Metadata)},
+		}, nil
+	case data.Data_Raw, data.Data_File:
+		size, err := ufsr.store.FileSize(ctx, ufsr.root.CID, ufsr.root.Metadata)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			// the file is a single block
+			rootData, err := blockData(ctx, ufsr.lsys, ufsr.root.CID)
+			if err != nil {
+				return nil, err
+			}
+			return &stargate.Deserialized{File: bytes.NewReader(rootData)}, nil
+		}
+		return &stargate.Deserialized{File: &fileReader{ctx: ctx, store: ufsr.store, lsys: ufsr.lsys, root: ufsr.root, size: size}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported file type: %d", ufsr.root.Kind)
+	}
+}
+
+// fileReader reads a UnixFS file spread over many blocks, using the byte ranges in the store to find the block
+// holding each byte
+type fileReader struct {
+	ctx    context.Context
+	store  UnixFSStore
+	lsys   *ipld.LinkSystem
+	root   unixfsstore.RootCID
+	size   uint64
+	offset uint64
+	leaf   *unixfsstore.FileLeaf
+	data   []byte
+}
+
+func (fr *fileReader) Read(p []byte) (int, error) {
+	if fr.offset >= fr.size {
+		return 0, io.EOF
+	}
+	if fr.leaf == nil || fr.offset < fr.leaf.ByteMin || fr.offset >= fr.leaf.ByteMax {
+		if err := fr.loadLeaf(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, fr.data[fr.offset-fr.leaf.ByteMin:])
+	fr.offset += uint64(n)
+	return n, nil
+}
+
+func (fr *fileReader) loadLeaf() error {
+	leaf, err := fr.store.FileLeafAt(fr.ctx, fr.root.CID, fr.root.Metadata, fr.offset)
+	if err != nil {
+		return err
+	}
+	if leaf == nil {
+		return fmt.Errorf("no block holds byte %d of %s", fr.offset, fr.root.CID)
+	}
+	leafData, err := blockData(fr.ctx, fr.lsys, leaf.CID)
+	if err != nil {
+		return err
+	}
+	if uint64(len(leafData)) != leaf.ByteMax-leaf.ByteMin {
+		return fmt.Errorf("block %s holds %d bytes, expected %d", leaf.CID, len(leafData), leaf.ByteMax-leaf.ByteMin)
+	}
+	fr.leaf, fr.data = leaf, leafData
+	return nil
+}
+
+func (fr *fileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += int64(fr.offset)
+	case io.SeekEnd:
+		offset += int64(fr.size)
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	fr.offset = uint64(offset)
+	return offset, nil
+}
+
+// blockData returns the file bytes held in a single block -- all of a raw block, or the data of a UnixFS node
+func blockData(ctx context.Context, lsys *ipld.LinkSystem, c cid.Cid) ([]byte, error) {
+	if c.Prefix().Codec == cid.Raw {
+		return lsys.LoadRaw(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c})
+	}
+	nd, err := lsys.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: c}, dagpb.Type.PBNode)
+	if err != nil {
+		return nil, err
+	}
+	pbnd := nd.(dagpb.PBNode)
+	if !pbnd.FieldData().Exists() {
+		return nil, fmt.Errorf("%s is not a UnixFS node", c)
+	}
+	ufsdata, err := data.DecodeUnixFSData(pbnd.FieldData().Must().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if !ufsdata.FieldData().Exists() {
+		return nil, nil
+	}
+	return ufsdata.FieldData().Must().Bytes(), nil
+}
+
+// directoryIterator returns the entries of a directory, reading them from the store a page at a time
+type directoryIterator struct {
+	ctx     context.Context
+	entries unixfsstore.EntryIterator
+	page    []unixfsstore.DirEntry
+	done    bool
+}
+
+var _ stargate.DirectoryIterator = (*directoryIterator)(nil)
+
+func (di *directoryIterator) Next() (*stargate.DirectoryEntry, error) {
+	if err := di.fill(); err != nil {
+		return nil, err
+	}
+	if len(di.page) == 0 {
+		return nil, errors.New("no more entries")
+	}
+	entry := di.page[0]
+	di.page = di.page[1:]
+	return &stargate.DirectoryEntry{
+		Name:        entry.Name,
+		Link:        entry.CID,
+		IsDirectory: entry.Kind == data.Data_Directory || entry.Kind == data.Data_HAMTShard,
+	}, nil
+}
+
+// Done reads ahead so that it is accurate even when the last page is exactly full
+func (di *directoryIterator) Done() bool {
+	if err := di.fill(); err != nil {
+		// let the error surface from Next
+		return false
+	}
+	return len(di.page) == 0
+}
+
+func (di *directoryIterator) fill() error {
+	if len(di.page) > 0 || di.done {
+		return nil
+	}
+	page, err := di.entries.Next(di.ctx, entriesPageSize)
+	if err != nil {
+		return err
+	}
+	di.page = page
+	di.done = len(page) == 0
+	return nil
+}
@@ -0,0 +1,129 @@
+package unixfsresolver_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	quickbuilder "github.com/ipfs/go-unixfsnode/data/builder/quick"
+	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/ipfs/stargate/pkg/unixfsresolver"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeserializeFile(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	ls := cidlink.DefaultLinkSystem()
+	store := memstore.Store{Bag: make(map[string][]byte)}
+	ls.SetReadStorage(&store)
+	ls.SetWriteStorage(&store)
+
+	content := make([]byte, 1<<20)
+	_, err := rand.Read(content)
+	req.NoError(err)
+	n, _, err := builder.BuildUnixFSFile(bytes.NewReader(content), "size-4096", &ls)
+	req.NoError(err)
+	root := n.(cidlink.Link).Cid
+
+	db := createTestStore(t)
+	req.NoError(db.AddRoot(ctx, root, nil, &ls))
+	file := deserialize(ctx, t, unixfsresolver.NewUnixFSAppResolver(db, fixedLinkSystem{&ls}), root).File
+	req.NotNil(file)
+
+	// read the whole file
+	read, err := io.ReadAll(file)
+	req.NoError(err)
+	req.Equal(content, read)
+
+	// read a range crossing block boundaries, counting the blocks loaded
+	loads := 0
+	opener := ls.StorageReadOpener
+	ls.StorageReadOpener = func(lnkCtx ipld.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		loads++
+		return opener(lnkCtx, lnk)
+	}
+	offset, err := file.Seek(-10000, io.SeekEnd)
+	req.NoError(err)
+	req.Equal(int64(len(content)-10000), offset)
+	read = make([]byte, 5000)
+	_, err = io.ReadFull(file, read)
+	req.NoError(err)
+	req.Equal(content[len(content)-10000:len(content)-5000], read)
+	req.Equal(2, loads)
+
+	// seek past the end
+	_, err = file.Seek(1, io.SeekEnd)
+	req.NoError(err)
+	_, err = file.Read(read)
+	req.ErrorIs(err, io.EOF)
+}
+
+func TestDeserializeDirectory(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	ls := cidlink.DefaultLinkSystem()
+	store := memstore.Store{Bag: make(map[string][]byte)}
+	ls.SetReadStorage(&store)
+	ls.SetWriteStorage(&store)
+
+	var root cid.Cid
+	names := []string{"subdir"}
+	err := quickbuilder.Store(&ls, func(b *quickbuilder.Builder) error {
+		entries := map[string]quickbuilder.Node{
+			"subdir": b.NewMapDirectory(map[string]quickbuilder.Node{
+				"file.txt": b.NewBytesFile([]byte("data")),
+			}),
+		}
+		// enough entries to be sharded and to span pages
+		for i := 0; i < 1000; i++ {
+			name := fmt.Sprintf("file%d.txt", i)
+			entries[name] = b.NewBytesFile([]byte(name))
+			names = append(names, name)
+		}
+		root = b.NewMapDirectory(entries).Link().(cidlink.Link).Cid
+		return nil
+	})
+	req.NoError(err)
+	sort.Strings(names)
+
+	db := createTestStore(t)
+	req.NoError(db.AddRootRecursive(ctx, root, nil, &ls))
+	appResolver := unixfsresolver.NewUnixFSAppResolver(db, fixedLinkSystem{&ls})
+
+	directory := deserialize(ctx, t, appResolver, root).Directory
+	req.NotNil(directory)
+	var listed []string
+	for !directory.Done() {
+		entry, err := directory.Next()
+		req.NoError(err)
+		req.Equal(entry.Name == "subdir", entry.IsDirectory)
+		file := deserialize(ctx, t, appResolver, entry.Link)
+		if entry.IsDirectory {
+			req.NotNil(file.Directory)
+		} else {
+			read, err := io.ReadAll(file.File)
+			req.NoError(err)
+			req.Equal(entry.Name, string(read))
+		}
+		listed = append(listed, entry.Name)
+	}
+	req.Equal(names, listed)
+}
+
+func deserialize(ctx context.Context, t *testing.T, appResolver stargate.AppResolver, root cid.Cid) *stargate.Deserialized {
+	_, pathResolver, err := appResolver.GetResolver(ctx, root)
+	require.NoError(t, err)
+	deserialized, err := pathResolver.(stargate.Deserializer).Deserialize(ctx)
+	require.NoError(t, err)
+	return deserialized
+}
@@ -4,23 +4,30 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/go-unixfsnode/data"
 	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/ipfs/stargate/pkg/tracing"
 	"github.com/ipfs/stargate/pkg/unixfsstore"
 	"github.com/ipld/go-ipld-prime"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/multierr"
 )
 
 // UnixFSStore is an interface for fetching metadata about UnixFS queries
 type UnixFSStore interface {
-	DirLs(ctx context.Context, root cid.Cid, metadata []byte) ([][]unixfsstore.TraversedCID, error)
+	DirLinks(ctx context.Context, root cid.Cid, metadata []byte) unixfsstore.LinkIterator
+	DirEntries(ctx context.Context, root cid.Cid, metadata []byte) unixfsstore.EntryIterator
 	DirPath(ctx context.Context, root cid.Cid, metadata []byte, path string) ([]cid.Cid, error)
-	FileAll(ctx context.Context, root cid.Cid, metadata []byte) ([][]unixfsstore.TraversedCID, error)
-	FileByteRange(ctx context.Context, root cid.Cid, metadata []byte, byteMin uint64, byteMax uint64) ([][]unixfsstore.TraversedCID, error)
+	FileLinks(ctx context.Context, root cid.Cid, metadata []byte, byteRanges []unixfsstore.ByteRange) unixfsstore.LinkIterator
+	FileSize(ctx context.Context, root cid.Cid, metadata []byte) (uint64, error)
+	FileLeafAt(ctx context.Context, root cid.Cid, metadata []byte, offset uint64) (*unixfsstore.FileLeaf, error)
 	RootCID(ctx context.Context, root cid.Cid) ([]unixfsstore.RootCID, error)
 	RootCIDWithMetadata(ctx context.Context, root cid.Cid, metadata []byte) (*unixfsstore.RootCID, error)
 }
@@ -58,9 +65,11 @@ func (ufsar *UnixFSAppResolver) GetResolver(ctx context.Context, root cid.Cid) (
 	// "the first that works"
 	var totalError error
 	for _, returnedRootCid := range rootCids {
-		lsys, err := ufsar.linkSystemResolver.ResolveLinkSystem(ctx, returnedRootCid.CID, returnedRootCid.Metadata)
+		spanCtx, span := tracing.StartSpan(ctx, "ResolveLinkSystem", trace.WithAttributes(attribute.String("stargate.root", returnedRootCid.CID.String())))
+		lsys, err := ufsar.linkSystemResolver.ResolveLinkSystem(spanCtx, returnedRootCid.CID, returnedRootCid.Metadata)
+		tracing.EndSpan(span, err)
 		if err == nil {
-			return lsys, &UnixFSResolver{ufsar.store, returnedRootCid}, nil
+			return lsys, &UnixFSResolver{ufsar.store, lsys, returnedRootCid}, nil
 		}
 		totalError = multierr.Append(totalError, err)
 	}
@@ -70,6 +79,7 @@ func (ufsar *UnixFSAppResolver) GetResolver(ctx context.Context, root cid.Cid) (
 // UnixFSResolver implements an PathResolver for the UnixFS domain
 type UnixFSResolver struct {
 	store UnixFSStore
+	lsys  *ipld.LinkSystem
 	root  unixfsstore.RootCID
 }
 
@@ -85,6 +95,7 @@ type traversalState struct {
 // - no unresolved segments
 // - a path resolver operating at the end of the path
 // On error, all values are be nil except the error value
+// If a path segment does not exist, the returned ErrPathError carries a proof of its absence
 func (ufsr *UnixFSResolver) ResolvePathSegments(ctx context.Context, path stargate.PathSegments) (*stargate.Path, stargate.PathSegments, stargate.PathResolver, error) {
 	state := traversalState{
 		blockMetadata: make(stargate.BlockMetadata, 0, len(path)*4),
@@ -92,17 +103,32 @@ func (ufsr *UnixFSResolver) ResolvePathSegments(ctx context.Context, path starga
 		root:        ufsr.root,
 		currentPath: "",
 	}
-	for _, segment := range path {
+	for i, segment := range path {
 		var err error
 		state, err = ufsr.traverseSegment(ctx, state, segment)
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, nil, ufsr.withAbsenceProof(ctx, err, path[:i], segment)
 		}
 	}
 	return &stargate.Path{
 		Segments: path,
 		Blocks:   state.blockMetadata,
-	}, nil, &UnixFSResolver{store: ufsr.store, root: state.root}, nil
+	}, nil, &UnixFSResolver{store: ufsr.store, lsys: ufsr.lsys, root: state.root}, nil
+}
+
+// withAbsenceProof attaches a proof to a path error caused by a missing directory entry
+// if a proof cannot be constructed, the original error is returned as is
+func (ufsr *UnixFSResolver) withAbsenceProof(ctx context.Context, err error, resolved []string, missing string) error {
+	var errPathError stargate.ErrPathError
+	if ufsr.lsys == nil || !errors.As(err, &errPathError) || !errors.Is(errPathError.Err, errNoEntry) {
+		return err
+	}
+	proof, proofErr := proveAbsence(ctx, ufsr.lsys, ufsr.root.CID, resolved, missing)
+	if proofErr != nil {
+		return err
+	}
+	errPathError.Proof = proof
+	return errPathError
 }
 
 func (ufsr *UnixFSResolver) traverseSegment(ctx context.Context, state traversalState, segment string) (traversalState, error) {
@@ -116,7 +142,7 @@ func (ufsr *UnixFSResolver) traverseSegment(ctx context.Context, state traversal
 		return traversalState{}, err
 	}
 	if len(pathCids) == 0 {
-		return traversalState{}, stargate.ErrPathError{Cid: state.root.CID, Path: state.currentPath, Err: fmt.Errorf("no file or folder %s", segment)}
+		return traversalState{}, stargate.ErrPathError{Cid: state.root.CID, Path: state.currentPath, Err: fmt.Errorf("%w %s", errNoEntry, segment)}
 	}
 	for _, pathCid := range pathCids[:len(pathCids)-1] {
 		state.blockMetadata = append(state.blockMetadata, stargate.BlockMetadatum{
@@ -138,172 +164,225 @@ func (ufsr *UnixFSResolver) traverseSegment(ctx context.Context, state traversal
 	return state, nil
 }
 
+// DefaultMaxBlocksPerMessage is the default maximum number of blocks listed in a single DAG message
+const DefaultMaxBlocksPerMessage = 4096
+
+// seenCacheSize bounds how many recently listed CIDs are remembered in order to mark repeats as duplicates
+const seenCacheSize = 1 << 16
+
 // UnixFSQueryResolver implements an QueryResolver for the UnixFS domain
+// It reads links from the store a page at a time as messages are requested, so memory use is bounded by the
+// message size rather than the size of the DAG
 type UnixFSQueryResolver struct {
-	ctx       context.Context
-	query     stargate.Query
-	store     UnixFSStore
-	root      unixfsstore.RootCID
-	fulfilled bool
+	ctx        context.Context
+	links      unixfsstore.LinkIterator
+	maxBlocks  int
+	compact    bool
+	sendLeaves bool
+	haves      *stargate.HaveSet
+	seen       *lru.Cache
+	pending    stargate.BlockMetadata
+	exhausted  bool
+	err        error
 }
 
 // ResolveQuery returns a resolver to fulfill the DAG part of a UnixFS query after path resolution with the
 // given query string.
-func (ufsr *UnixFSResolver) ResolveQuery(ctx context.Context, query stargate.Query) (stargate.QueryResolver, error) {
-	return &UnixFSQueryResolver{
-		ctx:   ctx,
-		query: query,
-		store: ufsr.store,
-		root:  ufsr.root,
-	}, nil
-}
-
-// Done indicates if a UnixFS query resolution is complete. Since there is only one message for UnixFS query resolution,
-// Done is true after a single call to Next
-func (ufsqr *UnixFSQueryResolver) Done() bool {
-	return ufsqr.fulfilled
-}
-
-// Next fulfilles a UnixFS DAG query
+// the query parameter 'maxblocks' sets the maximum number of blocks listed in each DAG message
+// the query parameter 'compact' encodes block lists in their compact form
 // For files:
 // the query parameter 'noleaves' will prevent leaves from being sent
-// the query parameter 'bytes' will narrow results to a specifc range of bytes in the UnixFS file
-func (ufsqr *UnixFSQueryResolver) Next() (*stargate.DAG, error) {
-	if ufsqr.fulfilled {
-		return nil, stargate.ErrNoMoreMessages{}
+// the query parameter 'bytes' will narrow results to specifc ranges of bytes in the UnixFS file -- each value is
+// 'start-end' (end exclusive), 'start-' for the rest of the file, or '-length' for the last length bytes
+// Blocks the client has are listed as duplicates rather than sent
+func (ufsr *UnixFSResolver) ResolveQuery(ctx context.Context, query stargate.Query, haves *stargate.HaveSet) (stargate.QueryResolver, error) {
+	maxBlocks := DefaultMaxBlocksPerMessage
+	if maxBlocksParams, ok := query["maxblocks"]; ok {
+		parsed, err := strconv.ParseUint(maxBlocksParams[0], 10, 31)
+		if err != nil || parsed == 0 {
+			return nil, fmt.Errorf("incorrectly formatted maxblocks param")
+		}
+		maxBlocks = int(parsed)
+	}
+	_, compact := query["compact"]
+	seen, err := lru.New(seenCacheSize)
+	if err != nil {
+		return nil, err
 	}
-	defer func() {
-		ufsqr.fulfilled = true
-	}()
-	switch ufsqr.root.Kind {
+	ufsqr := &UnixFSQueryResolver{
+		ctx:       ctx,
+		maxBlocks: maxBlocks,
+		compact:   compact,
+		haves:     haves,
+		seen:      seen,
+	}
+	switch ufsr.root.Kind {
 	case data.Data_Directory, data.Data_HAMTShard:
-		return ufsqr.directoryQuery()
+		ufsqr.links = ufsr.store.DirLinks(ctx, ufsr.root.CID, ufsr.root.Metadata)
 	case data.Data_Raw:
-		return &stargate.DAG{
-			Ordering: stargate.OrderingBreadthFirst,
-			Blocks: stargate.BlockMetadata{
-				{
-					Link:   ufsqr.root.CID,
-					Status: stargate.BlockStatusPresent,
-				},
-			},
-		}, nil
+		ufsqr.exhausted = true
 	case data.Data_File:
-		return ufsqr.fileQuery()
+		var byteRanges []unixfsstore.ByteRange
+		if bytesParams, ok := query["bytes"]; ok {
+			size, err := ufsr.store.FileSize(ctx, ufsr.root.CID, ufsr.root.Metadata)
+			if err != nil {
+				return nil, err
+			}
+			byteRanges, err = parseByteRanges(bytesParams, size)
+			if err != nil {
+				return nil, err
+			}
+		}
+		_, noLeaves := query["noleaves"]
+		ufsqr.sendLeaves = !noLeaves
+		ufsqr.links = ufsr.store.FileLinks(ctx, ufsr.root.CID, ufsr.root.Metadata, byteRanges)
 	default:
-		return nil, fmt.Errorf("unsupported file type: %d", ufsqr.root.Kind)
+		return nil, fmt.Errorf("unsupported file type: %d", ufsr.root.Kind)
 	}
+	ufsqr.pending = append(ufsqr.pending, ufsqr.blockMetadatum(unixfsstore.TraversedLink{
+		TraversedCID: unixfsstore.TraversedCID{CID: ufsr.root.CID},
+		InRange:      true,
+	}))
+	return ufsqr, nil
+}
 
+// Done indicates if a UnixFS query resolution is complete. The blocks for the query are split into DAG messages of
+// at most maxblocks entries, so Done is true once all of them have been returned by Next
+func (ufsqr *UnixFSQueryResolver) Done() bool {
+	return ufsqr.exhausted && len(ufsqr.pending) == 0 && ufsqr.err == nil
 }
 
-func (ufsqr *UnixFSQueryResolver) directoryQuery() (*stargate.DAG, error) {
-	cidLayers, err := ufsqr.store.DirLs(ufsqr.ctx, ufsqr.root.CID, ufsqr.root.Metadata)
-	if err != nil {
+// Next fulfilles the next part of a UnixFS DAG query
+func (ufsqr *UnixFSQueryResolver) Next() (*stargate.DAG, error) {
+	if ufsqr.err != nil {
+		return nil, ufsqr.err
+	}
+	if ufsqr.Done() {
+		return nil, stargate.ErrNoMoreMessages{}
+	}
+	if err := ufsqr.fill(ufsqr.maxBlocks); err != nil {
 		return nil, err
 	}
-	totalCids := 1
-	for _, cidLayer := range cidLayers {
-		totalCids += len(cidLayer)
-	}
-	blockMetadata := make(stargate.BlockMetadata, 0, totalCids)
-	blockMetadata = append(blockMetadata, stargate.BlockMetadatum{
-		Link:   ufsqr.root.CID,
-		Status: stargate.BlockStatusPresent,
-	})
-	for _, cidLayer := range cidLayers {
-		for _, traversedCID := range cidLayer {
-			status := stargate.BlockStatusPresent
-			if traversedCID.IsLeaf {
-				status = stargate.BlockStatusNotSent
-			}
-			blockMetadata = append(blockMetadata, stargate.BlockMetadatum{
-				Link:   traversedCID.CID,
-				Status: status,
-			})
-		}
+	next := ufsqr.pending
+	if len(next) > ufsqr.maxBlocks {
+		next = next[:ufsqr.maxBlocks]
+	}
+	ufsqr.pending = ufsqr.pending[len(next):]
+	// look ahead so that Done is accurate, reporting any error on the following call to Next
+	ufsqr.err = ufsqr.fill(1)
+	if ufsqr.compact {
+		return &stargate.DAG{
+			Ordering: stargate.OrderingBreadthFirst,
+			Compact:  stargate.CompactBlocks(next),
+		}, nil
 	}
 	return &stargate.DAG{
 		Ordering: stargate.OrderingBreadthFirst,
-		Blocks:   blockMetadata,
+		Blocks:   next,
 	}, nil
 }
 
-func (ufsqr *UnixFSQueryResolver) fileQuery() (*stargate.DAG, error) {
-	cidLayers, err := ufsqr.store.FileAll(ufsqr.ctx, ufsqr.root.CID, ufsqr.root.Metadata)
-	if err != nil {
-		return nil, err
-	}
-
-	var byteCidSets []map[cid.Cid]struct{}
-	if bytesParams, ok := ufsqr.query["bytes"]; ok {
-		start, end, err := splitBytesParams(bytesParams)
+// fill reads pages of links from the store until at least count blocks are pending or the links are exhausted
+func (ufsqr *UnixFSQueryResolver) fill(count int) error {
+	for len(ufsqr.pending) < count && !ufsqr.exhausted {
+		links, err := ufsqr.links.Next(ufsqr.ctx, ufsqr.maxBlocks)
 		if err != nil {
-			return nil, fmt.Errorf("incorrectly formatted byte param")
+			return err
 		}
-		byteCidLayers, err := ufsqr.store.FileByteRange(ufsqr.ctx, ufsqr.root.CID, ufsqr.root.Metadata, start, end)
-		if err != nil {
-			return nil, err
+		if len(links) == 0 {
+			ufsqr.exhausted = true
 		}
-		byteCidSets = make([]map[cid.Cid]struct{}, len(byteCidLayers))
-		for i, byteCidLayer := range byteCidLayers {
-			byteCidSet := make(map[cid.Cid]struct{}, len(byteCidLayer))
-			for _, traversedCid := range byteCidLayer {
-				byteCidSet[traversedCid.CID] = struct{}{}
-			}
-			byteCidSets[i] = byteCidSet
+		for _, link := range links {
+			ufsqr.pending = append(ufsqr.pending, ufsqr.blockMetadatum(link))
 		}
 	}
-	sendLeaves := true
-	if _, ok := ufsqr.query["noleaves"]; ok {
-		sendLeaves = false
+	return nil
+}
+
+// blockMetadatum determines the status of a link. Links already listed recently are marked as duplicates, unless
+// they were not sent before and must be sent now. Links the client has are also marked as duplicates
+func (ufsqr *UnixFSQueryResolver) blockMetadatum(link unixfsstore.TraversedLink) stargate.BlockMetadatum {
+	status := stargate.BlockStatusPresent
+	if !link.InRange || (link.IsLeaf && !ufsqr.sendLeaves) {
+		status = stargate.BlockStatusNotSent
+	}
+	if previous, ok := ufsqr.seen.Get(link.CID); ok && (previous == stargate.BlockStatusPresent || status == stargate.BlockStatusNotSent) {
+		status = stargate.BlockStatusDuplicate
+	} else {
+		ufsqr.seen.Add(link.CID, status)
+		if status == stargate.BlockStatusPresent && ufsqr.haves.Has(link.CID) {
+			status = stargate.BlockStatusDuplicate
+		}
 	}
+	return stargate.BlockMetadatum{
+		Link:   link.CID,
+		Status: status,
+	}
+}
 
-	totalCids := 1
-	for _, cidLayer := range cidLayers {
-		totalCids += len(cidLayer)
-	}
-	blockMetadata := make(stargate.BlockMetadata, 0, totalCids)
-	blockMetadata = append(blockMetadata, stargate.BlockMetadatum{
-		Link:   ufsqr.root.CID,
-		Status: stargate.BlockStatusPresent,
-	})
-	for i, cidLayer := range cidLayers {
-		for _, traversedCID := range cidLayer {
-			status := stargate.BlockStatusPresent
-			if byteCidSets != nil {
-				if _, ok := byteCidSets[i][traversedCID.CID]; !ok {
-					status = stargate.BlockStatusNotSent
-				}
-			}
-			if traversedCID.IsLeaf && !sendLeaves {
-				status = stargate.BlockStatusNotSent
-			}
-			blockMetadata = append(blockMetadata, stargate.BlockMetadatum{
-				Link:   traversedCID.CID,
-				Status: status,
-			})
+// openEnded is the end of a byte range running to the end of a file
+const openEnded = math.MaxInt64
+
+// parseByteRanges parses byte range params for a file of the given size. A size of zero means the size is unknown,
+// as for a file in a single block
+func parseByteRanges(bytesParams []string, size uint64) ([]unixfsstore.ByteRange, error) {
+	byteRanges := make([]unixfsstore.ByteRange, 0, len(bytesParams))
+	satisfiable := size == 0
+	for _, bytesParam := range bytesParams {
+		byteRange, err := parseByteRange(bytesParam, size)
+		if errors.Is(err, errEmptyRange) {
+			// an empty range selects nothing, so it can't be satisfied whatever the size of the file
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("incorrectly formatted byte param: %w", err)
 		}
+		satisfiable = satisfiable || byteRange.Min < size
+		byteRanges = append(byteRanges, byteRange)
 	}
-	return &stargate.DAG{
-		Ordering: stargate.OrderingBreadthFirst,
-		Blocks:   blockMetadata,
-	}, nil
+	if !satisfiable || len(byteRanges) == 0 {
+		return nil, stargate.ErrRangeNotSatisfiable{Size: size}
+	}
+	return byteRanges, nil
 }
 
-func splitBytesParams(bytesParams []string) (uint64, uint64, error) {
-	// only use the first
-	bytesParam := bytesParams[0]
-	parts := strings.Split(bytesParam, "-")
-	if len(parts) != 2 {
-		return 0, 0, errors.New("must be seperated by a single dash")
-	}
-	start, err := strconv.ParseUint(parts[0], 10, 64)
+// errEmptyRange is returned for a byte range of no bytes
+var errEmptyRange = errors.New("range is empty")
+
+func parseByteRange(bytesParam string, size uint64) (unixfsstore.ByteRange, error) {
+	startParam, endParam, ok := strings.Cut(bytesParam, "-")
+	if !ok || strings.Contains(endParam, "-") {
+		return unixfsstore.ByteRange{}, errors.New("must be seperated by a single dash")
+	}
+	if startParam == "" {
+		length, err := strconv.ParseUint(endParam, 10, 63)
+		if err != nil {
+			return unixfsstore.ByteRange{}, err
+		}
+		if length == 0 {
+			return unixfsstore.ByteRange{}, errEmptyRange
+		}
+		if length > size {
+			length = size
+		}
+		return unixfsstore.ByteRange{Min: size - length, Max: openEnded}, nil
+	}
+	start, err := strconv.ParseUint(startParam, 10, 63)
 	if err != nil {
-		return 0, 0, err
+		return unixfsstore.ByteRange{}, err
+	}
+	if endParam == "" {
+		return unixfsstore.ByteRange{Min: start, Max: openEnded}, nil
 	}
-	end, err := strconv.ParseUint(parts[1], 10, 64)
+	end, err := strconv.ParseUint(endParam, 10, 63)
 	if err != nil {
-		return 0, 0, err
+		return unixfsstore.ByteRange{}, err
+	}
+	if end < start {
+		return unixfsstore.ByteRange{}, errors.New("end must not precede start")
+	}
+	if end == start {
+		return unixfsstore.ByteRange{}, errEmptyRange
 	}
-	return start, end, nil
+	return unixfsstore.ByteRange{Min: start, Max: end}, nil
 }
@@ -0,0 +1,181 @@
+package unixfsresolver_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data/builder"
+	stargate "github.com/ipfs/stargate/pkg"
+	"github.com/ipfs/stargate/pkg/unixfsresolver"
+	"github.com/ipfs/stargate/pkg/unixfsstore/sql"
+	"github.com/ipld/go-ipld-prime"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	"github.com/ipld/go-ipld-prime/storage/memstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitQuery(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	ls := cidlink.DefaultLinkSystem()
+	store := memstore.Store{Bag: make(map[string][]byte)}
+	ls.SetReadStorage(&store)
+	ls.SetWriteStorage(&store)
+
+	delimited := io.LimitReader(rand.Reader, 1<<20)
+	n, _, err := builder.BuildUnixFSFile(delimited, "size-4096", &ls)
+	req.NoError(err)
+	root := n.(cidlink.Link).Cid
+
+	db := createTestStore(t)
+	req.NoError(db.AddRoot(ctx, root, nil, &ls))
+	appResolver := unixfsresolver.NewUnixFSAppResolver(db, fixedLinkSystem{&ls})
+
+	collect := func(query stargate.Query) []*stargate.DAG {
+		_, pathResolver, err := appResolver.GetResolver(ctx, root)
+		req.NoError(err)
+		queryResolver, err := pathResolver.ResolveQuery(ctx, query, nil)
+		req.NoError(err)
+		var dags []*stargate.DAG
+		for !queryResolver.Done() {
+			dag, err := queryResolver.Next()
+			req.NoError(err)
+			dags = append(dags, dag)
+		}
+		_, err = queryResolver.Next()
+		req.ErrorIs(err, stargate.ErrNoMoreMessages{})
+		return dags
+	}
+
+	unsplit := collect(stargate.Query{})
+	req.Len(unsplit, 1)
+	// root + 2 intermediate nodes + 256 leaves
+	req.Len(unsplit[0].Blocks, 259)
+
+	split := collect(stargate.Query{"maxblocks": {"100"}})
+	req.Len(split, 3)
+	var joined stargate.BlockMetadata
+	for _, dag := range split {
+		req.LessOrEqual(len(dag.Blocks), 100)
+		joined = append(joined, dag.Blocks...)
+	}
+	req.Equal(unsplit[0].Blocks, joined)
+
+	compact := collect(stargate.Query{"maxblocks": {"100"}, "compact": {""}})
+	req.Len(compact, 3)
+	joined = nil
+	for _, dag := range compact {
+		req.Empty(dag.Blocks)
+		expanded, err := dag.Compact.Expand()
+		req.NoError(err)
+		joined = append(joined, expanded...)
+	}
+	req.Equal(unsplit[0].Blocks, joined)
+
+	_, pathResolver, err := appResolver.GetResolver(ctx, root)
+	req.NoError(err)
+	_, err = pathResolver.ResolveQuery(ctx, stargate.Query{"maxblocks": {"0"}}, nil)
+	req.Error(err)
+
+	// blocks the client has are not sent
+	var haveCids []cid.Cid
+	for _, blockMetadatum := range unsplit[0].Blocks[:100] {
+		haveCids = append(haveCids, blockMetadatum.Link)
+	}
+	haves, err := stargate.NewHaveSet(&stargate.Haves{Cids: haveCids})
+	req.NoError(err)
+	_, pathResolver, err = appResolver.GetResolver(ctx, root)
+	req.NoError(err)
+	queryResolver, err := pathResolver.ResolveQuery(ctx, stargate.Query{}, haves)
+	req.NoError(err)
+	dag, err := queryResolver.Next()
+	req.NoError(err)
+	req.True(queryResolver.Done())
+	for i, blockMetadatum := range dag.Blocks {
+		req.Equal(unsplit[0].Blocks[i].Link, blockMetadatum.Link)
+		if i < 100 {
+			req.Equal(stargate.BlockStatusDuplicate, blockMetadatum.Status)
+		} else {
+			req.Equal(stargate.BlockStatusPresent, blockMetadatum.Status)
+		}
+	}
+}
+
+func TestRepeatedBlocks(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+	ls := cidlink.DefaultLinkSystem()
+	store := memstore.Store{Bag: make(map[string][]byte)}
+	ls.SetReadStorage(&store)
+	ls.SetWriteStorage(&store)
+
+	// every leaf of a file of zeros is the same block
+	n, _, err := builder.BuildUnixFSFile(bytes.NewReader(make([]byte, 10*4096)), "size-4096", &ls)
+	req.NoError(err)
+	root := n.(cidlink.Link).Cid
+
+	db := createTestStore(t)
+	req.NoError(db.AddRoot(ctx, root, nil, &ls))
+	appResolver := unixfsresolver.NewUnixFSAppResolver(db, fixedLinkSystem{&ls})
+
+	resolve := func(query stargate.Query) []stargate.BlockStatus {
+		_, pathResolver, err := appResolver.GetResolver(ctx, root)
+		req.NoError(err)
+		queryResolver, err := pathResolver.ResolveQuery(ctx, query, nil)
+		req.NoError(err)
+		dag, err := queryResolver.Next()
+		req.NoError(err)
+		req.True(queryResolver.Done())
+		statuses := make([]stargate.BlockStatus, 0, len(dag.Blocks))
+		for _, blockMetadatum := range dag.Blocks {
+			statuses = append(statuses, blockMetadatum.Status)
+		}
+		return statuses
+	}
+
+	present, notSent, duplicate := stargate.BlockStatusPresent, stargate.BlockStatusNotSent, stargate.BlockStatusDuplicate
+	req.Equal([]stargate.BlockStatus{present, present, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate}, resolve(nil))
+	// a repeated block is sent the first time it falls in range
+	req.Equal([]stargate.BlockStatus{present, notSent, duplicate, present, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate}, resolve(stargate.Query{"bytes": {"8192-12288"}}))
+	req.Equal([]stargate.BlockStatus{present, notSent, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate}, resolve(stargate.Query{"noleaves": {""}}))
+	// suffix, open ended and multiple ranges
+	req.Equal([]stargate.BlockStatus{present, notSent, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, present}, resolve(stargate.Query{"bytes": {"-4096"}}))
+	req.Equal([]stargate.BlockStatus{present, notSent, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, present, duplicate}, resolve(stargate.Query{"bytes": {"32768-"}}))
+	req.Equal([]stargate.BlockStatus{present, present, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate}, resolve(stargate.Query{"bytes": {"0-1", "-1"}}))
+
+	_, pathResolver, err := appResolver.GetResolver(ctx, root)
+	req.NoError(err)
+	_, err = pathResolver.ResolveQuery(ctx, stargate.Query{"bytes": {"40960-", "50000-50001"}}, nil)
+	req.ErrorIs(err, stargate.ErrRangeNotSatisfiable{Size: 40960})
+	_, err = pathResolver.ResolveQuery(ctx, stargate.Query{"bytes": {"10-5"}}, nil)
+	req.Error(err)
+	// empty ranges can't be satisfied, but don't stop other ranges from being
+	_, err = pathResolver.ResolveQuery(ctx, stargate.Query{"bytes": {"-0"}}, nil)
+	req.ErrorIs(err, stargate.ErrRangeNotSatisfiable{Size: 40960})
+	_, err = pathResolver.ResolveQuery(ctx, stargate.Query{"bytes": {"5-5", "-0"}}, nil)
+	req.ErrorIs(err, stargate.ErrRangeNotSatisfiable{Size: 40960})
+	req.Equal([]stargate.BlockStatus{present, present, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate, duplicate}, resolve(stargate.Query{"bytes": {"-0", "0-1"}}))
+}
+
+type fixedLinkSystem struct {
+	lsys *ipld.LinkSystem
+}
+
+func (fls fixedLinkSystem) ResolveLinkSystem(ctx context.Context, root cid.Cid, metadata []byte) (*ipld.LinkSystem, error) {
+	return fls.lsys, nil
+}
+
+func createTestStore(t *testing.T) *sql.SQLUnixFSStore {
+	f, err := os.CreateTemp(t.TempDir(), "*.db")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	sqldb, err := sql.SqlDB(f.Name())
+	require.NoError(t, err)
+	require.NoError(t, sql.CreateTables(context.Background(), sqldb))
+	return sql.NewSQLUnixFSStore(sqldb)
+}
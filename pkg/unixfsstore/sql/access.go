@@ -0,0 +1,226 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/stargate/pkg/unixfsstore"
+	"github.com/ipfs/stargate/pkg/unixfsstore/sql/fielddef"
+)
+
+var setRootPrivate string = "INSERT INTO RootVisibility (CID, Private) VALUES (?, ?) ON CONFLICT(CID) DO UPDATE SET Private = excluded.Private"
+
+// SetRootPrivate sets whether a root is private, so that it is only served to requests presenting a token for it
+func SetRootPrivate(ctx context.Context, db Transactable, root cid.Cid, private bool) error {
+	_, err := db.ExecContext(ctx, setRootPrivate, root.Bytes(), private)
+	return err
+}
+
+var getRootPrivate string = "SELECT Private FROM RootVisibility WHERE CID = ?"
+
+// RootPrivate returns whether a root is private. Roots are public unless set otherwise
+func RootPrivate(ctx context.Context, db Transactable, root cid.Cid) (bool, error) {
+	var private bool
+	err := db.QueryRowContext(ctx, getRootPrivate, root.Bytes()).Scan(&private)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return private, err
+}
+
+// containingRoots selects, for each import a root is part of, the root and every directory above it up to the root of
+// the import, with whether each is private
+var containingRoots string = `WITH RECURSIVE Containing(CID, Metadata) AS (
+  SELECT CID, Metadata FROM RootCIDs WHERE CID = ?
+  UNION
+  SELECT d.RootCID, d.Metadata FROM DirLinks d JOIN Containing c ON d.CID = c.CID AND d.Metadata = c.Metadata
+  WHERE d.RootCID != c.CID
+) SELECT c.CID, c.Metadata, COALESCE(v.Private, 0) FROM Containing c LEFT JOIN RootVisibility v ON v.CID = c.CID`
+
+// PrivateRoots returns the private roots access to a root is governed by: the root itself if it is private, and the
+// private directories containing it. A root reachable in some import without passing through a private root is
+// public, and has none
+func PrivateRoots(ctx context.Context, db Transactable, root cid.Cid) ([]cid.Cid, error) {
+	rows, err := db.QueryContext(ctx, containingRoots, root.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	// private roots by the import they are found in
+	imports := make(map[string][]cid.Cid)
+	for rows.Next() {
+		var containing cid.Cid
+		var metadata []byte
+		var private bool
+		err := fielddef.Scan(rows, []string{"CID", "Metadata", "Private"}, map[string]fielddef.FieldDefinition{
+			"CID":      &fielddef.CidFieldDef{F: &containing},
+			"Metadata": &fielddef.BytesFieldDef{F: (*fielddef.SqlBytes)(&metadata)},
+			"Private":  &fielddef.FieldDef{F: &private},
+		})
+		if err != nil {
+			return nil, err
+		}
+		privateRoots := imports[string(metadata)]
+		if private {
+			privateRoots = append(privateRoots, containing)
+		}
+		imports[string(metadata)] = privateRoots
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// a root that was never indexed can still have been set private
+	if len(imports) == 0 {
+		private, err := RootPrivate(ctx, db, root)
+		if err != nil || !private {
+			return nil, err
+		}
+		return []cid.Cid{root}, nil
+	}
+	var privateRoots []cid.Cid
+	for _, importPrivateRoots := range imports {
+		if len(importPrivateRoots) == 0 {
+			return nil, nil
+		}
+		privateRoots = append(privateRoots, importPrivateRoots...)
+	}
+	return privateRoots, nil
+}
+
+// PathCIDs returns the CIDs of the entries a path under a root resolves through, ending with the entry at the end
+// of the path. It stops at the first segment that does not resolve, so it returns the entries leading to it
+func PathCIDs(ctx context.Context, db Transactable, root cid.Cid, path []string) ([]cid.Cid, error) {
+	rootCIDs, err := RootCID(ctx, db, root)
+	if err != nil || len(rootCIDs) == 0 {
+		return nil, err
+	}
+	// every import of a root has the same entries below it, so any one of them resolves the path
+	metadata := rootCIDs[0].Metadata
+	var cids []cid.Cid
+	current := root
+	for _, segment := range path {
+		if segment == "" {
+			continue
+		}
+		entry, err := DirPath(ctx, db, current, metadata, segment)
+		if err != nil {
+			return nil, err
+		}
+		if len(entry) == 0 {
+			break
+		}
+		// the path of an entry in a sharded directory leads through its shards, then to the entry itself
+		current = entry[len(entry)-1]
+		cids = append(cids, current)
+	}
+	return cids, nil
+}
+
+var accessTokenFields = []string{"ID", "RootCID", "Name", "SecretHash", "Created", "Expires", "Revoked"}
+
+// accessTokenRow maps an access token to its columns, with times stored as unix seconds and zero for no time
+type accessTokenRow struct {
+	token   *unixfsstore.AccessToken
+	created int64
+	expires int64
+}
+
+func newAccessTokenRow(token *unixfsstore.AccessToken) *accessTokenRow {
+	row := &accessTokenRow{token: token, created: token.Created.Unix()}
+	if !token.Expires.IsZero() {
+		row.expires = token.Expires.Unix()
+	}
+	return row
+}
+
+func (atr *accessTokenRow) fields() map[string]fielddef.FieldDefinition {
+	return map[string]fielddef.FieldDefinition{
+		"ID":         &fielddef.FieldDef{F: &atr.token.ID},
+		"RootCID":    &fielddef.CidFieldDef{F: &atr.token.Root},
+		"Name":       &fielddef.FieldDef{F: &atr.token.Name},
+		"SecretHash": &fielddef.BytesFieldDef{F: (*fielddef.SqlBytes)(&atr.token.SecretHash)},
+		"Created":    &fielddef.FieldDef{F: &atr.created},
+		"Expires":    &fielddef.FieldDef{F: &atr.expires},
+		"Revoked":    &fielddef.FieldDef{F: &atr.token.Revoked},
+	}
+}
+
+func (atr *accessTokenRow) scan(row fielddef.Scannable) error {
+	if err := fielddef.Scan(row, accessTokenFields, atr.fields()); err != nil {
+		return err
+	}
+	atr.token.Created = time.Unix(atr.created, 0)
+	if atr.expires != 0 {
+		atr.token.Expires = time.Unix(atr.expires, 0)
+	}
+	return nil
+}
+
+// InsertAccessToken records a new access token
+func InsertAccessToken(ctx context.Context, db Transactable, token unixfsstore.AccessToken) error {
+	return fielddef.Insert(ctx, db, "AccessTokens", accessTokenFields, newAccessTokenRow(&token).fields())
+}
+
+var getAccessToken string = "SELECT ID, RootCID, Name, SecretHash, Created, Expires, Revoked FROM AccessTokens WHERE ID = ?"
+
+// AccessToken returns the token with the given ID, or nil if there is none
+func AccessToken(ctx context.Context, db Transactable, id string) (*unixfsstore.AccessToken, error) {
+	token := &unixfsstore.AccessToken{}
+	err := newAccessTokenRow(token).scan(db.QueryRowContext(ctx, getAccessToken, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return token, nil
+}
+
+var listAccessTokens string = "SELECT ID, RootCID, Name, SecretHash, Created, Expires, Revoked FROM AccessTokens ORDER BY Created, ID"
+
+var listAccessTokensForRoot string = "SELECT ID, RootCID, Name, SecretHash, Created, Expires, Revoked FROM AccessTokens WHERE RootCID = ? ORDER BY Created, ID"
+
+// AccessTokens lists the tokens for a root in the order they were created, or all tokens if root is undefined
+func AccessTokens(ctx context.Context, db Transactable, root cid.Cid) ([]unixfsstore.AccessToken, error) {
+	var rows *sql.Rows
+	var err error
+	if root.Defined() {
+		rows, err = db.QueryContext(ctx, listAccessTokensForRoot, root.Bytes())
+	} else {
+		rows, err = db.QueryContext(ctx, listAccessTokens)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tokens []unixfsstore.AccessToken
+	for rows.Next() {
+		var token unixfsstore.AccessToken
+		if err := newAccessTokenRow(&token).scan(rows); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+var revokeAccessToken string = "UPDATE AccessTokens SET Revoked = 1 WHERE ID = ?"
+
+// RevokeAccessToken revokes the token with the given ID, returning ErrNotFound if there is none
+func RevokeAccessToken(ctx context.Context, db Transactable, id string) error {
+	result, err := db.ExecContext(ctx, revokeAccessToken, id)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
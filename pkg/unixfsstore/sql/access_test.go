@@ -0,0 +1,189 @@
+package sql_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-unixfsnode/data"
+	"github.com/ipfs/stargate/internal/testutil"
+	"github.com/ipfs/stargate/pkg/unixfsstore"
+	"github.com/ipfs/stargate/pkg/unixfsstore/sql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessDb(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	sqldb := CreateTestTmpDB(t)
+	req.NoError(sql.CreateTables(ctx, sqldb))
+
+	rootCid := testutil.GenerateCid()
+	otherRootCid := testutil.GenerateCid()
+
+	// roots are public until set private
+	private, err := sql.RootPrivate(ctx, sqldb, rootCid)
+	req.NoError(err)
+	req.False(private)
+	req.NoError(sql.SetRootPrivate(ctx, sqldb, rootCid, true))
+	private, err = sql.RootPrivate(ctx, sqldb, rootCid)
+	req.NoError(err)
+	req.True(private)
+	req.NoError(sql.SetRootPrivate(ctx, sqldb, rootCid, false))
+	private, err = sql.RootPrivate(ctx, sqldb, rootCid)
+	req.NoError(err)
+	req.False(private)
+
+	created := time.Unix(time.Now().Unix(), 0)
+	token := unixfsstore.AccessToken{
+		ID:         "apples",
+		Root:       rootCid,
+		Name:       "partner",
+		SecretHash: []byte("hash"),
+		Created:    created,
+		Expires:    created.Add(time.Hour),
+	}
+	req.NoError(sql.InsertAccessToken(ctx, sqldb, token))
+	otherToken := unixfsstore.AccessToken{
+		ID:         "oranges",
+		Root:       otherRootCid,
+		SecretHash: []byte("other hash"),
+		Created:    created.Add(time.Second),
+	}
+	req.NoError(sql.InsertAccessToken(ctx, sqldb, otherToken))
+
+	returned, err := sql.AccessToken(ctx, sqldb, "apples")
+	req.NoError(err)
+	req.Equal(&token, returned)
+	returned, err = sql.AccessToken(ctx, sqldb, "missing")
+	req.NoError(err)
+	req.Nil(returned)
+
+	tokens, err := sql.AccessTokens(ctx, sqldb, otherRootCid)
+	req.NoError(err)
+	req.Equal([]unixfsstore.AccessToken{otherToken}, tokens)
+	tokens, err = sql.AccessTokens(ctx, sqldb, cid.Undef)
+	req.NoError(err)
+	req.Equal([]unixfsstore.AccessToken{token, otherToken}, tokens)
+
+	req.NoError(sql.RevokeAccessToken(ctx, sqldb, "apples"))
+	returned, err = sql.AccessToken(ctx, sqldb, "apples")
+	req.NoError(err)
+	req.True(returned.Revoked)
+	req.ErrorIs(sql.RevokeAccessToken(ctx, sqldb, "missing"), sql.ErrNotFound)
+}
+
+func TestStoreSetRootPrivate(t *testing.T) {
+	ctx := context.Background()
+	sqldb := CreateTestTmpDB(t)
+	require.NoError(t, sql.CreateTables(ctx, sqldb))
+	store := sql.NewSQLUnixFSStore(sqldb)
+
+	// only indexed roots can be made private
+	require.ErrorIs(t, store.SetRootPrivate(ctx, testutil.GenerateCid(), true), sql.ErrNotFound)
+}
+
+func TestPrivateRoots(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	sqldb := CreateTestTmpDB(t)
+	req.NoError(sql.CreateTables(ctx, sqldb))
+
+	// a file inside a sub directory of a directory, with the file also imported on its own
+	dirCid := testutil.GenerateCid()
+	subDirCid := testutil.GenerateCid()
+	fileCid := testutil.GenerateCid()
+	for _, rootCID := range []unixfsstore.RootCID{
+		{CID: dirCid, Kind: data.Data_Directory, Metadata: []byte("apples")},
+		{CID: subDirCid, Kind: data.Data_Directory, Metadata: []byte("apples")},
+		{CID: fileCid, Kind: data.Data_File, Metadata: []byte("apples")},
+		{CID: fileCid, Kind: data.Data_File, Metadata: []byte("oranges")},
+	} {
+		req.NoError(sql.InsertRootCID(ctx, sqldb, rootCID))
+	}
+	req.NoError(sql.InsertDirLinks(ctx, sqldb, []*sql.DirLink{
+		{RootCID: dirCid, Metadata: []byte("apples"), CID: subDirCid, Leaf: true, SubPath: "sub"},
+		{RootCID: dirCid, Metadata: []byte("apples"), CID: fileCid, Leaf: true, SubPath: "sub/file"},
+		{RootCID: subDirCid, Metadata: []byte("apples"), CID: fileCid, Leaf: true, SubPath: "file"},
+	}))
+
+	privateRoots, err := sql.PrivateRoots(ctx, sqldb, fileCid)
+	req.NoError(err)
+	req.Empty(privateRoots)
+
+	// everything inside a private directory is private
+	req.NoError(sql.SetRootPrivate(ctx, sqldb, dirCid, true))
+	privateRoots, err = sql.PrivateRoots(ctx, sqldb, subDirCid)
+	req.NoError(err)
+	req.Equal([]cid.Cid{dirCid}, privateRoots)
+	privateRoots, err = sql.PrivateRoots(ctx, sqldb, dirCid)
+	req.NoError(err)
+	req.Equal([]cid.Cid{dirCid}, privateRoots)
+
+	// unless it is also imported publicly
+	privateRoots, err = sql.PrivateRoots(ctx, sqldb, fileCid)
+	req.NoError(err)
+	req.Empty(privateRoots)
+	req.NoError(sql.RemoveMetadata(ctx, sqldb, []byte("oranges")))
+	privateRoots, err = sql.PrivateRoots(ctx, sqldb, fileCid)
+	req.NoError(err)
+	req.ElementsMatch([]cid.Cid{dirCid}, privateRoots)
+
+	req.NoError(sql.SetRootPrivate(ctx, sqldb, subDirCid, true))
+	privateRoots, err = sql.PrivateRoots(ctx, sqldb, fileCid)
+	req.NoError(err)
+	req.ElementsMatch([]cid.Cid{dirCid, subDirCid}, privateRoots)
+
+	// roots that are not indexed are private only if set so
+	otherCid := testutil.GenerateCid()
+	privateRoots, err = sql.PrivateRoots(ctx, sqldb, otherCid)
+	req.NoError(err)
+	req.Empty(privateRoots)
+	req.NoError(sql.SetRootPrivate(ctx, sqldb, otherCid, true))
+	privateRoots, err = sql.PrivateRoots(ctx, sqldb, otherCid)
+	req.NoError(err)
+	req.Equal([]cid.Cid{otherCid}, privateRoots)
+}
+
+func TestPathCIDs(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	sqldb := CreateTestTmpDB(t)
+	req.NoError(sql.CreateTables(ctx, sqldb))
+
+	// a file inside a sharded sub directory of a directory
+	dirCid := testutil.GenerateCid()
+	subDirCid := testutil.GenerateCid()
+	shardCid := testutil.GenerateCid()
+	fileCid := testutil.GenerateCid()
+	for _, rootCID := range []unixfsstore.RootCID{
+		{CID: dirCid, Kind: data.Data_Directory, Metadata: []byte("apples")},
+		{CID: subDirCid, Kind: data.Data_HAMTShard, Metadata: []byte("apples")},
+		{CID: fileCid, Kind: data.Data_File, Metadata: []byte("apples")},
+	} {
+		req.NoError(sql.InsertRootCID(ctx, sqldb, rootCID))
+	}
+	req.NoError(sql.InsertDirLinks(ctx, sqldb, []*sql.DirLink{
+		{RootCID: dirCid, Metadata: []byte("apples"), CID: subDirCid, Leaf: true, SubPath: "sub"},
+		{RootCID: subDirCid, Metadata: []byte("apples"), CID: shardCid, Depth: 0, SubPath: "file"},
+		{RootCID: subDirCid, Metadata: []byte("apples"), CID: fileCid, Depth: 1, Leaf: true, SubPath: "file"},
+	}))
+
+	cids, err := sql.PathCIDs(ctx, sqldb, dirCid, []string{"sub", "file"})
+	req.NoError(err)
+	req.Equal([]cid.Cid{subDirCid, fileCid}, cids)
+
+	// empty segments are skipped, and resolution stops at the first segment that does not resolve
+	cids, err = sql.PathCIDs(ctx, sqldb, dirCid, []string{"sub", "", "missing", "file"})
+	req.NoError(err)
+	req.Equal([]cid.Cid{subDirCid}, cids)
+
+	// roots that are not indexed resolve nothing
+	cids, err = sql.PathCIDs(ctx, sqldb, testutil.GenerateCid(), []string{"sub"})
+	req.NoError(err)
+	req.Empty(cids)
+}
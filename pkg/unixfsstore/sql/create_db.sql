@@ -28,6 +28,37 @@ CREATE TABLE IF NOT EXISTS RootCIDs (
 
 CREATE INDEX IF NOT EXISTS index_dir_links_root_cid on DirLinks(RootCID, Metadata);
 CREATE INDEX IF NOT EXISTS index_dir_links_root_cid_sub_path on DirLinks(RootCID, Metadata, SubPath);
+CREATE INDEX IF NOT EXISTS index_dir_links_root_cid_depth_sub_path on DirLinks(RootCID, Metadata, Depth, SubPath);
+CREATE INDEX IF NOT EXISTS index_dir_links_root_cid_depth_cid_leaf on DirLinks(RootCID, Metadata, Depth, CID, Leaf);
 CREATE INDEX IF NOT EXISTS index_file_links_root_cid on FileLinks(RootCID, Metadata);
 CREATE INDEX IF NOT EXISTS index_file_links_root_cid_byte_min_max on FileLinks(RootCID, Metadata, ByteMin, ByteMax);
-CREATE INDEX IF NOT EXISTS index_root_cids_cid on RootCIDS(CID)
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS index_root_cids_cid on RootCIDS(CID);
+CREATE INDEX IF NOT EXISTS index_dir_links_cid on DirLinks(CID, Metadata);
+
+CREATE TABLE IF NOT EXISTS RootVisibility (
+  CID BLOB NOT NULL,
+  Private INT NOT NULL,
+  PRIMARY KEY(CID)
+) WITHOUT ROWID;
+
+CREATE TABLE IF NOT EXISTS AccessTokens (
+  ID TEXT NOT NULL,
+  RootCID BLOB NOT NULL,
+  Name TEXT NOT NULL,
+  SecretHash BLOB NOT NULL,
+  Created INT NOT NULL,
+  Expires INT NOT NULL,
+  Revoked INT NOT NULL,
+  PRIMARY KEY(ID)
+) WITHOUT ROWID;
+
+CREATE INDEX IF NOT EXISTS index_access_tokens_root_cid on AccessTokens(RootCID);
+
+CREATE TABLE IF NOT EXISTS Names (
+  Name TEXT NOT NULL,
+  RootCID BLOB NOT NULL,
+  Source TEXT NOT NULL,
+  Fingerprint BLOB NOT NULL,
+  Updated INT NOT NULL,
+  PRIMARY KEY(Name)
+) WITHOUT ROWID
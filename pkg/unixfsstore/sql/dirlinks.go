@@ -23,6 +23,15 @@ func InsertDirLink(ctx context.Context, db Transactable, dirLink *DirLink) error
 	return fielddef.Insert(ctx, db, "DirLinks", dirLinksOrder, dirLinkFields(dirLink))
 }
 
+// InsertDirLinks inserts several dir links with a single statement
+func InsertDirLinks(ctx context.Context, db Transactable, dirLinks []*DirLink) error {
+	defs := make([]map[string]fielddef.FieldDefinition, 0, len(dirLinks))
+	for _, dirLink := range dirLinks {
+		defs = append(defs, dirLinkFields(dirLink))
+	}
+	return fielddef.InsertMany(ctx, db, "DirLinks", dirLinksOrder, defs)
+}
+
 func dirLinkFields(dirLink *DirLink) map[string]fielddef.FieldDefinition {
 	return map[string]fielddef.FieldDefinition{
 		"RootCID":  &fielddef.CidFieldDef{F: &dirLink.RootCID},
@@ -58,7 +67,8 @@ func DirPath(ctx context.Context, db Transactable, root cid.Cid, metadata fieldd
 	return cids, nil
 }
 
-var lsQuery string = "SELECT DISTINCT CID, Depth, Leaf FROM DirLinks WHERE RootCID = ? AND Metadata = ? ORDER BY Depth ASC"
+// lsQuery lists links in path order within each depth, as the traversal that indexed them found them
+var lsQuery string = "SELECT DISTINCT CID, Depth, Leaf FROM DirLinks WHERE RootCID = ? AND Metadata = ? ORDER BY Depth ASC, SubPath ASC"
 
 func DirLs(ctx context.Context, db Transactable, root cid.Cid, metadata fielddef.SqlBytes) ([][]unixfsstore.TraversedCID, error) {
 	rows, err := db.QueryContext(ctx, lsQuery, root.Bytes(), metadata.Bytes())
@@ -87,3 +97,100 @@ func DirLs(ctx context.Context, db Transactable, root cid.Cid, metadata fielddef
 	}
 	return cidDepths, nil
 }
+
+var lsPageQuery string = "SELECT DISTINCT CID, Depth, Leaf FROM DirLinks WHERE RootCID = ? AND Metadata = ? AND (Depth, CID) > (?, ?) ORDER BY Depth ASC, CID ASC LIMIT ?"
+
+// DirLinkCursor iterates the links of a directory in breadth first order. Each page is a separate query, picking up
+// after the last row of the previous page, so no connection is held between pages.
+// As with DirLs, links repeated across sub paths at the same depth are collapsed
+type DirLinkCursor struct {
+	db        Transactable
+	root      cid.Cid
+	metadata  fielddef.SqlBytes
+	lastDepth int64
+	lastCID   []byte
+	done      bool
+}
+
+// NewDirLinkCursor returns a cursor over the links of the given directory
+func NewDirLinkCursor(db Transactable, root cid.Cid, metadata fielddef.SqlBytes) *DirLinkCursor {
+	return &DirLinkCursor{db: db, root: root, metadata: metadata, lastDepth: -1, lastCID: []byte{}}
+}
+
+// Next returns up to max further links
+func (dlc *DirLinkCursor) Next(ctx context.Context, max int) ([]unixfsstore.TraversedLink, error) {
+	if dlc.done {
+		return nil, nil
+	}
+	rows, err := dlc.db.QueryContext(ctx, lsPageQuery, dlc.root.Bytes(), dlc.metadata.Bytes(), dlc.lastDepth, dlc.lastCID, max)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := make([]unixfsstore.TraversedLink, 0, max)
+	for rows.Next() {
+		link := unixfsstore.TraversedLink{InRange: true}
+		err := fielddef.Scan(rows, []string{"CID", "Depth", "Leaf"}, map[string]fielddef.FieldDefinition{
+			"CID":   &fielddef.CidFieldDef{F: &link.CID},
+			"Depth": &fielddef.FieldDef{F: &dlc.lastDepth},
+			"Leaf":  &fielddef.FieldDef{F: &link.IsLeaf},
+		})
+		if err != nil {
+			return nil, err
+		}
+		dlc.lastCID = link.CID.Bytes()
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	dlc.done = len(links) < max
+	return links, nil
+}
+
+var entriesPageQuery string = "SELECT DirLinks.SubPath, DirLinks.CID, COALESCE(MIN(RootCIDs.Kind), ?) AS Kind FROM DirLinks LEFT JOIN RootCIDs ON RootCIDs.CID = DirLinks.CID AND RootCIDs.Metadata = DirLinks.Metadata WHERE DirLinks.RootCID = ? AND DirLinks.Metadata = ? AND DirLinks.Leaf = 1 AND DirLinks.SubPath > ? GROUP BY DirLinks.SubPath, DirLinks.CID ORDER BY DirLinks.SubPath ASC LIMIT ?"
+
+// DirEntryCursor iterates the entries of a directory in name order, with the same paging as DirLinkCursor
+type DirEntryCursor struct {
+	db       Transactable
+	root     cid.Cid
+	metadata fielddef.SqlBytes
+	lastName string
+	done     bool
+}
+
+// NewDirEntryCursor returns a cursor over the entries of the given directory
+func NewDirEntryCursor(db Transactable, root cid.Cid, metadata fielddef.SqlBytes) *DirEntryCursor {
+	return &DirEntryCursor{db: db, root: root, metadata: metadata}
+}
+
+// Next returns up to max further entries
+func (dec *DirEntryCursor) Next(ctx context.Context, max int) ([]unixfsstore.DirEntry, error) {
+	if dec.done {
+		return nil, nil
+	}
+	rows, err := dec.db.QueryContext(ctx, entriesPageQuery, unixfsstore.KindUnknown, dec.root.Bytes(), dec.metadata.Bytes(), dec.lastName, max)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]unixfsstore.DirEntry, 0, max)
+	for rows.Next() {
+		var entry unixfsstore.DirEntry
+		err := fielddef.Scan(rows, []string{"SubPath", "CID", "Kind"}, map[string]fielddef.FieldDefinition{
+			"SubPath": &fielddef.FieldDef{F: &entry.Name},
+			"CID":     &fielddef.CidFieldDef{F: &entry.CID},
+			"Kind":    &fielddef.FieldDef{F: &entry.Kind},
+		})
+		if err != nil {
+			return nil, err
+		}
+		dec.lastName = entry.Name
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	dec.done = len(entries) < max
+	return entries, nil
+}
@@ -126,6 +126,18 @@ func TestDirLinksDB(t *testing.T) {
 		{traversedPath1Cids[2], traversedPath2Cids[2], {CID: path3Leaf, IsLeaf: true}},
 	},
 		rootCidsAll)
+
+	// test cursor, which collapses repeated links as ls does, a depth at a time
+	links := drainCursor(t, ufssql.NewDirLinkCursor(sqldb, rootCid, []byte("orange")), 2)
+	traversedLinks := make([]unixfsstore.TraversedCID, 0, len(links))
+	for _, link := range links {
+		req.True(link.InRange)
+		traversedLinks = append(traversedLinks, link.TraversedCID)
+	}
+	req.Len(traversedLinks, 8)
+	req.ElementsMatch(rootCidsAll[0], traversedLinks[:2])
+	req.ElementsMatch(rootCidsAll[1], traversedLinks[2:5])
+	req.ElementsMatch(rootCidsAll[2], traversedLinks[5:])
 }
 
 func CreateTestTmpDB(t *testing.T) *sql.DB {
@@ -136,3 +148,24 @@ func CreateTestTmpDB(t *testing.T) *sql.DB {
 	require.NoError(t, err)
 	return d
 }
+
+func TestDirLinkCursorQueryPlan(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	sqldb := CreateTestTmpDB(t)
+	req.NoError(ufssql.CreateTables(ctx, sqldb))
+
+	// each page is read from an index in order, rather than sorting every link of the directory
+	rows, err := sqldb.QueryContext(ctx, "EXPLAIN QUERY PLAN "+ufssql.LsPageQuery, []byte{}, []byte{}, 0, []byte{}, 10)
+	req.NoError(err)
+	defer rows.Close()
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		req.NoError(rows.Scan(&id, &parent, &notUsed, &detail))
+		req.Contains(detail, "COVERING INDEX")
+		req.NotContains(detail, "TEMP B-TREE")
+	}
+	req.NoError(rows.Err())
+}
@@ -0,0 +1,4 @@
+package sql
+
+// LsPageQuery is the query paging through the links of a directory, to check its query plan
+var LsPageQuery = lsPageQuery
@@ -151,3 +151,28 @@ func Insert(ctx context.Context, db Executable, table string, fieldOrder []strin
 	_, err := db.ExecContext(ctx, qry, values...)
 	return err
 }
+
+// InsertMany inserts several rows into a table with a single statement
+func InsertMany(ctx context.Context, db Executable, table string, fieldOrder []string, defs []map[string]FieldDefinition) error {
+	if len(defs) == 0 {
+		return nil
+	}
+	values := make([]interface{}, 0, len(defs)*len(fieldOrder))
+	rowPlaceholders := "(" + strings.TrimSuffix(strings.Repeat("?,", len(fieldOrder)), ",") + ")"
+	rows := make([]string, 0, len(defs))
+	for _, def := range defs {
+		for _, name := range fieldOrder {
+			v, err := def[name].Marshall()
+			if err != nil {
+				return err
+			}
+			values = append(values, v)
+		}
+		rows = append(rows, rowPlaceholders)
+	}
+
+	qry := "INSERT INTO " + table + " (" + strings.Join(fieldOrder, ", ") + ") "
+	qry += "VALUES " + strings.Join(rows, ",")
+	_, err := db.ExecContext(ctx, qry, values...)
+	return err
+}
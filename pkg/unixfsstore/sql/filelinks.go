@@ -25,6 +25,15 @@ func InsertFileLink(ctx context.Context, db Transactable, fileLink *FileLink) er
 	return fielddef.Insert(ctx, db, "FileLinks", fileLinksOrder, fileLinkFields(fileLink))
 }
 
+// InsertFileLinks inserts several file links with a single statement
+func InsertFileLinks(ctx context.Context, db Transactable, fileLinks []*FileLink) error {
+	defs := make([]map[string]fielddef.FieldDefinition, 0, len(fileLinks))
+	for _, fileLink := range fileLinks {
+		defs = append(defs, fileLinkFields(fileLink))
+	}
+	return fielddef.InsertMany(ctx, db, "FileLinks", fileLinksOrder, defs)
+}
+
 func fileLinkFields(fileLink *FileLink) map[string]fielddef.FieldDefinition {
 	return map[string]fielddef.FieldDefinition{
 		"RootCID":  &fielddef.CidFieldDef{F: &fileLink.RootCID},
@@ -74,3 +83,103 @@ var fileQuery string = "SELECT DISTINCT CID, Depth, Leaf FROM FileLinks %s ORDER
 func FileAll(ctx context.Context, db Transactable, root cid.Cid, metadata fielddef.SqlBytes) ([][]unixfsstore.TraversedCID, error) {
 	return fileLinkQuery(ctx, db, "WHERE RootCID = ? AND Metadata = ?", root.Bytes(), metadata.Bytes())
 }
+
+var filePageQuery string = "SELECT CID, Depth, Leaf, ByteMin, ByteMax, %s AS InRange FROM FileLinks WHERE RootCID = ? AND Metadata = ? AND (Depth, ByteMin, ByteMax) > (?, ?, ?) ORDER BY Depth ASC, ByteMin ASC, ByteMax ASC LIMIT ?"
+
+// FileLinkCursor iterates the links of a file in breadth first order. Each page is a separate query, picking up
+// after the last row of the previous page, so no connection is held between pages.
+// Unlike FileAll, links repeated within a layer are not collapsed
+type FileLinkCursor struct {
+	db          Transactable
+	root        cid.Cid
+	metadata    fielddef.SqlBytes
+	byteRanges  []unixfsstore.ByteRange
+	lastDepth   int64
+	lastByteMin uint64
+	lastByteMax uint64
+	done        bool
+}
+
+// NewFileLinkCursor returns a cursor over the links of the given file. If byteRanges is not nil, links are marked
+// as in range only if they overlap one of them
+func NewFileLinkCursor(db Transactable, root cid.Cid, metadata fielddef.SqlBytes, byteRanges []unixfsstore.ByteRange) *FileLinkCursor {
+	return &FileLinkCursor{db: db, root: root, metadata: metadata, byteRanges: byteRanges, lastDepth: -1}
+}
+
+// Next returns up to max further links
+func (flc *FileLinkCursor) Next(ctx context.Context, max int) ([]unixfsstore.TraversedLink, error) {
+	if flc.done {
+		return nil, nil
+	}
+	inRange := "1"
+	var params []any
+	if flc.byteRanges != nil {
+		inRange = "0"
+		for _, byteRange := range flc.byteRanges {
+			inRange += " OR (ByteMin < ? AND ByteMax > ?)"
+			params = append(params, byteRange.Max, byteRange.Min)
+		}
+		inRange = "(" + inRange + ")"
+	}
+	params = append(params, flc.root.Bytes(), flc.metadata.Bytes(), flc.lastDepth, flc.lastByteMin, flc.lastByteMax, max)
+	rows, err := flc.db.QueryContext(ctx, fmt.Sprintf(filePageQuery, inRange), params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	links := make([]unixfsstore.TraversedLink, 0, max)
+	for rows.Next() {
+		var link unixfsstore.TraversedLink
+		err := fielddef.Scan(rows, []string{"CID", "Depth", "Leaf", "ByteMin", "ByteMax", "InRange"}, map[string]fielddef.FieldDefinition{
+			"CID":     &fielddef.CidFieldDef{F: &link.CID},
+			"Depth":   &fielddef.FieldDef{F: &flc.lastDepth},
+			"Leaf":    &fielddef.FieldDef{F: &link.IsLeaf},
+			"ByteMin": &fielddef.FieldDef{F: &flc.lastByteMin},
+			"ByteMax": &fielddef.FieldDef{F: &flc.lastByteMax},
+			"InRange": &fielddef.FieldDef{F: &link.InRange},
+		})
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	flc.done = len(links) < max
+	return links, nil
+}
+
+var fileSizeQuery string = "SELECT COALESCE(MAX(ByteMax), 0) FROM FileLinks WHERE RootCID = ? AND Metadata = ? AND Depth = 0"
+
+// FileSize returns the size of a file from its links, or zero if it has none
+func FileSize(ctx context.Context, db Transactable, root cid.Cid, metadata fielddef.SqlBytes) (uint64, error) {
+	var size uint64
+	err := db.QueryRowContext(ctx, fileSizeQuery, root.Bytes(), metadata.Bytes()).Scan(&size)
+	return size, err
+}
+
+var fileLeafQuery string = "SELECT CID, ByteMin, ByteMax FROM FileLinks WHERE RootCID = ? AND Metadata = ? AND ByteMin <= ? AND ByteMax > ? ORDER BY Depth DESC LIMIT 1"
+
+// FileLeafAt returns the deepest block holding the byte at the given offset of a file, or nil if the file has no
+// links covering it
+func FileLeafAt(ctx context.Context, db Transactable, root cid.Cid, metadata fielddef.SqlBytes, offset uint64) (*unixfsstore.FileLeaf, error) {
+	rows, err := db.QueryContext(ctx, fileLeafQuery, root.Bytes(), metadata.Bytes(), offset, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	var leaf unixfsstore.FileLeaf
+	err = fielddef.Scan(rows, []string{"CID", "ByteMin", "ByteMax"}, map[string]fielddef.FieldDefinition{
+		"CID":     &fielddef.CidFieldDef{F: &leaf.CID},
+		"ByteMin": &fielddef.FieldDef{F: &leaf.ByteMin},
+		"ByteMax": &fielddef.FieldDef{F: &leaf.ByteMax},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &leaf, nil
+}
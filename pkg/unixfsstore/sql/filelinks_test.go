@@ -110,4 +110,54 @@ func TestFileLinksDB(t *testing.T) {
 	},
 		rootRange)
 
+	// test cursors, with page sizes that do and don't divide the number of links
+	for _, pageSize := range []int{7, 10, 1000} {
+		links := drainCursor(t, sql.NewFileLinkCursor(sqldb, rootCid, []byte("orange"), nil), pageSize)
+		req.Len(links, 110)
+		for i, link := range links {
+			req.True(link.InRange)
+			if i < 10 {
+				req.Equal(traversedIntermediates[i], link.TraversedCID)
+			} else {
+				req.Equal(traversedLeaves[i-10], link.TraversedCID)
+			}
+		}
+
+		links = drainCursor(t, sql.NewFileLinkCursor(sqldb, rootCid, []byte("orange"), []unixfsstore.ByteRange{{Min: 10 * (1 << 22), Max: 21 * (1 << 22)}}), pageSize)
+		req.Len(links, 110)
+		for i, link := range links {
+			inRange := (i >= 1 && i < 3) || (i >= 20 && i < 31)
+			req.Equal(inRange, link.InRange)
+		}
+
+		links = drainCursor(t, sql.NewFileLinkCursor(sqldb, rootCid, []byte("orange"), []unixfsstore.ByteRange{
+			{Min: 0, Max: 1},
+			{Min: 95 * (1 << 22), Max: 1 << 62},
+		}), pageSize)
+		req.Len(links, 110)
+		for i, link := range links {
+			inRange := i == 0 || i == 9 || i == 10 || i >= 105
+			req.Equal(inRange, link.InRange)
+		}
+	}
+
+	size, err := sql.FileSize(ctx, sqldb, rootCid, []byte("orange"))
+	req.NoError(err)
+	req.Equal(uint64(100*(1<<22)), size)
+	size, err = sql.FileSize(ctx, sqldb, testutil.GenerateCid(), nil)
+	req.NoError(err)
+	req.Zero(size)
+}
+
+func drainCursor(t *testing.T, iterator unixfsstore.LinkIterator, pageSize int) []unixfsstore.TraversedLink {
+	var links []unixfsstore.TraversedLink
+	for {
+		page, err := iterator.Next(context.Background(), pageSize)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(page), pageSize)
+		if len(page) == 0 {
+			return links
+		}
+		links = append(links, page...)
+	}
 }
@@ -0,0 +1,99 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/ipfs/stargate/pkg/unixfsstore"
+	"github.com/ipfs/stargate/pkg/unixfsstore/sql/fielddef"
+)
+
+// nameRow maps a name to its columns, with the time it was updated stored as unix seconds
+type nameRow struct {
+	name    *unixfsstore.Name
+	updated int64
+}
+
+func (nr *nameRow) fields() map[string]fielddef.FieldDefinition {
+	return map[string]fielddef.FieldDefinition{
+		"Name":        &fielddef.FieldDef{F: &nr.name.Name},
+		"RootCID":     &fielddef.CidFieldDef{F: &nr.name.Root},
+		"Source":      &fielddef.FieldDef{F: &nr.name.Source},
+		"Fingerprint": &fielddef.BytesFieldDef{F: (*fielddef.SqlBytes)(&nr.name.Fingerprint)},
+		"Updated":     &fielddef.FieldDef{F: &nr.updated},
+	}
+}
+
+var nameFields = []string{"Name", "RootCID", "Source", "Fingerprint", "Updated"}
+
+func (nr *nameRow) scan(row fielddef.Scannable) error {
+	if err := fielddef.Scan(row, nameFields, nr.fields()); err != nil {
+		return err
+	}
+	nr.name.Updated = time.Unix(nr.updated, 0)
+	return nil
+}
+
+var setName string = "INSERT INTO Names (Name, RootCID, Source, Fingerprint, Updated) VALUES (?, ?, ?, ?, ?) ON CONFLICT(Name) DO UPDATE SET RootCID = excluded.RootCID, Source = excluded.Source, Fingerprint = excluded.Fingerprint, Updated = excluded.Updated"
+
+// SetName points a name at a root, replacing the root it pointed at before
+func SetName(ctx context.Context, db Transactable, name unixfsstore.Name) error {
+	_, err := db.ExecContext(ctx, setName, name.Name, name.Root.Bytes(), name.Source,
+		fielddef.SqlBytes(name.Fingerprint).Bytes(), name.Updated.Unix())
+	return err
+}
+
+var getName string = "SELECT Name, RootCID, Source, Fingerprint, Updated FROM Names WHERE Name = ?"
+
+// Name returns the name with the given name, or nil if there is none
+func Name(ctx context.Context, db Transactable, name string) (*unixfsstore.Name, error) {
+	returned := &unixfsstore.Name{}
+	err := (&nameRow{name: returned}).scan(db.QueryRowContext(ctx, getName, name))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return returned, nil
+}
+
+var listNames string = "SELECT Name, RootCID, Source, Fingerprint, Updated FROM Names ORDER BY Name"
+
+// Names lists every name in name order
+func Names(ctx context.Context, db Transactable) ([]unixfsstore.Name, error) {
+	rows, err := db.QueryContext(ctx, listNames)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []unixfsstore.Name
+	for rows.Next() {
+		var name unixfsstore.Name
+		if err := (&nameRow{name: &name}).scan(rows); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+var removeName string = "DELETE FROM Names WHERE Name = ?"
+
+// RemoveName removes a name, returning ErrNotFound if there is none
+func RemoveName(ctx context.Context, db Transactable, name string) error {
+	result, err := db.ExecContext(ctx, removeName, name)
+	if err != nil {
+		return err
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
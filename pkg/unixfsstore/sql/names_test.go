@@ -0,0 +1,48 @@
+package sql_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/stargate/internal/testutil"
+	"github.com/ipfs/stargate/pkg/unixfsstore"
+	"github.com/ipfs/stargate/pkg/unixfsstore/sql"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamesDb(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	sqldb := CreateTestTmpDB(t)
+	req.NoError(sql.CreateTables(ctx, sqldb))
+
+	updated := time.Unix(time.Now().Unix(), 0)
+	name := unixfsstore.Name{Name: "reports", Root: testutil.GenerateCid(), Source: "/drop", Fingerprint: []byte("apples"), Updated: updated}
+	req.NoError(sql.SetName(ctx, sqldb, name))
+	other := unixfsstore.Name{Name: "datasets", Root: testutil.GenerateCid(), Updated: updated}
+	req.NoError(sql.SetName(ctx, sqldb, other))
+
+	returned, err := sql.Name(ctx, sqldb, "reports")
+	req.NoError(err)
+	req.Equal(&name, returned)
+	returned, err = sql.Name(ctx, sqldb, "missing")
+	req.NoError(err)
+	req.Nil(returned)
+
+	// setting a name again points it at the new root
+	name.Root = testutil.GenerateCid()
+	name.Fingerprint = []byte("oranges")
+	name.Updated = updated.Add(time.Minute)
+	req.NoError(sql.SetName(ctx, sqldb, name))
+	names, err := sql.Names(ctx, sqldb)
+	req.NoError(err)
+	req.Equal([]unixfsstore.Name{other, name}, names)
+
+	req.NoError(sql.RemoveName(ctx, sqldb, "datasets"))
+	names, err = sql.Names(ctx, sqldb)
+	req.NoError(err)
+	req.Equal([]unixfsstore.Name{name}, names)
+	req.ErrorIs(sql.RemoveName(ctx, sqldb, "datasets"), sql.ErrNotFound)
+}
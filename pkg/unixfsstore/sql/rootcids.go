@@ -4,18 +4,34 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 
 	"github.com/ipfs/go-cid"
 	"github.com/ipfs/stargate/pkg/unixfsstore"
 	"github.com/ipfs/stargate/pkg/unixfsstore/sql/fielddef"
 )
 
+var rootCIDsOrder = []string{"CID", "Kind", "Metadata"}
+
 func InsertRootCID(ctx context.Context, db Transactable, rootCID unixfsstore.RootCID) error {
-	return fielddef.Insert(ctx, db, "RootCIDs", []string{"CID", "Kind", "Metadata"}, map[string]fielddef.FieldDefinition{
+	return fielddef.Insert(ctx, db, "RootCIDs", rootCIDsOrder, rootCIDFields(&rootCID))
+}
+
+// InsertRootCIDs inserts several root CIDs with a single statement
+func InsertRootCIDs(ctx context.Context, db Transactable, rootCIDs []unixfsstore.RootCID) error {
+	defs := make([]map[string]fielddef.FieldDefinition, 0, len(rootCIDs))
+	for i := range rootCIDs {
+		defs = append(defs, rootCIDFields(&rootCIDs[i]))
+	}
+	return fielddef.InsertMany(ctx, db, "RootCIDs", rootCIDsOrder, defs)
+}
+
+func rootCIDFields(rootCID *unixfsstore.RootCID) map[string]fielddef.FieldDefinition {
+	return map[string]fielddef.FieldDefinition{
 		"CID":      &fielddef.CidFieldDef{F: &rootCID.CID},
 		"Kind":     &fielddef.FieldDef{F: &rootCID.Kind},
 		"Metadata": &fielddef.BytesFieldDef{F: (*fielddef.SqlBytes)(&rootCID.Metadata)},
-	})
+	}
 }
 
 var getByCID string = "SELECT Kind, Metadata FROM RootCIDs WHERE CID = ?"
@@ -65,3 +81,43 @@ func RootCIDWithMetadata(ctx context.Context, db Transactable, root cid.Cid, met
 		Metadata: metadata,
 	}, nil
 }
+
+// topLevelRootCIDs selects roots that are not entries of another root with the same metadata -- the roots of whole
+// imports rather than the files and directories inside them
+var topLevelRootCIDs string = `SELECT CID, Kind, Metadata FROM RootCIDs r WHERE NOT EXISTS (
+  SELECT 1 FROM DirLinks d WHERE d.CID = r.CID AND d.Metadata = r.Metadata AND d.RootCID != r.CID
+) ORDER BY Metadata, CID`
+
+// TopLevelRootCIDs lists the roots that are not inside another root with the same metadata
+func TopLevelRootCIDs(ctx context.Context, db Transactable) ([]unixfsstore.RootCID, error) {
+	rows, err := db.QueryContext(ctx, topLevelRootCIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rootCIDs []unixfsstore.RootCID
+	for rows.Next() {
+		var rootCID unixfsstore.RootCID
+		err := fielddef.Scan(rows, []string{"CID", "Kind", "Metadata"}, map[string]fielddef.FieldDefinition{
+			"CID":      &fielddef.CidFieldDef{F: &rootCID.CID},
+			"Kind":     &fielddef.FieldDef{F: &rootCID.Kind},
+			"Metadata": &fielddef.BytesFieldDef{F: (*fielddef.SqlBytes)(&rootCID.Metadata)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		rootCIDs = append(rootCIDs, rootCID)
+	}
+	return rootCIDs, rows.Err()
+}
+
+// RemoveMetadata removes every root, directory link and file link indexed with the given metadata
+func RemoveMetadata(ctx context.Context, db Transactable, metadata []byte) error {
+	for _, table := range []string{"DirLinks", "FileLinks", "RootCIDs"} {
+		_, err := db.ExecContext(ctx, "DELETE FROM "+table+" WHERE Metadata = ?", fielddef.SqlBytes(metadata).Bytes())
+		if err != nil {
+			return fmt.Errorf("removing from %s: %w", table, err)
+		}
+	}
+	return nil
+}
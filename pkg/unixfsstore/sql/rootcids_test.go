@@ -85,3 +85,51 @@ func TestRootCIDSDb(t *testing.T) {
 	req.Empty(missingRootCids)
 	req.NoError(err)
 }
+
+func TestTopLevelRootCIDs(t *testing.T) {
+	req := require.New(t)
+	ctx := context.Background()
+
+	sqldb := CreateTestTmpDB(t)
+	req.NoError(sql.CreateTables(ctx, sqldb))
+
+	dirCid := testutil.GenerateCid()
+	fileCid := testutil.GenerateCid()
+	otherCid := testutil.GenerateCid()
+	for _, rootCID := range []unixfsstore.RootCID{
+		{CID: dirCid, Kind: data.Data_Directory, Metadata: []byte("apples")},
+		{CID: fileCid, Kind: data.Data_File, Metadata: []byte("apples")},
+		// the same file imported on its own is top level
+		{CID: fileCid, Kind: data.Data_File, Metadata: []byte("oranges")},
+		{CID: otherCid, Kind: data.Data_File, Metadata: []byte("pears")},
+	} {
+		req.NoError(sql.InsertRootCID(ctx, sqldb, rootCID))
+	}
+	req.NoError(sql.InsertDirLink(ctx, sqldb, &sql.DirLink{
+		RootCID:  dirCid,
+		Metadata: []byte("apples"),
+		CID:      fileCid,
+		Depth:    0,
+		Leaf:     true,
+		SubPath:  "file",
+	}))
+
+	rootCids, err := sql.TopLevelRootCIDs(ctx, sqldb)
+	req.NoError(err)
+	req.Equal([]unixfsstore.RootCID{
+		{CID: dirCid, Kind: data.Data_Directory, Metadata: []byte("apples")},
+		{CID: fileCid, Kind: data.Data_File, Metadata: []byte("oranges")},
+		{CID: otherCid, Kind: data.Data_File, Metadata: []byte("pears")},
+	}, rootCids)
+
+	req.NoError(sql.RemoveMetadata(ctx, sqldb, []byte("apples")))
+	rootCids, err = sql.TopLevelRootCIDs(ctx, sqldb)
+	req.NoError(err)
+	req.Equal([]unixfsstore.RootCID{
+		{CID: fileCid, Kind: data.Data_File, Metadata: []byte("oranges")},
+		{CID: otherCid, Kind: data.Data_File, Metadata: []byte("pears")},
+	}, rootCids)
+	dirPath, err := sql.DirPath(ctx, sqldb, dirCid, []byte("apples"), "file")
+	req.NoError(err)
+	req.Empty(dirPath)
+}
@@ -3,22 +3,38 @@ package sql
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"time"
 
 	"github.com/ipfs/go-cid"
+	"github.com/ipfs/stargate/pkg/metrics"
+	"github.com/ipfs/stargate/pkg/tracing"
 	"github.com/ipfs/stargate/pkg/unixfsstore"
 	"github.com/ipfs/stargate/pkg/unixfsstore/traversal"
 	"github.com/ipld/go-ipld-prime"
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// insertBatchSize is the most rows of a table the visitor inserts with a single statement, keeping the parameters of
+// a statement well within what sqlite allows
+const insertBatchSize = 100
+
+// unixFSVisitor inserts what it visits in batches, and must be flushed once the traversal is done
 type unixFSVisitor struct {
-	db       Transactable
-	metadata []byte
+	db        Transactable
+	metadata  []byte
+	dirLinks  []*DirLink
+	fileLinks []*FileLink
+	rootCIDs  []unixfsstore.RootCID
+}
+
+func newUnixFSVisitor(db Transactable, metadata []byte) *unixFSVisitor {
+	return &unixFSVisitor{db: db, metadata: metadata}
 }
 
 func (ufsv *unixFSVisitor) OnPath(ctx context.Context, root cid.Cid, path string, cids []cid.Cid) error {
 	for i, c := range cids {
-		err := InsertDirLink(ctx, ufsv.db, &DirLink{
+		ufsv.dirLinks = append(ufsv.dirLinks, &DirLink{
 			RootCID:  root,
 			Metadata: ufsv.metadata,
 			CID:      c,
@@ -26,15 +42,17 @@ func (ufsv *unixFSVisitor) OnPath(ctx context.Context, root cid.Cid, path string
 			Leaf:     (i == len(cids)-1),
 			SubPath:  path,
 		})
-		if err != nil {
-			return err
+		if len(ufsv.dirLinks) == insertBatchSize {
+			if err := ufsv.flushDirLinks(ctx); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
 func (ufsv *unixFSVisitor) OnFileRange(ctx context.Context, root cid.Cid, cid cid.Cid, depth int, byteMin uint64, byteMax uint64, leaf bool) error {
-	return InsertFileLink(ctx, ufsv.db, &FileLink{
+	ufsv.fileLinks = append(ufsv.fileLinks, &FileLink{
 		RootCID:  root,
 		Metadata: ufsv.metadata,
 		CID:      cid,
@@ -43,10 +61,47 @@ func (ufsv *unixFSVisitor) OnFileRange(ctx context.Context, root cid.Cid, cid ci
 		ByteMin:  byteMin,
 		ByteMax:  byteMax,
 	})
+	if len(ufsv.fileLinks) == insertBatchSize {
+		return ufsv.flushFileLinks(ctx)
+	}
+	return nil
 }
 
 func (ufsv *unixFSVisitor) OnRoot(ctx context.Context, root cid.Cid, kind int64) error {
-	return InsertRootCID(ctx, ufsv.db, unixfsstore.RootCID{CID: root, Kind: kind, Metadata: ufsv.metadata})
+	ufsv.rootCIDs = append(ufsv.rootCIDs, unixfsstore.RootCID{CID: root, Kind: kind, Metadata: ufsv.metadata})
+	if len(ufsv.rootCIDs) == insertBatchSize {
+		return ufsv.flushRootCIDs(ctx)
+	}
+	return nil
+}
+
+func (ufsv *unixFSVisitor) flushDirLinks(ctx context.Context) error {
+	err := InsertDirLinks(ctx, ufsv.db, ufsv.dirLinks)
+	ufsv.dirLinks = ufsv.dirLinks[:0]
+	return err
+}
+
+func (ufsv *unixFSVisitor) flushFileLinks(ctx context.Context) error {
+	err := InsertFileLinks(ctx, ufsv.db, ufsv.fileLinks)
+	ufsv.fileLinks = ufsv.fileLinks[:0]
+	return err
+}
+
+func (ufsv *unixFSVisitor) flushRootCIDs(ctx context.Context) error {
+	err := InsertRootCIDs(ctx, ufsv.db, ufsv.rootCIDs)
+	ufsv.rootCIDs = ufsv.rootCIDs[:0]
+	return err
+}
+
+// flush inserts everything visited that has not been inserted yet
+func (ufsv *unixFSVisitor) flush(ctx context.Context) error {
+	if err := ufsv.flushRootCIDs(ctx); err != nil {
+		return err
+	}
+	if err := ufsv.flushDirLinks(ctx); err != nil {
+		return err
+	}
+	return ufsv.flushFileLinks(ctx)
 }
 
 type SQLUnixFSStore struct {
@@ -59,43 +114,205 @@ func NewSQLUnixFSStore(db *sql.DB) *SQLUnixFSStore {
 
 func (s *SQLUnixFSStore) AddRoot(ctx context.Context, root cid.Cid, metadata []byte, linkSystem *ipld.LinkSystem) error {
 	return withTransaction(ctx, s.db, func(tx *sql.Tx) error {
-		visitor := &unixFSVisitor{tx, metadata}
-		return traversal.IterateUnixFSNode(ctx, root, linkSystem, visitor)
+		visitor := newUnixFSVisitor(tx, metadata)
+		if err := traversal.IterateUnixFSNode(ctx, root, linkSystem, visitor); err != nil {
+			return err
+		}
+		return visitor.flush(ctx)
 	})
 }
 
 func (s *SQLUnixFSStore) AddRootRecursive(ctx context.Context, root cid.Cid, metadata []byte, linkSystem *ipld.LinkSystem) error {
 	return withTransaction(ctx, s.db, func(tx *sql.Tx) error {
-		var visitor traversal.UnixFSVisitor = &unixFSVisitor{tx, metadata}
-		visitor = traversal.RecursiveVisitor(visitor, linkSystem)
-		return traversal.IterateUnixFSNode(ctx, root, linkSystem, visitor)
+		visitor := newUnixFSVisitor(tx, metadata)
+		if err := traversal.IterateUnixFSNode(ctx, root, linkSystem, traversal.RecursiveVisitor(visitor, linkSystem)); err != nil {
+			return err
+		}
+		return visitor.flush(ctx)
+	})
+}
+
+// ReplaceRoots indexes the given roots with the metadata, replacing everything indexed with the metadata before, in
+// a single transaction
+func (s *SQLUnixFSStore) ReplaceRoots(ctx context.Context, metadata []byte, roots []cid.Cid, linkSystem *ipld.LinkSystem) error {
+	return withTransaction(ctx, s.db, func(tx *sql.Tx) error {
+		if err := RemoveMetadata(ctx, tx, metadata); err != nil {
+			return err
+		}
+		visitor := newUnixFSVisitor(tx, metadata)
+		for _, root := range roots {
+			if err := traversal.IterateUnixFSNode(ctx, root, linkSystem, visitor); err != nil {
+				return fmt.Errorf("indexing %s: %w", root, err)
+			}
+		}
+		return visitor.flush(ctx)
+	})
+}
+
+// RemoveMetadata removes everything indexed with the metadata
+func (s *SQLUnixFSStore) RemoveMetadata(ctx context.Context, metadata []byte) error {
+	return withTransaction(ctx, s.db, func(tx *sql.Tx) error {
+		return RemoveMetadata(ctx, tx, metadata)
 	})
 }
 
+func (s *SQLUnixFSStore) TopLevelRootCIDs(ctx context.Context) ([]unixfsstore.RootCID, error) {
+	return TopLevelRootCIDs(ctx, s.db)
+}
+
 func (s *SQLUnixFSStore) DirLs(ctx context.Context, root cid.Cid, metadata []byte) ([][]unixfsstore.TraversedCID, error) {
+	ctx, end := instrument(ctx, "dir_ls")
+	defer end()
 	return DirLs(ctx, s.db, root, metadata)
 }
 
 func (s *SQLUnixFSStore) DirPath(ctx context.Context, root cid.Cid, metadata []byte, path string) ([]cid.Cid, error) {
+	ctx, end := instrument(ctx, "dir_path")
+	defer end()
 	return DirPath(ctx, s.db, root, metadata, path)
 }
 
 func (s *SQLUnixFSStore) FileAll(ctx context.Context, root cid.Cid, metadata []byte) ([][]unixfsstore.TraversedCID, error) {
+	ctx, end := instrument(ctx, "file_all")
+	defer end()
 	return FileAll(ctx, s.db, root, metadata)
 }
 
 func (s *SQLUnixFSStore) FileByteRange(ctx context.Context, root cid.Cid, metadata []byte, byteMin uint64, byteMax uint64) ([][]unixfsstore.TraversedCID, error) {
+	ctx, end := instrument(ctx, "file_byte_range")
+	defer end()
 	return FileByteRange(ctx, s.db, root, metadata, byteMin, byteMax)
 }
 
+func (s *SQLUnixFSStore) DirLinks(ctx context.Context, root cid.Cid, metadata []byte) unixfsstore.LinkIterator {
+	return &timedLinkIterator{NewDirLinkCursor(s.db, root, metadata), "dir_links"}
+}
+
+func (s *SQLUnixFSStore) FileLinks(ctx context.Context, root cid.Cid, metadata []byte, byteRanges []unixfsstore.ByteRange) unixfsstore.LinkIterator {
+	return &timedLinkIterator{NewFileLinkCursor(s.db, root, metadata, byteRanges), "file_links"}
+}
+
+func (s *SQLUnixFSStore) FileSize(ctx context.Context, root cid.Cid, metadata []byte) (uint64, error) {
+	ctx, end := instrument(ctx, "file_size")
+	defer end()
+	return FileSize(ctx, s.db, root, metadata)
+}
+
+func (s *SQLUnixFSStore) DirEntries(ctx context.Context, root cid.Cid, metadata []byte) unixfsstore.EntryIterator {
+	return &timedEntryIterator{NewDirEntryCursor(s.db, root, metadata), "dir_entries"}
+}
+
+func (s *SQLUnixFSStore) FileLeafAt(ctx context.Context, root cid.Cid, metadata []byte, offset uint64) (*unixfsstore.FileLeaf, error) {
+	ctx, end := instrument(ctx, "file_leaf_at")
+	defer end()
+	return FileLeafAt(ctx, s.db, root, metadata, offset)
+}
+
 func (s *SQLUnixFSStore) RootCID(ctx context.Context, root cid.Cid) ([]unixfsstore.RootCID, error) {
+	ctx, end := instrument(ctx, "root_cid")
+	defer end()
 	return RootCID(ctx, s.db, root)
 }
 
 func (s *SQLUnixFSStore) RootCIDWithMetadata(ctx context.Context, root cid.Cid, metadata []byte) (*unixfsstore.RootCID, error) {
+	ctx, end := instrument(ctx, "root_cid_with_metadata")
+	defer end()
 	return RootCIDWithMetadata(ctx, s.db, root, metadata)
 }
 
+// SetRootPrivate sets whether a root is private, returning ErrNotFound if the root has not been indexed
+func (s *SQLUnixFSStore) SetRootPrivate(ctx context.Context, root cid.Cid, private bool) error {
+	rootCIDs, err := RootCID(ctx, s.db, root)
+	if err != nil {
+		return err
+	}
+	if len(rootCIDs) == 0 {
+		return ErrNotFound
+	}
+	return SetRootPrivate(ctx, s.db, root, private)
+}
+
+func (s *SQLUnixFSStore) PrivateRoots(ctx context.Context, root cid.Cid) ([]cid.Cid, error) {
+	ctx, end := instrument(ctx, "private_roots")
+	defer end()
+	return PrivateRoots(ctx, s.db, root)
+}
+
+func (s *SQLUnixFSStore) PathCIDs(ctx context.Context, root cid.Cid, path []string) ([]cid.Cid, error) {
+	ctx, end := instrument(ctx, "path_cids")
+	defer end()
+	return PathCIDs(ctx, s.db, root, path)
+}
+
+func (s *SQLUnixFSStore) AddAccessToken(ctx context.Context, token unixfsstore.AccessToken) error {
+	return InsertAccessToken(ctx, s.db, token)
+}
+
+func (s *SQLUnixFSStore) AccessToken(ctx context.Context, id string) (*unixfsstore.AccessToken, error) {
+	ctx, end := instrument(ctx, "access_token")
+	defer end()
+	return AccessToken(ctx, s.db, id)
+}
+
+func (s *SQLUnixFSStore) AccessTokens(ctx context.Context, root cid.Cid) ([]unixfsstore.AccessToken, error) {
+	return AccessTokens(ctx, s.db, root)
+}
+
+func (s *SQLUnixFSStore) RevokeAccessToken(ctx context.Context, id string) error {
+	return RevokeAccessToken(ctx, s.db, id)
+}
+
+func (s *SQLUnixFSStore) SetName(ctx context.Context, name unixfsstore.Name) error {
+	return SetName(ctx, s.db, name)
+}
+
+func (s *SQLUnixFSStore) Name(ctx context.Context, name string) (*unixfsstore.Name, error) {
+	return Name(ctx, s.db, name)
+}
+
+func (s *SQLUnixFSStore) Names(ctx context.Context) ([]unixfsstore.Name, error) {
+	return Names(ctx, s.db)
+}
+
+func (s *SQLUnixFSStore) RemoveName(ctx context.Context, name string) error {
+	return RemoveName(ctx, s.db, name)
+}
+
+// instrument starts a span for a store operation, returning a function that ends it and records the operation's
+// duration
+func instrument(ctx context.Context, operation string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := tracing.StartSpan(ctx, "UnixFSStore."+operation)
+	return ctx, func() {
+		span.End()
+		metrics.Since(metrics.SQLQueryDuration.WithLabelValues(operation), start)
+	}
+}
+
+// timedLinkIterator instruments reading each page of links
+type timedLinkIterator struct {
+	unixfsstore.LinkIterator
+	operation string
+}
+
+func (tli *timedLinkIterator) Next(ctx context.Context, max int) ([]unixfsstore.TraversedLink, error) {
+	ctx, end := instrument(ctx, tli.operation)
+	defer end()
+	return tli.LinkIterator.Next(ctx, max)
+}
+
+// timedEntryIterator instruments reading each page of directory entries
+type timedEntryIterator struct {
+	unixfsstore.EntryIterator
+	operation string
+}
+
+func (tei *timedEntryIterator) Next(ctx context.Context, max int) ([]unixfsstore.DirEntry, error) {
+	ctx, end := instrument(ctx, tei.operation)
+	defer end()
+	return tei.EntryIterator.Next(ctx, max)
+}
+
 func withTransaction(ctx context.Context, db *sql.DB, f func(*sql.Tx) error) (err error) {
 	var tx *sql.Tx
 	tx, err = db.BeginTx(ctx, &sql.TxOptions{
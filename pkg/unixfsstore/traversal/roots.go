@@ -16,83 +16,102 @@ import (
 
 // DiscoverRoots scans all keys in a store and finds UnixFS roots among them
 func DiscoverRoots(ctx context.Context, incoming <-chan cid.Cid, ls *linking.LinkSystem) ([]cid.Cid, error) {
-	roots := make(map[cid.Cid]struct{})
-	nonRoots := make(map[cid.Cid]struct{})
-	for {
-		next, ok := <-incoming
-		if !ok {
-			rootsResult := make([]cid.Cid, 0, len(roots))
-			for root := range roots {
-				rootsResult = append(rootsResult, root)
-			}
-			return rootsResult, nil
+	finder := NewRootFinder()
+	for next := range incoming {
+		if err := finder.Add(ctx, next, ls); err != nil {
+			return nil, err
 		}
+	}
+	return finder.Roots(), nil
+}
 
-		// we only care about protobuf nodes
-		var nonRootChildren []cid.Cid
-		switch multicodec.Code(next.Type()) {
-		case multicodec.DagPb:
-			nd, err := ls.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: next}, dagpb.Type.PBNode)
-			if err != nil {
-				return nil, fmt.Errorf("malformed blockstore cid %s: %w", next.String(), err)
-			}
-			pbnd, ok := nd.(dagpb.PBNode)
-			if !ok {
-				return nil, fmt.Errorf("malformed blockstore cid %s: %w", next.String(), hamt.ErrNotProtobuf)
-			}
-			// if no data field, ignore
-			if !pbnd.FieldData().Exists() {
-				continue
-			}
-			// if not UnixFS data, ignore
-			ufsdata, err := data.DecodeUnixFSData(pbnd.FieldData().Must().Bytes())
-			if err != nil {
-				continue
+// RootFinder finds the UnixFS roots among blocks added to it one at a time, in any order -- such as while the blocks
+// are being written
+type RootFinder struct {
+	roots    map[cid.Cid]struct{}
+	nonRoots map[cid.Cid]struct{}
+}
+
+// NewRootFinder constructs a RootFinder that has seen no blocks
+func NewRootFinder() *RootFinder {
+	return &RootFinder{
+		roots:    make(map[cid.Cid]struct{}),
+		nonRoots: make(map[cid.Cid]struct{}),
+	}
+}
+
+// Add looks at the block with the given CID, loading it from the link system if it may have children
+func (rf *RootFinder) Add(ctx context.Context, next cid.Cid, ls *linking.LinkSystem) error {
+	// we only care about protobuf nodes
+	var nonRootChildren []cid.Cid
+	switch multicodec.Code(next.Type()) {
+	case multicodec.DagPb:
+		nd, err := ls.Load(ipld.LinkContext{Ctx: ctx}, cidlink.Link{Cid: next}, dagpb.Type.PBNode)
+		if err != nil {
+			return fmt.Errorf("malformed blockstore cid %s: %w", next.String(), err)
+		}
+		pbnd, ok := nd.(dagpb.PBNode)
+		if !ok {
+			return fmt.Errorf("malformed blockstore cid %s: %w", next.String(), hamt.ErrNotProtobuf)
+		}
+		// if no data field, ignore
+		if !pbnd.FieldData().Exists() {
+			return nil
+		}
+		// if not UnixFS data, ignore
+		ufsdata, err := data.DecodeUnixFSData(pbnd.FieldData().Must().Bytes())
+		if err != nil {
+			return nil
+		}
+		// ok, it's a unixfsnode, so we may want to add as root
+		// record relevant non-root children
+		switch ufsdata.DataType.Int() {
+		case data.Data_File:
+			// for a regular file, all children are now non-root children
+			iter := pbnd.Links.Iterator()
+			for !iter.Done() {
+				_, lnk := iter.Next()
+				nonRootChildren = append(nonRootChildren, lnk.Hash.Link().(cidlink.Link).Cid)
 			}
-			// ok, it's a unixfsnode, so we may want to add as root
-			// record relevant non-root children
-			switch ufsdata.DataType.Int() {
-			case data.Data_File:
-				// for a regular file, all children are now non-root children
-				iter := pbnd.Links.Iterator()
-				for !iter.Done() {
-					_, lnk := iter.Next()
-					nonRootChildren = append(nonRootChildren, lnk.Hash.Link().(cidlink.Link).Cid)
+		case data.Data_HAMTShard:
+			// for a hamt directory, all children that are not value nodes are non root children
+			iter := pbnd.Links.Iterator()
+			maxPadLen := maxPadLength(ufsdata)
+			for !iter.Done() {
+				_, lnk := iter.Next()
+				isValue, err := isValueLink(lnk, maxPadLen)
+				if err != nil {
+					return err
 				}
-			case data.Data_HAMTShard:
-				// for a hamt directory, all children that are not value nodes are non root children
-				iter := pbnd.Links.Iterator()
-				maxPadLen := maxPadLength(ufsdata)
-				for !iter.Done() {
-					_, lnk := iter.Next()
-					isValue, err := isValueLink(lnk, maxPadLen)
-					if err != nil {
-						return nil, err
-					}
-					if !isValue {
-						nonRootChildren = append(nonRootChildren, lnk.Hash.Link().(cidlink.Link).Cid)
-					}
+				if !isValue {
+					nonRootChildren = append(nonRootChildren, lnk.Hash.Link().(cidlink.Link).Cid)
 				}
-			default:
-				// all other unixfs types do not have non-root children
 			}
-		case multicodec.Raw:
-			// raw may be a root, but it has no children
 		default:
-			// not raw or dabpb, ignore
-			continue
+			// all other unixfs types do not have non-root children
 		}
+	case multicodec.Raw:
+		// raw may be a root, but it has no children
+	default:
+		// not raw or dabpb, ignore
+		return nil
+	}
 
-		for _, child := range nonRootChildren {
-			_, isRoot := roots[child]
-			if isRoot {
-				delete(roots, child)
-			}
-			nonRoots[child] = struct{}{}
-		}
-		_, isNonRoot := nonRoots[next]
-		if !isNonRoot {
-			roots[next] = struct{}{}
-		}
+	for _, child := range nonRootChildren {
+		delete(rf.roots, child)
+		rf.nonRoots[child] = struct{}{}
+	}
+	if _, isNonRoot := rf.nonRoots[next]; !isNonRoot {
+		rf.roots[next] = struct{}{}
+	}
+	return nil
+}
+
+// Roots returns the roots among the blocks added so far
+func (rf *RootFinder) Roots() []cid.Cid {
+	roots := make([]cid.Cid, 0, len(rf.roots))
+	for root := range rf.roots {
+		roots = append(roots, root)
 	}
+	return roots
 }
@@ -12,6 +12,7 @@ import (
 	quickbuilder "github.com/ipfs/go-unixfsnode/data/builder/quick"
 	"github.com/ipfs/stargate/pkg/unixfsstore/traversal"
 	dagpb "github.com/ipld/go-codec-dagpb"
+	"github.com/ipld/go-ipld-prime"
 	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
 	"github.com/ipld/go-ipld-prime/storage/memstore"
 	"github.com/stretchr/testify/require"
@@ -82,3 +83,39 @@ func TestDiscoverRoots(t *testing.T) {
 	req.NoError(err)
 	req.ElementsMatch(expectedRoots, roots)
 }
+
+func TestRootFinder(t *testing.T) {
+	ctx := context.Background()
+	req := require.New(t)
+	ls := cidlink.DefaultLinkSystem()
+	store := memstore.Store{Bag: make(map[string][]byte)}
+	ls.SetReadStorage(&store)
+	ls.SetWriteStorage(&store)
+
+	// add the blocks of a file as they are written, leaves first
+	finder := traversal.NewRootFinder()
+	var written []cid.Cid
+	writeLs := ls
+	writeLs.StorageWriteOpener = func(lctx ipld.LinkContext) (io.Writer, ipld.BlockWriteCommitter, error) {
+		w, commit, err := ls.StorageWriteOpener(lctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		return w, func(lnk ipld.Link) error {
+			if err := commit(lnk); err != nil {
+				return err
+			}
+			written = append(written, lnk.(cidlink.Link).Cid)
+			return finder.Add(ctx, lnk.(cidlink.Link).Cid, &ls)
+		}, nil
+	}
+	n, _, err := builder.BuildUnixFSFile(io.LimitReader(rand.Reader, 1<<16), "size-4096", &writeLs)
+	req.NoError(err)
+	req.Len(written, 17)
+	// only the file remains a root once its node is added
+	req.Equal([]cid.Cid{n.(cidlink.Link).Cid}, finder.Roots())
+
+	// a leaf added again stays a child of the file
+	req.NoError(finder.Add(ctx, written[0], &ls))
+	req.Equal([]cid.Cid{n.(cidlink.Link).Cid}, finder.Roots())
+}
@@ -1,6 +1,9 @@
 package unixfsstore
 
 import (
+	"context"
+	"time"
+
 	"github.com/ipfs/go-cid"
 )
 
@@ -14,3 +17,71 @@ type TraversedCID struct {
 	CID    cid.Cid
 	IsLeaf bool
 }
+
+// TraversedLink is a CID visited while iterating the links of a UnixFS DAG
+type TraversedLink struct {
+	TraversedCID
+	// InRange is false for file links that fall outside a requested byte range
+	InRange bool
+}
+
+// ByteRange is a range of bytes in a UnixFS file, from Min inclusive to Max exclusive
+type ByteRange struct {
+	Min uint64
+	Max uint64
+}
+
+// LinkIterator iterates over the links of a UnixFS DAG in breadth first order, a page at a time
+type LinkIterator interface {
+	// Next returns up to max further links. It returns no links once iteration is complete
+	Next(ctx context.Context, max int) ([]TraversedLink, error)
+}
+
+// KindUnknown is the kind of a directory entry that is not indexed as a root
+const KindUnknown = -1
+
+// DirEntry is a named entry in a UnixFS directory
+type DirEntry struct {
+	Name string
+	CID  cid.Cid
+	// Kind is the UnixFS data type of the entry, or KindUnknown
+	Kind int64
+}
+
+// EntryIterator iterates over the entries of a UnixFS directory in name order, a page at a time
+type EntryIterator interface {
+	// Next returns up to max further entries. It returns no entries once iteration is complete
+	Next(ctx context.Context, max int) ([]DirEntry, error)
+}
+
+// FileLeaf is a block holding the data for a range of bytes in a UnixFS file, from ByteMin inclusive to ByteMax
+// exclusive
+type FileLeaf struct {
+	CID     cid.Cid
+	ByteMin uint64
+	ByteMax uint64
+}
+
+// AccessToken grants access to a private root. Only a hash of the token's secret is kept
+type AccessToken struct {
+	ID         string
+	Root       cid.Cid
+	Name       string
+	SecretHash []byte
+	Created    time.Time
+	// Expires is zero for a token that does not expire
+	Expires time.Time
+	Revoked bool
+}
+
+// Name points a stable name at the latest root published under it
+type Name struct {
+	Name string
+	Root cid.Cid
+	// Source is the directory the name is published from, or empty for a name set by hand
+	Source string
+	// Fingerprint identifies the state of the entry of Source the root was imported from, so it is only imported
+	// again once it changes
+	Fingerprint []byte
+	Updated     time.Time
+}